@@ -0,0 +1,313 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nwaples/rardecode/v2"
+)
+
+type Format string
+
+const (
+	FormatZip    Format = "zip"
+	Format7z     Format = "7z"
+	FormatRar    Format = "rar"
+	FormatTar    Format = "tar"
+	FormatTarGz  Format = "tar.gz"
+	FormatTarZst Format = "tar.zst"
+)
+
+var ErrUnknownFormat = errors.New("unknown archive format")
+
+var (
+	zipMagic      = []byte("PK\x03\x04")
+	zipEmptyMagic = []byte("PK\x05\x06")
+	sevenZipMagic = []byte("7z\xBC\xAF\x27\x1C")
+	rarMagic      = []byte("Rar!\x1A\x07")
+	gzipMagic     = []byte{0x1F, 0x8B}
+	zstdMagic     = []byte{0x28, 0xB5, 0x2F, 0xFD}
+	tarMagic      = []byte("ustar")
+)
+
+// Entry is a file or directory inside of an archive. Sizes come from the
+// archive's headers and can not be trusted
+type Entry struct {
+	Name           string
+	Size           int64 // -1 when the archive does not store it
+	CompressedSize int64 // -1 when the format does not store it per entry
+	Mode           fs.FileMode
+	IsDir          bool
+	IsSymlink      bool
+}
+
+// Reader walks the entries of an archive in order
+type Reader interface {
+	// Next advances to the next entry, io.EOF after the last one
+	Next() (*Entry, error)
+
+	// Open returns the content of the current entry
+	Open() (io.ReadCloser, error)
+
+	// Count returns the number of entries, -1 if it is only known after reading all of them
+	Count() int
+
+	Close() error
+}
+
+// Detect finds the format of an archive from its magic bytes, the file name is never trusted
+func Detect(r io.ReaderAt, size int64) (Format, error) {
+	header := make([]byte, 512)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, zipMagic), bytes.HasPrefix(header, zipEmptyMagic):
+		return FormatZip, nil
+	case bytes.HasPrefix(header, sevenZipMagic):
+		return Format7z, nil
+	case bytes.HasPrefix(header, rarMagic):
+		return FormatRar, nil
+	case isTar(header):
+		return FormatTar, nil
+	case bytes.HasPrefix(header, gzipMagic):
+		if decompressedIsTar(FormatTarGz, r, size) {
+			return FormatTarGz, nil
+		}
+	case bytes.HasPrefix(header, zstdMagic):
+		if decompressedIsTar(FormatTarZst, r, size) {
+			return FormatTarZst, nil
+		}
+	}
+
+	return "", ErrUnknownFormat
+}
+
+// NewReader detects the archive's format and returns a reader of its entries
+func NewReader(r io.ReaderAt, size int64) (Reader, error) {
+	format, err := Detect(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatZip:
+		zipReader, err := zip.NewReader(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return &zipArchive{files: zipReader.File, index: -1}, nil
+	case Format7z:
+		sevenZipReader, err := sevenzip.NewReader(r, size)
+		if err != nil {
+			return nil, err
+		}
+		return &sevenZipArchive{files: sevenZipReader.File, index: -1}, nil
+	case FormatRar:
+		rarReader, err := rardecode.NewReader(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return nil, err
+		}
+		return &rarArchive{reader: rarReader}, nil
+	default:
+		decompressor, err := newDecompressor(format, io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchive{reader: tar.NewReader(decompressor), decompressor: decompressor}, nil
+	}
+}
+
+func isTar(header []byte) bool {
+	return len(header) >= 262 && bytes.Equal(header[257:262], tarMagic)
+}
+
+func decompressedIsTar(format Format, r io.ReaderAt, size int64) bool {
+	decompressor, err := newDecompressor(format, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return false
+	}
+	defer decompressor.Close()
+
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(decompressor, header)
+	return isTar(header[:n])
+}
+
+func newDecompressor(format Format, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case FormatTarGz:
+		return gzip.NewReader(r)
+	case FormatTarZst:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return io.NopCloser(r), nil
+}
+
+// zip, random access
+type zipArchive struct {
+	files []*zip.File
+	index int
+}
+
+func (a *zipArchive) Next() (*Entry, error) {
+	a.index++
+	if a.index >= len(a.files) {
+		return nil, io.EOF
+	}
+
+	f := a.files[a.index]
+	mode := f.Mode()
+	return &Entry{
+		Name:           f.Name,
+		Size:           int64(f.UncompressedSize64),
+		CompressedSize: int64(f.CompressedSize64),
+		Mode:           mode,
+		IsDir:          mode.IsDir() || strings.HasSuffix(f.Name, "/"),
+		IsSymlink:      mode&fs.ModeSymlink != 0,
+	}, nil
+}
+
+func (a *zipArchive) Open() (io.ReadCloser, error) {
+	return a.files[a.index].Open()
+}
+
+func (a *zipArchive) Count() int {
+	return len(a.files)
+}
+
+func (a *zipArchive) Close() error {
+	return nil
+}
+
+// 7z, random access
+type sevenZipArchive struct {
+	files []*sevenzip.File
+	index int
+}
+
+func (a *sevenZipArchive) Next() (*Entry, error) {
+	a.index++
+	if a.index >= len(a.files) {
+		return nil, io.EOF
+	}
+
+	f := a.files[a.index]
+	mode := f.Mode()
+	return &Entry{
+		Name:           f.Name,
+		Size:           int64(f.UncompressedSize),
+		CompressedSize: -1,
+		Mode:           mode,
+		IsDir:          mode.IsDir(),
+		IsSymlink:      mode&fs.ModeSymlink != 0,
+	}, nil
+}
+
+func (a *sevenZipArchive) Open() (io.ReadCloser, error) {
+	return a.files[a.index].Open()
+}
+
+func (a *sevenZipArchive) Count() int {
+	return len(a.files)
+}
+
+func (a *sevenZipArchive) Close() error {
+	return nil
+}
+
+// rar, sequential
+type rarArchive struct {
+	reader *rardecode.Reader
+}
+
+func (a *rarArchive) Next() (*Entry, error) {
+	header, err := a.reader.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	size := header.UnPackedSize
+	if header.UnKnownSize {
+		size = -1
+	}
+
+	mode := header.Mode()
+	return &Entry{
+		Name:           header.Name,
+		Size:           size,
+		CompressedSize: header.PackedSize,
+		Mode:           mode,
+		IsDir:          header.IsDir,
+		IsSymlink:      mode&fs.ModeSymlink != 0,
+	}, nil
+}
+
+func (a *rarArchive) Open() (io.ReadCloser, error) {
+	return io.NopCloser(a.reader), nil
+}
+
+func (a *rarArchive) Count() int {
+	return -1
+}
+
+func (a *rarArchive) Close() error {
+	return nil
+}
+
+// tar, tar.gz and tar.zst, sequential
+type tarArchive struct {
+	reader       *tar.Reader
+	decompressor io.ReadCloser
+}
+
+func (a *tarArchive) Next() (*Entry, error) {
+	for {
+		header, err := a.reader.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// PAX global headers carry no file, devices and pipes are never wanted
+		switch header.Typeflag {
+		case tar.TypeXGlobalHeader, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			continue
+		}
+
+		return &Entry{
+			Name:           header.Name,
+			Size:           header.Size,
+			CompressedSize: -1,
+			Mode:           header.FileInfo().Mode(),
+			IsDir:          header.Typeflag == tar.TypeDir,
+			IsSymlink:      header.Typeflag == tar.TypeSymlink || header.Typeflag == tar.TypeLink,
+		}, nil
+	}
+}
+
+func (a *tarArchive) Open() (io.ReadCloser, error) {
+	return io.NopCloser(a.reader), nil
+}
+
+func (a *tarArchive) Count() int {
+	return -1
+}
+
+func (a *tarArchive) Close() error {
+	return a.decompressor.Close()
+}
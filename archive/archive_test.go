@@ -0,0 +1,247 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// testFile is an entry of an archive built by a test, a directory when its name ends with a slash
+type testFile struct {
+	name    string
+	content string
+	link    bool
+}
+
+// A 7z of bar and foo, each holding its name and a line feed. Nothing in Go writes 7z
+const sevenZipHex = "377abcaf271c0004a047a58808000000000000006600000000000000dd91" +
+	"f3f16261720a666f6f0a010406000209040400070b02000101000101000c" +
+	"040400080a01e9b3a204a865327e00000502190500000000001111006200" +
+	"61007200000066006f006f000000190200001412010000853373f263d601" +
+	"00580272f263d601150a01002080a4812080a4810000"
+
+func TestDetect(t *testing.T) {
+	files := []testFile{{name: "dir/a.txt", content: "hello"}}
+	for _, test := range []struct {
+		name string
+		data []byte
+		want Format
+	}{
+		{"zip", buildZip(t, files), FormatZip},
+		{"empty zip", buildZip(t, nil), FormatZip},
+		{"7z", buildSevenZip(t), Format7z},
+		{"rar", buildRar("dir/a.txt", "hello"), FormatRar},
+		{"tar", buildTar(t, files), FormatTar},
+		{"tar.gz", gzipped(t, buildTar(t, files)), FormatTarGz},
+		{"tar.zst", zstded(t, buildTar(t, files)), FormatTarZst},
+	} {
+		format, err := Detect(bytes.NewReader(test.data), int64(len(test.data)))
+		if err != nil || format != test.want {
+			t.Errorf("%s: got %q and %v, want %q", test.name, format, err, test.want)
+		}
+	}
+
+	// Compressed files which are not tars and anything else are not archives
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"text", []byte("dir/a.txt,hello\n")},
+		{"gzip", gzipped(t, []byte("hello"))},
+		{"zstd", zstded(t, []byte("hello"))},
+		{"short tar", buildTar(t, files)[:200]},
+	} {
+		if format, err := Detect(bytes.NewReader(test.data), int64(len(test.data))); !errors.Is(err, ErrUnknownFormat) {
+			t.Errorf("%s: got %q and %v, want ErrUnknownFormat", test.name, format, err)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	files := []testFile{{name: "dir/"}, {name: "dir/a.txt", content: "hello"}, {name: "b.txt", content: "bye"}}
+	want := map[string]string{"dir/": "", "dir/a.txt": "hello", "b.txt": "bye"}
+	for _, test := range []struct {
+		name string
+		data []byte
+		want map[string]string
+	}{
+		{"zip", buildZip(t, files), want},
+		{"7z", buildSevenZip(t), map[string]string{"bar": "bar\n", "foo": "foo\n"}},
+		{"rar", buildRar("dir/a.txt", "hello"), map[string]string{"dir/a.txt": "hello"}},
+		{"tar", buildTar(t, files), want},
+		{"tar.gz", gzipped(t, buildTar(t, files)), want},
+		{"tar.zst", zstded(t, buildTar(t, files)), want},
+	} {
+		got, err := readAll(test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got %d entries, want %d", test.name, len(got), len(test.want))
+		}
+		for name, content := range test.want {
+			if got[name] != content {
+				t.Errorf("%s: got %q for %s, want %q", test.name, got[name], name, content)
+			}
+		}
+	}
+}
+
+// readAll returns the content of every entry of an archive by name, directories with a trailing slash
+func readAll(data []byte) (map[string]string, error) {
+	reader, err := NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	contents := map[string]string{}
+	for {
+		entry, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return contents, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if entry.IsDir {
+			contents[entry.Name] = ""
+			continue
+		}
+		content, err := reader.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(content)
+		content.Close()
+		if err != nil {
+			return nil, err
+		}
+		contents[entry.Name] = string(data)
+	}
+}
+
+func buildZip(t *testing.T, files []testFile) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for _, file := range files {
+		header := &zip.FileHeader{Name: file.name, Method: zip.Deflate}
+		if file.link {
+			header.SetMode(0777 | 1<<27) // fs.ModeSymlink
+		}
+		w, err := writer.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, file.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func buildTar(t *testing.T, files []testFile) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	for _, file := range files {
+		header := &tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content)), Typeflag: tar.TypeReg, Format: tar.FormatUSTAR}
+		switch {
+		case file.link:
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, file.content, 0
+		case file.name[len(file.name)-1] == '/':
+			header.Typeflag = tar.TypeDir
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := io.WriteString(writer, file.content); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func zstded(t *testing.T, data []byte) []byte {
+	t.Helper()
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(data, nil)
+}
+
+func buildSevenZip(t *testing.T) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(sevenZipHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// buildRar returns a RAR 5 archive of one stored file, nothing in Go writes RAR
+func buildRar(name, content string) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("Rar!\x1A\x07\x01\x00")
+	// Main header: type, flags, archive flags
+	buffer.Write(rarHeader(rarNumber(1), rarNumber(0), rarNumber(0)))
+	// File header: type, flags (data follows), data size, file flags, size, attributes,
+	// compression (stored), host OS (unix) and name
+	buffer.Write(rarHeader(rarNumber(2), rarNumber(2), rarNumber(uint64(len(content))), rarNumber(0),
+		rarNumber(uint64(len(content))), rarNumber(0), rarNumber(0), rarNumber(1), rarNumber(uint64(len(name))), []byte(name)))
+	buffer.WriteString(content)
+	// End of archive header
+	buffer.Write(rarHeader(rarNumber(5), rarNumber(0), rarNumber(0)))
+	return buffer.Bytes()
+}
+
+// rarHeader prefixes the fields of a header with their size and the CRC of both
+func rarHeader(fields ...[]byte) []byte {
+	body := bytes.Join(fields, nil)
+	header := append(rarNumber(uint64(len(body))), body...)
+	crc := crc32.ChecksumIEEE(header)
+	return append([]byte{byte(crc), byte(crc >> 8), byte(crc >> 16), byte(crc >> 24)}, header...)
+}
+
+// rarNumber encodes a variable length integer, 7 bits per byte with the high bit set on all but the last
+func rarNumber(n uint64) []byte {
+	var encoded []byte
+	for n >= 0x80 {
+		encoded = append(encoded, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(encoded, byte(n))
+}
@@ -0,0 +1,209 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Compression ratio is only checked past this many bytes, small text files compress
+// far better than any sane ratio limit and are harmless anyway
+const ratioCheckThreshold = 1024 * 1024
+
+// ErrBudgetExceeded is returned once archives extracted together use more than their Budget
+var ErrBudgetExceeded = errors.New("storage quota exceeded")
+
+// Limits bounds what an archive may extract to, zero values mean no limit
+type Limits struct {
+	MaxTotalSize int64   // bytes of all entries once extracted
+	MaxEntries   int     // number of entries, directories included
+	MaxEntrySize int64   // bytes of a single extracted entry
+	MaxRatio     float64 // extracted bytes divided by compressed bytes
+	MaxDepth     int     // directories an entry may be nested in
+	Budget       *Budget // bytes shared with other archives, nil for none
+}
+
+// Budget is a number of bytes archives extracted together may use, e.g. a company's remaining quota.
+// A budget made by NewSharedBudget uses its own bytes first, then takes from a budget shared with
+// others, to which it can give back what it took. Safe to share between goroutines
+type Budget struct {
+	lock      sync.Mutex
+	remaining int64
+	shared    *Budget
+	taken     int64 // from shared
+}
+
+func NewBudget(bytes int64) *Budget {
+	return &Budget{remaining: bytes}
+}
+
+// NewSharedBudget returns a budget of its own bytes, e.g. of files it replaces, then of shared's
+func NewSharedBudget(bytes int64, shared *Budget) *Budget {
+	return &Budget{remaining: bytes, shared: shared}
+}
+
+// Remaining returns the bytes left, negative once exceeded
+func (b *Budget) Remaining() int64 {
+	b.lock.Lock()
+	remaining := b.remaining
+	b.lock.Unlock()
+
+	if b.shared == nil {
+		return remaining
+	}
+	return remaining + b.shared.Remaining()
+}
+
+// Release gives back to the shared budget what was taken from it, once the extracted files are deleted
+func (b *Budget) Release() {
+	b.lock.Lock()
+	taken := b.taken
+	b.taken = 0
+	b.lock.Unlock()
+
+	if b.shared != nil && taken > 0 {
+		b.shared.take(-taken)
+	}
+}
+
+// take uses n bytes, false once the budget is exceeded
+func (b *Budget) take(n int64) bool {
+	b.lock.Lock()
+	if b.shared == nil {
+		b.remaining -= n
+		exceeded := b.remaining < 0
+		b.lock.Unlock()
+		return !exceeded
+	}
+
+	own := min(n, b.remaining)
+	b.remaining -= own
+	b.taken += n - own
+	b.lock.Unlock()
+	return own == n || b.shared.take(n-own)
+}
+
+// LimitError is returned when an archive breaks its limits or contains an unsafe entry
+type LimitError struct {
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("archive rejected: %s", e.Reason)
+}
+
+// Limiter enforces Limits on one archive. Sizes are counted on the bytes actually
+// extracted, the sizes declared in the archive's headers are only used to fail early
+type Limiter struct {
+	limits      Limits
+	archiveSize int64
+	totalSize   int64
+	entries     int
+}
+
+func NewLimiter(limits Limits, archiveSize int64) *Limiter {
+	return &Limiter{limits: limits, archiveSize: archiveSize}
+}
+
+// TotalSize returns the bytes extracted so far
+func (l *Limiter) TotalSize() int64 {
+	return l.totalSize
+}
+
+// CheckEntry validates an entry before it is extracted
+func (l *Limiter) CheckEntry(entry *Entry) error {
+	l.entries++
+	if l.limits.MaxEntries > 0 && l.entries > l.limits.MaxEntries {
+		return &LimitError{Reason: fmt.Sprintf("more than %d entries", l.limits.MaxEntries)}
+	}
+
+	if entry.IsSymlink {
+		return &LimitError{Reason: fmt.Sprintf("%s is a link", entry.Name)}
+	}
+
+	// Absolute paths, windows drives and parent directories could all escape the destination
+	name := strings.ReplaceAll(entry.Name, "\\", "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return &LimitError{Reason: fmt.Sprintf("%s is an absolute path", entry.Name)}
+	}
+	var segments []string
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return &LimitError{Reason: fmt.Sprintf("%s points outside of the archive", entry.Name)}
+		} else if segment != "" && segment != "." {
+			segments = append(segments, segment)
+		}
+	}
+
+	depth := len(segments)
+	if !entry.IsDir {
+		depth--
+	}
+	if l.limits.MaxDepth > 0 && depth > l.limits.MaxDepth {
+		return &LimitError{Reason: fmt.Sprintf("%s is nested deeper than %d directories", entry.Name, l.limits.MaxDepth)}
+	}
+
+	if l.limits.MaxEntrySize > 0 && entry.Size > l.limits.MaxEntrySize {
+		return &LimitError{Reason: fmt.Sprintf("%s is larger than %d bytes", entry.Name, l.limits.MaxEntrySize)}
+	}
+	if l.limits.MaxTotalSize > 0 && l.totalSize+entry.Size > l.limits.MaxTotalSize {
+		return &LimitError{Reason: fmt.Sprintf("extracted size is larger than %d bytes", l.limits.MaxTotalSize)}
+	}
+	if l.limits.Budget != nil && entry.Size > l.limits.Budget.Remaining() {
+		return ErrBudgetExceeded
+	}
+
+	return nil
+}
+
+// Reader wraps an entry's content, failing the read once the entry breaks a limit
+func (l *Limiter) Reader(entry *Entry, reader io.Reader) io.Reader {
+	return &limitedReader{limiter: l, entry: entry, reader: reader}
+}
+
+type limitedReader struct {
+	limiter *Limiter
+	entry   *Entry
+	reader  io.Reader
+	read    int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	r.limiter.totalSize += int64(n)
+
+	// Entries are stored with the size of their header, which must be the size extracted
+	if r.entry.Size >= 0 && (r.read > r.entry.Size || (errors.Is(err, io.EOF) && r.read < r.entry.Size)) {
+		return n, &LimitError{Reason: fmt.Sprintf("%s does not have the size of its header", r.entry.Name)}
+	}
+
+	limits := r.limiter.limits
+	if limits.MaxEntrySize > 0 && r.read > limits.MaxEntrySize {
+		return n, &LimitError{Reason: fmt.Sprintf("%s is larger than %d bytes", r.entry.Name, limits.MaxEntrySize)}
+	}
+	if limits.MaxTotalSize > 0 && r.limiter.totalSize > limits.MaxTotalSize {
+		return n, &LimitError{Reason: fmt.Sprintf("extracted size is larger than %d bytes", limits.MaxTotalSize)}
+	}
+	if limits.Budget != nil && !limits.Budget.take(int64(n)) {
+		return n, ErrBudgetExceeded
+	}
+
+	if limits.MaxRatio > 0 {
+		// Ratio of this entry when the format stores its compressed size
+		if r.entry.CompressedSize > 0 && r.read > ratioCheckThreshold &&
+			float64(r.read)/float64(r.entry.CompressedSize) > limits.MaxRatio {
+			return n, &LimitError{Reason: fmt.Sprintf("%s compression ratio is higher than %.0f", r.entry.Name, limits.MaxRatio)}
+		}
+
+		// Ratio of the whole archive
+		if r.limiter.archiveSize > 0 && r.limiter.totalSize > ratioCheckThreshold &&
+			float64(r.limiter.totalSize)/float64(r.limiter.archiveSize) > limits.MaxRatio {
+			return n, &LimitError{Reason: fmt.Sprintf("compression ratio is higher than %.0f", limits.MaxRatio)}
+		}
+	}
+
+	return n, err
+}
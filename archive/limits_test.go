@@ -0,0 +1,179 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	zeros := strings.Repeat("\x00", 2*ratioCheckThreshold)
+	for _, test := range []struct {
+		name   string
+		data   []byte
+		limits Limits
+		want   error // nil, a *LimitError or ErrBudgetExceeded
+	}{
+		{"within limits", buildZip(t, []testFile{{name: "a/b/c.txt", content: "hello"}}),
+			Limits{MaxTotalSize: 5, MaxEntries: 1, MaxEntrySize: 5, MaxRatio: 2, MaxDepth: 2, Budget: NewBudget(5)}, nil},
+
+		// Unsafe entries
+		{"tar symlink", buildTar(t, []testFile{{name: "link", content: "/etc/passwd", link: true}}), Limits{}, &LimitError{}},
+		{"zip symlink", buildZip(t, []testFile{{name: "link", content: "/etc/passwd", link: true}}), Limits{}, &LimitError{}},
+		{"absolute path", buildZip(t, []testFile{{name: "/etc/passwd", content: "x"}}), Limits{}, &LimitError{}},
+		{"windows drive", buildZip(t, []testFile{{name: "C:/Windows/x", content: "x"}}), Limits{}, &LimitError{}},
+		{"parent directory", buildTar(t, []testFile{{name: "a/../../x", content: "x"}}), Limits{}, &LimitError{}},
+		{"windows parent directory", buildZip(t, []testFile{{name: "a\\..\\..\\x", content: "x"}}), Limits{}, &LimitError{}},
+
+		// Limits of the headers, checked before extracting
+		{"too deep", buildTar(t, []testFile{{name: "a/b/c/d.txt", content: "x"}}), Limits{MaxDepth: 2}, &LimitError{}},
+		{"too deep directory", buildTar(t, []testFile{{name: "a/b/c/"}}), Limits{MaxDepth: 2}, &LimitError{}},
+		{"too many entries", buildTar(t, []testFile{{name: "a", content: "x"}, {name: "b", content: "x"}, {name: "c", content: "x"}}),
+			Limits{MaxEntries: 2}, &LimitError{}},
+		{"entry too large", buildTar(t, []testFile{{name: "a", content: "123456"}}), Limits{MaxEntrySize: 5}, &LimitError{}},
+		{"total too large", buildTar(t, []testFile{{name: "a", content: "123"}, {name: "b", content: "456"}}),
+			Limits{MaxTotalSize: 5}, &LimitError{}},
+		{"budget exceeded", buildTar(t, []testFile{{name: "a", content: "123456"}}), Limits{Budget: NewBudget(5)}, ErrBudgetExceeded},
+
+		// Compression ratio, of an entry when stored and of the whole archive
+		{"zip bomb", buildZip(t, []testFile{{name: "zeros", content: zeros}}), Limits{MaxRatio: 100}, &LimitError{}},
+		{"tar.gz bomb", gzipped(t, buildTar(t, []testFile{{name: "zeros", content: zeros}})), Limits{MaxRatio: 100}, &LimitError{}},
+		{"small files compress well", gzipped(t, buildTar(t, []testFile{{name: "zeros", content: zeros[:1000]}})),
+			Limits{MaxRatio: 2}, nil},
+	} {
+		err := extract(test.data, test.limits)
+		var limitErr *LimitError
+		switch {
+		case test.want == nil && err != nil:
+			t.Errorf("%s: got %v, want no error", test.name, err)
+		case test.want != nil && errors.As(test.want, &limitErr) && !errors.As(err, &limitErr):
+			t.Errorf("%s: got %v, want a LimitError", test.name, err)
+		case errors.Is(test.want, ErrBudgetExceeded) && !errors.Is(err, ErrBudgetExceeded):
+			t.Errorf("%s: got %v, want ErrBudgetExceeded", test.name, err)
+		}
+	}
+}
+
+// Sizes in headers can not be trusted, the bytes read are counted
+func TestLimitedReader(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		size    int64
+		content string
+		limits  Limits
+		want    error
+	}{
+		{"header size", 5, "hello", Limits{}, nil},
+		{"longer than its header", 3, "hello", Limits{}, &LimitError{}},
+		{"shorter than its header", 8, "hello", Limits{}, &LimitError{}},
+		{"unknown size", -1, "hello", Limits{MaxEntrySize: 5, MaxTotalSize: 5}, nil},
+		{"entry too large", -1, "hello", Limits{MaxEntrySize: 4}, &LimitError{}},
+		{"total too large", -1, "hello", Limits{MaxTotalSize: 4}, &LimitError{}},
+		{"budget exceeded", -1, "hello", Limits{Budget: NewBudget(4)}, ErrBudgetExceeded},
+		{"ratio of the archive", -1, strings.Repeat("x", 2*ratioCheckThreshold), Limits{MaxRatio: 100}, &LimitError{}},
+	} {
+		limiter := NewLimiter(test.limits, 1000)
+		entry := &Entry{Name: "a", Size: test.size, CompressedSize: -1}
+		_, err := io.Copy(io.Discard, limiter.Reader(entry, strings.NewReader(test.content)))
+		var limitErr *LimitError
+		switch {
+		case test.want == nil && err != nil:
+			t.Errorf("%s: got %v, want no error", test.name, err)
+		case test.want != nil && errors.As(test.want, &limitErr) && !errors.As(err, &limitErr):
+			t.Errorf("%s: got %v, want a LimitError", test.name, err)
+		case errors.Is(test.want, ErrBudgetExceeded) && !errors.Is(err, ErrBudgetExceeded):
+			t.Errorf("%s: got %v, want ErrBudgetExceeded", test.name, err)
+		}
+	}
+}
+
+func TestSharedBudget(t *testing.T) {
+	shared := NewBudget(100)
+	first := NewSharedBudget(50, shared)
+	second := NewSharedBudget(0, shared)
+
+	// Own bytes are used first, then the shared ones
+	if !first.take(120) {
+		t.Fatal("first budget exceeded with 150 bytes left")
+	}
+	if remaining := shared.Remaining(); remaining != 30 {
+		t.Errorf("got %d shared bytes left, want 30", remaining)
+	}
+	if remaining := second.Remaining(); remaining != 30 {
+		t.Errorf("got %d bytes left in the second budget, want 30", remaining)
+	}
+	if second.take(40) {
+		t.Error("second budget not exceeded taking 40 of 30 bytes")
+	}
+
+	// Releasing gives back what was taken from the shared budget only, once
+	first.Release()
+	first.Release()
+	if remaining := shared.Remaining(); remaining != 60 {
+		t.Errorf("got %d shared bytes left after the first release, want 60", remaining)
+	}
+	second.Release()
+	if remaining := shared.Remaining(); remaining != 100 {
+		t.Errorf("got %d shared bytes left after both releases, want 100", remaining)
+	}
+
+	// Jobs extracting together never take more than what is shared
+	var wg sync.WaitGroup
+	var taken sync.Map
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			budget := NewSharedBudget(0, shared)
+			if budget.take(1) {
+				taken.Store(budget, true)
+			}
+		}()
+	}
+	wg.Wait()
+	count := 0
+	taken.Range(func(_, _ any) bool {
+		count++
+		return true
+	})
+	if count != 100 {
+		t.Errorf("%d jobs took a byte of 100", count)
+	}
+}
+
+// extract reads every entry of an archive within limits, the way uploads are extracted
+func extract(data []byte, limits Limits) error {
+	reader, err := NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	limiter := NewLimiter(limits, int64(len(data)))
+	for {
+		entry, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := limiter.CheckEntry(entry); err != nil {
+			return err
+		}
+		if entry.IsDir {
+			continue
+		}
+		content, err := reader.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.Discard, limiter.Reader(entry, content))
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache is a bounded in memory cache, entries expire after their TTL and the
+// least recently used entry is evicted once the cache is full
+type Cache[K comparable, V any] struct {
+	lock       sync.Mutex
+	maxEntries int
+	maxSize    int64
+	size       int64
+	sizeOf     func(value V) int64
+	ttl        time.Duration
+	entries    map[K]*list.Element
+	order      *list.List
+	hits       int64
+	misses     int64
+}
+
+type cacheEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	size    int64
+	expires time.Time
+}
+
+// Stats of a cache since it was created
+type Stats struct {
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+	Entries int     `json:"entries"`
+}
+
+func New[K comparable, V any](maxEntries int, ttl time.Duration) *Cache[K, V] {
+	return &Cache[K, V]{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    map[K]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+// NewSized returns a cache bounded by the total size of its values instead of their number,
+// sizeOf measures a value in the same unit as maxSize
+func NewSized[K comparable, V any](maxSize int64, ttl time.Duration, sizeOf func(value V) int64) *Cache[K, V] {
+	c := New[K, V](0, ttl)
+	c.maxSize = maxSize
+	c.sizeOf = sizeOf
+	return c
+}
+
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, exist := c.entries[key]
+	if !exist {
+		c.misses++
+		var empty V
+		return empty, false
+	}
+
+	entry := element.Value.(*cacheEntry[K, V])
+	if time.Now().After(entry.expires) {
+		c.removeElement(element)
+		c.misses++
+		var empty V
+		return empty, false
+	}
+
+	c.hits++
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// Set adds an entry with the cache's default TTL
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.ttl)
+}
+
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, exist := c.entries[key]; exist {
+		c.removeElement(element)
+	}
+
+	entry := &cacheEntry[K, V]{key: key, value: value, expires: time.Now().Add(ttl)}
+	if c.sizeOf != nil {
+		entry.size = c.sizeOf(value)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	c.size += entry.size
+
+	// Evict least recently used entries, a value larger than the whole cache is not kept
+	for (c.maxEntries > 0 && c.order.Len() > c.maxEntries) || (c.maxSize > 0 && c.size > c.maxSize) {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *Cache[K, V]) Delete(key K) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, exist := c.entries[key]; exist {
+		c.removeElement(element)
+	}
+}
+
+// DeleteFunc removes every entry which key matches, returns how many were removed
+func (c *Cache[K, V]) DeleteFunc(match func(key K) bool) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	removed := 0
+	for key, element := range c.entries {
+		if match(key) {
+			c.removeElement(element)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (c *Cache[K, V]) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := Stats{Hits: c.hits, Misses: c.misses, Entries: c.order.Len()}
+	if c.hits+c.misses > 0 {
+		stats.HitRate = float64(c.hits) / float64(c.hits+c.misses)
+	}
+	return stats
+}
+
+func (c *Cache[K, V]) removeElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry[K, V])
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
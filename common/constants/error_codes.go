@@ -46,5 +46,28 @@ const (
 	ERR_ROLE_NOT_FOUND                 = 309
 
 	// File manager
-	ERR_FILE_TYPE_NOT_ALLOWED = 400
+	ERR_FILE_TYPE_NOT_ALLOWED       = 400
+	ERR_FILE_ARCHIVE_LIMIT_EXCEEDED = 401
+	ERR_FILE_QUOTA_EXCEEDED         = 402
+	ERR_FILE_INVALID_GEOJSON        = 403
+	ERR_FILE_INVALID_3D_TILES       = 404
+	ERR_FILE_INVALID_GEOTIFF        = 405
+	ERR_FILE_NOT_RENDERABLE         = 406
+	ERR_FILE_UNKNOWN_LAYER          = 407
+	ERR_FILE_INVALID_GLOB           = 408
+	ERR_FILE_VERSION_NOT_FOUND      = 409
+	ERR_FILE_TOO_MANY_TILES         = 410
+	ERR_FILE_TOO_MANY_FEATURES      = 411
+
+	// Resumable upload
+	ERR_UPLOAD_NOT_FOUND       = 450
+	ERR_UPLOAD_INCOMPLETE      = 451
+	ERR_UPLOAD_OFFSET_MISMATCH = 452
+	ERR_UPLOAD_LOCKED          = 453
+
+	// Jobs
+	ERR_JOB_NOT_FOUND      = 460
+	ERR_JOB_QUEUE_FULL     = 461
+	ERR_JOB_FINISHED       = 462
+	ERR_JOB_ITERATION_BUSY = 463
 )
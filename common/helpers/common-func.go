@@ -4,11 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 	"filemanager/models/response"
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 func GetFileSystemRootLocation() string {
@@ -22,6 +25,102 @@ func GetFileSystemRootLocation() string {
 	return fileSystemRoot
 }
 
+// GetPartialUploadLocation returns where resumable uploads are kept until they are completed and used
+func GetPartialUploadLocation() string {
+	partialUploadLocation := os.Getenv("PARTIAL_UPLOAD_DIRECTORY")
+	if len(partialUploadLocation) == 0 {
+		partialUploadLocation, _ = os.Executable()
+		partialUploadLocation = filepath.Dir(partialUploadLocation)
+		partialUploadLocation += "/partial_uploads"
+	}
+
+	return partialUploadLocation
+}
+
+// GetJournalLocation returns the file where unfinished iteration operations are journaled
+func GetJournalLocation() string {
+	journalLocation := os.Getenv("JOURNAL_FILE")
+	if len(journalLocation) == 0 {
+		journalLocation, _ = os.Executable()
+		journalLocation = filepath.Dir(journalLocation)
+		journalLocation += "/journal.db"
+	}
+
+	return journalLocation
+}
+
+// GetUsageLocation returns the file where storage usage of every layer is tracked
+func GetUsageLocation() string {
+	usageLocation := os.Getenv("USAGE_FILE")
+	if len(usageLocation) == 0 {
+		usageLocation, _ = os.Executable()
+		usageLocation = filepath.Dir(usageLocation)
+		usageLocation += "/usage.db"
+	}
+
+	return usageLocation
+}
+
+// GetTileCacheLocation returns where map tiles rendered from uploaded images are cached
+func GetTileCacheLocation() string {
+	tileCacheLocation := os.Getenv("TILE_CACHE_DIRECTORY")
+	if len(tileCacheLocation) == 0 {
+		tileCacheLocation, _ = os.Executable()
+		tileCacheLocation = filepath.Dir(tileCacheLocation)
+		tileCacheLocation += "/tile_cache"
+	}
+
+	return tileCacheLocation
+}
+
+// GetUserIDClaim returns the claim of the token service's tokens holding the user's ID,
+// JWT_USER_ID_CLAIM (default user_id)
+func GetUserIDClaim() string {
+	userIDClaim := os.Getenv("JWT_USER_ID_CLAIM")
+	if len(userIDClaim) == 0 {
+		userIDClaim = "user_id"
+	}
+
+	return userIDClaim
+}
+
+// GetTokenUserID returns the ID of a token's user, an error if the token does not have it
+func GetTokenUserID(token *jwt.Token) (string, error) {
+	userIDClaim := GetUserIDClaim()
+	if token == nil {
+		return "", errors.New("no token")
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", errors.New("token claims can not be read")
+	}
+
+	// IDs are strings, or numbers for services numbering their users
+	switch userID := claims[userIDClaim].(type) {
+	case string:
+		if userID != "" {
+			return userID, nil
+		}
+	case float64:
+		return strconv.FormatFloat(userID, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("token has no %s claim", userIDClaim)
+}
+
+// GetUserID returns the ID of the request's user, the JWT middleware rejects tokens without it
+func GetUserID(c *fiber.Ctx) string {
+	userLocal, _ := c.Locals("user").(*jwt.Token)
+	userID, _ := GetTokenUserID(userLocal)
+	return userID
+}
+
+// GetServiceCredentials returns the filemanager's own token and refresh token, SERVICE_TOKEN and
+// SERVICE_REFRESH_TOKEN. Work outliving a request calls the project service with them since
+// the user's token expires and is never persisted
+func GetServiceCredentials() (string, string) {
+	return os.Getenv("SERVICE_TOKEN"), os.Getenv("SERVICE_REFRESH_TOKEN")
+}
+
 func SendAndParseResponseData(agent *fiber.Agent, object any, token, refreshToken string) (int, error) {
 	// Validate object to be a pointer
 	reflectObject := reflect.ValueOf(object)
@@ -0,0 +1,248 @@
+package geojson
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrTooManyFeatures is returned by AddOld when the older version has more features than the diff's maximum
+var ErrTooManyFeatures = errors.New("older version has too many features to compare")
+
+// Types of change of a feature
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// ChangedFeature is a feature of one version which is not the same in the other, with its
+// properties as they are in the newer version, or in the older one once removed
+type ChangedFeature struct {
+	Type       string         `json:"type"`
+	ID         any            `json:"id,omitempty"`
+	Geometry   *Geometry      `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+	Change     Change         `json:"change"` // a foreign member, RFC 7946 section 6.1
+}
+
+// Change describes how a feature changed, Properties has the properties which differ
+type Change struct {
+	Type             string                    `json:"type"`
+	File             string                    `json:"file"`
+	Properties       map[string]PropertyChange `json:"properties,omitempty"`
+	GeometryChanged  bool                      `json:"geometry_changed,omitempty"`
+	PreviousGeometry *Geometry                 `json:"previous_geometry,omitempty"`
+}
+
+// PropertyChange is a property before and after, null when it is not there
+type PropertyChange struct {
+	Old any `json:"old"`
+	New any `json:"new"`
+}
+
+// DiffSummary counts the features of each type of change
+type DiffSummary struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Modified  int `json:"modified"`
+	Unchanged int `json:"unchanged"`
+}
+
+// Diff compares the features of two versions of a set of files. The older features are kept in
+// memory, the newer ones are compared as they are read so they are never all loaded. Features are
+// matched within a file by ID, features without ID by their geometry
+type Diff struct {
+	Summary DiffSummary
+
+	old     []*oldFeature
+	maxOld  int
+	matches map[string][]int // file and match key to old features not matched yet, in order
+}
+
+type oldFeature struct {
+	file        string
+	feature     *Feature
+	geometryKey string
+	matched     bool
+}
+
+// NewDiff returns a diff keeping at most maxOld features of the older version, 0 for no limit
+func NewDiff(maxOld int) *Diff {
+	return &Diff{maxOld: maxOld, matches: map[string][]int{}}
+}
+
+// AddOld adds a feature of the older version, before any feature of the newer one is compared.
+// ErrTooManyFeatures is returned once the older version has more features than the maximum
+func (d *Diff) AddOld(file string, feature *Feature) error {
+	if d.maxOld > 0 && len(d.old) >= d.maxOld {
+		return fmt.Errorf("%w, more than %d", ErrTooManyFeatures, d.maxOld)
+	}
+	geometryKey, err := hashGeometry(feature.Geometry)
+	if err != nil {
+		return err
+	}
+	key, err := matchKey(file, feature, geometryKey)
+	if err != nil {
+		return err
+	}
+	d.matches[key] = append(d.matches[key], len(d.old))
+	d.old = append(d.old, &oldFeature{file: file, feature: feature, geometryKey: geometryKey})
+	return nil
+}
+
+// Compare calls fn with a feature of the newer version when it was added or modified
+func (d *Diff) Compare(file string, feature *Feature, fn func(*ChangedFeature) error) error {
+	geometryKey, err := hashGeometry(feature.Geometry)
+	if err != nil {
+		return err
+	}
+	key, err := matchKey(file, feature, geometryKey)
+	if err != nil {
+		return err
+	}
+
+	candidates := d.matches[key]
+	if len(candidates) == 0 {
+		d.Summary.Added++
+		return fn(changedFeature(feature, Change{Type: ChangeAdded, File: file}))
+	}
+	old := d.old[candidates[0]]
+	old.matched = true
+	d.matches[key] = candidates[1:]
+
+	change := Change{Type: ChangeModified, File: file, Properties: map[string]PropertyChange{}}
+	if old.geometryKey != geometryKey {
+		change.GeometryChanged = true
+		change.PreviousGeometry = old.feature.Geometry
+	}
+	for name, value := range feature.Properties {
+		if oldValue, exist := old.feature.Properties[name]; !exist || !sameValue(oldValue, value) {
+			change.Properties[name] = PropertyChange{Old: oldValue, New: value}
+		}
+	}
+	for name, oldValue := range old.feature.Properties {
+		if _, exist := feature.Properties[name]; !exist {
+			change.Properties[name] = PropertyChange{Old: oldValue}
+		}
+	}
+	if !change.GeometryChanged && len(change.Properties) == 0 {
+		d.Summary.Unchanged++
+		return nil
+	}
+	d.Summary.Modified++
+	return fn(changedFeature(feature, change))
+}
+
+// Removed calls fn with every feature of the older version no feature of the newer one matched,
+// once every newer feature is compared
+func (d *Diff) Removed(fn func(*ChangedFeature) error) error {
+	for _, old := range d.old {
+		if old.matched {
+			continue
+		}
+		d.Summary.Removed++
+		if err := fn(changedFeature(old.feature, Change{Type: ChangeRemoved, File: old.file})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func changedFeature(feature *Feature, change Change) *ChangedFeature {
+	return &ChangedFeature{
+		Type:       "Feature",
+		ID:         feature.ID,
+		Geometry:   feature.Geometry,
+		Properties: feature.Properties,
+		Change:     change,
+	}
+}
+
+// matchKey is what a feature is matched by: its file and its ID, or its geometry without ID
+func matchKey(file string, feature *Feature, geometryKey string) (string, error) {
+	if feature.ID == nil {
+		return fmt.Sprintf("%s\x00geometry:%s", file, geometryKey), nil
+	}
+	id, err := canonicalJSON(feature.ID)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s\x00id:%s", file, id), nil
+}
+
+// hashGeometry returns a hash of a geometry which does not depend on how its numbers are written
+func hashGeometry(geometry *Geometry) (string, error) {
+	if geometry == nil {
+		return "", nil
+	}
+	hash := sha256.New()
+	var write func(g *Geometry) error
+	write = func(g *Geometry) error {
+		fmt.Fprintf(hash, "%s(", g.Type)
+		if g.Type == "GeometryCollection" {
+			for _, child := range g.Geometries {
+				if child == nil {
+					continue
+				}
+				if err := write(child); err != nil {
+					return err
+				}
+			}
+		} else {
+			var coordinates any
+			if err := json.Unmarshal(g.Coordinates, &coordinates); err != nil {
+				return err
+			}
+			data, err := json.Marshal(coordinates)
+			if err != nil {
+				return err
+			}
+			hash.Write(data)
+		}
+		hash.Write([]byte(")"))
+		return nil
+	}
+	if err := write(geometry); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// sameValue reports if two JSON values are equal, numbers by value
+func sameValue(a, b any) bool {
+	aJSON, aErr := canonicalJSON(a)
+	bJSON, bErr := canonicalJSON(b)
+	return aErr == nil && bErr == nil && aJSON == bJSON
+}
+
+// canonicalJSON writes a value with its numbers as float64 and object members sorted
+func canonicalJSON(value any) (string, error) {
+	var normalize func(value any) any
+	normalize = func(value any) any {
+		switch value := value.(type) {
+		case json.Number:
+			if number, err := value.Float64(); err == nil {
+				return number
+			}
+			return value.String()
+		case map[string]any:
+			normalized := make(map[string]any, len(value))
+			for name, member := range value {
+				normalized[name] = normalize(member)
+			}
+			return normalized
+		case []any:
+			normalized := make([]any, len(value))
+			for i, item := range value {
+				normalized[i] = normalize(item)
+			}
+			return normalized
+		}
+		return value
+	}
+	data, err := json.Marshal(normalize(value))
+	return string(data), err
+}
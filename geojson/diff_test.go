@@ -0,0 +1,156 @@
+package geojson
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	older := map[string]string{
+		"a.geojson": `{"type": "FeatureCollection", "features": [
+			{"type": "Feature", "id": 1, "geometry": {"type": "Point", "coordinates": [1, 2]}, "properties": {"name": "one", "height": 10}},
+			{"type": "Feature", "id": 2, "geometry": {"type": "Point", "coordinates": [2, 3]}, "properties": {"name": "two", "tags": {"a": 1, "b": [1.0, 2]}}},
+			{"type": "Feature", "id": "3", "geometry": {"type": "Point", "coordinates": [3, 4]}, "properties": {"name": "three"}},
+			{"type": "Feature", "id": 4, "geometry": {"type": "Point", "coordinates": [4, 5]}, "properties": {"name": "four"}},
+			{"type": "Feature", "geometry": {"type": "LineString", "coordinates": [[0, 0], [1.5, 1]]}, "properties": {"name": "line"}},
+			{"type": "Feature", "geometry": {"type": "Point", "coordinates": [9, 9]}, "properties": {"name": "twin"}},
+			{"type": "Feature", "geometry": {"type": "Point", "coordinates": [9, 9]}, "properties": {"name": "twin"}},
+			{"type": "Feature", "geometry": null, "properties": {"name": "nowhere"}}
+		]}`,
+		"b.geojson": `{"type": "Feature", "id": 1, "geometry": {"type": "Point", "coordinates": [1, 2]}, "properties": {"name": "other one"}}`,
+	}
+	newer := map[string]string{
+		"a.geojson": `{"type": "FeatureCollection", "features": [
+			{"type": "Feature", "id": 1.0, "geometry": {"type": "Point", "coordinates": [1, 2]}, "properties": {"name": "one", "height": 12, "color": "red"}},
+			{"type": "Feature", "id": 2, "geometry": {"type": "Point", "coordinates": [2.0, 3e0]}, "properties": {"tags": {"b": [1, 2.0], "a": 1e0}, "name": "two"}},
+			{"type": "Feature", "id": "3", "geometry": {"type": "Point", "coordinates": [3, 4.5]}, "properties": {"name": "three"}},
+			{"type": "Feature", "id": 3, "geometry": {"type": "Point", "coordinates": [3, 4]}, "properties": {"name": "three"}},
+			{"type": "Feature", "geometry": {"type": "LineString", "coordinates": [[0.0, 0], [1.50, 1]]}, "properties": {}},
+			{"type": "Feature", "geometry": {"type": "Point", "coordinates": [9, 9]}, "properties": {"name": "twin"}},
+			{"type": "Feature", "geometry": null, "properties": {"name": "nowhere"}}
+		]}`,
+		"b.geojson": `{"type": "Feature", "id": 1, "geometry": {"type": "Point", "coordinates": [1, 2]}, "properties": {"name": "other one"}}`,
+	}
+
+	diff := NewDiff(0)
+	for _, file := range []string{"a.geojson", "b.geojson"} {
+		err := ReadFeatures(strings.NewReader(older[file]), func(feature *Feature) error {
+			return diff.AddOld(file, feature)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var changes []*ChangedFeature
+	collect := func(feature *ChangedFeature) error {
+		changes = append(changes, feature)
+		return nil
+	}
+	for _, file := range []string{"a.geojson", "b.geojson"} {
+		err := ReadFeatures(strings.NewReader(newer[file]), func(feature *Feature) error {
+			return diff.Compare(file, feature, collect)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := diff.Removed(collect); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (DiffSummary{Added: 1, Removed: 2, Modified: 3, Unchanged: 4}); diff.Summary != want {
+		t.Errorf("got %+v, want %+v", diff.Summary, want)
+	}
+	type summary struct {
+		change     string
+		id         any
+		name       any
+		properties []string // names of the properties which changed
+		geometry   bool
+	}
+	var got []summary
+	for _, feature := range changes {
+		s := summary{change: feature.Change.Type, id: feature.ID, name: feature.Properties["name"], geometry: feature.Change.GeometryChanged}
+		for name := range feature.Change.Properties {
+			s.properties = append(s.properties, name)
+		}
+		if len(s.properties) > 1 {
+			// Two at most, in a stable order
+			if s.properties[0] > s.properties[1] {
+				s.properties[0], s.properties[1] = s.properties[1], s.properties[0]
+			}
+		}
+		got = append(got, s)
+	}
+	want := []summary{
+		// Matched by ID, 1.0 is 1
+		{ChangeModified, json.Number("1.0"), "one", []string{"color", "height"}, false},
+		{ChangeModified, "3", "three", nil, true},
+		// 3 is not "3"
+		{ChangeAdded, json.Number("3"), "three", nil, false},
+		// Matched by geometry, 1.50 is 1.5
+		{ChangeModified, nil, nil, []string{"name"}, false},
+		{ChangeRemoved, json.Number("4"), "four", nil, false},
+		// Twins are matched in order, the second is left
+		{ChangeRemoved, nil, "twin", nil, false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A modified feature has the properties before and after, and the geometry before
+	if change := changes[0].Change.Properties["height"]; change.Old != json.Number("10") || change.New != json.Number("12") {
+		t.Errorf("got height %+v, want from 10 to 12", change)
+	}
+	if change := changes[0].Change.Properties["color"]; change.Old != nil || change.New != "red" {
+		t.Errorf("got color %+v, want added red", change)
+	}
+	if change := changes[3].Change.Properties["name"]; change.Old != "line" || change.New != nil {
+		t.Errorf("got name %+v, want removed line", change)
+	}
+	if previous := changes[1].Change.PreviousGeometry; previous == nil || string(previous.Coordinates) != "[3, 4]" {
+		t.Errorf("got previous geometry %+v, want [3, 4]", previous)
+	}
+}
+
+func TestDiffTooManyFeatures(t *testing.T) {
+	diff := NewDiff(2)
+	feature := &Feature{Geometry: &Geometry{Type: "Point", Coordinates: json.RawMessage("[1, 2]")}}
+	for i := 0; i < 2; i++ {
+		if err := diff.AddOld("a.geojson", feature); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := diff.AddOld("b.geojson", feature); !errors.Is(err, ErrTooManyFeatures) {
+		t.Errorf("got %v, want ErrTooManyFeatures", err)
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	for _, test := range []struct {
+		a, b any
+		same bool
+	}{
+		{json.Number("1"), json.Number("1.0"), true},
+		{json.Number("100"), json.Number("1e2"), true},
+		{json.Number("-0.5"), json.Number("-5E-1"), true},
+		{json.Number("1"), json.Number("2"), false},
+		{json.Number("1"), "1", false},
+		{json.Number("1"), true, false},
+		{nil, json.Number("0"), false},
+		{map[string]any{"a": json.Number("1"), "b": "x"}, map[string]any{"b": "x", "a": json.Number("1.00")}, true},
+		{map[string]any{"a": json.Number("1")}, map[string]any{"a": json.Number("1"), "b": nil}, false},
+		{[]any{json.Number("1"), json.Number("2")}, []any{json.Number("1.0"), json.Number("2e0")}, true},
+		{[]any{json.Number("1"), json.Number("2")}, []any{json.Number("2"), json.Number("1")}, false},
+		{[]any{map[string]any{"a": []any{json.Number("0.1")}}}, []any{map[string]any{"a": []any{json.Number("1e-1")}}}, true},
+	} {
+		if same := sameValue(test.a, test.b); same != test.same {
+			a, _ := canonicalJSON(test.a)
+			b, _ := canonicalJSON(test.b)
+			t.Errorf("%v and %v: got same %v, want %v (%s and %s)", test.a, test.b, same, test.same, a, b)
+		}
+	}
+}
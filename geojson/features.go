@@ -0,0 +1,116 @@
+package geojson
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// Feature is a feature of a GeoJSON document, numbers are json.Number
+type Feature struct {
+	ID         any            `json:"id,omitempty"`
+	Geometry   *Geometry      `json:"geometry"`
+	Properties map[string]any `json:"properties"`
+}
+
+// Geometry is a geometry whose coordinates are left to be decoded by its type
+type Geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometries  []*Geometry     `json:"geometries"`
+}
+
+// MarshalJSON writes the members the type of the geometry has, coordinates or geometries
+func (g Geometry) MarshalJSON() ([]byte, error) {
+	if g.Type == "GeometryCollection" {
+		geometries := g.Geometries
+		if geometries == nil {
+			geometries = []*Geometry{}
+		}
+		return json.Marshal(struct {
+			Type       string      `json:"type"`
+			Geometries []*Geometry `json:"geometries"`
+		}{g.Type, geometries})
+	}
+	return json.Marshal(struct {
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	}{g.Type, g.Coordinates})
+}
+
+// ReadFeatures calls fn with every feature of a valid document, one at a time: the features of a
+// collection, a lone feature, or a bare geometry as a feature without properties
+func ReadFeatures(r io.Reader, fn func(*Feature) error) error {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if _, err := decoder.Token(); err != nil {
+		return syntaxError(err)
+	}
+
+	members := map[string]json.RawMessage{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return syntaxError(err)
+		}
+		name := token.(string)
+
+		if name == "features" {
+			if _, err := decoder.Token(); err != nil {
+				return syntaxError(err)
+			}
+			for decoder.More() {
+				var feature Feature
+				if err := decoder.Decode(&feature); err != nil {
+					return syntaxError(err)
+				}
+				if err := fn(&feature); err != nil {
+					return err
+				}
+			}
+			if _, err := decoder.Token(); err != nil {
+				return syntaxError(err)
+			}
+			continue
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return syntaxError(err)
+		}
+		members[name] = value
+	}
+
+	documentType, err := typeOf(members, "")
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	switch documentType {
+	case "FeatureCollection":
+		return nil
+	case "Feature":
+		var feature Feature
+		if err := decodeNumbers(data, &feature); err != nil {
+			return err
+		}
+		return fn(&feature)
+	default:
+		var geometry Geometry
+		if err := decodeNumbers(data, &geometry); err != nil {
+			return err
+		}
+		return fn(&Feature{Geometry: &geometry})
+	}
+}
+
+func decodeNumbers(data []byte, value any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(value); err != nil {
+		return syntaxError(err)
+	}
+	return nil
+}
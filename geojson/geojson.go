@@ -0,0 +1,490 @@
+package geojson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ValidationError is a document which is not GeoJSON as RFC 7946 defines it,
+// Path points to the offending member like features[3].geometry.coordinates
+type ValidationError struct {
+	Path   string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Reason)
+}
+
+// Metadata describes a GeoJSON document
+type Metadata struct {
+	Type          string            `json:"type"`
+	FeatureCount  int               `json:"feature_count"`
+	GeometryTypes map[string]int    `json:"geometry_types"`
+	BBox          []float64         `json:"bbox,omitempty"` // west, south, east, north, none without coordinates
+	Properties    map[string]string `json:"properties"`     // name to JSON type, "mixed" when features disagree
+}
+
+// Members a type must not have, RFC 7946 section 7.1
+var forbiddenMembers = map[string][]string{
+	"FeatureCollection": {"coordinates", "geometries", "geometry", "properties"},
+	"Feature":           {"coordinates", "geometries", "features"},
+	"geometry":          {"geometry", "properties", "features"},
+}
+
+// Validate reads a GeoJSON document and describes it. The features of a collection are read one
+// at a time, large collections are never loaded whole
+func Validate(r io.Reader) (*Metadata, error) {
+	v := &validator{
+		decoder: json.NewDecoder(r),
+		metadata: &Metadata{
+			GeometryTypes: map[string]int{},
+			Properties:    map[string]string{},
+		},
+		west:  math.Inf(1),
+		south: math.Inf(1),
+		east:  math.Inf(-1),
+		north: math.Inf(-1),
+	}
+	if err := v.document(); err != nil {
+		return nil, err
+	}
+
+	if v.west <= v.east {
+		v.metadata.BBox = []float64{v.west, v.south, v.east, v.north}
+	}
+	return v.metadata, nil
+}
+
+type validator struct {
+	decoder  *json.Decoder
+	metadata *Metadata
+
+	west, south, east, north float64
+}
+
+func (v *validator) document() error {
+	if err := v.expectDelim('{', ""); err != nil {
+		return err
+	}
+
+	// Features are checked as they are read, every other member is kept until the type is known
+	members := map[string]json.RawMessage{}
+	hasFeatures := false
+	for v.decoder.More() {
+		token, err := v.decoder.Token()
+		if err != nil {
+			return syntaxError(err)
+		}
+		name := token.(string)
+
+		if name == "features" {
+			if err := v.features(); err != nil {
+				return err
+			}
+			hasFeatures = true
+			continue
+		}
+		var value json.RawMessage
+		if err := v.decoder.Decode(&value); err != nil {
+			return syntaxError(err)
+		}
+		members[name] = value
+	}
+	if err := v.expectDelim('}', ""); err != nil {
+		return err
+	}
+	if _, err := v.decoder.Token(); !errors.Is(err, io.EOF) {
+		return &ValidationError{Reason: "unexpected data after the document"}
+	}
+
+	documentType, err := typeOf(members, "")
+	if err != nil {
+		return err
+	}
+	v.metadata.Type = documentType
+	if hasFeatures && documentType != "FeatureCollection" {
+		return &ValidationError{Path: "features", Reason: fmt.Sprintf("not allowed in a %s", documentType)}
+	}
+
+	switch documentType {
+	case "FeatureCollection":
+		if !hasFeatures {
+			return &ValidationError{Path: "features", Reason: "missing"}
+		}
+		if err := checkForbidden(members, forbiddenMembers[documentType], ""); err != nil {
+			return err
+		}
+		return checkBBox(members, "")
+	case "Feature":
+		return v.feature(members, "")
+	default:
+		return v.geometry(members, "")
+	}
+}
+
+func (v *validator) features() error {
+	if err := v.expectDelim('[', "features"); err != nil {
+		return err
+	}
+	for i := 0; v.decoder.More(); i++ {
+		path := fmt.Sprintf("features[%d]", i)
+		members, err := decodeObject(v.decoderValue, path)
+		if err != nil {
+			return err
+		}
+		if members == nil {
+			return &ValidationError{Path: path, Reason: "a feature can not be null"}
+		}
+		if featureType, err := typeOf(members, path); err != nil {
+			return err
+		} else if featureType != "Feature" {
+			return &ValidationError{Path: path + ".type", Reason: fmt.Sprintf("expected Feature, got %s", featureType)}
+		}
+		if err := v.feature(members, path); err != nil {
+			return err
+		}
+	}
+	return v.expectDelim(']', "features")
+}
+
+func (v *validator) feature(members map[string]json.RawMessage, path string) error {
+	if err := checkForbidden(members, forbiddenMembers["Feature"], path); err != nil {
+		return err
+	}
+	if err := checkBBox(members, path); err != nil {
+		return err
+	}
+	if id, exist := members["id"]; exist {
+		if kind := kindOf(id); kind != "string" && kind != "number" {
+			return &ValidationError{Path: join(path, "id"), Reason: "must be a string or a number"}
+		}
+	}
+
+	// A feature without geometry has a null one, never a missing one
+	geometry, exist := members["geometry"]
+	if !exist {
+		return &ValidationError{Path: join(path, "geometry"), Reason: "missing"}
+	}
+	geometryMembers, err := decodeObject(rawValue(geometry), join(path, "geometry"))
+	if err != nil {
+		return err
+	}
+	if geometryMembers != nil {
+		if err := v.geometry(geometryMembers, join(path, "geometry")); err != nil {
+			return err
+		}
+	}
+
+	properties, exist := members["properties"]
+	if !exist {
+		return &ValidationError{Path: join(path, "properties"), Reason: "missing"}
+	}
+	propertyMembers, err := decodeObject(rawValue(properties), join(path, "properties"))
+	if err != nil {
+		return err
+	}
+	for name, value := range propertyMembers {
+		v.addProperty(name, kindOf(value))
+	}
+
+	v.metadata.FeatureCount++
+	return nil
+}
+
+func (v *validator) geometry(members map[string]json.RawMessage, path string) error {
+	geometryType, err := typeOf(members, path)
+	if err != nil {
+		return err
+	}
+	if err := checkForbidden(members, forbiddenMembers["geometry"], path); err != nil {
+		return err
+	}
+	if err := checkBBox(members, path); err != nil {
+		return err
+	}
+
+	if geometryType == "GeometryCollection" {
+		geometries, exist := members["geometries"]
+		if !exist {
+			return &ValidationError{Path: join(path, "geometries"), Reason: "missing"}
+		}
+		var list []json.RawMessage
+		if err := json.Unmarshal(geometries, &list); err != nil {
+			return &ValidationError{Path: join(path, "geometries"), Reason: "must be an array"}
+		}
+		for i, geometry := range list {
+			geometryPath := fmt.Sprintf("%s[%d]", join(path, "geometries"), i)
+			geometryMembers, err := decodeObject(rawValue(geometry), geometryPath)
+			if err != nil {
+				return err
+			}
+			if geometryMembers == nil {
+				return &ValidationError{Path: geometryPath, Reason: "a geometry can not be null"}
+			}
+			if err := v.geometry(geometryMembers, geometryPath); err != nil {
+				return err
+			}
+		}
+		v.metadata.GeometryTypes[geometryType]++
+		return nil
+	}
+
+	coordinates, exist := members["coordinates"]
+	if !exist {
+		return &ValidationError{Path: join(path, "coordinates"), Reason: "missing"}
+	}
+	typePath := join(path, "type")
+	path = join(path, "coordinates")
+	switch geometryType {
+	case "Point":
+		var position []float64
+		if err := unmarshalCoordinates(coordinates, &position, geometryType, path); err != nil {
+			return err
+		}
+		// An empty point is an empty geometry
+		if len(position) > 0 {
+			if err := v.position(position, path); err != nil {
+				return err
+			}
+		}
+	case "MultiPoint", "LineString":
+		var positions [][]float64
+		if err := unmarshalCoordinates(coordinates, &positions, geometryType, path); err != nil {
+			return err
+		}
+		if geometryType == "LineString" && len(positions) == 1 {
+			return &ValidationError{Path: path, Reason: "a line string needs two or more positions"}
+		}
+		if err := v.positions(positions, path); err != nil {
+			return err
+		}
+	case "MultiLineString", "Polygon":
+		var lines [][][]float64
+		if err := unmarshalCoordinates(coordinates, &lines, geometryType, path); err != nil {
+			return err
+		}
+		for i, line := range lines {
+			if err := v.line(line, geometryType == "Polygon", fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "MultiPolygon":
+		var polygons [][][][]float64
+		if err := unmarshalCoordinates(coordinates, &polygons, geometryType, path); err != nil {
+			return err
+		}
+		for i, polygon := range polygons {
+			for j, ring := range polygon {
+				if err := v.line(ring, true, fmt.Sprintf("%s[%d][%d]", path, i, j)); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return &ValidationError{Path: typePath, Reason: fmt.Sprintf("unknown geometry type %s", geometryType)}
+	}
+
+	v.metadata.GeometryTypes[geometryType]++
+	return nil
+}
+
+// line checks a line string, or a linear ring which is closed and has four or more positions
+func (v *validator) line(positions [][]float64, ring bool, path string) error {
+	if ring {
+		if len(positions) < 4 {
+			return &ValidationError{Path: path, Reason: "a linear ring needs four or more positions"}
+		}
+		first, last := positions[0], positions[len(positions)-1]
+		if len(first) != len(last) {
+			return &ValidationError{Path: path, Reason: "linear ring is not closed"}
+		}
+		for i := range first {
+			if first[i] != last[i] {
+				return &ValidationError{Path: path, Reason: "linear ring is not closed"}
+			}
+		}
+	} else if len(positions) < 2 {
+		return &ValidationError{Path: path, Reason: "a line string needs two or more positions"}
+	}
+	return v.positions(positions, path)
+}
+
+func (v *validator) positions(positions [][]float64, path string) error {
+	for i, position := range positions {
+		if err := v.position(position, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// position checks a longitude, latitude and optional altitude, extending the bounding box
+func (v *validator) position(position []float64, path string) error {
+	if len(position) < 2 {
+		return &ValidationError{Path: path, Reason: "a position needs a longitude and a latitude"}
+	}
+	longitude, latitude := position[0], position[1]
+	if longitude < -180 || longitude > 180 {
+		return &ValidationError{Path: path, Reason: fmt.Sprintf("longitude %v is out of range", longitude)}
+	}
+	if latitude < -90 || latitude > 90 {
+		return &ValidationError{Path: path, Reason: fmt.Sprintf("latitude %v is out of range", latitude)}
+	}
+
+	v.west = math.Min(v.west, longitude)
+	v.east = math.Max(v.east, longitude)
+	v.south = math.Min(v.south, latitude)
+	v.north = math.Max(v.north, latitude)
+	return nil
+}
+
+// addProperty merges the type of a property into the schema, null never overrides a known type
+func (v *validator) addProperty(name, kind string) {
+	known, exist := v.metadata.Properties[name]
+	switch {
+	case !exist, known == "null":
+		v.metadata.Properties[name] = kind
+	case kind != known && kind != "null":
+		v.metadata.Properties[name] = "mixed"
+	}
+}
+
+func (v *validator) expectDelim(delim json.Delim, path string) error {
+	token, err := v.decoder.Token()
+	if err != nil {
+		return syntaxError(err)
+	}
+	if token != delim {
+		return &ValidationError{Path: path, Reason: fmt.Sprintf("expected %v", delim)}
+	}
+	return nil
+}
+
+// decoderValue reads the next value of the decoder
+func (v *validator) decoderValue() (json.RawMessage, error) {
+	var value json.RawMessage
+	if err := v.decoder.Decode(&value); err != nil {
+		return nil, syntaxError(err)
+	}
+	return value, nil
+}
+
+func rawValue(value json.RawMessage) func() (json.RawMessage, error) {
+	return func() (json.RawMessage, error) {
+		return value, nil
+	}
+}
+
+// decodeObject reads an object's members, nil for null
+func decodeObject(next func() (json.RawMessage, error), path string) (map[string]json.RawMessage, error) {
+	value, err := next()
+	if err != nil {
+		return nil, err
+	}
+	switch kindOf(value) {
+	case "null":
+		return nil, nil
+	case "object":
+		var members map[string]json.RawMessage
+		if err := json.Unmarshal(value, &members); err != nil {
+			return nil, syntaxError(err)
+		}
+		return members, nil
+	default:
+		return nil, &ValidationError{Path: path, Reason: "must be an object or null"}
+	}
+}
+
+func typeOf(members map[string]json.RawMessage, path string) (string, error) {
+	value, exist := members["type"]
+	if !exist {
+		return "", &ValidationError{Path: join(path, "type"), Reason: "missing"}
+	}
+	var objectType string
+	if err := json.Unmarshal(value, &objectType); err != nil {
+		return "", &ValidationError{Path: join(path, "type"), Reason: "must be a string"}
+	}
+
+	switch objectType {
+	case "FeatureCollection", "Feature", "Point", "MultiPoint", "LineString", "MultiLineString",
+		"Polygon", "MultiPolygon", "GeometryCollection":
+		return objectType, nil
+	}
+	return "", &ValidationError{Path: join(path, "type"), Reason: fmt.Sprintf("unknown type %s", objectType)}
+}
+
+func checkForbidden(members map[string]json.RawMessage, forbidden []string, path string) error {
+	for _, name := range forbidden {
+		if _, exist := members[name]; exist {
+			return &ValidationError{Path: join(path, name), Reason: "not allowed here"}
+		}
+	}
+	return nil
+}
+
+// checkBBox checks an optional bounding box, two or three dimensions of minimums then maximums
+func checkBBox(members map[string]json.RawMessage, path string) error {
+	value, exist := members["bbox"]
+	if !exist {
+		return nil
+	}
+	var bbox []float64
+	if err := json.Unmarshal(value, &bbox); err != nil || (len(bbox) != 4 && len(bbox) != 6) {
+		return &ValidationError{Path: join(path, "bbox"), Reason: "must be an array of 4 or 6 numbers"}
+	}
+	return nil
+}
+
+func unmarshalCoordinates(value json.RawMessage, coordinates any, geometryType, path string) error {
+	if err := json.Unmarshal(value, coordinates); err != nil {
+		return &ValidationError{Path: path, Reason: fmt.Sprintf("not the nested arrays of numbers a %s needs", geometryType)}
+	}
+	return nil
+}
+
+// kindOf returns the JSON type of a value
+func kindOf(value json.RawMessage) string {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 {
+		return "null"
+	}
+	switch value[0] {
+	case '"':
+		return "string"
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	}
+	return "number"
+}
+
+func syntaxError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &ValidationError{Reason: "unexpected end of the document"}
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return &ValidationError{Reason: fmt.Sprintf("invalid JSON at byte %d: %v", syntaxErr.Offset, err)}
+	}
+	return err
+}
+
+func join(path, member string) string {
+	if path == "" {
+		return member
+	}
+	return path + "." + member
+}
@@ -0,0 +1,122 @@
+package geojson
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	document := `{"type": "FeatureCollection", "bbox": [-10, -5, 20, 40], "features": [
+		{"type": "Feature", "id": 1, "geometry": {"type": "Point", "coordinates": [-10, 40, 120]},
+			"properties": {"name": "a", "height": 12, "note": null}},
+		{"type": "Feature", "id": "b", "geometry": {"type": "Polygon", "coordinates": [[[0, 0], [20, 0], [20, -5], [0, 0]]]},
+			"properties": {"name": 2, "note": "kept"}},
+		{"type": "Feature", "geometry": null, "properties": null},
+		{"type": "Feature", "geometry": {"type": "GeometryCollection", "geometries": [
+			{"type": "LineString", "coordinates": [[1, 1], [2, 2]]},
+			{"type": "MultiPoint", "coordinates": []}]}, "properties": {}}
+	]}`
+	metadata, err := Validate(strings.NewReader(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Metadata{
+		Type:          "FeatureCollection",
+		FeatureCount:  4,
+		GeometryTypes: map[string]int{"Point": 1, "Polygon": 1, "GeometryCollection": 1, "LineString": 1, "MultiPoint": 1},
+		BBox:          []float64{-10, -5, 20, 40},
+		Properties:    map[string]string{"name": "mixed", "height": "number", "note": "string"},
+	}
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("got %+v, want %+v", metadata, want)
+	}
+
+	// A single geometry or feature is a document too, without coordinates there is no bounding box
+	for _, test := range []struct {
+		document string
+		want     *Metadata
+	}{
+		{`{"type": "MultiPolygon", "coordinates": [[[[1, 2], [3, 2], [3, 4], [1, 2]]]]}`,
+			&Metadata{Type: "MultiPolygon", GeometryTypes: map[string]int{"MultiPolygon": 1}, BBox: []float64{1, 2, 3, 4}, Properties: map[string]string{}}},
+		{`{"type": "Feature", "geometry": {"type": "Point", "coordinates": []}, "properties": {"a": true}}`,
+			&Metadata{Type: "Feature", FeatureCount: 1, GeometryTypes: map[string]int{"Point": 1}, Properties: map[string]string{"a": "boolean"}}},
+		{`{"features": [], "type": "FeatureCollection"}`,
+			&Metadata{Type: "FeatureCollection", GeometryTypes: map[string]int{}, Properties: map[string]string{}}},
+	} {
+		metadata, err := Validate(strings.NewReader(test.document))
+		if err != nil {
+			t.Errorf("%s: %v", test.document, err)
+		} else if !reflect.DeepEqual(metadata, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.document, metadata, test.want)
+		}
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	for _, test := range []struct {
+		document string
+		path     string
+	}{
+		// Not JSON, or not an object
+		{``, ""},
+		{`[]`, ""},
+		{`{"type": "Point", "coordinates": [1, 2]`, ""},
+		{`{"type": "Point", "coordinates": [1, 2]} {}`, ""},
+		{`{"type": "Point", "coordinates": [1, 2],}`, ""},
+
+		// Types
+		{`{"coordinates": [1, 2]}`, "type"},
+		{`{"type": 1, "coordinates": [1, 2]}`, "type"},
+		{`{"type": "Circle", "coordinates": [1, 2]}`, "type"},
+		{`{"type": "Feature", "geometry": null, "properties": null, "features": []}`, "features"},
+
+		// Feature collections
+		{`{"type": "FeatureCollection"}`, "features"},
+		{`{"type": "FeatureCollection", "features": {}}`, "features"},
+		{`{"type": "FeatureCollection", "features": [], "geometry": null}`, "geometry"},
+		{`{"type": "FeatureCollection", "features": [], "bbox": [1, 2, 3]}`, "bbox"},
+		{`{"type": "FeatureCollection", "features": [null]}`, "features[0]"},
+		{`{"type": "FeatureCollection", "features": [{"type": "Point", "coordinates": [1, 2]}]}`, "features[0].type"},
+
+		// Features
+		{`{"type": "Feature", "properties": {}}`, "geometry"},
+		{`{"type": "Feature", "geometry": null}`, "properties"},
+		{`{"type": "Feature", "geometry": null, "properties": []}`, "properties"},
+		{`{"type": "Feature", "id": {}, "geometry": null, "properties": null}`, "id"},
+		{`{"type": "Feature", "geometry": 1, "properties": null}`, "geometry"},
+		{`{"type": "Feature", "geometry": null, "properties": null, "coordinates": [1, 2]}`, "coordinates"},
+
+		// Geometries
+		{`{"type": "Point"}`, "coordinates"},
+		{`{"type": "Point", "coordinates": [1, 2], "properties": {}}`, "properties"},
+		{`{"type": "Point", "coordinates": "1, 2"}`, "coordinates"},
+		{`{"type": "Point", "coordinates": [1]}`, "coordinates"},
+		{`{"type": "Point", "coordinates": [181, 0]}`, "coordinates"},
+		{`{"type": "Point", "coordinates": [0, -91]}`, "coordinates"},
+		{`{"type": "LineString", "coordinates": [[1, 2]]}`, "coordinates"},
+		{`{"type": "MultiLineString", "coordinates": [[[1, 2]]]}`, "coordinates[0]"},
+		{`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [0, 0]]]}`, "coordinates[0]"},
+		{`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 1]]]}`, "coordinates[0]"},
+		{`{"type": "Polygon", "coordinates": [[[0, 0], [1, 0], [1, 1], [0, 0, 1]]]}`, "coordinates[0]"},
+		{`{"type": "MultiPolygon", "coordinates": [[[[0, 0], [1, 0], [1, 1], [0, 0]]], [[[0, 0], [1, 0]]]]}`, "coordinates[1][0]"},
+		{`{"type": "GeometryCollection"}`, "geometries"},
+		{`{"type": "GeometryCollection", "geometries": {}}`, "geometries"},
+		{`{"type": "GeometryCollection", "geometries": [null]}`, "geometries[0]"},
+		{`{"type": "GeometryCollection", "geometries": [{"type": "Point", "coordinates": [0, 100]}]}`, "geometries[0].coordinates"},
+
+		// Paths lead to the offending member of a feature
+		{`{"type": "FeatureCollection", "features": [{"type": "Feature", "geometry": null, "properties": null},
+			{"type": "Feature", "geometry": {"type": "LineString", "coordinates": [[0, 0], [200, 0]]}, "properties": null}]}`,
+			"features[1].geometry.coordinates[1]"},
+	} {
+		_, err := Validate(strings.NewReader(test.document))
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Errorf("%s: got %v, want a ValidationError", test.document, err)
+		} else if validationErr.Path != test.path {
+			t.Errorf("%s: got %v at %q, want it at %q", test.document, err, validationErr.Path, test.path)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package geotiff
+
+import "fmt"
+
+// Images up to this size in both dimensions need neither tiles nor overviews to be cloud optimized
+const smallImageSize = 512
+
+// COG tells if a GeoTIFF is cloud optimized: tiled, with overviews, its IFDs before the image
+// data and the data of smaller overviews before larger ones, so a reader needs few range requests
+type COG struct {
+	Valid    bool     `json:"valid"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+func checkCloudOptimized(t *tiffReader, metadata *Metadata) (COG, error) {
+	cog := COG{Errors: []string{}, Warnings: []string{}}
+	large := metadata.Width > smallImageSize || metadata.Height > smallImageSize
+
+	if large && !metadata.Tiled {
+		cog.Errors = append(cog.Errors, "the image is not tiled")
+	}
+	if large && len(metadata.Overviews) == 0 {
+		cog.Warnings = append(cog.Warnings, fmt.Sprintf("the image is larger than %d pixels without overviews", smallImageSize))
+	}
+	for i, overview := range metadata.Overviews {
+		if (overview.Width > smallImageSize || overview.Height > smallImageSize) && !overview.Tiled {
+			cog.Errors = append(cog.Errors, fmt.Sprintf("overview %d is not tiled", i))
+		}
+	}
+
+	// IFDs follow each other, all of them before the image data
+	var lastIFD int64
+	for i, directory := range t.ifds {
+		if directory.offset < lastIFD {
+			cog.Errors = append(cog.Errors, fmt.Sprintf("IFD %d is before IFD %d", i, i-1))
+		}
+		lastIFD = max(lastIFD, directory.offset)
+	}
+
+	// The data of every image is after the IFDs, and the data of the main image and its overviews
+	// is after the data of the smaller overviews. Masks are interleaved with their image, not checked
+	var previous int64
+	for i, directory := range t.ifds {
+		offset, err := firstDataOffset(t, directory)
+		if err != nil {
+			return cog, err
+		}
+		if offset != 0 && offset < lastIFD {
+			cog.Errors = append(cog.Errors, fmt.Sprintf("data of image %d is before the last IFD", i))
+		}
+
+		subfileType, err := t.number(directory, tagNewSubfileType, 0)
+		if err != nil {
+			return cog, err
+		}
+		if i > 0 && int(subfileType)&subfileReducedResolution == 0 || int(subfileType)&subfileMask != 0 {
+			continue
+		}
+		if offset != 0 && previous != 0 && offset > previous {
+			cog.Errors = append(cog.Errors, fmt.Sprintf("data of image %d is after the data of a larger image", i))
+		}
+		if offset != 0 {
+			previous = offset
+		}
+	}
+
+	cog.Valid = len(cog.Errors) == 0
+	return cog, nil
+}
+
+// firstDataOffset returns where the first tile or strip of an image is, 0 when it has none
+func firstDataOffset(t *tiffReader, directory *ifd) (int64, error) {
+	tag := uint16(tagStripOffsets)
+	if _, tiled := directory.entries[tagTileOffsets]; tiled {
+		tag = tagTileOffsets
+	}
+	offset, err := t.number(directory, tag, 0)
+	return int64(offset), err
+}
@@ -0,0 +1,365 @@
+package geotiff
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Metadata describes a GeoTIFF from its headers, pixels are never read
+type Metadata struct {
+	BigTIFF        bool       `json:"bigtiff"`
+	ByteOrder      string     `json:"byte_order"`
+	Width          int        `json:"width"`
+	Height         int        `json:"height"`
+	Bands          int        `json:"bands"`
+	DataType       string     `json:"data_type"`
+	Compression    string     `json:"compression"`
+	Photometric    string     `json:"photometric"`
+	Tiled          bool       `json:"tiled"`
+	TileWidth      int        `json:"tile_width,omitempty"`
+	TileHeight     int        `json:"tile_height,omitempty"`
+	Overviews      []Overview `json:"overviews"`
+	Masks          int        `json:"masks"`
+	NoData         string     `json:"nodata,omitempty"`
+	Georeferenced  bool       `json:"georeferenced"`
+	CRS            *CRS       `json:"crs,omitempty"`
+	GeoTransform   []float64  `json:"geotransform,omitempty"` // GDAL order: origin x, pixel width, row rotation, origin y, column rotation, pixel height
+	Bounds         []float64  `json:"bounds,omitempty"`       // min x, min y, max x, max y in the CRS
+	BBox           []float64  `json:"bbox,omitempty"`         // west, south, east, north in WGS 84 degrees, when the CRS is known
+	CloudOptimized COG        `json:"cloud_optimized"`
+}
+
+type Overview struct {
+	Width  int  `json:"width"`
+	Height int  `json:"height"`
+	Tiled  bool `json:"tiled"`
+}
+
+// CRS is the coordinate reference system from the GeoKeys
+type CRS struct {
+	Model    string `json:"model"` // projected, geographic or geocentric
+	EPSG     int    `json:"epsg,omitempty"`
+	Citation string `json:"citation,omitempty"`
+}
+
+// Read parses the headers of a TIFF or BigTIFF and its GeoTIFF tags
+func Read(r io.ReaderAt, size int64) (*Metadata, error) {
+	t, err := newTIFFReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return describe(t)
+}
+
+func describe(t *tiffReader) (*Metadata, error) {
+	main := t.ifds[0]
+
+	metadata := &Metadata{BigTIFF: t.bigTIFF, ByteOrder: t.byteOrder, Overviews: []Overview{}}
+	width, err := t.number(main, tagImageWidth, 0)
+	if err != nil {
+		return nil, err
+	}
+	height, err := t.number(main, tagImageLength, 0)
+	if err != nil {
+		return nil, err
+	}
+	if width == 0 || height == 0 {
+		return nil, &FormatError{Reason: "image has no width or height"}
+	}
+	metadata.Width, metadata.Height = int(width), int(height)
+
+	bands, err := t.number(main, tagSamplesPerPixel, 1)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Bands = int(bands)
+	bits, err := t.number(main, tagBitsPerSample, 1)
+	if err != nil {
+		return nil, err
+	}
+	sampleFormat, err := t.number(main, tagSampleFormat, 1)
+	if err != nil {
+		return nil, err
+	}
+	metadata.DataType = dataType(int(sampleFormat), int(bits))
+	compression, err := t.number(main, tagCompression, 1)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Compression = compressionName(int(compression))
+	photometric, err := t.number(main, tagPhotometric, -1)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Photometric = photometricName(int(photometric))
+	if metadata.NoData, err = t.text(main, tagGDALNoData); err != nil {
+		return nil, err
+	}
+
+	_, metadata.Tiled = main.entries[tagTileWidth]
+	if metadata.Tiled {
+		tileWidth, err := t.number(main, tagTileWidth, 0)
+		if err != nil {
+			return nil, err
+		}
+		tileHeight, err := t.number(main, tagTileLength, 0)
+		if err != nil {
+			return nil, err
+		}
+		metadata.TileWidth, metadata.TileHeight = int(tileWidth), int(tileHeight)
+	}
+
+	// The other images are overviews or masks
+	for _, directory := range t.ifds[1:] {
+		subfileType, err := t.number(directory, tagNewSubfileType, 0)
+		if err != nil {
+			return nil, err
+		}
+		if int(subfileType)&subfileMask != 0 {
+			metadata.Masks++
+			continue
+		}
+		if int(subfileType)&subfileReducedResolution == 0 {
+			continue
+		}
+		overviewWidth, err := t.number(directory, tagImageWidth, 0)
+		if err != nil {
+			return nil, err
+		}
+		overviewHeight, err := t.number(directory, tagImageLength, 0)
+		if err != nil {
+			return nil, err
+		}
+		_, tiled := directory.entries[tagTileWidth]
+		metadata.Overviews = append(metadata.Overviews, Overview{Width: int(overviewWidth), Height: int(overviewHeight), Tiled: tiled})
+	}
+
+	if err := readGeoreference(t, main, metadata); err != nil {
+		return nil, err
+	}
+	if metadata.CloudOptimized, err = checkCloudOptimized(t, metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// GeoKeys this package reads
+const (
+	keyModelType         = 1024
+	keyRasterType        = 1025
+	keyCitation          = 1026
+	keyGeographicType    = 2048
+	keyGeogCitation      = 2049
+	keyProjectedType     = 3072
+	keyProjectedCitation = 3073
+
+	userDefined        = 32767
+	rasterPixelIsPoint = 2
+)
+
+func readGeoreference(t *tiffReader, main *ifd, metadata *Metadata) error {
+	transformation, err := t.numbers(main, tagModelTransformation, 16)
+	if err != nil {
+		return err
+	}
+	tiepoint, err := t.numbers(main, tagModelTiepoint, 6)
+	if err != nil {
+		return err
+	}
+	scale, err := t.numbers(main, tagModelPixelScale, 3)
+	if err != nil {
+		return err
+	}
+
+	var geoTransform []float64
+	switch {
+	case len(transformation) == 16:
+		geoTransform = []float64{transformation[3], transformation[0], transformation[1], transformation[7], transformation[4], transformation[5]}
+	case len(tiepoint) == 6 && len(scale) >= 2:
+		geoTransform = []float64{tiepoint[3] - tiepoint[0]*scale[0], scale[0], 0, tiepoint[4] + tiepoint[1]*scale[1], 0, -scale[1]}
+	default:
+		return nil
+	}
+
+	keys, err := readGeoKeys(t, main)
+	if err != nil {
+		return err
+	}
+	if keys.number(keyRasterType) == rasterPixelIsPoint {
+		// Tiepoints are at pixel centers, the transform is at their corner
+		geoTransform[0] -= 0.5*geoTransform[1] + 0.5*geoTransform[2]
+		geoTransform[3] -= 0.5*geoTransform[4] + 0.5*geoTransform[5]
+	}
+	metadata.Georeferenced = true
+	metadata.GeoTransform = geoTransform
+
+	// Bounds of the four corners
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	var corners [][2]float64
+	for _, pixel := range [][2]float64{{0, 0}, {float64(metadata.Width), 0}, {0, float64(metadata.Height)}, {float64(metadata.Width), float64(metadata.Height)}} {
+		x := geoTransform[0] + pixel[0]*geoTransform[1] + pixel[1]*geoTransform[2]
+		y := geoTransform[3] + pixel[0]*geoTransform[4] + pixel[1]*geoTransform[5]
+		corners = append(corners, [2]float64{x, y})
+		minX, minY, maxX, maxY = math.Min(minX, x), math.Min(minY, y), math.Max(maxX, x), math.Max(maxY, y)
+	}
+	metadata.Bounds = []float64{minX, minY, maxX, maxY}
+
+	// Finite values may still overflow once combined
+	if !isFinite(geoTransform...) || !isFinite(metadata.Bounds...) {
+		return &FormatError{Reason: "georeference is not finite"}
+	}
+
+	switch keys.number(keyModelType) {
+	case 1:
+		metadata.CRS = &CRS{Model: "projected", Citation: firstNonEmpty(keys.text(keyProjectedCitation), keys.text(keyCitation))}
+		if epsg := keys.number(keyProjectedType); epsg != 0 && epsg != userDefined {
+			metadata.CRS.EPSG = epsg
+		}
+	case 2:
+		metadata.CRS = &CRS{Model: "geographic", Citation: firstNonEmpty(keys.text(keyGeogCitation), keys.text(keyCitation))}
+		if epsg := keys.number(keyGeographicType); epsg != 0 && epsg != userDefined {
+			metadata.CRS.EPSG = epsg
+		}
+	case 3:
+		metadata.CRS = &CRS{Model: "geocentric", Citation: keys.text(keyCitation)}
+	}
+	if metadata.CRS != nil {
+		metadata.BBox = toWGS84(metadata.CRS, corners)
+	}
+	return nil
+}
+
+// geoKeys are the keys of the GeoKeyDirectory, numbers or text
+type geoKeys struct {
+	numbers map[int]int
+	texts   map[int]string
+}
+
+func (k geoKeys) number(key int) int {
+	return k.numbers[key]
+}
+
+func (k geoKeys) text(key int) string {
+	return k.texts[key]
+}
+
+func readGeoKeys(t *tiffReader, main *ifd) (geoKeys, error) {
+	keys := geoKeys{numbers: map[int]int{}, texts: map[int]string{}}
+	directory, err := t.numbers(main, tagGeoKeyDirectory, maxValues)
+	if err != nil || len(directory) < 4 {
+		return keys, err
+	}
+	asciiParams, err := t.text(main, tagGeoASCIIParams)
+	if err != nil {
+		return keys, err
+	}
+
+	count := int(directory[3])
+	for i := 0; i < count && 4+i*4+3 < len(directory); i++ {
+		key := directory[4+i*4 : 8+i*4]
+		id, location, valueCount, value := int(key[0]), int(key[1]), int(key[2]), int(key[3])
+		switch location {
+		case 0:
+			keys.numbers[id] = value
+		case tagGeoASCIIParams:
+			if value >= 0 && value+valueCount <= len(asciiParams) {
+				keys.texts[id] = strings.TrimRight(asciiParams[value:value+valueCount], "|\x00")
+			}
+		}
+	}
+	return keys, nil
+}
+
+// toWGS84 returns the WGS 84 bounding box of corners, nil when the CRS has no known projection
+func toWGS84(crs *CRS, corners [][2]float64) []float64 {
+	projection := ProjectionOf(crs)
+	if projection == nil {
+		return nil
+	}
+
+	west, south, east, north := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, corner := range corners {
+		longitude, latitude := projection.Inverse(corner[0], corner[1])
+		west, south = math.Min(west, longitude), math.Min(south, latitude)
+		east, north = math.Max(east, longitude), math.Max(north, latitude)
+	}
+	if !(west >= -180 && east <= 180 && south >= -90 && north <= 90) {
+		return nil
+	}
+	return []float64{west, south, east, north}
+}
+
+func dataType(sampleFormat, bits int) string {
+	switch sampleFormat {
+	case 2:
+		return fmt.Sprintf("int%d", bits)
+	case 3:
+		return fmt.Sprintf("float%d", bits)
+	case 5:
+		return fmt.Sprintf("complex_int%d", bits)
+	case 6:
+		return fmt.Sprintf("complex_float%d", bits)
+	}
+	return fmt.Sprintf("uint%d", bits)
+}
+
+func compressionName(compression int) string {
+	switch compression {
+	case 1:
+		return "none"
+	case 5:
+		return "lzw"
+	case 6, 7:
+		return "jpeg"
+	case 8, 32946:
+		return "deflate"
+	case 32773:
+		return "packbits"
+	case 34887:
+		return "lerc"
+	case 34925:
+		return "lzma"
+	case 50000:
+		return "zstd"
+	case 50001:
+		return "webp"
+	case 50002:
+		return "jxl"
+	}
+	return fmt.Sprintf("unknown (%d)", compression)
+}
+
+func photometricName(photometric int) string {
+	switch photometric {
+	case 0:
+		return "min_is_white"
+	case 1:
+		return "min_is_black"
+	case 2:
+		return "rgb"
+	case 3:
+		return "palette"
+	case 4:
+		return "mask"
+	case 5:
+		return "cmyk"
+	case 6:
+		return "ycbcr"
+	case 8:
+		return "cielab"
+	case -1:
+		return ""
+	}
+	return fmt.Sprintf("unknown (%d)", photometric)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
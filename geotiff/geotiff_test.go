@@ -0,0 +1,398 @@
+package geotiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	for _, builder := range []tiffBuilder{
+		{order: binary.LittleEndian},
+		{order: binary.BigEndian},
+		{order: binary.LittleEndian, bigTIFF: true},
+	} {
+		data := builder.build(georeferencedImage(grayImage(4, 4, 4)))
+		metadata, err := Read(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("%s: %v", builder, err)
+		}
+
+		if metadata.BigTIFF != builder.bigTIFF || metadata.Width != 4 || metadata.Height != 4 || metadata.Bands != 1 ||
+			metadata.DataType != "uint8" || metadata.Compression != "none" || metadata.Tiled {
+			t.Errorf("%s: got %+v", builder, metadata)
+		}
+		if !metadata.Georeferenced || metadata.CRS == nil || metadata.CRS.Model != "geographic" || metadata.CRS.EPSG != 4326 {
+			t.Errorf("%s: got georeference %v and CRS %+v", builder, metadata.Georeferenced, metadata.CRS)
+		}
+		if want := []float64{10, 0.5, 0, 50, 0, -0.5}; !reflect.DeepEqual(metadata.GeoTransform, want) {
+			t.Errorf("%s: got geotransform %v, want %v", builder, metadata.GeoTransform, want)
+		}
+		if want := []float64{10, 48, 12, 50}; !reflect.DeepEqual(metadata.Bounds, want) || !reflect.DeepEqual(metadata.BBox, want) {
+			t.Errorf("%s: got bounds %v and bbox %v, want %v", builder, metadata.Bounds, metadata.BBox, want)
+		}
+	}
+}
+
+func TestReadOverviews(t *testing.T) {
+	main := georeferencedImage(tiledImage(grayImage(1024, 1024, 1024), 512, 512))
+	overview := tiledImage(grayImage(512, 512, 512), 512, 512)
+	overview.tags[tagNewSubfileType] = tiffTag{fieldType: 4, values: []float64{subfileReducedResolution}}
+	mask := grayImage(1024, 1024, 1024)
+	mask.tags[tagNewSubfileType] = tiffTag{fieldType: 4, values: []float64{subfileMask}}
+
+	data := tiffBuilder{order: binary.LittleEndian}.build(main, overview, mask)
+	metadata, err := Read(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Overview{{Width: 512, Height: 512, Tiled: true}}; !reflect.DeepEqual(metadata.Overviews, want) || metadata.Masks != 1 {
+		t.Errorf("got overviews %+v and %d masks", metadata.Overviews, metadata.Masks)
+	}
+
+	// Block data is written before the IFDs, which is what cloud optimized files never do
+	if metadata.CloudOptimized.Valid || len(metadata.CloudOptimized.Errors) == 0 {
+		t.Errorf("got %+v for data before the IFDs", metadata.CloudOptimized)
+	}
+}
+
+// Files which are not readable TIFFs fail with a FormatError, they are never read past their end
+func TestReadRejects(t *testing.T) {
+	little := tiffBuilder{order: binary.LittleEndian}
+	valid := little.build(georeferencedImage(grayImage(4, 4, 4)))
+
+	withTag := func(tag uint16, value tiffTag) []byte {
+		img := georeferencedImage(grayImage(4, 4, 4))
+		img.tags[tag] = value
+		return little.build(img)
+	}
+	rational := func(numerator, denominator uint32) []byte {
+		raw := make([]byte, 0, 24)
+		for i := 0; i < 3; i++ {
+			raw = binary.LittleEndian.AppendUint32(raw, numerator)
+			raw = binary.LittleEndian.AppendUint32(raw, denominator)
+		}
+		return raw
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"no byte order", append([]byte("XX"), valid[2:]...)},
+		{"unknown version", append([]byte("II\x2c\x00"), valid[4:]...)},
+		{"BigTIFF offsets of 4 bytes", append([]byte("II\x2b\x00\x04\x00\x00\x00"), make([]byte, 16)...)},
+		{"no image", append([]byte("II\x2a\x00\x00\x00\x00\x00"), make([]byte, 8)...)},
+		{"first IFD past the end", append([]byte("II\x2a\x00\x00\x00\x10\x00"), make([]byte, 8)...)},
+		{"IFD loop", tiffBuilder{order: binary.LittleEndian, loop: true}.build(grayImage(4, 4, 4), grayImage(2, 2, 2))},
+		{"values past the end", valid[:len(valid)-8]},
+		{"no width", withTag(tagImageWidth, tiffTag{fieldType: 3, values: []float64{0}})},
+		{"NaN pixel scale", withTag(tagModelPixelScale, tiffTag{fieldType: 12, values: []float64{math.NaN(), 0.5, 0}})},
+		{"infinite tiepoint", withTag(tagModelTiepoint, tiffTag{fieldType: 12, values: []float64{0, 0, 0, math.Inf(1), 50, 0}})},
+		{"zero denominator", withTag(tagModelPixelScale, tiffTag{fieldType: 5, raw: rational(1, 0)})},
+		{"undefined rational", withTag(tagModelPixelScale, tiffTag{fieldType: 5, raw: rational(0, 0)})},
+		{"overflowing georeference", withTag(tagModelPixelScale, tiffTag{fieldType: 12, values: []float64{math.MaxFloat64, 0.5, 0}})},
+	} {
+		metadata, err := Read(bytes.NewReader(test.data), int64(len(test.data)))
+		var formatErr *FormatError
+		if !errors.As(err, &formatErr) {
+			t.Errorf("%s: got %+v and %v, want a FormatError", test.name, metadata, err)
+		}
+	}
+
+	// A BigTIFF IFD claiming more entries than any TIFF can have
+	data := tiffBuilder{order: binary.LittleEndian, bigTIFF: true}.build(grayImage(4, 4, 4))
+	firstIFD := binary.LittleEndian.Uint64(data[8:16])
+	binary.LittleEndian.PutUint64(data[firstIFD:], 1<<20)
+	if _, err := Read(bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Error("read an IFD of a million entries")
+	}
+}
+
+// Whatever the file, reading it never panics and its metadata is always valid JSON
+func FuzzRead(f *testing.F) {
+	little := tiffBuilder{order: binary.LittleEndian}
+	f.Add(little.build(georeferencedImage(grayImage(4, 4, 4))))
+	f.Add(tiffBuilder{order: binary.BigEndian, bigTIFF: true}.build(georeferencedImage(rgbImage(4, 2, 1))))
+	f.Add(little.build(compressed(tiledImage(rgbImage(4, 2, 2), 2, 2), compressionLZW, 1)))
+	f.Add(little.build(compressed(rgbImage(4, 2, 1), compressionDeflate, 2), compressed(grayImage(2, 1, 1), compressionPackBits, 1)))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		metadata, err := Read(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return
+		}
+		if _, err := json.Marshal(metadata); err != nil {
+			t.Fatalf("metadata %+v is not valid JSON: %v", metadata, err)
+		}
+
+		img, err := Open(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return
+		}
+		for _, level := range img.Levels {
+			// Huge blocks are valid but too slow to decode on every input
+			if level.BlockWidth*level.BlockHeight > 1<<16 {
+				continue
+			}
+			for i := 0; i < min(level.Blocks, 4); i++ {
+				level.Block(i)
+			}
+		}
+	})
+}
+
+// tiffTag is a tag of a test image, its values encoded as its type or already encoded in raw
+type tiffTag struct {
+	fieldType uint16
+	values    []float64
+	raw       []byte
+}
+
+// testImage is an image of a test file, whose blocks are its strips or, once tiled, its tiles
+type testImage struct {
+	tags   map[uint16]tiffTag
+	blocks [][]byte
+	tiled  bool
+}
+
+// tiffBuilder writes test files: the header, the blocks of every image then every IFD with the values
+// which do not fit in it. With loop, the last IFD points back to the first
+type tiffBuilder struct {
+	order interface {
+		binary.ByteOrder
+		binary.AppendByteOrder
+	}
+	bigTIFF bool
+	loop    bool
+}
+
+func (b tiffBuilder) String() string {
+	name := "TIFF"
+	if b.bigTIFF {
+		name = "BigTIFF"
+	}
+	if b.order == binary.BigEndian {
+		return "big endian " + name
+	}
+	return "little endian " + name
+}
+
+func (b tiffBuilder) build(images ...testImage) []byte {
+	var file []byte
+	if b.order == binary.BigEndian {
+		file = append(file, "MM"...)
+	} else {
+		file = append(file, "II"...)
+	}
+	if b.bigTIFF {
+		file = b.order.AppendUint16(file, 43)
+		file = b.order.AppendUint16(file, 8)
+		file = b.order.AppendUint16(file, 0)
+		file = b.order.AppendUint64(file, 0)
+	} else {
+		file = b.order.AppendUint16(file, 42)
+		file = b.order.AppendUint32(file, 0)
+	}
+
+	// Blocks first, so their offsets are known when writing the IFDs
+	for i, img := range images {
+		var offsets, counts []float64
+		for _, block := range img.blocks {
+			offsets = append(offsets, float64(len(file)))
+			counts = append(counts, float64(len(block)))
+			file = append(file, block...)
+		}
+		offsetsTag, countsTag := uint16(tagStripOffsets), uint16(tagStripByteCounts)
+		if img.tiled {
+			offsetsTag, countsTag = tagTileOffsets, tagTileByteCounts
+		}
+		images[i].tags[offsetsTag] = tiffTag{fieldType: 4, values: offsets}
+		images[i].tags[countsTag] = tiffTag{fieldType: 4, values: counts}
+	}
+
+	countSize, entrySize, offsetSize := 2, 12, 4
+	if b.bigTIFF {
+		countSize, entrySize, offsetSize = 8, 20, 8
+	}
+	putOffset := func(at []byte, offset int) {
+		if b.bigTIFF {
+			b.order.PutUint64(at, uint64(offset))
+		} else {
+			b.order.PutUint32(at, uint32(offset))
+		}
+	}
+	if b.bigTIFF {
+		putOffset(file[8:16], len(file))
+	} else {
+		putOffset(file[4:8], len(file))
+	}
+
+	firstIFD := len(file)
+	for i, img := range images {
+		tags := make([]uint16, 0, len(img.tags))
+		for tag := range img.tags {
+			tags = append(tags, tag)
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+		ifdOffset := len(file)
+		ifdSize := countSize + len(tags)*entrySize + offsetSize
+		ifd := make([]byte, ifdSize)
+		if b.bigTIFF {
+			b.order.PutUint64(ifd, uint64(len(tags)))
+		} else {
+			b.order.PutUint16(ifd, uint16(len(tags)))
+		}
+
+		var extra []byte
+		for k, tag := range tags {
+			value := b.encode(img.tags[tag])
+			entry := ifd[countSize+k*entrySize:]
+			b.order.PutUint16(entry[0:2], tag)
+			b.order.PutUint16(entry[2:4], img.tags[tag].fieldType)
+			count := len(value) / int(typeSizes[img.tags[tag].fieldType])
+			inline := entry[8:12]
+			if b.bigTIFF {
+				b.order.PutUint64(entry[4:12], uint64(count))
+				inline = entry[12:20]
+			} else {
+				b.order.PutUint32(entry[4:8], uint32(count))
+			}
+			if len(value) <= len(inline) {
+				copy(inline, value)
+			} else {
+				putOffset(inline, ifdOffset+ifdSize+len(extra))
+				extra = append(extra, value...)
+				// Offsets are word aligned
+				if len(extra)%2 == 1 {
+					extra = append(extra, 0)
+				}
+			}
+		}
+
+		next := ifdOffset + ifdSize + len(extra)
+		if i == len(images)-1 {
+			next = 0
+			if b.loop {
+				next = firstIFD
+			}
+		}
+		putOffset(ifd[ifdSize-offsetSize:], next)
+		file = append(file, ifd...)
+		file = append(file, extra...)
+	}
+	return file
+}
+
+// encode returns the values of a tag as its type
+func (b tiffBuilder) encode(tag tiffTag) []byte {
+	if tag.raw != nil {
+		return tag.raw
+	}
+	var encoded []byte
+	for _, value := range tag.values {
+		switch tag.fieldType {
+		case 1, 2, 7:
+			encoded = append(encoded, byte(value))
+		case 3:
+			encoded = b.order.AppendUint16(encoded, uint16(value))
+		case 4:
+			encoded = b.order.AppendUint32(encoded, uint32(value))
+		case 5:
+			encoded = b.order.AppendUint32(encoded, uint32(value*1000))
+			encoded = b.order.AppendUint32(encoded, 1000)
+		case 12:
+			encoded = b.order.AppendUint64(encoded, math.Float64bits(value))
+		case 16:
+			encoded = b.order.AppendUint64(encoded, uint64(value))
+		}
+	}
+	return encoded
+}
+
+// grayImage returns an 8 bit gray image in strips of rowsPerStrip rows, its pixels numbered from 1
+func grayImage(width, height, rowsPerStrip int) testImage {
+	return stripImage(width, height, rowsPerStrip, 1, 1)
+}
+
+// rgbImage returns an 8 bit RGB image in strips of rowsPerStrip rows, its samples numbered from 1
+func rgbImage(width, height, rowsPerStrip int) testImage {
+	return stripImage(width, height, rowsPerStrip, 3, 2)
+}
+
+func stripImage(width, height, rowsPerStrip, samples, photometric int) testImage {
+	img := testImage{tags: map[uint16]tiffTag{
+		tagImageWidth:      {fieldType: 3, values: []float64{float64(width)}},
+		tagImageLength:     {fieldType: 3, values: []float64{float64(height)}},
+		tagBitsPerSample:   {fieldType: 3, values: repeat(8, samples)},
+		tagSamplesPerPixel: {fieldType: 3, values: []float64{float64(samples)}},
+		tagPhotometric:     {fieldType: 3, values: []float64{float64(photometric)}},
+		tagRowsPerStrip:    {fieldType: 3, values: []float64{float64(rowsPerStrip)}},
+	}}
+	pixels := samplesOf(width, height, samples)
+	stride := width * samples
+	for row := 0; row < height; row += rowsPerStrip {
+		img.blocks = append(img.blocks, pixels[row*stride:min(row+rowsPerStrip, height)*stride])
+	}
+	return img
+}
+
+// tiledImage cuts a strip image of a single strip in tiles, padded past the edges
+func tiledImage(img testImage, tileWidth, tileHeight int) testImage {
+	width, height := int(img.tags[tagImageWidth].values[0]), int(img.tags[tagImageLength].values[0])
+	samples := int(img.tags[tagSamplesPerPixel].values[0])
+	pixels := bytes.Join(img.blocks, nil)
+
+	delete(img.tags, tagRowsPerStrip)
+	img.tags[tagTileWidth] = tiffTag{fieldType: 3, values: []float64{float64(tileWidth)}}
+	img.tags[tagTileLength] = tiffTag{fieldType: 3, values: []float64{float64(tileHeight)}}
+	img.tiled, img.blocks = true, nil
+	for top := 0; top < height; top += tileHeight {
+		for left := 0; left < width; left += tileWidth {
+			tile := make([]byte, tileWidth*tileHeight*samples)
+			for y := 0; y < tileHeight && top+y < height; y++ {
+				for x := 0; x < tileWidth && left+x < width; x++ {
+					copy(tile[(y*tileWidth+x)*samples:], pixels[((top+y)*width+left+x)*samples:][:samples])
+				}
+			}
+			img.blocks = append(img.blocks, tile)
+		}
+	}
+	return img
+}
+
+// georeferencedImage places an image at 10°E 50°N with pixels of half a degree, in WGS 84
+func georeferencedImage(img testImage) testImage {
+	img.tags[tagModelTiepoint] = tiffTag{fieldType: 12, values: []float64{0, 0, 0, 10, 50, 0}}
+	img.tags[tagModelPixelScale] = tiffTag{fieldType: 12, values: []float64{0.5, 0.5, 0}}
+	img.tags[tagGeoKeyDirectory] = tiffTag{fieldType: 3, values: []float64{
+		1, 1, 0, 2,
+		keyModelType, 0, 1, 2,
+		keyGeographicType, 0, 1, 4326,
+	}}
+	return img
+}
+
+// samplesOf numbers the samples of an image from 1, wrapping after 255
+func samplesOf(width, height, samples int) []byte {
+	pixels := make([]byte, width*height*samples)
+	for i := range pixels {
+		pixels[i] = byte(i%255 + 1)
+	}
+	return pixels
+}
+
+func repeat(value float64, count int) []float64 {
+	values := make([]float64, count)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
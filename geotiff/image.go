@@ -0,0 +1,481 @@
+package geotiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// UnsupportedError is a valid TIFF whose pixels this package can not decode
+type UnsupportedError struct {
+	Reason string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("unsupported TIFF: %s", e.Reason)
+}
+
+// Blocks with more pixels than this are refused, a single strip can hold a whole image otherwise
+const maxBlockPixels = 16 << 20
+
+// Pixels with more samples than this are refused, they are decoded in a buffer of the whole block
+const maxSamples = 8
+
+// Widths and heights are 32 bit in a TIFF, larger values would overflow once multiplied
+const maxDimension = math.MaxUint32
+
+// TIFF compressions which can be decoded
+const (
+	compressionNone     = 1
+	compressionLZW      = 5
+	compressionJPEG     = 7
+	compressionDeflate  = 8
+	compressionPackBits = 32773
+	compressionAdobe    = 32946
+)
+
+// Image is a GeoTIFF whose pixels can be read, 8 bit gray or RGB with an optional alpha
+type Image struct {
+	Metadata *Metadata
+	Levels   []*Level // the main image then its overviews, from the largest
+}
+
+// Level is the main image or an overview, stored in blocks which are its tiles or strips
+type Level struct {
+	Width, Height           int
+	BlockWidth, BlockHeight int
+	BlocksAcross            int
+	Blocks                  int
+
+	t           *tiffReader
+	offsets     []int64
+	counts      []int64
+	compression int
+	predictor   int
+	photometric int
+	samples     int
+	alpha       int  // sample of the alpha, -1 without
+	premultiply bool // the alpha is associated
+	jpegTables  []byte
+	noData      int // value of transparent pixels, -1 without
+}
+
+// Open reads the headers of a GeoTIFF and prepares its main image and overviews for decoding.
+// Overviews which can not be decoded are left out, a main image which can not is an UnsupportedError
+func Open(r io.ReaderAt, size int64) (*Image, error) {
+	t, err := newTIFFReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := describe(t)
+	if err != nil {
+		return nil, err
+	}
+
+	noData := -1
+	if value, err := strconv.ParseFloat(metadata.NoData, 64); err == nil && value >= 0 && value <= 255 && value == float64(int(value)) {
+		noData = int(value)
+	}
+
+	img := &Image{Metadata: metadata}
+	for i, directory := range t.ifds {
+		if i > 0 {
+			subfileType, err := t.number(directory, tagNewSubfileType, 0)
+			if err != nil {
+				return nil, err
+			}
+			if int(subfileType)&subfileMask != 0 || int(subfileType)&subfileReducedResolution == 0 {
+				continue
+			}
+		}
+
+		level, err := openLevel(t, directory, noData)
+		var unsupportedErr *UnsupportedError
+		if errors.As(err, &unsupportedErr) && i > 0 {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		img.Levels = append(img.Levels, level)
+	}
+	sort.SliceStable(img.Levels[1:], func(i, j int) bool { return img.Levels[1+i].Width > img.Levels[1+j].Width })
+	return img, nil
+}
+
+func openLevel(t *tiffReader, directory *ifd, noData int) (*Level, error) {
+	values := map[uint16]float64{
+		tagImageWidth: 0, tagImageLength: 0, tagSamplesPerPixel: 1, tagBitsPerSample: 1, tagSampleFormat: 1,
+		tagCompression: 1, tagPhotometric: -1, tagPlanarConfiguration: 1, tagPredictor: 1,
+	}
+	for tag, defaultValue := range values {
+		value, err := t.number(directory, tag, defaultValue)
+		if err != nil {
+			return nil, err
+		}
+		values[tag] = value
+	}
+	if values[tagImageWidth] > maxDimension || values[tagImageLength] > maxDimension {
+		return nil, &FormatError{Reason: fmt.Sprintf("image of %gx%g pixels", values[tagImageWidth], values[tagImageLength])}
+	}
+	if values[tagSamplesPerPixel] > maxSamples {
+		return nil, &UnsupportedError{Reason: fmt.Sprintf("%g samples per pixel", values[tagSamplesPerPixel])}
+	}
+
+	level := &Level{
+		t:           t,
+		Width:       int(values[tagImageWidth]),
+		Height:      int(values[tagImageLength]),
+		samples:     int(values[tagSamplesPerPixel]),
+		compression: int(values[tagCompression]),
+		photometric: int(values[tagPhotometric]),
+		predictor:   int(values[tagPredictor]),
+		alpha:       -1,
+		noData:      noData,
+	}
+	if level.Width <= 0 || level.Height <= 0 {
+		return nil, &FormatError{Reason: "image has no width or height"}
+	}
+
+	bits, err := t.numbers(directory, tagBitsPerSample, maxValues)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bits {
+		if b != 8 {
+			return nil, &UnsupportedError{Reason: fmt.Sprintf("%d bits per sample", int(b))}
+		}
+	}
+	if values[tagSampleFormat] != 1 {
+		return nil, &UnsupportedError{Reason: "samples are not unsigned integers"}
+	}
+	if values[tagPlanarConfiguration] != 1 && level.samples > 1 {
+		return nil, &UnsupportedError{Reason: "bands are stored in separate planes"}
+	}
+	switch level.compression {
+	case compressionNone, compressionLZW, compressionJPEG, compressionDeflate, compressionPackBits, compressionAdobe:
+	default:
+		return nil, &UnsupportedError{Reason: fmt.Sprintf("%s compression", compressionName(level.compression))}
+	}
+	if level.predictor != 1 && level.predictor != 2 {
+		return nil, &UnsupportedError{Reason: fmt.Sprintf("predictor %d", level.predictor)}
+	}
+
+	// Color samples come first, any extra sample may be the alpha
+	colors := 0
+	switch {
+	case level.photometric == 0 || level.photometric == 1:
+		colors = 1
+	case level.photometric == 2:
+		colors = 3
+	case level.photometric == 6 && level.compression == compressionJPEG:
+		colors = 3
+	default:
+		return nil, &UnsupportedError{Reason: fmt.Sprintf("%s photometric", photometricName(level.photometric))}
+	}
+	if level.samples < colors {
+		return nil, &FormatError{Reason: fmt.Sprintf("%d samples for %s photometric", level.samples, photometricName(level.photometric))}
+	}
+	extraSamples, err := t.numbers(directory, tagExtraSamples, maxValues)
+	if err != nil {
+		return nil, err
+	}
+	if len(extraSamples) > 0 && (extraSamples[0] == 1 || extraSamples[0] == 2) && level.samples > colors {
+		level.alpha = colors
+		level.premultiply = extraSamples[0] == 1
+	}
+
+	if _, tiled := directory.entries[tagTileWidth]; tiled {
+		tileWidth, err := t.number(directory, tagTileWidth, 0)
+		if err != nil {
+			return nil, err
+		}
+		tileHeight, err := t.number(directory, tagTileLength, 0)
+		if err != nil {
+			return nil, err
+		}
+		if tileWidth > maxDimension || tileHeight > maxDimension {
+			return nil, &FormatError{Reason: fmt.Sprintf("tiles of %gx%g pixels", tileWidth, tileHeight)}
+		}
+		level.BlockWidth, level.BlockHeight = int(tileWidth), int(tileHeight)
+		if level.offsets, err = t.integers(directory, tagTileOffsets); err != nil {
+			return nil, err
+		}
+		if level.counts, err = t.integers(directory, tagTileByteCounts); err != nil {
+			return nil, err
+		}
+	} else {
+		rowsPerStrip, err := t.number(directory, tagRowsPerStrip, float64(level.Height))
+		if err != nil {
+			return nil, err
+		}
+		level.BlockWidth, level.BlockHeight = level.Width, int(min(rowsPerStrip, float64(level.Height)))
+		if level.offsets, err = t.integers(directory, tagStripOffsets); err != nil {
+			return nil, err
+		}
+		if level.counts, err = t.integers(directory, tagStripByteCounts); err != nil {
+			return nil, err
+		}
+	}
+	if level.BlockWidth <= 0 || level.BlockHeight <= 0 {
+		return nil, &FormatError{Reason: "blocks have no width or height"}
+	}
+	if level.BlockWidth > maxBlockPixels || level.BlockHeight > maxBlockPixels || level.BlockWidth*level.BlockHeight > maxBlockPixels {
+		return nil, &UnsupportedError{Reason: fmt.Sprintf("blocks of %dx%d pixels", level.BlockWidth, level.BlockHeight)}
+	}
+
+	level.BlocksAcross = (level.Width + level.BlockWidth - 1) / level.BlockWidth
+	blocksDown := (level.Height + level.BlockHeight - 1) / level.BlockHeight
+	if blocksDown > maxBlocks/level.BlocksAcross {
+		return nil, &FormatError{Reason: fmt.Sprintf("%dx%d blocks", level.BlocksAcross, blocksDown)}
+	}
+	level.Blocks = level.BlocksAcross * blocksDown
+	if len(level.offsets) < level.Blocks || len(level.counts) < level.Blocks {
+		return nil, &FormatError{Reason: fmt.Sprintf("%d blocks but %d offsets", level.Blocks, len(level.offsets))}
+	}
+
+	if level.compression == compressionJPEG {
+		if level.jpegTables, err = t.bytes(directory, tagJPEGTables); err != nil {
+			return nil, err
+		}
+	}
+	return level, nil
+}
+
+// Block decodes a block of the level, numbered left to right then top to bottom. Pixels past
+// the edges of the level and pixels equal to the nodata value are transparent
+func (l *Level) Block(index int) (*image.NRGBA, error) {
+	if index < 0 || index >= l.Blocks {
+		return nil, fmt.Errorf("block %d of %d", index, l.Blocks)
+	}
+	block := image.NewNRGBA(image.Rect(0, 0, l.BlockWidth, l.BlockHeight))
+	if l.counts[index] == 0 {
+		return block, nil
+	}
+	data, err := l.t.read(l.offsets[index], l.counts[index])
+	if err != nil {
+		return nil, err
+	}
+
+	// Pixels of the block inside of the level
+	width := min(l.BlockWidth, l.Width-(index%l.BlocksAcross)*l.BlockWidth)
+	height := min(l.BlockHeight, l.Height-(index/l.BlocksAcross)*l.BlockHeight)
+
+	if l.compression == compressionJPEG {
+		return block, l.decodeJPEG(data, block, width, height)
+	}
+
+	size := l.BlockWidth * l.BlockHeight * l.samples
+	switch l.compression {
+	case compressionLZW:
+		data, err = decodeLZW(data, size)
+	case compressionDeflate, compressionAdobe:
+		data, err = decodeDeflate(data, size)
+	case compressionPackBits:
+		data, err = decodePackBits(data, size)
+	}
+	if err != nil {
+		return nil, &FormatError{Reason: fmt.Sprintf("block %d: %s", index, err)}
+	}
+
+	// Strips are as wide as the level, tiles as wide as the block even at the edges
+	stride := l.BlockWidth * l.samples
+	if l.predictor == 2 {
+		for row := 0; row+stride <= len(data); row += stride {
+			for i := row + l.samples; i < row+stride; i++ {
+				data[i] += data[i-l.samples]
+			}
+		}
+	}
+
+	for y := 0; y < height && (y+1)*stride <= len(data); y++ {
+		for x := 0; x < width; x++ {
+			pixel := data[y*stride+x*l.samples : y*stride+(x+1)*l.samples]
+			l.setPixel(block, x, y, pixel)
+		}
+	}
+	return block, nil
+}
+
+func (l *Level) setPixel(block *image.NRGBA, x, y int, pixel []byte) {
+	var r, g, b, a byte = pixel[0], pixel[0], pixel[0], 255
+	if l.photometric == 2 {
+		g, b = pixel[1], pixel[2]
+	}
+	if l.noData >= 0 && r == byte(l.noData) && g == byte(l.noData) && b == byte(l.noData) {
+		return
+	}
+	if l.photometric == 0 {
+		r, g, b = 255-r, 255-g, 255-b
+	}
+	if l.alpha >= 0 {
+		a = pixel[l.alpha]
+		if a == 0 {
+			return
+		}
+		if l.premultiply {
+			r, g, b = unpremultiply(r, a), unpremultiply(g, a), unpremultiply(b, a)
+		}
+	}
+	i := block.PixOffset(x, y)
+	block.Pix[i], block.Pix[i+1], block.Pix[i+2], block.Pix[i+3] = r, g, b, a
+}
+
+func unpremultiply(value, alpha byte) byte {
+	return byte(min(255, int(value)*255/int(alpha)))
+}
+
+// decodeJPEG decodes a JPEG block, whose tables may be shared by every block in the JPEGTables tag
+func (l *Level) decodeJPEG(data []byte, block *image.NRGBA, width, height int) error {
+	if len(l.jpegTables) >= 4 && len(data) >= 2 {
+		// The tables end with EOI and the block starts with SOI, both are dropped to join them
+		joined := make([]byte, 0, len(l.jpegTables)+len(data))
+		joined = append(joined, l.jpegTables[:len(l.jpegTables)-2]...)
+		data = append(joined, data[2:]...)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return &FormatError{Reason: fmt.Sprintf("JPEG block: %s", err)}
+	}
+	draw.Draw(block, image.Rect(0, 0, width, height), decoded, decoded.Bounds().Min, draw.Src)
+
+	if l.noData >= 0 {
+		noData := byte(l.noData)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				i := block.PixOffset(x, y)
+				if block.Pix[i] == noData && block.Pix[i+1] == noData && block.Pix[i+2] == noData {
+					block.Pix[i+3] = 0
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func decodeDeflate(data []byte, size int) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	decoded := make([]byte, size)
+	n, err := io.ReadFull(reader, decoded)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return decoded[:n], nil
+}
+
+func decodePackBits(data []byte, size int) ([]byte, error) {
+	decoded := make([]byte, 0, size)
+	for i := 0; i < len(data) && len(decoded) < size; {
+		n := int(int8(data[i]))
+		i++
+		switch {
+		case n >= 0:
+			if i+n+1 > len(data) {
+				return nil, fmt.Errorf("packbits literal past the end of the data")
+			}
+			decoded = append(decoded, data[i:i+n+1]...)
+			i += n + 1
+		case n != -128:
+			if i >= len(data) {
+				return nil, fmt.Errorf("packbits run past the end of the data")
+			}
+			for j := 0; j < 1-n; j++ {
+				decoded = append(decoded, data[i])
+			}
+			i++
+		}
+	}
+	return decoded[:min(len(decoded), size)], nil
+}
+
+// LZW codes of TIFF
+const (
+	lzwClear = 256
+	lzwEnd   = 257
+	lzwFirst = 258
+)
+
+// decodeLZW decodes TIFF LZW: codes are read most significant bit first and grow a bit one code
+// early, unlike GIF's, which is why compress/lzw can not read them
+func decodeLZW(data []byte, size int) ([]byte, error) {
+	// Every code is a previous code and one more byte, which is always where the two were decoded
+	// next to each other, so the table only holds where its strings are in the output
+	type span struct{ start, length int }
+	var table [4096]span
+
+	decoded := make([]byte, 0, size)
+	width, next := 9, lzwFirst
+	previous := span{start: -1}
+	var bits uint32
+	var count int
+	for i := 0; ; {
+		for count < width && i < len(data) {
+			bits |= uint32(data[i]) << (24 - count)
+			count += 8
+			i++
+		}
+		if count < width {
+			break
+		}
+		code := int(bits >> (32 - width))
+		bits <<= width
+		count -= width
+
+		switch {
+		case code == lzwClear:
+			width, next, previous = 9, lzwFirst, span{start: -1}
+			continue
+		case code == lzwEnd:
+			return decoded, nil
+		case previous.start < 0:
+			if code > 255 {
+				return nil, fmt.Errorf("LZW code %d after a clear code", code)
+			}
+			previous = span{start: len(decoded), length: 1}
+			decoded = append(decoded, byte(code))
+			continue
+		}
+
+		current := span{start: len(decoded)}
+		switch {
+		case code < 256:
+			decoded = append(decoded, byte(code))
+			current.length = 1
+		case code < next:
+			s := table[code]
+			decoded = append(decoded, decoded[s.start:s.start+s.length]...)
+			current.length = s.length
+		case code == next:
+			decoded = append(decoded, decoded[previous.start:previous.start+previous.length]...)
+			decoded = append(decoded, decoded[previous.start])
+			current.length = previous.length + 1
+		default:
+			return nil, fmt.Errorf("LZW code %d is not in the table", code)
+		}
+		if len(decoded) > size {
+			return decoded[:size], nil
+		}
+
+		if next < len(table) {
+			table[next] = span{start: previous.start, length: previous.length + 1}
+			next++
+		}
+		if next+1 >= 1<<width && width < 12 {
+			width++
+		}
+		previous = current
+	}
+	return decoded, nil
+}
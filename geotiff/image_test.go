@@ -0,0 +1,323 @@
+package geotiff
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestBlock(t *testing.T) {
+	little := tiffBuilder{order: binary.LittleEndian}
+	for _, test := range []struct {
+		name    string
+		data    []byte
+		samples int
+	}{
+		{"gray", little.build(grayImage(5, 3, 2)), 1},
+		{"rgb", little.build(rgbImage(5, 3, 2)), 3},
+		{"big endian", tiffBuilder{order: binary.BigEndian}.build(rgbImage(5, 3, 2)), 3},
+		{"BigTIFF", tiffBuilder{order: binary.LittleEndian, bigTIFF: true}.build(rgbImage(5, 3, 2)), 3},
+		{"lzw", little.build(compressed(rgbImage(5, 3, 2), compressionLZW, 1)), 3},
+		{"deflate", little.build(compressed(rgbImage(5, 3, 2), compressionDeflate, 1)), 3},
+		{"adobe deflate", little.build(compressed(grayImage(5, 3, 2), compressionAdobe, 1)), 1},
+		{"packbits", little.build(compressed(rgbImage(5, 3, 2), compressionPackBits, 1)), 3},
+		{"predictor", little.build(compressed(rgbImage(5, 3, 2), compressionLZW, 2)), 3},
+		{"tiles", little.build(tiledImage(rgbImage(5, 3, 3), 2, 2)), 3},
+		{"compressed tiles", little.build(compressed(tiledImage(rgbImage(5, 3, 3), 4, 4), compressionDeflate, 2)), 3},
+	} {
+		img, err := Open(bytes.NewReader(test.data), int64(len(test.data)))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got := decodeLevel(t, img.Levels[0])
+		want := samplesOf(5, 3, test.samples)
+		for y := 0; y < 3; y++ {
+			for x := 0; x < 5; x++ {
+				pixel := want[(y*5+x)*test.samples:][:test.samples]
+				wantColor := color.NRGBA{pixel[0], pixel[0], pixel[0], 255}
+				if test.samples == 3 {
+					wantColor = color.NRGBA{pixel[0], pixel[1], pixel[2], 255}
+				}
+				if got.NRGBAAt(x, y) != wantColor {
+					t.Errorf("%s: got %v at %d,%d, want %v", test.name, got.NRGBAAt(x, y), x, y, wantColor)
+				}
+			}
+		}
+
+		// Tiles past the edges of the image are transparent there
+		if bounds := got.Bounds(); bounds.Dx() > 5 {
+			if pixel := got.NRGBAAt(5, 0); pixel.A != 0 {
+				t.Errorf("%s: got %v past the edge", test.name, pixel)
+			}
+		}
+	}
+}
+
+func TestBlockTransparency(t *testing.T) {
+	little := tiffBuilder{order: binary.LittleEndian}
+
+	// Pixels of the nodata value, the first sample is 1
+	gray := grayImage(2, 2, 2)
+	gray.tags[tagGDALNoData] = tiffTag{fieldType: 2, raw: []byte("1\x00")}
+	data := little.build(gray)
+	img, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := decodeLevel(t, img.Levels[0])
+	if block.NRGBAAt(0, 0).A != 0 || block.NRGBAAt(1, 0) != (color.NRGBA{2, 2, 2, 255}) {
+		t.Errorf("got %v and %v with a nodata value of 1", block.NRGBAAt(0, 0), block.NRGBAAt(1, 0))
+	}
+
+	// Unassociated and associated alpha, the second pixel is transparent
+	for _, test := range []struct {
+		extraSample float64
+		want        color.NRGBA
+	}{
+		{2, color.NRGBA{10, 20, 30, 128}},
+		{1, color.NRGBA{19, 39, 59, 128}},
+	} {
+		rgba := stripImage(2, 1, 1, 4, 2)
+		rgba.tags[tagExtraSamples] = tiffTag{fieldType: 3, values: []float64{test.extraSample}}
+		rgba.blocks = [][]byte{{10, 20, 30, 128, 40, 50, 60, 0}}
+		data := little.build(rgba)
+		img, err := Open(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := decodeLevel(t, img.Levels[0])
+		if block.NRGBAAt(0, 0) != test.want || block.NRGBAAt(1, 0).A != 0 {
+			t.Errorf("extra sample %v: got %v and %v, want %v then transparent", test.extraSample, block.NRGBAAt(0, 0), block.NRGBAAt(1, 0), test.want)
+		}
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	little := tiffBuilder{order: binary.LittleEndian}
+	withTags := func(tags map[uint16]tiffTag) []byte {
+		img := rgbImage(4, 4, 4)
+		for tag, value := range tags {
+			img.tags[tag] = value
+		}
+		return little.build(img)
+	}
+	short := func(value float64) tiffTag {
+		return tiffTag{fieldType: 3, values: []float64{value}}
+	}
+	long := func(value float64) tiffTag {
+		return tiffTag{fieldType: 4, values: []float64{value}}
+	}
+
+	for _, test := range []struct {
+		name        string
+		data        []byte
+		unsupported bool
+	}{
+		{"16 bits", withTags(map[uint16]tiffTag{tagBitsPerSample: {fieldType: 3, values: []float64{16, 16, 16}}}), true},
+		{"floats", withTags(map[uint16]tiffTag{tagSampleFormat: short(3)}), true},
+		{"planes", withTags(map[uint16]tiffTag{tagPlanarConfiguration: short(2)}), true},
+		{"JPEG 2000", withTags(map[uint16]tiffTag{tagCompression: short(34712)}), true},
+		{"floating point predictor", withTags(map[uint16]tiffTag{tagPredictor: short(3)}), true},
+		{"CMYK", withTags(map[uint16]tiffTag{tagPhotometric: short(5)}), true},
+		{"huge strips", withTags(map[uint16]tiffTag{tagImageWidth: short(8192), tagImageLength: short(4096), tagRowsPerStrip: short(4096)}), true},
+		{"too many samples", withTags(map[uint16]tiffTag{tagSamplesPerPixel: short(40000)}), true},
+		{"wider than 32 bits", withTags(map[uint16]tiffTag{tagImageWidth: {fieldType: 16, values: []float64{1 << 40}}}), false},
+		{"too many blocks", withTags(map[uint16]tiffTag{tagImageWidth: long(math.MaxUint32), tagImageLength: long(math.MaxUint32),
+			tagTileWidth: short(1), tagTileLength: short(1)}), false},
+		{"missing samples", withTags(map[uint16]tiffTag{tagSamplesPerPixel: short(1), tagBitsPerSample: short(8)}), false},
+		{"missing strips", withTags(map[uint16]tiffTag{tagRowsPerStrip: short(1)}), false},
+		{"no block height", withTags(map[uint16]tiffTag{tagRowsPerStrip: short(0)}), false},
+	} {
+		_, err := Open(bytes.NewReader(test.data), int64(len(test.data)))
+		var unsupportedErr *UnsupportedError
+		var formatErr *FormatError
+		if test.unsupported && !errors.As(err, &unsupportedErr) {
+			t.Errorf("%s: got %v, want an UnsupportedError", test.name, err)
+		} else if !test.unsupported && !errors.As(err, &formatErr) {
+			t.Errorf("%s: got %v, want a FormatError", test.name, err)
+		}
+	}
+}
+
+// Blocks past the end of the file or which do not decompress fail with a FormatError
+func TestBlockRejects(t *testing.T) {
+	little := tiffBuilder{order: binary.LittleEndian}
+
+	data := little.build(rgbImage(4, 4, 2))
+	img, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Levels[0].offsets[1] = int64(len(data)) - 4
+	var formatErr *FormatError
+	if _, err := img.Levels[0].Block(1); !errors.As(err, &formatErr) {
+		t.Errorf("got %v for a block past the end, want a FormatError", err)
+	}
+	if _, err := img.Levels[0].Block(2); err == nil {
+		t.Error("decoded a block past the last")
+	}
+
+	broken := rgbImage(4, 4, 4)
+	broken.tags[tagCompression] = tiffTag{fieldType: 3, values: []float64{compressionDeflate}}
+	data = little.build(broken)
+	img, err = Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.Levels[0].Block(0); !errors.As(err, &formatErr) {
+		t.Errorf("got %v for a block which is not deflated, want a FormatError", err)
+	}
+}
+
+func TestDecodeLZW(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		codes []int
+		want  string
+	}{
+		{"literals", []int{lzwClear, 'a', 'b', 'c', lzwEnd}, "abc"},
+		{"code of the table", []int{lzwClear, 'a', 'b', lzwFirst, lzwEnd}, "abab"},
+		{"code being added", []int{lzwClear, 'a', lzwFirst, 'b', lzwEnd}, "aaab"},
+		{"clear code", []int{lzwClear, 'a', 'b', lzwClear, 'c', lzwFirst, lzwEnd}, "abccc"},
+		{"no end code", []int{lzwClear, 'a', 'b'}, "ab"},
+	} {
+		got, err := decodeLZW(lzwCodes(test.codes), 100)
+		if err != nil || string(got) != test.want {
+			t.Errorf("%s: got %q and %v, want %q", test.name, got, err, test.want)
+		}
+	}
+
+	// Output stops at the size of the block
+	if got, err := decodeLZW(lzwCodes([]int{lzwClear, 'a', 'b', 'c', lzwEnd}), 2); err != nil || string(got) != "ab" {
+		t.Errorf("got %q and %v, want %q", got, err, "ab")
+	}
+
+	for _, codes := range [][]int{
+		{lzwClear, lzwFirst + 1, lzwEnd},
+		{lzwClear, 'a', lzwFirst + 1, lzwEnd},
+	} {
+		if got, err := decodeLZW(lzwCodes(codes), 100); err == nil {
+			t.Errorf("codes %v: got %q, want an error", codes, got)
+		}
+	}
+}
+
+func TestDecodePackBits(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"literal", []byte{2, 'a', 'b', 'c'}, "abc"},
+		{"run", []byte{0xFE, 'a'}, "aaa"},
+		{"no operation", []byte{0x80, 0, 'a'}, "a"},
+		{"both", []byte{1, 'a', 'b', 0xFF, 'c'}, "abcc"},
+		{"past the size", []byte{0xF0, 'a'}, "aaaaa"},
+	} {
+		got, err := decodePackBits(test.data, 5)
+		if err != nil || string(got) != test.want {
+			t.Errorf("%s: got %q and %v, want %q", test.name, got, err, test.want)
+		}
+	}
+
+	for _, data := range [][]byte{{3, 'a'}, {0xFE}} {
+		if got, err := decodePackBits(data, 5); err == nil {
+			t.Errorf("%v: got %q, want an error", data, got)
+		}
+	}
+}
+
+// decodeLevel decodes every block of a level in one image, as wide and high as its blocks
+func decodeLevel(t *testing.T, level *Level) *image.NRGBA {
+	t.Helper()
+	rows := (level.Blocks + level.BlocksAcross - 1) / level.BlocksAcross
+	decoded := image.NewNRGBA(image.Rect(0, 0, level.BlocksAcross*level.BlockWidth, rows*level.BlockHeight))
+	for i := 0; i < level.Blocks; i++ {
+		block, err := level.Block(i)
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		left, top := (i%level.BlocksAcross)*level.BlockWidth, (i/level.BlocksAcross)*level.BlockHeight
+		for y := 0; y < level.BlockHeight; y++ {
+			copy(decoded.Pix[decoded.PixOffset(left, top+y):], block.Pix[block.PixOffset(0, y):block.PixOffset(level.BlockWidth, y)])
+		}
+	}
+	return decoded
+}
+
+// compressed compresses every block of an image, after differencing its samples with predictor 2
+func compressed(img testImage, compression, predictor int) testImage {
+	samples := int(img.tags[tagSamplesPerPixel].values[0])
+	width := img.tags[tagImageWidth].values[0]
+	if img.tiled {
+		width = img.tags[tagTileWidth].values[0]
+	}
+	stride := int(width) * samples
+
+	img.tags[tagCompression] = tiffTag{fieldType: 3, values: []float64{float64(compression)}}
+	img.tags[tagPredictor] = tiffTag{fieldType: 3, values: []float64{float64(predictor)}}
+	for i, block := range img.blocks {
+		block = bytes.Clone(block)
+		if predictor == 2 {
+			for row := 0; row < len(block); row += stride {
+				for k := row + stride - 1; k >= row+samples; k-- {
+					block[k] -= block[k-samples]
+				}
+			}
+		}
+
+		switch compression {
+		case compressionLZW:
+			// Literal codes only, cleared before the codes grow past 9 bits
+			codes := []int{lzwClear}
+			for k, sample := range block {
+				if k > 0 && k%200 == 0 {
+					codes = append(codes, lzwClear)
+				}
+				codes = append(codes, int(sample))
+			}
+			block = lzwCodes(append(codes, lzwEnd))
+		case compressionDeflate, compressionAdobe:
+			var buffer bytes.Buffer
+			writer := zlib.NewWriter(&buffer)
+			writer.Write(block)
+			writer.Close()
+			block = buffer.Bytes()
+		case compressionPackBits:
+			var encoded []byte
+			for start := 0; start < len(block); start += 128 {
+				literal := block[start:min(start+128, len(block))]
+				encoded = append(encoded, byte(len(literal)-1))
+				encoded = append(encoded, literal...)
+			}
+			block = encoded
+		}
+		img.blocks[i] = block
+	}
+	return img
+}
+
+// lzwCodes packs codes of 9 bits, most significant bit first
+func lzwCodes(codes []int) []byte {
+	var packed []byte
+	var bits uint32
+	count := 0
+	for _, code := range codes {
+		bits = bits<<9 | uint32(code)
+		count += 9
+		for count >= 8 {
+			packed = append(packed, byte(bits>>(count-8)))
+			count -= 8
+		}
+	}
+	if count > 0 {
+		packed = append(packed, byte(bits<<(8-count)))
+	}
+	return packed
+}
@@ -0,0 +1,120 @@
+package geotiff
+
+import "math"
+
+// Projection converts between the coordinates of a CRS and WGS 84 longitudes and latitudes in degrees
+type Projection interface {
+	Forward(longitude, latitude float64) (x, y float64)
+	Inverse(x, y float64) (longitude, latitude float64)
+}
+
+// ProjectionOf returns the projection of the systems this package knows: geographic ones,
+// web mercator and the UTM zones of WGS 84 and NAD83. Nil for the others
+func ProjectionOf(crs *CRS) Projection {
+	switch {
+	case crs == nil:
+		return nil
+	case crs.Model == "geographic":
+		return geographic{}
+	case crs.EPSG == 3857 || crs.EPSG == 900913:
+		return webMercator{}
+	case crs.EPSG > 32600 && crs.EPSG <= 32660, crs.EPSG > 26900 && crs.EPSG <= 26923:
+		return utm{zone: crs.EPSG % 100, north: true}
+	case crs.EPSG > 32700 && crs.EPSG <= 32760:
+		return utm{zone: crs.EPSG % 100, north: false}
+	}
+	return nil
+}
+
+const (
+	earthRadius = 6378137.0
+	flattening  = 1 / 298.257223563
+)
+
+type geographic struct{}
+
+func (geographic) Forward(longitude, latitude float64) (float64, float64) { return longitude, latitude }
+func (geographic) Inverse(x, y float64) (float64, float64)                { return x, y }
+
+type webMercator struct{}
+
+func (webMercator) Forward(longitude, latitude float64) (float64, float64) {
+	x := longitude * math.Pi / 180 * earthRadius
+	y := math.Log(math.Tan(math.Pi/4+latitude*math.Pi/360)) * earthRadius
+	return x, y
+}
+
+func (webMercator) Inverse(x, y float64) (float64, float64) {
+	longitude := x / earthRadius * 180 / math.Pi
+	latitude := (2*math.Atan(math.Exp(y/earthRadius)) - math.Pi/2) * 180 / math.Pi
+	return longitude, latitude
+}
+
+// utm is the transverse mercator of a UTM zone on the WGS 84 ellipsoid, Snyder's formulas
+type utm struct {
+	zone  int
+	north bool
+}
+
+const utmScale = 0.9996
+
+func (p utm) centralMeridian() float64 {
+	return float64(p.zone*6-183) * math.Pi / 180
+}
+
+func (p utm) Forward(longitude, latitude float64) (float64, float64) {
+	e2 := flattening * (2 - flattening)
+	ePrime2 := e2 / (1 - e2)
+	phi := latitude * math.Pi / 180
+	lambda := longitude * math.Pi / 180
+
+	sinPhi, cosPhi, tanPhi := math.Sin(phi), math.Cos(phi), math.Tan(phi)
+	n := earthRadius / math.Sqrt(1-e2*sinPhi*sinPhi)
+	t := tanPhi * tanPhi
+	c := ePrime2 * cosPhi * cosPhi
+	a := (lambda - p.centralMeridian()) * cosPhi
+	m := earthRadius * ((1-e2/4-3*e2*e2/64-5*e2*e2*e2/256)*phi -
+		(3*e2/8+3*e2*e2/32+45*e2*e2*e2/1024)*math.Sin(2*phi) +
+		(15*e2*e2/256+45*e2*e2*e2/1024)*math.Sin(4*phi) -
+		(35*e2*e2*e2/3072)*math.Sin(6*phi))
+
+	x := utmScale*n*(a+(1-t+c)*math.Pow(a, 3)/6+(5-18*t+t*t+72*c-58*ePrime2)*math.Pow(a, 5)/120) + 500000
+	y := utmScale * (m + n*tanPhi*(a*a/2+(5-t+9*c+4*c*c)*math.Pow(a, 4)/24+(61-58*t+t*t+600*c-330*ePrime2)*math.Pow(a, 6)/720))
+	if !p.north {
+		y += 10000000
+	}
+	return x, y
+}
+
+func (p utm) Inverse(x, y float64) (float64, float64) {
+	e2 := flattening * (2 - flattening)
+	ePrime2 := e2 / (1 - e2)
+
+	x -= 500000
+	if !p.north {
+		y -= 10000000
+	}
+
+	m := y / utmScale
+	mu := m / (earthRadius * (1 - e2/4 - 3*e2*e2/64 - 5*e2*e2*e2/256))
+	e1 := (1 - math.Sqrt(1-e2)) / (1 + math.Sqrt(1-e2))
+	phi1 := mu + (3*e1/2-27*math.Pow(e1, 3)/32)*math.Sin(2*mu) +
+		(21*e1*e1/16-55*math.Pow(e1, 4)/32)*math.Sin(4*mu) +
+		(151*math.Pow(e1, 3)/96)*math.Sin(6*mu) +
+		(1097*math.Pow(e1, 4)/512)*math.Sin(8*mu)
+
+	sinPhi1, cosPhi1, tanPhi1 := math.Sin(phi1), math.Cos(phi1), math.Tan(phi1)
+	n1 := earthRadius / math.Sqrt(1-e2*sinPhi1*sinPhi1)
+	t1 := tanPhi1 * tanPhi1
+	c1 := ePrime2 * cosPhi1 * cosPhi1
+	r1 := earthRadius * (1 - e2) / math.Pow(1-e2*sinPhi1*sinPhi1, 1.5)
+	d := x / (n1 * utmScale)
+
+	latitude := phi1 - (n1*tanPhi1/r1)*(d*d/2-
+		(5+3*t1+10*c1-4*c1*c1-9*ePrime2)*math.Pow(d, 4)/24+
+		(61+90*t1+298*c1+45*t1*t1-252*ePrime2-3*c1*c1)*math.Pow(d, 6)/720)
+	longitude := (d - (1+2*t1+c1)*math.Pow(d, 3)/6 +
+		(5-2*c1+28*t1-3*c1*c1+8*ePrime2+24*t1*t1)*math.Pow(d, 5)/120) / cosPhi1
+
+	return (p.centralMeridian() + longitude) * 180 / math.Pi, latitude * 180 / math.Pi
+}
@@ -0,0 +1,346 @@
+package geotiff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// FormatError is a file which is not a readable TIFF
+type FormatError struct {
+	Reason string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("invalid TIFF: %s", e.Reason)
+}
+
+var ErrNotGeoreferenced = errors.New("image is not georeferenced")
+
+// Files with more images than this are refused, a loop of IFDs would never end otherwise
+const maxIFDs = 1024
+
+// Values of a tag read at most, tags with more like tile offsets only have their first values read
+const maxValues = 65536
+
+// Blocks of an image at most, so their offsets fit in memory
+const maxBlocks = 1 << 24
+
+// TIFF tags this package reads
+const (
+	tagNewSubfileType      = 254
+	tagImageWidth          = 256
+	tagImageLength         = 257
+	tagBitsPerSample       = 258
+	tagCompression         = 259
+	tagPhotometric         = 262
+	tagStripOffsets        = 273
+	tagSamplesPerPixel     = 277
+	tagRowsPerStrip        = 278
+	tagStripByteCounts     = 279
+	tagPlanarConfiguration = 284
+	tagPredictor           = 317
+	tagTileWidth           = 322
+	tagTileLength          = 323
+	tagTileOffsets         = 324
+	tagTileByteCounts      = 325
+	tagExtraSamples        = 338
+	tagSampleFormat        = 339
+	tagJPEGTables          = 347
+	tagModelPixelScale     = 33550
+	tagModelTiepoint       = 33922
+	tagModelTransformation = 34264
+	tagGeoKeyDirectory     = 34735
+	tagGeoASCIIParams      = 34737
+	tagGDALNoData          = 42113
+)
+
+// Bits of NewSubfileType
+const (
+	subfileReducedResolution = 1
+	subfileMask              = 4
+)
+
+// Sizes in bytes of the TIFF field types, by type number
+var typeSizes = map[uint16]int64{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4, 16: 8, 17: 8, 18: 8,
+}
+
+type entry struct {
+	fieldType   uint16
+	count       uint64
+	valueOffset int64 // where the values are, inside of the entry when they fit
+}
+
+// ifd is an image file directory, one image of the file
+type ifd struct {
+	offset  int64
+	entries map[uint16]entry
+}
+
+type tiffReader struct {
+	r         io.ReaderAt
+	size      int64
+	order     binary.ByteOrder
+	bigTIFF   bool
+	ifds      []*ifd
+	byteOrder string
+}
+
+func newTIFFReader(r io.ReaderAt, size int64) (*tiffReader, error) {
+	t := &tiffReader{r: r, size: size}
+	header, err := t.read(0, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	switch string(header[0:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+		t.byteOrder = "little_endian"
+	case "MM":
+		t.order = binary.BigEndian
+		t.byteOrder = "big_endian"
+	default:
+		return nil, &FormatError{Reason: "no byte order mark"}
+	}
+
+	var firstIFD int64
+	switch version := t.order.Uint16(header[2:4]); version {
+	case 42:
+		firstIFD = int64(t.order.Uint32(header[4:8]))
+	case 43:
+		t.bigTIFF = true
+		if t.order.Uint16(header[4:6]) != 8 {
+			return nil, &FormatError{Reason: "BigTIFF offsets are not 8 bytes"}
+		}
+		firstIFD = int64(t.order.Uint64(header[8:16]))
+	default:
+		return nil, &FormatError{Reason: fmt.Sprintf("unknown version %d", version)}
+	}
+
+	// Every image, following the chain of IFDs
+	seen := map[int64]bool{}
+	for offset := firstIFD; offset != 0; {
+		if seen[offset] || len(t.ifds) >= maxIFDs {
+			return nil, &FormatError{Reason: "IFDs loop or are too many"}
+		}
+		seen[offset] = true
+
+		directory, next, err := t.readIFD(offset)
+		if err != nil {
+			return nil, err
+		}
+		t.ifds = append(t.ifds, directory)
+		offset = next
+	}
+	if len(t.ifds) == 0 {
+		return nil, &FormatError{Reason: "no image"}
+	}
+	return t, nil
+}
+
+// read returns length bytes at offset, failing when the file is shorter
+func (t *tiffReader) read(offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 || offset+length > t.size {
+		return nil, &FormatError{Reason: fmt.Sprintf("%d bytes at %d are past the end of the file", length, offset)}
+	}
+	data := make([]byte, length)
+	if _, err := t.r.ReadAt(data, offset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (t *tiffReader) readIFD(offset int64) (*ifd, int64, error) {
+	countSize, entrySize, offsetSize := int64(2), int64(12), int64(4)
+	if t.bigTIFF {
+		countSize, entrySize, offsetSize = 8, 20, 8
+	}
+
+	countData, err := t.read(offset, countSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	var count int64
+	if t.bigTIFF {
+		count = int64(t.order.Uint64(countData))
+	} else {
+		count = int64(t.order.Uint16(countData))
+	}
+	if count > 65535 {
+		return nil, 0, &FormatError{Reason: fmt.Sprintf("IFD at %d has %d entries", offset, count)}
+	}
+
+	data, err := t.read(offset+countSize, count*entrySize+offsetSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	directory := &ifd{offset: offset, entries: make(map[uint16]entry, count)}
+	for i := int64(0); i < count; i++ {
+		raw := data[i*entrySize : (i+1)*entrySize]
+		e := entry{fieldType: t.order.Uint16(raw[2:4])}
+		valueStart := offset + countSize + i*entrySize
+		var value []byte
+		if t.bigTIFF {
+			e.count = t.order.Uint64(raw[4:12])
+			value, valueStart = raw[12:20], valueStart+12
+		} else {
+			e.count = uint64(t.order.Uint32(raw[4:8]))
+			value, valueStart = raw[8:12], valueStart+8
+		}
+
+		// Values are in the entry when they fit, else the entry has their offset
+		size, known := typeSizes[e.fieldType]
+		if !known {
+			continue
+		}
+		if size*int64(e.count) <= int64(len(value)) {
+			e.valueOffset = valueStart
+		} else if t.bigTIFF {
+			e.valueOffset = int64(t.order.Uint64(value))
+		} else {
+			e.valueOffset = int64(t.order.Uint32(value))
+		}
+		directory.entries[t.order.Uint16(raw[0:2])] = e
+	}
+
+	var next int64
+	nextData := data[count*entrySize:]
+	if t.bigTIFF {
+		next = int64(t.order.Uint64(nextData))
+	} else {
+		next = int64(t.order.Uint32(nextData))
+	}
+	return directory, next, nil
+}
+
+// numbers returns up to limit values of a numeric tag, nil when the tag is missing
+func (t *tiffReader) numbers(directory *ifd, tag uint16, limit uint64) ([]float64, error) {
+	e, exist := directory.entries[tag]
+	if !exist {
+		return nil, nil
+	}
+	count := min(e.count, limit, maxValues)
+	size := typeSizes[e.fieldType]
+	data, err := t.read(e.valueOffset, size*int64(count))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]float64, count)
+	for i := range values {
+		raw := data[int64(i)*size : int64(i+1)*size]
+		switch e.fieldType {
+		case 1, 7:
+			values[i] = float64(raw[0])
+		case 6:
+			values[i] = float64(int8(raw[0]))
+		case 3:
+			values[i] = float64(t.order.Uint16(raw))
+		case 8:
+			values[i] = float64(int16(t.order.Uint16(raw)))
+		case 4, 13:
+			values[i] = float64(t.order.Uint32(raw))
+		case 9:
+			values[i] = float64(int32(t.order.Uint32(raw)))
+		case 5:
+			values[i] = float64(t.order.Uint32(raw[0:4])) / float64(t.order.Uint32(raw[4:8]))
+		case 10:
+			values[i] = float64(int32(t.order.Uint32(raw[0:4]))) / float64(int32(t.order.Uint32(raw[4:8])))
+		case 11:
+			values[i] = float64(math.Float32frombits(t.order.Uint32(raw)))
+		case 12:
+			values[i] = math.Float64frombits(t.order.Uint64(raw))
+		case 16, 18:
+			values[i] = float64(t.order.Uint64(raw))
+		case 17:
+			values[i] = float64(int64(t.order.Uint64(raw)))
+		default:
+			return nil, &FormatError{Reason: fmt.Sprintf("tag %d is not a number", tag)}
+		}
+
+		// Zero denominators and NaN or infinite floats would end up in metadata JSON can not hold
+		if !isFinite(values[i]) {
+			return nil, &FormatError{Reason: fmt.Sprintf("tag %d has a value which is not finite", tag)}
+		}
+	}
+	return values, nil
+}
+
+func isFinite(values ...float64) bool {
+	for _, value := range values {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// number returns the first value of a numeric tag, defaultValue when the tag is missing
+func (t *tiffReader) number(directory *ifd, tag uint16, defaultValue float64) (float64, error) {
+	values, err := t.numbers(directory, tag, 1)
+	if err != nil || len(values) == 0 {
+		return defaultValue, err
+	}
+	return values[0], nil
+}
+
+// text returns an ASCII tag without its trailing NUL
+func (t *tiffReader) text(directory *ifd, tag uint16) (string, error) {
+	e, exist := directory.entries[tag]
+	if !exist || e.fieldType != 2 {
+		return "", nil
+	}
+	data, err := t.read(e.valueOffset, int64(min(e.count, maxValues)))
+	if err != nil {
+		return "", err
+	}
+	for len(data) > 0 && data[len(data)-1] == 0 {
+		data = data[:len(data)-1]
+	}
+	return string(data), nil
+}
+
+// integers returns every value of a tag of offsets or byte counts
+func (t *tiffReader) integers(directory *ifd, tag uint16) ([]int64, error) {
+	e, exist := directory.entries[tag]
+	if !exist {
+		return nil, nil
+	}
+	if e.count > maxBlocks {
+		return nil, &FormatError{Reason: fmt.Sprintf("tag %d has %d values", tag, e.count)}
+	}
+	size := typeSizes[e.fieldType]
+	data, err := t.read(e.valueOffset, size*int64(e.count))
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]int64, e.count)
+	for i := range values {
+		raw := data[int64(i)*size : int64(i+1)*size]
+		switch e.fieldType {
+		case 3:
+			values[i] = int64(t.order.Uint16(raw))
+		case 4, 13:
+			values[i] = int64(t.order.Uint32(raw))
+		case 16, 18:
+			values[i] = int64(t.order.Uint64(raw))
+		default:
+			return nil, &FormatError{Reason: fmt.Sprintf("tag %d is not an integer", tag)}
+		}
+	}
+	return values, nil
+}
+
+// bytes returns the raw values of a tag, nil when the tag is missing
+func (t *tiffReader) bytes(directory *ifd, tag uint16) ([]byte, error) {
+	e, exist := directory.entries[tag]
+	if !exist {
+		return nil, nil
+	}
+	return t.read(e.valueOffset, typeSizes[e.fieldType]*int64(min(e.count, maxValues)))
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"errors"
+	"filemanager/storage"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// Extracted files are stored once per project by their SHA-256 in this directory of the project,
+// layers only keep their manifest referencing them. Successive iterations share unchanged files
+const blobDirectory = ".blobs"
+
+// blobKey returns where a file of a layer with the given checksum is stored
+func blobKey(layerKey, sha256 string) string {
+	segments := strings.SplitN(storage.CleanKey(layerKey), "/", 3)
+	return storage.Join(segments[0], segments[1], blobDirectory, sha256[:2], sha256)
+}
+
+// fileKey returns where a file of a layer is stored, its blob or its path in the layer for files
+// extracted before blobs were kept
+func fileKey(layerKey string, file manifestFile) string {
+	if file.Blob {
+		return blobKey(layerKey, file.SHA256)
+	}
+	return storage.Join(layerKey, file.Path)
+}
+
+// storeBlob moves a file extracted to stagingKey to its blob, or drops it when the project already
+// has the same content. Blobs of a project are not collected while one of its iterations is changed
+func storeBlob(backend storage.Backend, layerKey, stagingKey, sha256 string) error {
+	key := blobKey(layerKey, sha256)
+
+	// Two uploads storing the same content write the same bytes, whichever is first is kept
+	_, err := backend.Stat(key)
+	if err == nil {
+		err = storage.ErrExist
+	} else if errors.Is(err, storage.ErrNotFound) {
+		err = backend.Rename(stagingKey, key)
+	}
+	if errors.Is(err, storage.ErrExist) {
+		err = backend.Delete(stagingKey)
+	}
+	return err
+}
+
+// deleteLayerFiles deletes an iteration or a layer directory with its versions. Its blobs are deleted
+// by the next collection unless another layer of the project references them
+func deleteLayerFiles(backend storage.Backend, key string) error {
+	return backend.Delete(storage.CleanKey(key))
+}
+
+// CollectUnusedBlobs prunes expired layer versions then deletes blobs no layer references anymore every interval
+func CollectUnusedBlobs(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		backend := storage.GetBackend()
+		if _, err := pruneExpiredLayerVersions(backend); err != nil {
+			log.Error(fmt.Sprintf("Failed to prune layer versions: %v", err))
+		}
+		if _, _, err := collectUnusedBlobs(backend); err != nil {
+			log.Error(fmt.Sprintf("Failed to collect unused blobs: %v", err))
+		}
+	}
+}
+
+// Only one collection runs at a time, whether from the interval or the maintenance endpoint
+var blobCollectionLock sync.Mutex
+
+// collectUnusedBlobs deletes every blob no manifest references, returning how many and how many bytes.
+// Manifests are the ones in the storage: of the layers, of their temporary directories and of their versions
+func collectUnusedBlobs(backend storage.Backend) (int, int64, error) {
+	blobCollectionLock.Lock()
+	defer blobCollectionLock.Unlock()
+
+	// Blobs and staged files are kept BLOB_COLLECT_GRACE_PERIOD hours (default 24)
+	gracePeriod := time.Duration(getEnvInt("BLOB_COLLECT_GRACE_PERIOD", 24)) * time.Hour
+	collected, freed := 0, int64(0)
+	companies, err := listDirectories(backend, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, company := range companies {
+		projects, err := listDirectories(backend, company.Key)
+		if err != nil {
+			return collected, freed, err
+		}
+		for _, project := range projects {
+			count, size, err := collectProjectBlobs(backend, project.Key, gracePeriod)
+			collected += count
+			freed += size
+			if err != nil {
+				return collected, freed, err
+			}
+		}
+	}
+
+	if collected > 0 {
+		log.Info(fmt.Sprintf("Collected %d unused blobs, %d bytes", collected, freed))
+	}
+	return collected, freed, nil
+}
+
+// collectProjectBlobs marks the blobs referenced by every manifest of a project, then deletes the others
+// past the grace period, and staged files left by extractions which stopped. A project with a change in
+// progress is skipped, its files are in flux, and no change begins until the project is collected
+func collectProjectBlobs(backend storage.Backend, projectKey string, gracePeriod time.Duration) (int, int64, error) {
+	lock := getProjectLock(projectKey)
+	lock.Lock()
+	defer lock.Unlock()
+
+	busy, err := busyProjects()
+	if err != nil {
+		return 0, 0, err
+	}
+	if busy[storage.CleanKey(projectKey)] {
+		return 0, 0, nil
+	}
+
+	// Mark
+	referenced := map[string]bool{}
+	var unused []storage.ObjectInfo
+	children, err := backend.List(projectKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, child := range children {
+		if !child.IsDir || path.Base(child.Key) == blobDirectory {
+			continue
+		}
+		err := storage.Walk(backend, child.Key, func(info storage.ObjectInfo) error {
+			metadataKey := path.Dir(info.Key)
+			if path.Base(metadataKey) == "staging" && path.Base(path.Dir(metadataKey)) == layerMetadataDirectory {
+				if time.Since(info.ModTime) >= gracePeriod {
+					unused = append(unused, info)
+				}
+				return nil
+			}
+			if path.Base(metadataKey) != layerMetadataDirectory || info.Key != manifestKey(path.Dir(metadataKey)) {
+				return nil
+			}
+
+			// Manifests which can not be read stop the collection rather than losing their blobs
+			layerKey := path.Dir(metadataKey)
+			manifest, err := readLayerManifest(backend, layerKey)
+			if err != nil {
+				return fmt.Errorf("%s: %w", info.Key, err)
+			}
+			for _, file := range manifest.Files {
+				if file.Blob {
+					referenced[blobKey(layerKey, file.SHA256)] = true
+				}
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return 0, 0, err
+		}
+	}
+
+	// Sweep
+	err = storage.Walk(backend, storage.Join(projectKey, blobDirectory), func(info storage.ObjectInfo) error {
+		if !referenced[info.Key] && time.Since(info.ModTime) >= gracePeriod {
+			unused = append(unused, info)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return 0, 0, err
+	}
+
+	collected, freed := 0, int64(0)
+	for _, info := range unused {
+		if err := backend.Delete(info.Key); err != nil {
+			return collected, freed, err
+		}
+		collected++
+		freed += info.Size
+	}
+	return collected, freed, nil
+}
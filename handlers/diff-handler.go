@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"errors"
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/models/response"
+	"filemanager/storage"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// GetIterationDiff returns the changes of the GeoJSON between two iterations of a project as a
+// FeatureCollection, in either order: from the older iteration to the newer one. Every feature has
+// a "change" member with its type (added, removed or modified), its file and what changed, the
+// collection has a "summary" member counting them. Features are matched within a file by ID, or by
+// geometry when they have none. The diff is computed by a job the first time, answering 202 with
+// the job's ID, then saved with the newer iteration until either GeoJSON is replaced
+// Params
+// companyID: ID of the company
+// projectID: ID of the project
+// iterationID: ID of an iteration
+// otherIterationID: ID of the other iteration
+func GetIterationDiff(c *fiber.Ctx) error {
+	projectID, iterationID, ok := checkIterationURL(c)
+	if !ok {
+		return nil
+	}
+	token := c.Cookies("token")
+	refreshToken := c.Cookies("refreshToken")
+
+	otherIterationID, err := uuid.Parse(c.Params("otherIterationID"))
+	if err != nil {
+		helpers.BadRequest(c, "invalid iteration id", constants.ERR_PROJECT_ITERATION_NOT_FOUND)
+		return nil
+	}
+	if otherIterationID == iterationID {
+		helpers.BadRequest(c, "an iteration can not be compared with itself", constants.ERR_PROJECT_ITERATION_NOT_FOUND)
+		return nil
+	}
+
+	// Both iterations must be of the project, the newer one is the one created last
+	iteration, errCode, err := callGetProjectIteration(iterationID.String(), token, refreshToken)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
+	}
+	otherIteration, errCode, err := callGetProjectIteration(otherIterationID.String(), token, refreshToken)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
+	}
+	if otherIteration.ProjectID != projectID {
+		helpers.BadRequest(c, "iteration not found in project", constants.ERR_PROJECT_ITERATION_NOT_FOUND)
+		return nil
+	}
+	diff := &iterationDiff{CompanyID: c.Params("companyID"), ProjectID: projectID, From: otherIterationID, To: iterationID}
+	if iteration.CreatedTime.Before(otherIteration.CreatedTime) {
+		diff.From, diff.To = iterationID, otherIterationID
+	}
+
+	backend := storage.GetBackend()
+	if diff.fromManifest, err = getLayerManifest(backend, diff.layerKey(diff.From)); err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+	if diff.toManifest, err = getLayerManifest(backend, diff.layerKey(diff.To)); err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	} else if diff.toManifest == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
+	}
+
+	// Saved diffs never change, a new one is saved under another key
+	info, err := backend.Stat(diff.key())
+	if err == nil {
+		etag := fmt.Sprintf("\"%s\"", strings.TrimSuffix(path.Base(info.Key), ".geojson"))
+		return sendStorageFile(c, backend, info, contentTypeOf(info.Key), etag)
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	job, err := submitDiffJob(diff, helpers.GetUserID(c))
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), constants.ERR_JOB_QUEUE_FULL)
+		return nil
+	}
+	c.Location("/jobs/" + job.ID)
+	c.Status(202)
+	c.JSON(response.BaseResponse{
+		Data: response.DiffAcceptedResponse{
+			JobID: job.ID,
+			URL:   diff.url(),
+		},
+		Meta: struct{ Status int }{Status: 202},
+	})
+	return nil
+}
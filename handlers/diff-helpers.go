@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"filemanager/common/constants"
+	"filemanager/geojson"
+	"filemanager/jobs"
+	"filemanager/models/response"
+	"filemanager/storage"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const jobKindDiffIterations = "diff_iterations"
+
+// iterationDiff is a diff of the GeoJSON of two iterations of a project, saved with the newer one
+type iterationDiff struct {
+	CompanyID string
+	ProjectID uuid.UUID
+	From      uuid.UUID // older iteration
+	To        uuid.UUID // newer iteration
+
+	fromManifest *layerManifest // nil when the older iteration has no GeoJSON
+	toManifest   *layerManifest
+}
+
+func (d *iterationDiff) layerKey(iterationID uuid.UUID) string {
+	return storage.Join(d.CompanyID, d.ProjectID.String(), iterationID.String(), "geojson")
+}
+
+// key is where the diff is saved, in the metadata of the newer layer so it goes when that layer is
+// replaced. The creation time of both layers is part of the name so a replaced layer is compared again
+func (d *iterationDiff) key() string {
+	var fromCreated int64
+	if d.fromManifest != nil {
+		fromCreated = d.fromManifest.CreatedTime.UnixNano()
+	}
+	name := fmt.Sprintf("%s-%x-%x.geojson", d.From, fromCreated, d.toManifest.CreatedTime.UnixNano())
+	return storage.Join(layerDiffsKey(d.layerKey(d.To)), name)
+}
+
+// layerDiffsKey returns where the diffs of a layer are saved. Any user viewing a project may save them,
+// they are not counted in the company's storage usage
+func layerDiffsKey(layerKey string) string {
+	return storage.Join(layerKey, layerMetadataDirectory, "diff")
+}
+
+func (d *iterationDiff) url() string {
+	return fmt.Sprintf("/project/%s/%s/%s/diff/%s", d.CompanyID, d.ProjectID, d.To, d.From)
+}
+
+var (
+	diffJobs     = map[string]*jobs.Job{}
+	diffJobsLock sync.Mutex
+)
+
+// submitDiffJob queues a job computing a diff, or returns the one of the same user already computing it
+func submitDiffJob(diff *iterationDiff, owner string) (*jobs.Job, error) {
+	diffJobsLock.Lock()
+	defer diffJobsLock.Unlock()
+
+	jobKey := owner + "\x00" + diff.key()
+	if job, exist := diffJobs[jobKey]; exist && !jobs.IsFinal(job.Info().Status) {
+		return job, nil
+	}
+	for key, job := range diffJobs {
+		if jobs.IsFinal(job.Info().Status) {
+			delete(diffJobs, key)
+		}
+	}
+
+	job, err := jobs.Get().Submit(jobKindDiffIterations, owner, diff.ProjectID.String(),
+		func(ctx context.Context, job *jobs.Job) (any, int, error) {
+			return diffIterationsJob(ctx, job, diff)
+		})
+	if err != nil {
+		return nil, err
+	}
+	diffJobs[jobKey] = job
+	return job, nil
+}
+
+// diffIterationsJob compares the GeoJSON of two iterations, saving the changed features as a
+// FeatureCollection whose "summary" member counts them. The job fails when the older iteration has more
+// than DIFF_MAX_FEATURES features (default 1000000), they are all kept in memory
+func diffIterationsJob(ctx context.Context, job *jobs.Job, diff *iterationDiff) (any, int, error) {
+	backend := storage.GetBackend()
+	job.SetStatus(jobs.StatusComparing)
+	compared := geojson.NewDiff(getEnvInt("DIFF_MAX_FEATURES", 1000000))
+
+	// Older features are kept, newer ones compared as they are read
+	read := func(iterationID uuid.UUID, manifest *layerManifest, fn func(filePath string, feature *geojson.Feature) error) error {
+		part := iterationID.String()
+		job.Report(part, func(p *jobs.Progress) {
+			p.Status = jobs.StatusComparing
+		})
+		var err error
+		if manifest != nil {
+			count := 0
+			err = readLayerFeatures(ctx, backend, diff.layerKey(iterationID), manifest, func(filePath string, feature *geojson.Feature) error {
+				if count++; count%1000 == 0 {
+					job.Report(part, func(p *jobs.Progress) {
+						p.Entries = count
+					})
+				}
+				return fn(filePath, feature)
+			})
+			job.Report(part, func(p *jobs.Progress) {
+				p.Entries = count
+			})
+		}
+		status := jobs.StatusDone
+		if err != nil {
+			status = jobs.StatusFailed
+		}
+		job.Report(part, func(p *jobs.Progress) {
+			p.Status = status
+		})
+		return err
+	}
+
+	// The collection goes to a temporary file, then to the storage at once
+	file, err := os.CreateTemp("", "diff-*.geojson")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	writer.WriteString(`{"type":"FeatureCollection","features":[`)
+	first := true
+	write := func(feature *geojson.ChangedFeature) error {
+		data, err := json.Marshal(feature)
+		if err != nil {
+			return err
+		}
+		if !first {
+			writer.WriteByte(',')
+		}
+		first = false
+		_, err = writer.Write(data)
+		return err
+	}
+
+	err = read(diff.From, diff.fromManifest, compared.AddOld)
+	if err == nil {
+		err = read(diff.To, diff.toManifest, func(filePath string, feature *geojson.Feature) error {
+			return compared.Compare(filePath, feature, write)
+		})
+	}
+	if err == nil {
+		err = compared.Removed(write)
+	}
+	if errors.Is(err, geojson.ErrTooManyFeatures) {
+		return nil, constants.ERR_FILE_TOO_MANY_FEATURES, err
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	summary, err := json.Marshal(compared.Summary)
+	if err != nil {
+		return nil, 0, err
+	}
+	fmt.Fprintf(writer, `],"summary":%s}`, summary)
+	if err := writer.Flush(); err != nil {
+		return nil, 0, err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	// The diff is not saved while the newer iteration is changed, its layer may be moving. No change
+	// begins until it is saved, it is computed again on the next request otherwise
+	lock := getIterationLock(diff.To)
+	lock.Lock()
+	defer lock.Unlock()
+	busy, err := busyIterations()
+	if err != nil {
+		return nil, 0, err
+	}
+	result := response.IterationDiffResponse{
+		URL:             diff.url(),
+		FromIterationID: diff.From,
+		ToIterationID:   diff.To,
+		Added:           compared.Summary.Added,
+		Removed:         compared.Summary.Removed,
+		Modified:        compared.Summary.Modified,
+		Unchanged:       compared.Summary.Unchanged,
+	}
+	if busy[diff.To] {
+		return result, 0, nil
+	}
+
+	// Diffs of layers which were replaced since are of no use
+	diffDirectory := layerDiffsKey(diff.layerKey(diff.To))
+	if saved, err := backend.List(diffDirectory); err == nil {
+		for _, info := range saved {
+			if strings.HasPrefix(info.Key, storage.Join(diffDirectory, diff.From.String()+"-")) {
+				backend.Delete(info.Key)
+			}
+		}
+	}
+	if err := backend.Put(diff.key(), file, size); err != nil {
+		return nil, 0, err
+	}
+	return result, 0, nil
+}
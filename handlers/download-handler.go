@@ -1,53 +1,69 @@
 package handlers
 
 import (
-	"filemanager/common/constants"
 	"filemanager/common/helpers"
+	"filemanager/storage"
 	"fmt"
-	"net/http"
-	"net/url"
+	"path"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/filesystem"
-	"github.com/google/uuid"
 )
 
 func GetProjectFile(c *fiber.Ctx) error {
 	// Parse url
 	companyID := c.Params("companyID")
-	projectIDString := c.Params("projectID")
-	iterationID := c.Params("iterationID")
-	file, _ := url.PathUnescape(c.Params("*"))
-	token := c.Cookies("token")
-	refreshToken := c.Cookies("refreshToken")
-
-	// Parse ProjectID
-	projectID, err := uuid.Parse(projectIDString)
-	if err != nil {
-		helpers.BadRequest(c, "invalid project id", constants.ERR_PROJECT_NOT_FOUND)
-		return nil
-	}
 
-	// Validate permission
-	if errCode, err := callValidatePermission(projectID, token, refreshToken); err != nil {
-		helpers.BadRequest(c, err.Error(), errCode)
+	projectID, iterationID, ok := checkIterationURL(c)
+	if !ok {
 		return nil
 	}
 
-	// Path to file
-	fileSystemRoot := helpers.GetFileSystemRootLocation()
-	fileLocation := fmt.Sprintf("%s/%s/%s/%s",
-		companyID,
-		projectID,
-		iterationID,
-		file)
+	// Path to file, the first directory is the layer. It can never leave the iteration that was checked
+	backend := storage.GetBackend()
+	iterationKey := storage.Join(companyID, projectID.String(), iterationID.String())
+	fileLocation, ok := iterationFileKey(iterationKey, c.Params("*"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).SendString("File not found")
+	}
+	layer, layerFilePath, _ := strings.Cut(strings.TrimPrefix(fileLocation, iterationKey+"/"), "/")
+	if isReservedLayerPath(layerFilePath) {
+		return c.Status(fiber.StatusNotFound).SendString("File not found")
+	}
 
-	// Serve the file using SendFile function
-	err = filesystem.SendFile(c, http.Dir(fileSystemRoot), fileLocation)
+	// Files listed in the layer's manifest have a strong ETag from their checksum and are stored as blobs,
+	// older uploads without manifest fall back to a weak one from size and modified time
+	var info storage.ObjectInfo
+	var etag string
+	contentType := contentTypeOf(layerFilePath)
+	layerKey := storage.Join(iterationKey, layer)
+	manifest, err := getLayerManifest(backend, layerKey)
 	if err != nil {
-		// Handle the error, e.g., return a 404 Not Found response
-		return c.Status(fiber.StatusNotFound).SendString("File not found")
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+	if manifestFile, exist := manifest.find(layerFilePath); exist {
+		info = storage.ObjectInfo{Key: fileKey(layerKey, manifestFile), Size: manifestFile.Size, ModTime: manifestFile.ModTime}
+		etag = fmt.Sprintf("\"%s\"", manifestFile.SHA256)
+		if manifestFile.ContentType != "" {
+			contentType = manifestFile.ContentType
+		}
+	} else {
+		info, err = backend.Stat(fileLocation)
+		if err != nil || info.IsDir {
+			// Handle the error, e.g., return a 404 Not Found response
+			return c.Status(fiber.StatusNotFound).SendString("File not found")
+		}
+		etag = fmt.Sprintf("W/\"%x-%x\"", info.Size, info.ModTime.Unix())
+	}
+
+	// Let the client download directly from the storage when it supports presigned urls,
+	// named and typed as the file since blobs are neither
+	if presigner, ok := backend.(storage.Presigner); ok {
+		if presignedURL, err := presigner.PresignGet(info.Key, path.Base(layerFilePath), contentType); err == nil && presignedURL != "" {
+			return c.Redirect(presignedURL, fiber.StatusTemporaryRedirect)
+		}
 	}
 
-	return nil
+	return sendStorageFile(c, backend, info, contentType, etag)
 }
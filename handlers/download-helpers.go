@@ -4,39 +4,338 @@ import (
 	"errors"
 	"filemanager/common/constants"
 	"filemanager/common/helpers"
-	"filemanager/models/request"
+	"filemanager/storage"
 	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
-func callValidatePermission(projectID uuid.UUID, token, refreshToken string) (int, error) {
-	// Get info of User microservice
-	host := os.Getenv("USER_SERVICE_HOST")
-	port := os.Getenv("USER_SERVICE_PORT")
-	api := constants.PermissionValidate
-	url := fmt.Sprintf("%s:%s/permission%s", host, port, api)
+// More ranges than this in one request are answered with the whole file
+const maxRangesPerRequest = 32
 
-	// Check if user has permission view to this project
-	agent := fiber.Post(url)
-	agent.JSON(request.GetUserSpecificPermissionRequest{
-		ProjectID:       &projectID,
-		PermissionType:  constants.PERM_PROJECT,
-		PermissionLevel: constants.PERM_LEVEL_VIEW,
-	})
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
 
-	// Get permission
-	var data string
-	if errCode, err := helpers.SendAndParseResponseData(agent, &data, token, refreshToken); err != nil {
-		return errCode, err
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// sendStorageFile answers a GET or HEAD of a stored file, handling conditional requests
+// (If-None-Match, If-Modified-Since, If-Match, If-Unmodified-Since, If-Range) and byte ranges
+func sendStorageFile(c *fiber.Ctx, backend storage.Backend, info storage.ObjectInfo, contentType, etag string) error {
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("private, max-age=%d", getFileCacheMaxAge()))
+	c.Response().Header.SetLastModified(info.ModTime)
+
+	// Conditional requests
+	if status := checkPreconditions(c, etag, info.ModTime); status != 0 {
+		c.Status(status)
+		c.Response().ResetBody()
+		return nil
+	}
+
+	// Only honor Range if If-Range still matches the file
+	var ranges []byteRange
+	if ifRange := c.Get(fiber.HeaderIfRange); ifRange == "" || ifRangeMatches(ifRange, etag, info.ModTime) {
+		var err error
+		ranges, err = parseRange(c.Get(fiber.HeaderRange), info.Size)
+		if errors.Is(err, errRangeNotSatisfiable) {
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", info.Size))
+			return c.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
+		}
+		if len(ranges) > maxRangesPerRequest {
+			ranges = nil
+		}
+	}
+
+	isHead := c.Method() == fiber.MethodHead
+
+	switch len(ranges) {
+	case 0:
+		if isHead {
+			c.Response().Header.SetContentLength(int(info.Size))
+			return nil
+		}
+
+		reader, err := backend.Get(info.Key)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).SendString("File not found")
+		}
+		return c.SendStream(reader, int(info.Size))
+
+	case 1:
+		c.Status(fiber.StatusPartialContent)
+		c.Set(fiber.HeaderContentRange, ranges[0].contentRange(info.Size))
+		if isHead {
+			c.Response().Header.SetContentLength(int(ranges[0].length))
+			return nil
+		}
+
+		reader, err := backend.GetRange(info.Key, ranges[0].start, ranges[0].length)
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).SendString("File not found")
+		}
+		return c.SendStream(reader, int(ranges[0].length))
+
+	default:
+		// Multiple ranges are sent as multipart/byteranges, streamed part by part
+		contentType := string(c.Response().Header.ContentType())
+		pipeReader, pipeWriter := io.Pipe()
+		multipartWriter := multipart.NewWriter(pipeWriter)
+
+		c.Status(fiber.StatusPartialContent)
+		c.Set(fiber.HeaderContentType, "multipart/byteranges; boundary="+multipartWriter.Boundary())
+		if isHead {
+			return nil
+		}
+
+		go func() {
+			for _, byteRange := range ranges {
+				part, err := multipartWriter.CreatePart(textproto.MIMEHeader{
+					fiber.HeaderContentType:  {contentType},
+					fiber.HeaderContentRange: {byteRange.contentRange(info.Size)},
+				})
+				if err != nil {
+					pipeWriter.CloseWithError(err)
+					return
+				}
+
+				reader, err := backend.GetRange(info.Key, byteRange.start, byteRange.length)
+				if err != nil {
+					pipeWriter.CloseWithError(err)
+					return
+				}
+				_, err = io.Copy(part, reader)
+				reader.Close()
+				if err != nil {
+					pipeWriter.CloseWithError(err)
+					return
+				}
+			}
+
+			pipeWriter.CloseWithError(multipartWriter.Close())
+		}()
+
+		return c.SendStream(pipeReader)
+	}
+}
+
+// iterationFileKey returns the key of a file of an iteration from the path of a url, false for paths with
+// a ".." segment, escaped or not, which could leave the iteration once cleaned
+func iterationFileKey(iterationKey, rawPath string) (string, bool) {
+	filePath, err := url.PathUnescape(rawPath)
+	if err != nil || hasParentSegment(rawPath) || hasParentSegment(filePath) {
+		return "", false
 	}
 
-	// Permission denied then return denied
-	if data != "Granted" {
-		return constants.ERR_COMMON_PERMISSION_NOT_ALLOWED, errors.New("no permission")
+	key := storage.Join(iterationKey, filePath)
+	if !strings.HasPrefix(key, storage.CleanKey(iterationKey)+"/") {
+		return "", false
 	}
+	return key, true
+}
+
+func hasParentSegment(filePath string) bool {
+	for _, segment := range strings.FieldsFunc(filePath, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
 
-	return 0, nil
+// checkIterationURL checks the user may view the project, company and iteration of the url,
+// responding and returning false when a check fails
+func checkIterationURL(c *fiber.Ctx) (uuid.UUID, uuid.UUID, bool) {
+	companyID := c.Params("companyID")
+	projectIDString := c.Params("projectID")
+	iterationIDString := c.Params("iterationID")
+	token := c.Cookies("token")
+	refreshToken := c.Cookies("refreshToken")
+
+	// Parse ProjectID
+	projectID, err := uuid.Parse(projectIDString)
+	if err != nil {
+		helpers.BadRequest(c, "invalid project id", constants.ERR_PROJECT_NOT_FOUND)
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	// Validate permission
+	if errCode, err := callValidatePermission(helpers.GetUserID(c), projectID, constants.PERM_LEVEL_VIEW, token, refreshToken); err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	// The company and iteration in the url must be the project's own, else any company's
+	// files could be read with a permission on another project
+	realCompanyID, errCode, err := getCachedCompanyIDFromProjectID(projectID, token, refreshToken)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return uuid.Nil, uuid.Nil, false
+	}
+	if realCompanyID != companyID {
+		helpers.BadRequest(c, "project not found in company", constants.ERR_PROJECT_NOT_FOUND)
+		return uuid.Nil, uuid.Nil, false
+	}
+	iterationID, err := uuid.Parse(iterationIDString)
+	if err != nil {
+		helpers.BadRequest(c, "invalid iteration id", constants.ERR_PROJECT_ITERATION_NOT_FOUND)
+		return uuid.Nil, uuid.Nil, false
+	}
+	iterationProjectID, errCode, err := getCachedProjectIDFromIterationID(iterationID, token, refreshToken)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return uuid.Nil, uuid.Nil, false
+	}
+	if iterationProjectID != projectID {
+		helpers.BadRequest(c, "iteration not found in project", constants.ERR_PROJECT_ITERATION_NOT_FOUND)
+		return uuid.Nil, uuid.Nil, false
+	}
+
+	return projectID, iterationID, true
+}
+
+func getFileCacheMaxAge() int {
+	maxAge, err := strconv.Atoi(os.Getenv("FILE_CACHE_MAX_AGE"))
+	if err != nil || maxAge < 0 {
+		return 0
+	}
+	return maxAge
+}
+
+// checkPreconditions evaluates conditional headers in the order of RFC 9110 13.2.2,
+// returns the status to answer with or 0 to send the file
+func checkPreconditions(c *fiber.Ctx, etag string, lastModified time.Time) int {
+	if ifMatch := c.Get(fiber.HeaderIfMatch); ifMatch != "" {
+		if !etagListMatches(ifMatch, etag, true) {
+			return fiber.StatusPreconditionFailed
+		}
+	} else if ifUnmodifiedSince, err := http.ParseTime(c.Get(fiber.HeaderIfUnmodifiedSince)); err == nil {
+		if lastModified.Truncate(time.Second).After(ifUnmodifiedSince) {
+			return fiber.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := c.Get(fiber.HeaderIfNoneMatch); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, etag, false) {
+			return fiber.StatusNotModified
+		}
+	} else if ifModifiedSince, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince)); err == nil {
+		if !lastModified.Truncate(time.Second).After(ifModifiedSince) {
+			return fiber.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// etagListMatches checks an If-Match/If-None-Match list, strong comparison never matches weak ETags
+func etagListMatches(header, etag string, strong bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	if strong && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strong && strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ifRangeMatches checks If-Range, which holds either a strong ETag or an exact date
+func ifRangeMatches(ifRange, etag string, lastModified time.Time) bool {
+	if strings.HasPrefix(ifRange, "\"") {
+		return !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+
+	date, err := http.ParseTime(ifRange)
+	return err == nil && lastModified.Truncate(time.Second).Equal(date)
+}
+
+// parseRange parses a Range header against a file's size. A missing or malformed header
+// returns no ranges (send the whole file), errRangeNotSatisfiable when no range fits the file
+func parseRange(header string, size int64) ([]byteRange, error) {
+	specs, isBytes := strings.CutPrefix(header, "bytes=")
+	if header == "" || !isBytes {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		startString, endString, found := strings.Cut(spec, "-")
+		if !found {
+			return nil, nil
+		}
+
+		// Suffix range, the last n bytes
+		if startString == "" {
+			suffixLength, err := strconv.ParseInt(endString, 10, 64)
+			if err != nil || suffixLength < 0 {
+				return nil, nil
+			}
+			if suffixLength == 0 || size == 0 {
+				continue
+			}
+			if suffixLength > size {
+				suffixLength = size
+			}
+			ranges = append(ranges, byteRange{start: size - suffixLength, length: suffixLength})
+			continue
+		}
+
+		start, err := strconv.ParseInt(startString, 10, 64)
+		if err != nil || start < 0 {
+			return nil, nil
+		}
+		end := size - 1
+		if endString != "" {
+			end, err = strconv.ParseInt(endString, 10, 64)
+			if err != nil || end < start {
+				return nil, nil
+			}
+			if end > size-1 {
+				end = size - 1
+			}
+		}
+
+		// Starts past the end of the file, unsatisfiable but other ranges may still fit
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+	return ranges, nil
 }
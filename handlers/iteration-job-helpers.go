@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"filemanager/archive"
+	"filemanager/common/constants"
+	"filemanager/jobs"
+	"filemanager/journal"
+	"filemanager/models/request"
+	"filemanager/models/response"
+	"filemanager/storage"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/google/uuid"
+)
+
+const (
+	jobKindCreateIteration = "create_iteration"
+	jobKindUpdateIteration = "update_iteration"
+)
+
+// createIterationJob saves the files of a created iteration then sets their urls on the record,
+// deleting the iteration when anything fails
+func createIterationJob(ctx context.Context, job *jobs.Job, operation *journal.Operation, data *iterationOperation,
+	files map[string]*layerFile, budget *archive.Budget, revision string) (any, int, error) {
+	fileList := []*layerFile{files["geojson"], files["tile_3d"], files["ortho_photo"]}
+	defer releaseLayerFiles(fileList)
+	kept := false
+	defer func() { releaseCompanyBudget(data.CompanyID, budget, kept) }()
+
+	// Extract, validate and tile every layer, a cancelled job stops here
+	backend := storage.GetBackend()
+	job.SetStatus(jobs.StatusExtracting)
+	saveFileErr := saveLayerFiles(ctx, job, backend, data.saveDirectory(), "", files, budget)
+	if saveFileErr == nil {
+		job.SetStatus(jobs.StatusValidating)
+		saveFileErr = validateLayerFiles(ctx, job, backend, data.saveDirectory(), "", files)
+	}
+	if saveFileErr == nil {
+		job.SetStatus(jobs.StatusTiling)
+		saveFileErr = tileLayerFiles(ctx, job, backend, data.saveDirectory(), "", files)
+	}
+	if saveFileErr == nil {
+		saveFileErr = ctx.Err()
+	}
+	if saveFileErr != nil {
+		if errCode, err := compensateCreateIteration(backend, operation, data); err != nil {
+			return nil, errCode, err
+		}
+		return validationErrorResult(saveFileErr), saveFileErrorCode(saveFileErr), saveFileErr
+	}
+
+	// No error, update project iteration on db with project's url and file names
+	updateIterationRequest := request.UpdateIterationRequest{
+		ID:       data.IterationID,
+		Revision: &revision,
+	}
+	baseURL := fmt.Sprintf("/%s/%s/%s", data.CompanyID, data.ProjectID, data.IterationID.String())
+	if files["geojson"] != nil {
+		geoJSONURL := fmt.Sprintf("%s/%s", baseURL, "geojson")
+		updateIterationRequest.GeoJSONURL = &geoJSONURL
+		updateIterationRequest.GeoJSONFileName = &files["geojson"].Filename
+	}
+	if files["tile_3d"] != nil {
+		tile3DURL := fmt.Sprintf("%s/%s", baseURL, "tile_3d")
+		updateIterationRequest.Tile3DURL = &tile3DURL
+		updateIterationRequest.Tile3DFileName = &files["tile_3d"].Filename
+	}
+	if files["ortho_photo"] != nil {
+		orthoPhotoURL := fmt.Sprintf("%s/%s", baseURL, "ortho_photo")
+		updateIterationRequest.OrthoPhotoURL = &orthoPhotoURL
+		updateIterationRequest.OrthoPhotoFileName = &files["ortho_photo"].Filename
+	}
+
+	// Files are saved, from here an interrupted create is completed instead
+	data.Update = &updateIterationRequest
+	stepIterationOperation(operation, stepFilesSaved, data)
+	updatedProjectIteration, errCode, err := serviceUpdateProjectIteration(updateIterationRequest)
+	if err != nil {
+		// Back to compensating, the files are about to be deleted
+		stepIterationOperation(operation, stepRecordCreated, data)
+		if deleteErrCode, deleteErr := compensateCreateIteration(backend, operation, data); deleteErr != nil {
+			return nil, deleteErrCode, deleteErr
+		}
+		return nil, errCode, err
+	}
+	finishIterationOperation(operation)
+	kept = true
+	refreshIterationUsage(backend, data.saveDirectory())
+
+	// Files are saved, resumable uploads are no longer needed
+	removeConsumedUploads(fileList)
+
+	return updatedProjectIteration, 0, nil
+}
+
+// compensateCreateIteration deletes the files and the record of an iteration which could not be created.
+// If either can not be deleted the operation stays journaled to be compensated in the background
+func compensateCreateIteration(backend storage.Backend, operation *journal.Operation, data *iterationOperation) (int, error) {
+	// Delete files
+	if err := deleteLayerFiles(backend, data.saveDirectory()); err != nil {
+		retryIterationOperation(operation)
+		return constants.ERR_COMMON_INTERNAL_SERVER_ERROR, err
+	}
+
+	// Delete project iteration db record
+	if errCode, err := serviceDeleteProjectIteration(data.IterationID); err != nil {
+		retryIterationOperation(operation)
+		return errCode, err
+	}
+	finishIterationOperation(operation)
+	return 0, nil
+}
+
+// updateIterationJob saves the new files of an iteration to temporary directories, updates the
+// record then replaces the old files. Nothing changes when anything fails before the record is updated
+func updateIterationJob(ctx context.Context, job *jobs.Job, operation *journal.Operation, data *iterationOperation,
+	files map[string]*layerFile, budget *archive.Budget) (any, int, error) {
+	fileList := []*layerFile{files["geojson"], files["tile_3d"], files["ortho_photo"]}
+	defer releaseLayerFiles(fileList)
+	kept := false
+	defer func() { releaseCompanyBudget(data.CompanyID, budget, kept) }()
+
+	// Clear leftovers of a previous failed edit
+	backend := storage.GetBackend()
+	for _, layer := range iterationLayers {
+		if err := deleteLayerFiles(backend, storage.Join(data.saveDirectory(), layer+"_temp")); err != nil {
+			discardIterationUpdate(backend, operation, data)
+			return nil, constants.ERR_COMMON_INTERNAL_SERVER_ERROR, err
+		}
+	}
+
+	// Extract, validate and tile every new layer, a cancelled job stops here
+	job.SetStatus(jobs.StatusExtracting)
+	saveFileErr := saveLayerFiles(ctx, job, backend, data.saveDirectory(), "_temp", files, budget)
+	if saveFileErr == nil {
+		job.SetStatus(jobs.StatusValidating)
+		saveFileErr = validateLayerFiles(ctx, job, backend, data.saveDirectory(), "_temp", files)
+	}
+	if saveFileErr == nil {
+		job.SetStatus(jobs.StatusTiling)
+		saveFileErr = tileLayerFiles(ctx, job, backend, data.saveDirectory(), "_temp", files)
+	}
+	if saveFileErr == nil {
+		saveFileErr = ctx.Err()
+	}
+	if saveFileErr != nil {
+		discardIterationUpdate(backend, operation, data)
+		return validationErrorResult(saveFileErr), saveFileErrorCode(saveFileErr), saveFileErr
+	}
+
+	// Update record on db
+	updatedProjectIteration, errCode, err := serviceUpdateProjectIteration(*data.Update)
+	if err != nil {
+		discardIterationUpdate(backend, operation, data)
+		return nil, errCode, err
+	}
+	kept = true
+
+	// Success, if remove is true then delete all files in the folder.
+	// Else if remove is false, and uploaded a new file, then remove the old files and rename the
+	// temporary folder to the original folder name. A failed commit is resumed in the background
+	stepIterationOperation(operation, stepCommitting, data)
+	if err := commitIterationLayers(backend, operation, data); err != nil {
+		retryIterationOperation(operation)
+		return nil, constants.ERR_COMMON_INTERNAL_SERVER_ERROR, err
+	}
+	finishIterationOperation(operation)
+
+	// Files are saved, resumable uploads are no longer needed
+	removeConsumedUploads(fileList)
+
+	return updatedProjectIteration, 0, nil
+}
+
+// discardIterationUpdate deletes the temporary directories of an update whose record was not updated.
+// If they can not be deleted the operation stays journaled and they are deleted in the background
+func discardIterationUpdate(backend storage.Backend, operation *journal.Operation, data *iterationOperation) {
+	for layer := range data.Layers {
+		if err := deleteLayerFiles(backend, storage.Join(data.saveDirectory(), layer+"_temp")); err != nil {
+			log.Error(fmt.Sprintf("Failed to discard update of iteration %s: %v", data.IterationID, err))
+			retryIterationOperation(operation)
+			return
+		}
+	}
+	finishIterationOperation(operation)
+}
+
+// checkIterationNotBusy fails while a change of the iteration is still queued or running, before any
+// work is done for a new one. beginIterationOperation checks again as it journals the new change
+func checkIterationNotBusy(iterationID uuid.UUID) (int, error) {
+	busy, err := busyIterations()
+	if err != nil {
+		return constants.ERR_COMMON_INTERNAL_SERVER_ERROR, err
+	}
+	if busy[iterationID] {
+		return constants.ERR_JOB_ITERATION_BUSY, errors.New("iteration has a change in progress")
+	}
+	return 0, nil
+}
+
+// jobAccepted answers 202 with the job now doing the request's work
+func jobAccepted(c *fiber.Ctx, job *jobs.Job, iteration response.IterationResponse) {
+	c.Location("/jobs/" + job.ID)
+	c.Status(202)
+	c.JSON(response.BaseResponse{
+		Data: response.JobAcceptedResponse{
+			JobID:     job.ID,
+			Iteration: iteration,
+		},
+		Meta: struct{ Status int }{Status: 202},
+	})
+}
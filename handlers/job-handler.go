@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/jobs"
+	"filemanager/models/response"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// GetJob returns the status of a job, its error code once failed and its result once done.
+// A job failed by validation has the validation report as result when there is one
+// Params
+// id: ID of the job
+func GetJob(c *fiber.Ctx) error {
+	job, ok := findOwnJob(c)
+	if !ok {
+		return nil
+	}
+
+	c.Status(200)
+	c.JSON(response.BaseResponse{
+		Data: job.Info(),
+		Meta: struct{ Status int }{Status: 200},
+	})
+	return nil
+}
+
+// GetJobEvents streams a job as server-sent events until it is finished. Every change sends a
+// "progress" event with the job's status and the progress of each layer, the last event is "done"
+// with the job's result or error. Changes in a row are sent at most every 250 ms
+// Params
+// id: ID of the job
+func GetJobEvents(c *fiber.Ctx) error {
+	job, ok := findOwnJob(c)
+	if !ok {
+		return nil
+	}
+
+	changed, unsubscribe := job.Subscribe()
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+	c.Status(200)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+
+		// Idle jobs are sent again now and then, so proxies keep the stream open and a gone client is noticed
+		keepAlive := time.NewTicker(15 * time.Second)
+		defer keepAlive.Stop()
+
+		for {
+			info := job.Info()
+			event := "progress"
+			if jobs.IsFinal(info.Status) {
+				event = "done"
+			}
+			if err := writeJobEvent(w, event, info); err != nil || event == "done" {
+				return
+			}
+
+			select {
+			case <-changed:
+				time.Sleep(250 * time.Millisecond)
+			case <-keepAlive.C:
+			}
+		}
+	})
+	return nil
+}
+
+// CancelJob stops a queued or running job, what it already did is undone
+// Params
+// id: ID of the job
+func CancelJob(c *fiber.Ctx) error {
+	job, ok := findOwnJob(c)
+	if !ok {
+		return nil
+	}
+
+	if err := jobs.Get().Cancel(job.ID); errors.Is(err, jobs.ErrFinished) {
+		helpers.BadRequest(c, err.Error(), constants.ERR_JOB_FINISHED)
+		return nil
+	} else if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	c.Status(200)
+	c.JSON(response.BaseResponse{
+		Data: job.Info(),
+		Meta: struct{ Status int }{Status: 200},
+	})
+	return nil
+}
+
+// findOwnJob returns the job of the url if the user started it or is root, else responds not found
+func findOwnJob(c *fiber.Ctx) (*jobs.Job, bool) {
+	job, err := jobs.Get().Find(c.Params("id"))
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), constants.ERR_JOB_NOT_FOUND)
+		return nil, false
+	}
+
+	// Get info from token
+	userLocal := c.Locals("user").(*jwt.Token)
+	claims := userLocal.Claims.(jwt.MapClaims)
+	isRoot, _ := claims["is_root"].(bool)
+
+	// Other users' jobs are not found, not forbidden, so their IDs can not be probed
+	if !isRoot && (job.Owner == "" || job.Owner != helpers.GetUserID(c)) {
+		helpers.BadRequest(c, jobs.ErrNotFound.Error(), constants.ERR_JOB_NOT_FOUND)
+		return nil, false
+	}
+	return job, true
+}
+
+func writeJobEvent(w *bufio.Writer, event string, info jobs.Info) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return w.Flush()
+}
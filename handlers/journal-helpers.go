@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/journal"
+	"filemanager/models/request"
+	"filemanager/models/response"
+	"filemanager/storage"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/google/uuid"
+)
+
+// Journaled iteration operations
+const (
+	operationCreateIteration = "create_iteration"
+	operationUpdateIteration = "update_iteration"
+	operationDeleteIteration = "delete_iteration"
+	operationRollbackLayer   = "rollback_layer"
+)
+
+// Steps of the operations, recovery completes an operation past its point of no return
+// and compensates it before
+const (
+	// Create: the iteration record exists and files are being saved, compensated
+	stepRecordCreated = "record_created"
+	// Create: files are saved and the record is being updated with their urls, completed
+	stepFilesSaved = "files_saved"
+	// Update: new files are saved to temporary directories and the record is being updated, compensated
+	stepFilesSaving = "files_saving"
+	// Update: the record is updated and layers are replaced by their temporary directories, completed
+	stepCommitting = "committing"
+	// Delete: the record is being deleted, completed
+	stepDeletingRecord = "deleting_record"
+	// Delete: the record is deleted and files are being deleted, completed
+	stepRecordDeleted = "record_deleted"
+	// Rollback: the record is being updated to the version's file name, compensated
+	stepUpdatingRecord = "updating_record"
+	// Rollback: the record is updated and the version is replacing the layer, completed
+	stepRestoringVersion = "restoring_version"
+)
+
+// What an update does to a layer once committed, and how far the commit of a layer went
+const (
+	layerActionReplace = "replace"
+	layerActionRemove  = "remove"
+	layerOldRemoved    = "old_removed"
+	layerCommitted     = "committed"
+)
+
+// iterationOperation is what recovery needs to finish an operation. No user token is kept, the
+// project service is called with the service credentials once the request is answered
+type iterationOperation struct {
+	CompanyID   string    `json:"company_id"`
+	ProjectID   uuid.UUID `json:"project_id"`
+	IterationID uuid.UUID `json:"iteration_id"`
+
+	// Record to save once files are saved (create), or to restore when compensating (update)
+	Update   *request.UpdateIterationRequest `json:"update,omitempty"`
+	Previous *request.UpdateIterationRequest `json:"previous,omitempty"`
+
+	// Update only, action and commit state of every changed layer
+	Layers    map[string]string `json:"layers,omitempty"`
+	Committed map[string]string `json:"committed,omitempty"`
+
+	// Rollback only, the layer and the version restored
+	Layer   string `json:"layer,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+func (o *iterationOperation) saveDirectory() string {
+	return storage.Join(o.CompanyID, o.ProjectID.String(), o.IterationID.String())
+}
+
+// Locks of iterations and projects. No operation begins while the reconciler fixes its iteration
+// or unused blobs of its project are collected
+var (
+	operationLocks     = map[string]*sync.Mutex{}
+	operationLocksLock sync.Mutex
+)
+
+func getOperationLock(key string) *sync.Mutex {
+	operationLocksLock.Lock()
+	defer operationLocksLock.Unlock()
+
+	lock, exist := operationLocks[key]
+	if !exist {
+		lock = &sync.Mutex{}
+		operationLocks[key] = lock
+	}
+	return lock
+}
+
+func getIterationLock(iterationID uuid.UUID) *sync.Mutex {
+	return getOperationLock(iterationID.String())
+}
+
+// getProjectLock returns the lock of a company/project key
+func getProjectLock(projectKey string) *sync.Mutex {
+	return getOperationLock(storage.CleanKey(projectKey))
+}
+
+// beginIterationOperation journals an operation before its first step. It fails while another
+// operation of the iteration is unfinished, checked in the same journal write
+func beginIterationOperation(kind, step string, data *iterationOperation) (*journal.Operation, int, error) {
+	projectLock := getProjectLock(storage.Join(data.CompanyID, data.ProjectID.String()))
+	projectLock.Lock()
+	defer projectLock.Unlock()
+	lock := getIterationLock(data.IterationID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	operation, err := journal.Get().BeginUnless(kind, step, data, func(unfinished *journal.Operation) bool {
+		var unfinishedData iterationOperation
+		return json.Unmarshal(unfinished.Data, &unfinishedData) == nil && unfinishedData.IterationID == data.IterationID
+	})
+	if errors.Is(err, journal.ErrConflict) {
+		return nil, constants.ERR_JOB_ITERATION_BUSY, errors.New("iteration has a change in progress")
+	} else if err != nil {
+		return nil, constants.ERR_COMMON_INTERNAL_SERVER_ERROR, err
+	}
+	return operation, 0, nil
+}
+
+// stepIterationOperation journals the next step. A failed write is only logged, the request goes on
+// and the operation is recovered from its previous step if the process stops
+func stepIterationOperation(operation *journal.Operation, step string, data *iterationOperation) {
+	if err := journal.Get().Step(operation, step, data); err != nil {
+		log.Error(fmt.Sprintf("Failed to journal step %s of operation %s: %v", step, operation.ID, err))
+	}
+}
+
+func finishIterationOperation(operation *journal.Operation) {
+	if err := journal.Get().Finish(operation); err != nil {
+		log.Error(fmt.Sprintf("Failed to finish operation %s: %v", operation.ID, err))
+	}
+}
+
+// commitIterationLayers replaces or removes the layers of an update, resuming wherever a previous
+// commit stopped. Old layers are kept as versions, each layer's progress is journaled since its
+// old files are gone once moved
+func commitIterationLayers(backend storage.Backend, operation *journal.Operation, data *iterationOperation) error {
+	if data.Committed == nil {
+		data.Committed = map[string]string{}
+	}
+
+	layers := make([]string, 0, len(data.Layers))
+	for layer := range data.Layers {
+		layers = append(layers, layer)
+	}
+	sort.Strings(layers)
+
+	for _, layer := range layers {
+		if data.Committed[layer] == layerCommitted {
+			continue
+		}
+		layerDirectory := storage.Join(data.saveDirectory(), layer)
+		tempDirectory := storage.Join(data.saveDirectory(), layer+"_temp")
+
+		if data.Committed[layer] != layerOldRemoved {
+			if err := archiveLayer(backend, data.saveDirectory(), layer, layerFileName(data.Previous, layer)); err != nil {
+				return err
+			}
+			data.Committed[layer] = layerOldRemoved
+			stepIterationOperation(operation, stepCommitting, data)
+		}
+
+		if data.Layers[layer] == layerActionReplace {
+			// Nothing left to move if the rename already happened
+			if files, err := backend.List(tempDirectory); err == nil && len(files) > 0 {
+				err := backend.Rename(tempDirectory, layerDirectory)
+				if errors.Is(err, storage.ErrExist) {
+					// The old layer is archived, what is there was copied by a rename stopped midway
+					if err = backend.Delete(layerDirectory); err == nil {
+						err = backend.Rename(tempDirectory, layerDirectory)
+					}
+				}
+				if err != nil {
+					return err
+				}
+			}
+		} else if err := deleteLayerFiles(backend, tempDirectory); err != nil {
+			return err
+		}
+		data.Committed[layer] = layerCommitted
+		stepIterationOperation(operation, stepCommitting, data)
+	}
+
+	invalidateManifests(data.saveDirectory())
+	refreshIterationUsage(backend, data.saveDirectory())
+	return nil
+}
+
+// RecoverIterationOperations completes or compensates the iteration operations left unfinished
+// by a previous run. Recovery is idempotent, an operation failing to recover is retried in the
+// background, up to JOURNAL_MAX_RECOVERY_ATTEMPTS times (default 10)
+func RecoverIterationOperations() {
+	operations, err := journal.Get().Unfinished()
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to read journal: %v", err))
+		return
+	}
+
+	backend := storage.GetBackend()
+	for _, operation := range operations {
+		if !recoverOperation(backend, operation) {
+			retryIterationOperation(operation)
+		}
+	}
+}
+
+// retryIterationOperation recovers an operation a request left unfinished in the background, so its
+// iteration is not busy until the next start. Attempts are JOURNAL_RETRY_DELAY seconds apart (default 5),
+// the delay doubling after every failed attempt up to an hour, and count against JOURNAL_MAX_RECOVERY_ATTEMPTS
+func retryIterationOperation(operation *journal.Operation) {
+	delay := time.Duration(max(getEnvInt("JOURNAL_RETRY_DELAY", 5), 1)) * time.Second
+	go func() {
+		for {
+			time.Sleep(delay)
+			if recoverOperation(storage.GetBackend(), operation) {
+				return
+			}
+			delay = min(2*delay, time.Hour)
+		}
+	}()
+}
+
+// recoverOperation completes or compensates an unfinished operation. Returns true once the operation
+// is finished: recovered, dropped when unreadable, or given up after its last attempt
+func recoverOperation(backend storage.Backend, operation *journal.Operation) bool {
+	var data iterationOperation
+	if err := json.Unmarshal(operation.Data, &data); err != nil {
+		log.Error(fmt.Sprintf("Dropped unreadable operation %s: %v", operation.ID, err))
+		finishIterationOperation(operation)
+		return true
+	}
+
+	err := recoverIterationOperation(backend, operation, &data)
+	refreshIterationUsage(backend, data.saveDirectory())
+	if err != nil {
+		if operation.Attempts+1 >= getEnvInt("JOURNAL_MAX_RECOVERY_ATTEMPTS", 10) {
+			log.Error(fmt.Sprintf("Gave up recovering %s %s of iteration %s at step %s: %v",
+				operation.Kind, operation.ID, data.IterationID, operation.Step, err))
+			finishIterationOperation(operation)
+			return true
+		}
+		log.Error(fmt.Sprintf("Failed to recover %s %s of iteration %s at step %s: %v",
+			operation.Kind, operation.ID, data.IterationID, operation.Step, err))
+		journal.Get().Retry(operation)
+		return false
+	}
+
+	log.Info(fmt.Sprintf("Recovered %s %s of iteration %s from step %s", operation.Kind, operation.ID, data.IterationID, operation.Step))
+	finishIterationOperation(operation)
+	return true
+}
+
+func recoverIterationOperation(backend storage.Backend, operation *journal.Operation, data *iterationOperation) error {
+	switch operation.Kind + "/" + operation.Step {
+	case operationCreateIteration + "/" + stepRecordCreated:
+		// Files may be partly saved, remove them and the record
+		if err := deleteLayerFiles(backend, data.saveDirectory()); err != nil {
+			return err
+		}
+		return deleteIterationRecord(data)
+
+	case operationCreateIteration + "/" + stepFilesSaved:
+		// Files are all saved, the record only misses their urls
+		if data.Update == nil {
+			return nil
+		}
+		_, _, err := serviceUpdateProjectIteration(*data.Update)
+		return err
+
+	case operationUpdateIteration + "/" + stepFilesSaving:
+		// Old files are untouched, drop the new ones and restore the record
+		for layer := range data.Layers {
+			if err := deleteLayerFiles(backend, storage.Join(data.saveDirectory(), layer+"_temp")); err != nil {
+				return err
+			}
+		}
+		if data.Previous == nil {
+			return nil
+		}
+		_, _, err := serviceUpdateProjectIteration(*data.Previous)
+		return err
+
+	case operationUpdateIteration + "/" + stepCommitting:
+		return commitIterationLayers(backend, operation, data)
+
+	case operationRollbackLayer + "/" + stepUpdatingRecord:
+		// The layer is untouched, restore the record
+		if data.Previous == nil {
+			return nil
+		}
+		_, _, err := serviceUpdateProjectIteration(*data.Previous)
+		return err
+
+	case operationRollbackLayer + "/" + stepRestoringVersion:
+		if err := restoreLayerVersion(backend, data.saveDirectory(), data.Layer, data.Version, layerFileName(data.Previous, data.Layer), true); err != nil {
+			return err
+		}
+		invalidateManifests(storage.Join(data.saveDirectory(), data.Layer))
+		return nil
+
+	case operationDeleteIteration + "/" + stepDeletingRecord:
+		if err := deleteIterationRecord(data); err != nil {
+			return err
+		}
+		fallthrough
+
+	case operationDeleteIteration + "/" + stepRecordDeleted:
+		if err := deleteLayerFiles(backend, data.saveDirectory()); err != nil {
+			return err
+		}
+		invalidateManifests(data.saveDirectory())
+		forgetIteration(data.IterationID)
+		return nil
+	}
+
+	return fmt.Errorf("unknown operation %s at step %s", operation.Kind, operation.Step)
+}
+
+// deleteIterationRecord deletes an iteration record, a record already gone is deleted
+func deleteIterationRecord(data *iterationOperation) error {
+	errCode, err := serviceDeleteProjectIteration(data.IterationID)
+	if err != nil && errCode != constants.ERR_PROJECT_ITERATION_NOT_FOUND {
+		return err
+	}
+	return nil
+}
+
+// serviceUpdateProjectIteration updates an iteration record with the service credentials
+func serviceUpdateProjectIteration(request request.UpdateIterationRequest) (response.IterationResponse, int, error) {
+	token, refreshToken := helpers.GetServiceCredentials()
+	return callUpdateProjectIteration(request, token, refreshToken)
+}
+
+// serviceDeleteProjectIteration deletes an iteration record with the service credentials
+func serviceDeleteProjectIteration(iterationID uuid.UUID) (int, error) {
+	token, refreshToken := helpers.GetServiceCredentials()
+	return callDeleteProjectIteration(iterationID, token, refreshToken)
+}
+
+// busyIterations returns the iterations with an unfinished operation, their files are in flux
+func busyIterations() (map[uuid.UUID]bool, error) {
+	operations, err := journal.Get().Unfinished()
+	if err != nil {
+		return nil, err
+	}
+
+	busy := map[uuid.UUID]bool{}
+	for _, operation := range operations {
+		var data iterationOperation
+		if json.Unmarshal(operation.Data, &data) == nil {
+			busy[data.IterationID] = true
+		}
+	}
+	return busy, nil
+}
+
+// busyProjects returns the company/project keys with an unfinished operation of one of their iterations
+func busyProjects() (map[string]bool, error) {
+	operations, err := journal.Get().Unfinished()
+	if err != nil {
+		return nil, err
+	}
+
+	busy := map[string]bool{}
+	for _, operation := range operations {
+		var data iterationOperation
+		if json.Unmarshal(operation.Data, &data) == nil {
+			busy[storage.Join(data.CompanyID, data.ProjectID.String())] = true
+		}
+	}
+	return busy, nil
+}
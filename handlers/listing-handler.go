@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/models/response"
+	"filemanager/storage"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetIterationFiles lists the files of an iteration from the manifests written when its layers were
+// extracted, sorted by layer then path. Layers uploaded before manifests are walked instead
+// Params
+// companyID: ID of the company
+// projectID: ID of the project
+// iterationID: ID of the iteration
+// layer: only list this layer, geojson, tile_3d or ortho_photo. Every layer if empty
+// glob: only list files matching this pattern, against the file name or, when it has a slash, the path in the layer
+// page: page to be listed, from 1 (default 1)
+// count: files per page (default 100, at most 1000)
+func GetIterationFiles(c *fiber.Ctx) error {
+	projectID, iterationID, ok := checkIterationURL(c)
+	if !ok {
+		return nil
+	}
+
+	layers := iterationLayers
+	if layer := c.Query("layer"); layer != "" {
+		if !slices.Contains(iterationLayers, layer) {
+			helpers.BadRequest(c, fmt.Sprintf("unknown layer %s", layer), constants.ERR_FILE_UNKNOWN_LAYER)
+			return nil
+		}
+		layers = []string{layer}
+	}
+	glob := c.Query("glob")
+	if _, err := path.Match(glob, ""); err != nil {
+		helpers.BadRequest(c, fmt.Sprintf("invalid glob %s", glob), constants.ERR_FILE_INVALID_GLOB)
+		return nil
+	}
+	page := max(c.QueryInt("page", 1), 1)
+	count := min(max(c.QueryInt("count", 100), 1), 1000)
+
+	backend := storage.GetBackend()
+	iterationPath := storage.Join(c.Params("companyID"), projectID.String(), iterationID.String())
+	files := []response.FileResponse{}
+	total := 0
+	for _, layer := range layers {
+		layerFiles, err := listLayerFiles(backend, storage.Join(iterationPath, layer))
+		if err != nil {
+			helpers.InternalServerError(c, err.Error())
+			return nil
+		}
+		for _, file := range layerFiles {
+			if glob != "" && !matchGlob(glob, file.Path) {
+				continue
+			}
+			total++
+			if total <= (page-1)*count || len(files) == count {
+				continue
+			}
+			files = append(files, response.FileResponse{
+				Layer:       layer,
+				Path:        file.Path,
+				URL:         fmt.Sprintf("/project/%s/%s/%s", iterationPath, layer, escapePath(file.Path)),
+				Size:        file.Size,
+				ModTime:     file.ModTime,
+				ContentType: file.ContentType,
+				SHA256:      file.SHA256,
+			})
+		}
+	}
+
+	c.Status(200)
+	c.JSON(response.BaseResponse{
+		Data: response.FileListResponse{
+			Files: files,
+			Page:  page,
+			Count: count,
+			Total: total,
+		},
+		Meta: struct{ Status int }{Status: 200},
+	})
+	return nil
+}
+
+// matchGlob reports if a file matches a pattern, by its name when the pattern has no slash
+func matchGlob(pattern, filePath string) bool {
+	if !strings.Contains(pattern, "/") {
+		filePath = path.Base(filePath)
+	}
+	matched, _ := path.Match(pattern, filePath)
+	return matched
+}
+
+func escapePath(filePath string) string {
+	segments := strings.Split(filePath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
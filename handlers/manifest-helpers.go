@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"filemanager/common/cache"
+	"filemanager/storage"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Every layer keeps its own metadata in this directory, it is never served as a layer file
+// and archives can not contain it
+const layerMetadataDirectory = ".filemanager"
+
+// layerManifest lists every file of a layer, written once the layer is extracted
+type layerManifest struct {
+	Layer       string         `json:"layer"`
+	CreatedTime time.Time      `json:"created_time"`
+	Files       []manifestFile `json:"files"`
+
+	index  map[string]int
+	stored storage.ObjectInfo // manifest file the cached manifest was read from
+}
+
+type manifestFile struct {
+	Path        string    `json:"path"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	ModTime     time.Time `json:"modified_time"`
+	ContentType string    `json:"content_type,omitempty"` // missing in manifests written before it was added
+	Blob        bool      `json:"blob,omitempty"`         // stored as a blob of the project, else in the layer
+}
+
+// Content types of layer files whose extension is not known by the usual tables
+var layerContentTypes = map[string]string{
+	".geojson": "application/geo+json",
+	".gltf":    "model/gltf+json",
+	".glb":     "model/gltf-binary",
+}
+
+// contentTypeOf returns the content type of a file by its extension, application/octet-stream if unknown
+func contentTypeOf(filePath string) string {
+	extension := strings.ToLower(path.Ext(filePath))
+	if contentType, exist := layerContentTypes[extension]; exist {
+		return contentType
+	}
+	if extension == "" {
+		return fiber.MIMEOctetStream
+	}
+	return utils.GetMIME(extension)
+}
+
+var (
+	manifestCache     *cache.Cache[string, *layerManifest]
+	manifestCacheOnce sync.Once
+)
+
+// getManifestCache returns the cache of parsed manifests, MANIFEST_CACHE_SIZE layers (default 1000)
+// kept MANIFEST_CACHE_TTL seconds (default 60). Created on first use, after the environment is loaded
+func getManifestCache() *cache.Cache[string, *layerManifest] {
+	manifestCacheOnce.Do(func() {
+		manifestCache = cache.New[string, *layerManifest](
+			getEnvInt("MANIFEST_CACHE_SIZE", 1000),
+			time.Duration(getEnvInt("MANIFEST_CACHE_TTL", 60))*time.Second,
+		)
+	})
+	return manifestCache
+}
+
+func manifestKey(layerKey string) string {
+	return storage.Join(layerKey, layerMetadataDirectory, "manifest.json")
+}
+
+func metadataKey(layerKey string) string {
+	return storage.Join(layerKey, layerMetadataDirectory, "metadata.json")
+}
+
+// isReservedLayerPath reports if a path relative to a layer is inside of the layer's metadata directory
+func isReservedLayerPath(filePath string) bool {
+	firstSegment, _, _ := strings.Cut(storage.CleanKey(filePath), "/")
+	return firstSegment == layerMetadataDirectory
+}
+
+// add adds a file to the manifest, replacing the file at the same path if any
+func (m *layerManifest) add(file manifestFile) {
+	if m.index == nil {
+		m.buildIndex()
+	}
+
+	// Archives may hold the same path twice, the last one is the one extracted
+	if i, exist := m.index[file.Path]; exist {
+		m.Files[i] = file
+		return
+	}
+	m.index[file.Path] = len(m.Files)
+	m.Files = append(m.Files, file)
+}
+
+func (m *layerManifest) buildIndex() {
+	m.index = make(map[string]int, len(m.Files))
+	for i, file := range m.Files {
+		m.index[file.Path] = i
+	}
+}
+
+// find returns a file of the manifest by its path relative to the layer, safe to call on a nil manifest
+func (m *layerManifest) find(filePath string) (manifestFile, bool) {
+	if m == nil {
+		return manifestFile{}, false
+	}
+
+	i, exist := m.index[storage.CleanKey(filePath)]
+	if !exist {
+		return manifestFile{}, false
+	}
+	return m.Files[i], true
+}
+
+func writeLayerManifest(backend storage.Backend, layerKey string, manifest *layerManifest) error {
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+	manifest.buildIndex()
+	manifest.CreatedTime = time.Now()
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return backend.Put(manifestKey(layerKey), bytes.NewReader(data), int64(len(data)))
+}
+
+// getLayerManifest returns the manifest of a layer, nil if the layer has none
+// (uploaded before manifests existed). Other instances replace layers too, a cached manifest
+// is only used while its file is unchanged
+func getLayerManifest(backend storage.Backend, layerKey string) (*layerManifest, error) {
+	layerKey = storage.CleanKey(layerKey)
+	info, err := backend.Stat(manifestKey(layerKey))
+	if errors.Is(err, storage.ErrNotFound) {
+		getManifestCache().Delete(layerKey)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if manifest, exist := getManifestCache().Get(layerKey); exist && manifest.stored.Size == info.Size && manifest.stored.ModTime.Equal(info.ModTime) {
+		return manifest, nil
+	}
+
+	manifest, err := readLayerManifest(backend, layerKey)
+	if manifest != nil {
+		manifest.stored = info
+		getManifestCache().Set(layerKey, manifest)
+	}
+	return manifest, err
+}
+
+// listLayerFiles returns the files of a layer from its manifest, or walks a layer written before manifests
+// were kept, whose files have no checksum. Nil when the layer does not exist
+func listLayerFiles(backend storage.Backend, layerKey string) ([]manifestFile, error) {
+	manifest, err := getLayerManifest(backend, layerKey)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		files := make([]manifestFile, len(manifest.Files))
+		for i, file := range manifest.Files {
+			if file.ContentType == "" {
+				file.ContentType = contentTypeOf(file.Path)
+			}
+			files[i] = file
+		}
+		return files, nil
+	}
+
+	var files []manifestFile
+	layerKey = storage.CleanKey(layerKey)
+	err = storage.Walk(backend, layerKey, func(info storage.ObjectInfo) error {
+		filePath := strings.TrimPrefix(info.Key, layerKey+"/")
+		if !isReservedLayerPath(filePath) {
+			files = append(files, manifestFile{Path: filePath, Size: info.Size, ModTime: info.ModTime, ContentType: contentTypeOf(filePath)})
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// readLayerManifest reads a manifest without the cache, for layers still being saved
+func readLayerManifest(backend storage.Backend, layerKey string) (*layerManifest, error) {
+	reader, err := backend.Get(manifestKey(layerKey))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	var manifest layerManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	manifest.buildIndex()
+	return &manifest, nil
+}
+
+// invalidateManifests drops cached manifests of every layer under a key, along with the map tiles
+// rendered from them, called whenever layers are replaced or deleted
+func invalidateManifests(key string) {
+	key = storage.CleanKey(key)
+	getManifestCache().DeleteFunc(func(layerKey string) bool {
+		return layerKey == key || strings.HasPrefix(layerKey, key+"/")
+	})
+	invalidateTiles(key)
+}
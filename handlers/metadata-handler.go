@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"filemanager/common/helpers"
+	"filemanager/models/response"
+	"filemanager/storage"
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetIterationMetadata returns what validation found out about the files of each layer of an
+// iteration, like the extent and features of its GeoJSON. Layers without metadata are left out
+// Params
+// companyID: ID of the company
+// projectID: ID of the project
+// iterationID: ID of the iteration
+func GetIterationMetadata(c *fiber.Ctx) error {
+	projectID, iterationID, ok := checkIterationURL(c)
+	if !ok {
+		return nil
+	}
+
+	backend := storage.GetBackend()
+	iterationKey := storage.Join(c.Params("companyID"), projectID.String(), iterationID.String())
+	layers := map[string]json.RawMessage{}
+	for _, layer := range iterationLayers {
+		reader, err := backend.Get(metadataKey(storage.Join(iterationKey, layer)))
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		} else if err != nil {
+			helpers.InternalServerError(c, err.Error())
+			return nil
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			helpers.InternalServerError(c, err.Error())
+			return nil
+		}
+		layers[layer] = data
+	}
+
+	c.Status(200)
+	c.JSON(response.BaseResponse{
+		Data: layers,
+		Meta: struct{ Status int }{Status: 200},
+	})
+	return nil
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/models/request"
+	"filemanager/models/response"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// InvalidatePermissionCache drops cached permission decisions, to be called when
+// roles or permissions change in the user service.
+// Params
+// user_id: optional, only this user's decisions
+// project_id: optional, only this project's decisions
+// Both empty clears the whole cache
+func InvalidatePermissionCache(c *fiber.Ctx) error {
+	// Parse request model
+	request := request.InvalidatePermissionCacheRequest{}
+	if err := c.BodyParser(&request); err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	// Get info from token
+	userLocal := c.Locals("user").(*jwt.Token)
+	claims := userLocal.Claims.(jwt.MapClaims)
+	isRoot, _ := claims["is_root"].(bool)
+
+	// Only allow root to invalidate
+	if !isRoot {
+		helpers.BadRequest(c, "no permission to invalidate", constants.ERR_COMMON_PERMISSION_NOT_ALLOWED)
+		return nil
+	}
+
+	removed := invalidatePermissions(request.UserID, request.ProjectID)
+
+	c.Status(200)
+	c.JSON(response.BaseResponse{
+		Data: struct {
+			Removed int `json:"removed"`
+		}{Removed: removed},
+		Meta: struct{ Status int }{Status: 200},
+	})
+	return nil
+}
+
+// GetPermissionCacheMetrics returns hits, misses and hit rate of the permission cache
+func GetPermissionCacheMetrics(c *fiber.Ctx) error {
+	// Get info from token
+	userLocal := c.Locals("user").(*jwt.Token)
+	claims := userLocal.Claims.(jwt.MapClaims)
+	isRoot, _ := claims["is_root"].(bool)
+
+	// Only allow root to read metrics
+	if !isRoot {
+		helpers.BadRequest(c, "no permission to read metrics", constants.ERR_COMMON_PERMISSION_NOT_ALLOWED)
+		return nil
+	}
+
+	c.Status(200)
+	c.JSON(response.BaseResponse{
+		Data: getPermissionCache().Stats(),
+		Meta: struct{ Status int }{Status: 200},
+	})
+	return nil
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"filemanager/common/cache"
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/models/request"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+type permissionCacheKey struct {
+	UserID          string
+	ProjectID       uuid.UUID
+	PermissionType  string
+	PermissionLevel string
+}
+
+// permissionDecision is a cached answer of the user service, ErrCode 0 means granted
+type permissionDecision struct {
+	ErrCode int
+	Error   string
+}
+
+var (
+	permissionCache     *cache.Cache[permissionCacheKey, permissionDecision]
+	permissionCacheOnce sync.Once
+)
+
+// getPermissionCache returns the permission decisions cache, granted decisions are kept
+// PERMISSION_CACHE_TTL seconds (default 300) and denied ones PERMISSION_CACHE_NEGATIVE_TTL
+// seconds (default 30). Created on first use, after the environment is loaded
+func getPermissionCache() *cache.Cache[permissionCacheKey, permissionDecision] {
+	permissionCacheOnce.Do(func() {
+		permissionCache = cache.New[permissionCacheKey, permissionDecision](
+			getEnvInt("PERMISSION_CACHE_SIZE", 10000),
+			time.Duration(getEnvInt("PERMISSION_CACHE_TTL", 300))*time.Second,
+		)
+	})
+	return permissionCache
+}
+
+func getEnvInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+	return value
+}
+
+func callValidatePermission(userID string, projectID uuid.UUID, permissionLevel, token, refreshToken string) (int, error) {
+	// Answer from cache when the user is known
+	cacheKey := permissionCacheKey{
+		UserID:          userID,
+		ProjectID:       projectID,
+		PermissionType:  constants.PERM_PROJECT,
+		PermissionLevel: permissionLevel,
+	}
+	if userID != "" {
+		if decision, exist := getPermissionCache().Get(cacheKey); exist {
+			if decision.ErrCode != 0 {
+				return decision.ErrCode, errors.New(decision.Error)
+			}
+			return 0, nil
+		}
+	}
+
+	// Get info of User microservice
+	host := os.Getenv("USER_SERVICE_HOST")
+	port := os.Getenv("USER_SERVICE_PORT")
+	api := constants.PermissionValidate
+	url := fmt.Sprintf("%s:%s/permission%s", host, port, api)
+
+	// Check if user has permission to this project
+	agent := fiber.Post(url)
+	agent.JSON(request.GetUserSpecificPermissionRequest{
+		ProjectID:       &projectID,
+		PermissionType:  constants.PERM_PROJECT,
+		PermissionLevel: permissionLevel,
+	})
+
+	// Get permission
+	var data string
+	if errCode, err := helpers.SendAndParseResponseData(agent, &data, token, refreshToken); err != nil {
+		// Only denials are cached, other errors are worth retrying
+		if userID != "" && (errCode == constants.ERR_COMMON_PERMISSION_NOT_FOUND || errCode == constants.ERR_COMMON_PERMISSION_NOT_ALLOWED) {
+			getPermissionCache().SetWithTTL(cacheKey, permissionDecision{ErrCode: errCode, Error: err.Error()}, getPermissionCacheNegativeTTL())
+		}
+		return errCode, err
+	}
+
+	// Permission denied then return denied
+	if data != "Granted" {
+		if userID != "" {
+			getPermissionCache().SetWithTTL(cacheKey, permissionDecision{ErrCode: constants.ERR_COMMON_PERMISSION_NOT_ALLOWED, Error: "no permission"}, getPermissionCacheNegativeTTL())
+		}
+		return constants.ERR_COMMON_PERMISSION_NOT_ALLOWED, errors.New("no permission")
+	}
+
+	if userID != "" {
+		getPermissionCache().Set(cacheKey, permissionDecision{})
+	}
+	return 0, nil
+}
+
+func getPermissionCacheNegativeTTL() time.Duration {
+	return time.Duration(getEnvInt("PERMISSION_CACHE_NEGATIVE_TTL", 30)) * time.Second
+}
+
+// invalidatePermissions removes cached decisions of a user and/or a project, everything if both are empty
+func invalidatePermissions(userID string, projectID *uuid.UUID) int {
+	return getPermissionCache().DeleteFunc(func(key permissionCacheKey) bool {
+		return (userID == "" || key.UserID == userID) && (projectID == nil || key.ProjectID == *projectID)
+	})
+}
+
+// checkProjectPermission allows root users and users with the permission level on the project,
+// an empty level allows root users only
+func checkProjectPermission(c *fiber.Ctx, projectID uuid.UUID, permissionLevel string) error {
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	if isRoot, _ := claims["is_root"].(bool); isRoot {
+		return nil
+	}
+	if permissionLevel == "" {
+		return errors.New("root only")
+	}
+
+	_, err := callValidatePermission(helpers.GetUserID(c), projectID, permissionLevel, c.Cookies("token"), c.Cookies("refreshToken"))
+	return err
+}
+
+// getDeleteIterationPermissionLevel returns the level needed to delete iterations from
+// DELETE_ITERATION_PERMISSION_LEVEL, "root" (default), "edit" or "view"
+func getDeleteIterationPermissionLevel() string {
+	switch os.Getenv("DELETE_ITERATION_PERMISSION_LEVEL") {
+	case constants.PERM_LEVEL_EDIT:
+		return constants.PERM_LEVEL_EDIT
+	case constants.PERM_LEVEL_VIEW:
+		return constants.PERM_LEVEL_VIEW
+	default:
+		return ""
+	}
+}
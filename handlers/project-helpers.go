@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"filemanager/common/cache"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Projects never move to another company and iterations never move to another project,
+// so the answers of the project service are cached to check download urls
+var (
+	projectCompanyCache     *cache.Cache[uuid.UUID, string]
+	iterationProjectCache   *cache.Cache[uuid.UUID, uuid.UUID]
+	projectServiceCacheOnce sync.Once
+)
+
+// initProjectServiceCaches creates the caches, PROJECT_CACHE_SIZE entries (default 10000)
+// kept PROJECT_CACHE_TTL seconds (default 600). Created on first use, after the environment is loaded
+func initProjectServiceCaches() {
+	projectServiceCacheOnce.Do(func() {
+		size := getEnvInt("PROJECT_CACHE_SIZE", 10000)
+		ttl := time.Duration(getEnvInt("PROJECT_CACHE_TTL", 600)) * time.Second
+		projectCompanyCache = cache.New[uuid.UUID, string](size, ttl)
+		iterationProjectCache = cache.New[uuid.UUID, uuid.UUID](size, ttl)
+	})
+}
+
+// getCachedCompanyIDFromProjectID returns the company a project belongs to
+func getCachedCompanyIDFromProjectID(projectID uuid.UUID, token, refreshToken string) (string, int, error) {
+	initProjectServiceCaches()
+	if companyID, exist := projectCompanyCache.Get(projectID); exist {
+		return companyID, 0, nil
+	}
+
+	companyID, errCode, err := callGetCompanyIDFromProjectID(projectID, token, refreshToken)
+	if err != nil {
+		return "", errCode, err
+	}
+	projectCompanyCache.Set(projectID, companyID)
+	return companyID, 0, nil
+}
+
+// getCachedProjectIDFromIterationID returns the project an iteration belongs to
+func getCachedProjectIDFromIterationID(iterationID uuid.UUID, token, refreshToken string) (uuid.UUID, int, error) {
+	initProjectServiceCaches()
+	if projectID, exist := iterationProjectCache.Get(iterationID); exist {
+		return projectID, 0, nil
+	}
+
+	iteration, errCode, err := callGetProjectIteration(iterationID.String(), token, refreshToken)
+	if err != nil {
+		return uuid.Nil, errCode, err
+	}
+	iterationProjectCache.Set(iterationID, iteration.ProjectID)
+	return iteration.ProjectID, 0, nil
+}
+
+// forgetIteration drops a deleted iteration from the cache
+func forgetIteration(iterationID uuid.UUID) {
+	initProjectServiceCaches()
+	iterationProjectCache.Delete(iterationID)
+}
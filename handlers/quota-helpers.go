@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"filemanager/archive"
+	"filemanager/storage"
+	"filemanager/usage"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// quotaConfig is the QUOTA_FILE, limits are in MB and 0 means unlimited
+//
+//	{"default_limit": 102400, "companies": {"<company id>": 204800}}
+type quotaConfig struct {
+	DefaultLimit int64            `json:"default_limit"`
+	Companies    map[string]int64 `json:"companies"`
+}
+
+var (
+	quotas        quotaConfig
+	quotasModTime time.Time
+	quotasLock    sync.Mutex
+)
+
+// getCompanyQuota returns a company's storage limit in bytes, 0 when unlimited. Limits come from
+// QUOTA_FILE, reloaded whenever it changes, else from QUOTA_DEFAULT_LIMIT (MB)
+func getCompanyQuota(companyID string) int64 {
+	quotasLock.Lock()
+	defer quotasLock.Unlock()
+
+	if quotaFile := os.Getenv("QUOTA_FILE"); quotaFile != "" {
+		if info, err := os.Stat(quotaFile); err != nil {
+			log.Error(fmt.Sprintf("Failed to read quota file: %v", err))
+		} else if !info.ModTime().Equal(quotasModTime) {
+			var config quotaConfig
+			if data, err := os.ReadFile(quotaFile); err != nil {
+				log.Error(fmt.Sprintf("Failed to read quota file: %v", err))
+			} else if err := json.Unmarshal(data, &config); err != nil {
+				log.Error(fmt.Sprintf("Failed to parse quota file: %v", err))
+			} else {
+				quotas = config
+				quotasModTime = info.ModTime()
+			}
+		}
+	} else {
+		quotas = quotaConfig{DefaultLimit: int64(getEnvInt("QUOTA_DEFAULT_LIMIT", 0))}
+	}
+
+	if limit, exist := quotas.Companies[companyID]; exist {
+		return limit * 1024 * 1024
+	}
+	return quotas.DefaultLimit * 1024 * 1024
+}
+
+// Quotas of the companies with running jobs, shared by their jobs so that together they stay
+// within it. A company's is dropped with its last job, the next starts again from the tracked usage
+var (
+	companyBudgets     = map[string]*companyBudget{}
+	companyBudgetsLock sync.Mutex
+)
+
+type companyBudget struct {
+	shared *archive.Budget
+	jobs   int
+}
+
+// getCompanyBudget reserves what a job may extract of its company's quota, nil when unlimited.
+// Layers about to be replaced give their bytes back to this job only, or when versions are kept the
+// versions pruned to make room for them. Uploads are refused early when their archives alone are
+// larger than what is left. The budget is released by releaseCompanyBudget
+func getCompanyBudget(companyID string, files []*layerFile, replacedLayers []string) (*archive.Budget, error) {
+	limit := getCompanyQuota(companyID)
+	if limit == 0 {
+		return nil, nil
+	}
+
+	layerSizes, err := usage.Get().Layers(companyID)
+	if err != nil {
+		return nil, err
+	}
+	var replaced int64
+	for _, layerKey := range replacedLayers {
+		replaced += replacedLayerSize(layerSizes, layerKey)
+	}
+
+	companyBudgetsLock.Lock()
+	defer companyBudgetsLock.Unlock()
+
+	company, exist := companyBudgets[companyID]
+	if !exist {
+		used, err := usage.Get().Total(companyID)
+		if err != nil {
+			return nil, err
+		}
+		company = &companyBudget{shared: archive.NewBudget(limit - used)}
+	}
+	budget := archive.NewSharedBudget(replaced, company.shared)
+
+	var declared int64
+	for _, file := range files {
+		if file != nil {
+			declared += file.Size
+		}
+	}
+	if remaining := budget.Remaining(); declared > remaining {
+		return nil, fmt.Errorf("%w: %d of %d bytes left", archive.ErrBudgetExceeded, max(remaining, 0), limit)
+	}
+
+	company.jobs++
+	companyBudgets[companyID] = company
+	return budget, nil
+}
+
+// releaseCompanyBudget ends a job's reservation. What it extracted is given back to the company
+// unless kept, kept files stay reserved until the company's jobs are done and they are in the usage
+func releaseCompanyBudget(companyID string, budget *archive.Budget, kept bool) {
+	if budget == nil {
+		return
+	}
+	if !kept {
+		budget.Release()
+	}
+
+	companyBudgetsLock.Lock()
+	defer companyBudgetsLock.Unlock()
+	if company, exist := companyBudgets[companyID]; exist {
+		company.jobs--
+		if company.jobs <= 0 {
+			delete(companyBudgets, companyID)
+		}
+	}
+}
+
+// replacedLayerSize returns the bytes freed once a layer is replaced: the layer itself when no version
+// is kept, else its oldest versions past the count limit, the layer taking one's place
+func replacedLayerSize(layerSizes map[string]int64, layerKey string) int64 {
+	layerSize, exist := layerSizes[layerKey]
+	if !exist {
+		return 0
+	}
+	maxCount, _ := getLayerVersionLimits()
+	if maxCount == 0 {
+		return layerSize
+	}
+
+	// Version IDs are fixed width, sorting their keys sorts them by when they were replaced
+	versionsKey := layerVersionsKey(path.Dir(layerKey), path.Base(layerKey)) + "/"
+	var versionKeys []string
+	for key := range layerSizes {
+		if strings.HasPrefix(key, versionsKey) {
+			versionKeys = append(versionKeys, key)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(versionKeys)))
+
+	var size int64
+	for i := maxCount - 1; i < len(versionKeys); i++ {
+		size += layerSizes[versionKeys[i]]
+	}
+	return size
+}
+
+// refreshIterationUsage updates the tracked usage of an iteration's layers and their versions after
+// they changed. Layer sizes come from their manifest, layers without one are walked
+func refreshIterationUsage(backend storage.Backend, iterationKey string) {
+	iterationKey = storage.CleanKey(iterationKey)
+	layerSizes := map[string]int64{}
+	if err := iterationSavedFileSize(backend, iterationKey, layerSizes); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Error(fmt.Sprintf("Failed to refresh usage of %s: %v", iterationKey, err))
+		return
+	}
+
+	if err := usage.Get().SetLayers(iterationKey, layerSizes); err != nil {
+		log.Error(fmt.Sprintf("Failed to refresh usage of %s: %v", iterationKey, err))
+	}
+}
+
+// iterationSavedFileSize adds the size of every layer of an iteration to layerSizes, along with the size of
+// every version of its layers. Versions count against the quota until they are pruned, like the layers
+func iterationSavedFileSize(backend storage.Backend, iterationKey string, layerSizes map[string]int64) error {
+	layers, err := listDirectories(backend, iterationKey)
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		size, err := layerSavedFileSize(backend, layer.Key)
+		if err != nil {
+			return err
+		}
+		layerSizes[layer.Key] = size
+	}
+
+	for _, layer := range iterationLayers {
+		versions, err := backend.List(layerVersionsKey(iterationKey, layer))
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, version := range versions {
+			if !version.IsDir {
+				continue
+			}
+			size, err := layerSavedFileSize(backend, version.Key)
+			if err != nil {
+				return err
+			}
+			layerSizes[version.Key] = size
+		}
+	}
+	return nil
+}
+
+func layerSavedFileSize(backend storage.Backend, layerKey string) (int64, error) {
+	manifest, err := getLayerManifest(backend, layerKey)
+	if err != nil {
+		return 0, err
+	}
+	if manifest == nil {
+		var size int64
+		err := storage.Walk(backend, layerKey, func(info storage.ObjectInfo) error {
+			size += info.Size
+			return nil
+		})
+		return size, err
+	}
+
+	// The manifest, metadata and vector tiles are stored in the layer too, diffs are not counted
+	var size int64
+	diffsKey := layerDiffsKey(layerKey)
+	err = storage.Walk(backend, storage.Join(layerKey, layerMetadataDirectory), func(info storage.ObjectInfo) error {
+		if !strings.HasPrefix(info.Key, diffsKey+"/") {
+			size += info.Size
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return 0, err
+	}
+	for _, file := range manifest.Files {
+		size += file.Size
+	}
+	return size, nil
+}
+
+// iterationKeyOf returns the company/project/iteration a key is in, empty above iterations
+func iterationKeyOf(key string) string {
+	segments := strings.SplitN(storage.CleanKey(key), "/", 4)
+	if len(segments) < 3 {
+		return ""
+	}
+	return path.Join(segments[:3]...)
+}
+
+// VerifyStorageUsage recounts the usage of every company from its files at start and then every
+// interval, correcting whatever incremental tracking missed
+func VerifyStorageUsage(interval time.Duration) {
+	for {
+		verifyStorageUsage(storage.GetBackend())
+		time.Sleep(interval)
+	}
+}
+
+func verifyStorageUsage(backend storage.Backend) {
+	companies, err := backend.List("")
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to verify storage usage: %v", err))
+		return
+	}
+
+	onStorage := map[string]bool{}
+	for _, company := range companies {
+		if !company.IsDir || strings.HasPrefix(company.Key, ".") {
+			continue
+		}
+		onStorage[company.Key] = true
+
+		tracked, _ := usage.Get().Total(company.Key)
+		layerSizes, err := companySavedFileSize(backend, company.Key)
+		if err != nil {
+			log.Error(fmt.Sprintf("Failed to verify storage usage of %s: %v", company.Key, err))
+			continue
+		}
+		var size int64
+		for _, layerSize := range layerSizes {
+			size += layerSize
+		}
+		if tracked != size {
+			log.Info(fmt.Sprintf("Corrected storage usage of %s from %d to %d bytes", company.Key, tracked, size))
+		}
+		if err := usage.Get().Verified(company.Key, layerSizes); err != nil {
+			log.Error(fmt.Sprintf("Failed to save storage usage of %s: %v", company.Key, err))
+		}
+	}
+
+	// Companies whose files are all gone
+	trackedCompanies, err := usage.Get().Companies()
+	if err != nil {
+		log.Error(fmt.Sprintf("Failed to verify storage usage: %v", err))
+		return
+	}
+	for _, companyID := range trackedCompanies {
+		if !onStorage[companyID] {
+			usage.Get().Forget(companyID)
+		}
+	}
+}
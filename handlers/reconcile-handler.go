@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/models/response"
+	"filemanager/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Reconcile compares stored iteration directories with the project service, reporting orphan
+// directories, leftover temporary directories of failed edits and urls of missing layers.
+// Params
+// dry_run: query, "false" to fix what is reported, defaults to only reporting
+func Reconcile(c *fiber.Ctx) error {
+	// Get info from token
+	userLocal := c.Locals("user").(*jwt.Token)
+	claims := userLocal.Claims.(jwt.MapClaims)
+	isRoot := claims["is_root"].(bool)
+	token := c.Cookies("token")
+	refreshToken := c.Cookies("refreshToken")
+
+	// Only allow root to reconcile
+	if !isRoot {
+		helpers.BadRequest(c, "no permission to reconcile", constants.ERR_COMMON_PERMISSION_NOT_ALLOWED)
+		return nil
+	}
+
+	report, err := RunReconcile(c.Query("dry_run") != "false", token, refreshToken)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	c.Status(200)
+	c.JSON(response.BaseResponse{
+		Data: report,
+		Meta: struct{ Status int }{Status: 200},
+	})
+	return nil
+}
+
+// CollectBlobs prunes the layer versions past their limits, then deletes the stored blobs no manifest
+// references anymore, files of deleted or replaced layers which no other iteration or version shares.
+// Blobs stored less than BLOB_COLLECT_GRACE_PERIOD hours ago are kept. It also runs every BLOB_COLLECT_INTERVAL hours
+func CollectBlobs(c *fiber.Ctx) error {
+	// Get info from token
+	userLocal := c.Locals("user").(*jwt.Token)
+	claims := userLocal.Claims.(jwt.MapClaims)
+	isRoot := claims["is_root"].(bool)
+
+	// Only allow root to collect blobs
+	if !isRoot {
+		helpers.BadRequest(c, "no permission to collect blobs", constants.ERR_COMMON_PERMISSION_NOT_ALLOWED)
+		return nil
+	}
+
+	backend := storage.GetBackend()
+	pruned, err := pruneExpiredLayerVersions(backend)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+	collected, freed, err := collectUnusedBlobs(backend)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	c.Status(200)
+	c.JSON(response.BaseResponse{
+		Data: response.BlobCollectionReport{
+			PrunedVersions: pruned,
+			Collected:      collected,
+			FreedBytes:     freed,
+		},
+		Meta: struct{ Status int }{Status: 200},
+	})
+	return nil
+}
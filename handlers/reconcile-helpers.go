@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"filemanager/common/constants"
+	"filemanager/models/request"
+	"filemanager/models/response"
+	"filemanager/storage"
+	"path"
+	"strings"
+
+	"github.com/devfeel/mapper"
+	"github.com/google/uuid"
+)
+
+// iterationLayers are the layers an iteration record has an url for
+var iterationLayers = []string{"geojson", "tile_3d", "ortho_photo"}
+
+// reconciler compares the company/project/iteration directories of the storage with the
+// iteration records of the project service. In dry run it only reports, else it fixes what it reports
+type reconciler struct {
+	backend      storage.Backend
+	dryRun       bool
+	token        string
+	refreshToken string
+	report       response.ReconcileReport
+}
+
+// RunReconcile checks every iteration directory of the storage, deleting orphan and temporary
+// directories and clearing urls of missing layers unless dryRun
+func RunReconcile(dryRun bool, token, refreshToken string) (response.ReconcileReport, error) {
+	r := &reconciler{
+		backend:      storage.GetBackend(),
+		dryRun:       dryRun,
+		token:        token,
+		refreshToken: refreshToken,
+		report:       response.ReconcileReport{DryRun: dryRun, Issues: []response.ReconcileIssue{}},
+	}
+
+	companies, err := r.backend.List("")
+	if err != nil {
+		return r.report, err
+	}
+	for _, company := range companies {
+		if !r.checkDirectory(company) {
+			continue
+		}
+		projects, err := r.backend.List(company.Key)
+		if err != nil {
+			return r.report, err
+		}
+
+		for _, project := range projects {
+			if !r.checkDirectory(project) {
+				continue
+			}
+			projectID, err := uuid.Parse(path.Base(project.Key))
+			if err != nil {
+				r.addIssue(response.ReconcileIssue{Kind: response.ReconcileUnknownDirectory, Path: project.Key}, nil)
+				continue
+			}
+			iterations, err := r.backend.List(project.Key)
+			if err != nil {
+				return r.report, err
+			}
+
+			for _, iteration := range iterations {
+				if !r.checkDirectory(iteration) {
+					continue
+				}
+				r.checkIteration(path.Base(company.Key), projectID, iteration.Key)
+			}
+		}
+	}
+
+	return r.report, nil
+}
+
+// checkDirectory reports if an entry is a directory to descend into. Dot directories belong to
+// the file manager itself and are skipped, files are reported as unknown
+func (r *reconciler) checkDirectory(info storage.ObjectInfo) bool {
+	if strings.HasPrefix(path.Base(info.Key), ".") {
+		return false
+	}
+	if !info.IsDir {
+		r.addIssue(response.ReconcileIssue{Kind: response.ReconcileUnknownDirectory, Path: info.Key}, nil)
+		return false
+	}
+	return true
+}
+
+func (r *reconciler) checkIteration(companyID string, projectID uuid.UUID, iterationKey string) {
+	iterationID, err := uuid.Parse(path.Base(iterationKey))
+	if err != nil {
+		r.addIssue(response.ReconcileIssue{Kind: response.ReconcileUnknownDirectory, Path: iterationKey}, nil)
+		return
+	}
+
+	// Iterations being created, updated or deleted are skipped, their files are in flux. The journal is
+	// read again for every iteration and no change begins until the iteration is checked and fixed
+	lock := getIterationLock(iterationID)
+	lock.Lock()
+	defer lock.Unlock()
+	busy, err := busyIterations()
+	if err != nil {
+		r.addIssue(response.ReconcileIssue{Kind: response.ReconcileCheckFailed, Path: iterationKey, IterationID: iterationID.String(), Error: err.Error()}, nil)
+		return
+	}
+	if busy[iterationID] {
+		r.report.SkippedIterations++
+		return
+	}
+	r.report.CheckedIterations++
+
+	// No record, or a record of another project or company, nothing can link to this directory
+	orphan := response.ReconcileIssue{Kind: response.ReconcileOrphanDirectory, Path: iterationKey, IterationID: iterationID.String()}
+	iteration, errCode, err := callGetProjectIteration(iterationID.String(), r.token, r.refreshToken)
+	if err != nil {
+		if errCode == constants.ERR_PROJECT_ITERATION_NOT_FOUND {
+			r.addIssue(orphan, r.deleteDirectory(iterationKey))
+		} else {
+			r.addIssue(response.ReconcileIssue{Kind: response.ReconcileCheckFailed, Path: iterationKey, IterationID: iterationID.String(), Error: err.Error()}, nil)
+		}
+		return
+	}
+	if iteration.ProjectID != projectID {
+		r.addIssue(orphan, r.deleteDirectory(iterationKey))
+		return
+	}
+	realCompanyID, _, err := getCachedCompanyIDFromProjectID(projectID, r.token, r.refreshToken)
+	if err != nil {
+		r.addIssue(response.ReconcileIssue{Kind: response.ReconcileCheckFailed, Path: iterationKey, IterationID: iterationID.String(), Error: err.Error()}, nil)
+		return
+	} else if realCompanyID != companyID {
+		r.addIssue(orphan, r.deleteDirectory(iterationKey))
+		return
+	}
+
+	// Leftovers of failed edits and layers the record has no url for
+	urls := map[string]*string{
+		"geojson":     iteration.GeoJSONURL,
+		"tile_3d":     iteration.Tile3DURL,
+		"ortho_photo": iteration.OrthoPhotoURL,
+	}
+	layers, err := r.backend.List(iterationKey)
+	if err != nil {
+		r.addIssue(response.ReconcileIssue{Kind: response.ReconcileCheckFailed, Path: iterationKey, IterationID: iterationID.String(), Error: err.Error()}, nil)
+		return
+	}
+	for _, layer := range layers {
+		layerName := path.Base(layer.Key)
+		if strings.HasPrefix(layerName, ".") {
+			continue
+		}
+
+		if strings.HasSuffix(layerName, "_temp") {
+			r.addIssue(response.ReconcileIssue{Kind: response.ReconcileTempDirectory, Path: layer.Key, IterationID: iterationID.String(), Layer: strings.TrimSuffix(layerName, "_temp")},
+				r.deleteDirectory(layer.Key))
+		} else if url, known := urls[layerName]; known && url == nil {
+			r.addIssue(response.ReconcileIssue{Kind: response.ReconcileOrphanLayer, Path: layer.Key, IterationID: iterationID.String(), Layer: layerName},
+				r.deleteDirectory(layer.Key))
+		}
+	}
+
+	// Urls of layers without any file
+	var dangling []string
+	for _, layer := range iterationLayers {
+		if urls[layer] == nil {
+			continue
+		}
+		hasFiles, err := r.hasFiles(*urls[layer])
+		if err != nil {
+			r.addIssue(response.ReconcileIssue{Kind: response.ReconcileCheckFailed, Path: *urls[layer], IterationID: iterationID.String(), Layer: layer, Error: err.Error()}, nil)
+		} else if !hasFiles {
+			dangling = append(dangling, layer)
+		}
+	}
+	if len(dangling) > 0 {
+		fixErr := r.clearURLs(iteration, dangling)
+		for _, layer := range dangling {
+			r.addIssue(response.ReconcileIssue{Kind: response.ReconcileDanglingURL, Path: *urls[layer], IterationID: iterationID.String(), Layer: layer}, fixErr)
+		}
+	}
+}
+
+// hasFiles reports if a layer url has at least one file, listed in its manifest or besides the layer's metadata
+func (r *reconciler) hasFiles(url string) (bool, error) {
+	files, err := listLayerFiles(r.backend, url)
+	return len(files) > 0, err
+}
+
+func (r *reconciler) deleteDirectory(key string) error {
+	if r.dryRun {
+		return nil
+	}
+	if err := deleteLayerFiles(r.backend, key); err != nil {
+		return err
+	}
+	invalidateManifests(key)
+	if iterationKey := iterationKeyOf(key); iterationKey != "" {
+		refreshIterationUsage(r.backend, iterationKey)
+	}
+	return nil
+}
+
+// clearURLs sets the url and file name of layers to null on the iteration record
+func (r *reconciler) clearURLs(iteration response.IterationResponse, layers []string) error {
+	if r.dryRun {
+		return nil
+	}
+
+	var updateRequest request.UpdateIterationRequest
+	updateRequest.ID = iteration.ID
+	mapper.Mapper(&iteration, &updateRequest)
+	for _, layer := range layers {
+		setLayerRecord(&updateRequest, layer, nil, nil)
+	}
+
+	_, _, err := callUpdateProjectIteration(updateRequest, r.token, r.refreshToken)
+	return err
+}
+
+// addIssue reports an issue, fixed unless in dry run or the fix failed
+func (r *reconciler) addIssue(issue response.ReconcileIssue, fixErr error) {
+	if issue.Kind != response.ReconcileUnknownDirectory && issue.Kind != response.ReconcileCheckFailed && !r.dryRun {
+		if fixErr != nil {
+			issue.Error = fixErr.Error()
+		} else {
+			issue.Fixed = true
+		}
+	}
+	r.report.Issues = append(r.report.Issues, issue)
+}
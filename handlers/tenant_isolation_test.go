@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"filemanager/common/constants"
+	"filemanager/models/response"
+	"filemanager/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// fakeServices answers the project and user services for fixed companies, projects, iterations and permissions.
+// Users are identified by their token, which is their ID
+type fakeServices struct {
+	projectCompanies  map[uuid.UUID]string
+	iterationProjects map[uuid.UUID]uuid.UUID
+	viewers           map[uuid.UUID][]string
+}
+
+func (f *fakeServices) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ID        string     `json:"id"`
+		ProjectID *uuid.UUID `json:"project_id"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	cookie, _ := r.Cookie("token")
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, constants.ProjectGetCompanyIDByProjectID):
+		if companyID, exist := f.projectCompanies[uuid.MustParse(body.ID)]; exist {
+			writeFakeData(w, companyID)
+			return
+		}
+		writeFakeError(w, constants.ERR_PROJECT_NOT_FOUND)
+
+	case strings.HasSuffix(r.URL.Path, constants.ProjectIterationGet):
+		iterationID := uuid.MustParse(body.ID)
+		if projectID, exist := f.iterationProjects[iterationID]; exist {
+			iteration := response.IterationResponse{ProjectID: projectID}
+			iteration.ID = iterationID
+			writeFakeData(w, iteration)
+			return
+		}
+		writeFakeError(w, constants.ERR_PROJECT_ITERATION_NOT_FOUND)
+
+	case strings.HasSuffix(r.URL.Path, constants.PermissionValidate):
+		for _, viewer := range f.viewers[*body.ProjectID] {
+			if cookie != nil && viewer == cookie.Value {
+				writeFakeData(w, "Granted")
+				return
+			}
+		}
+		writeFakeError(w, constants.ERR_COMMON_PERMISSION_NOT_ALLOWED)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeFakeData(w http.ResponseWriter, data any) {
+	json.NewEncoder(w).Encode(response.BaseResponse{Data: data})
+}
+
+func writeFakeError(w http.ResponseWriter, errCode int) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(response.ErrorResponse{ErrorCode: errCode, Error: "fake error"})
+}
+
+// tenantFixture is two companies with a project and an iteration each, alice views the first one
+// and bob the second one. Bob's iteration has a secret file stored as a blob and its manifest
+type tenantFixture struct {
+	app                                 *fiber.App
+	companyA, companyB                  string
+	projectA, projectB                  uuid.UUID
+	iterationA, iterationB              uuid.UUID
+	secret, secretSHA256, secretBlobKey string
+}
+
+func newTenantFixture(t *testing.T) *tenantFixture {
+	f := &tenantFixture{
+		companyA:   "company-" + uuid.NewString(),
+		companyB:   "company-" + uuid.NewString(),
+		projectA:   uuid.New(),
+		projectB:   uuid.New(),
+		iterationA: uuid.New(),
+		iterationB: uuid.New(),
+		secret:     `{"type":"FeatureCollection","features":[],"secret":true}`,
+	}
+
+	services := httptest.NewServer(&fakeServices{
+		projectCompanies:  map[uuid.UUID]string{f.projectA: f.companyA, f.projectB: f.companyB},
+		iterationProjects: map[uuid.UUID]uuid.UUID{f.iterationA: f.projectA, f.iterationB: f.projectB},
+		viewers:           map[uuid.UUID][]string{f.projectA: {"alice"}, f.projectB: {"bob"}},
+	})
+	t.Cleanup(services.Close)
+	servicesURL, _ := url.Parse(services.URL)
+	for _, service := range []string{"PROJECT", "USER"} {
+		t.Setenv(service+"_SERVICE_HOST", servicesURL.Scheme+"://"+servicesURL.Hostname())
+		t.Setenv(service+"_SERVICE_PORT", servicesURL.Port())
+	}
+
+	backend := storage.NewMemoryBackend()
+	storage.SetBackend(backend)
+	t.Cleanup(func() { storage.SetBackend(nil) })
+
+	// Alice's iteration was uploaded before manifests were kept, its files are read from the layer
+	iterationKeyA := storage.Join(f.companyA, f.projectA.String(), f.iterationA.String())
+	putString(t, backend, storage.Join(iterationKeyA, "geojson", "public.geojson"), `{"type":"FeatureCollection","features":[]}`)
+
+	// Bob's secret is a blob listed in the layer's manifest
+	layerKeyB := storage.Join(f.companyB, f.projectB.String(), f.iterationB.String(), "geojson")
+	sum := sha256.Sum256([]byte(f.secret))
+	f.secretSHA256 = hex.EncodeToString(sum[:])
+	f.secretBlobKey = blobKey(layerKeyB, f.secretSHA256)
+	putString(t, backend, f.secretBlobKey, f.secret)
+	manifest := &layerManifest{Layer: "geojson"}
+	manifest.add(manifestFile{Path: "secret.geojson", Size: int64(len(f.secret)), SHA256: f.secretSHA256, Blob: true})
+	if err := writeLayerManifest(backend, layerKeyB, manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens are checked by the JWT middleware, only the claims it leaves matter here
+	f.app = fiber.New()
+	f.app.Use(func(c *fiber.Ctx) error {
+		c.Locals("user", &jwt.Token{Claims: jwt.MapClaims{"user_id": c.Cookies("token"), "is_root": false}})
+		return c.Next()
+	})
+	f.app.Get("/project/:companyID/:projectID/:iterationID/metadata", GetIterationMetadata)
+	f.app.Get("/project/:companyID/:projectID/:iterationID/archive", GetIterationArchive)
+	f.app.Get("/project/:companyID/:projectID/:iterationID/files", GetIterationFiles)
+	f.app.Get("/project/:companyID/:projectID/:iterationID/versions/:layer", GetLayerVersions)
+	f.app.Get("/project/:companyID/:projectID/:iterationID/*", GetProjectFile)
+	return f
+}
+
+// get requests a raw path as a user, the path is sent as is without being cleaned
+func (f *tenantFixture) get(t *testing.T, user, rawPath string) (int, string) {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.URL = &url.URL{Path: rawPath, RawPath: rawPath}
+	request.RequestURI = rawPath
+	request.AddCookie(&http.Cookie{Name: "token", Value: user})
+	request.AddCookie(&http.Cookie{Name: "refreshToken", Value: user})
+
+	resp, err := f.app.Test(request, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func (f *tenantFixture) iterationPath(companyID string, projectID, iterationID uuid.UUID) string {
+	return "/project/" + companyID + "/" + projectID.String() + "/" + iterationID.String()
+}
+
+func putString(t *testing.T, backend storage.Backend, key, content string) {
+	t.Helper()
+	if err := backend.Put(key, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTenantIsolationOwnFiles(t *testing.T) {
+	f := newTenantFixture(t)
+
+	status, body := f.get(t, "alice", f.iterationPath(f.companyA, f.projectA, f.iterationA)+"/geojson/public.geojson")
+	if status != fiber.StatusOK || !strings.Contains(body, "FeatureCollection") {
+		t.Errorf("alice reading her own file got %d %s", status, body)
+	}
+	status, body = f.get(t, "bob", f.iterationPath(f.companyB, f.projectB, f.iterationB)+"/geojson/secret.geojson")
+	if status != fiber.StatusOK || body != f.secret {
+		t.Errorf("bob reading his own blob got %d %s", status, body)
+	}
+}
+
+func TestTenantIsolationURLs(t *testing.T) {
+	f := newTenantFixture(t)
+
+	// Every way alice could name bob's iteration in a url, none may answer its files
+	for _, test := range []struct {
+		name string
+		path string
+	}{
+		{"other project", f.iterationPath(f.companyB, f.projectB, f.iterationB)},
+		{"other company", f.iterationPath(f.companyB, f.projectA, f.iterationA)},
+		{"other iteration", f.iterationPath(f.companyA, f.projectA, f.iterationB)},
+		{"other company and iteration", f.iterationPath(f.companyB, f.projectA, f.iterationB)},
+		{"unknown iteration", f.iterationPath(f.companyA, f.projectA, uuid.New())},
+	} {
+		for _, endpoint := range []string{"/geojson/secret.geojson", "/files", "/metadata", "/archive", "/versions/geojson"} {
+			status, body := f.get(t, "alice", test.path+endpoint)
+			if status != fiber.StatusBadRequest || strings.Contains(body, "secret") {
+				t.Errorf("%s %s: got %d %s", test.name, endpoint, status, body)
+			}
+		}
+	}
+}
+
+func TestTenantIsolationTraversal(t *testing.T) {
+	f := newTenantFixture(t)
+
+	// Paths starting in alice's iteration and climbing to bob's, through a layer without
+	// manifest whose files are looked up in the storage directly
+	ownIteration := f.iterationPath(f.companyA, f.projectA, f.iterationA)
+	otherIteration := f.companyB + "/" + f.projectB.String() + "/" + f.iterationB.String()
+	otherBlob := strings.TrimPrefix(f.secretBlobKey, f.companyB+"/"+f.projectB.String()+"/")
+	for _, rawPath := range []string{
+		"/x/%2e%2e/%2e%2e/%2e%2e/%2e%2e/" + otherIteration + "/geojson/secret.geojson",
+		"/x/%2E%2E/%2E%2E/%2E%2E/%2E%2E/" + otherIteration + "/geojson/.filemanager/manifest.json",
+		"/x/.%2e/.%2e/%2e./%2e./" + otherIteration + "/geojson/.filemanager/manifest.json",
+		"/x/..%2f..%2f..%2f..%2f" + otherIteration + "/geojson/.filemanager/manifest.json",
+		"/x/..%5c..%5c..%5c..%5c" + otherIteration + "/geojson/.filemanager/manifest.json",
+		"/geojson/%2e%2e/%2e%2e/%2e%2e/%2e%2e/" + f.companyB + "/" + f.projectB.String() + "/" + otherBlob,
+		"/geojson/%2e%2e/%2e%2e/%2e%2e/" + f.projectB.String() + "/" + otherBlob,
+		"/geojson/%2e%2e/%2e%2e/" + f.iterationB.String() + "/geojson/.filemanager/manifest.json",
+		"/%2e%2e/" + f.iterationB.String() + "/geojson/.filemanager/manifest.json",
+		"/%2e%2e",
+		"/%252e%252e/%252e%252e/%252e%252e/" + otherIteration + "/geojson/.filemanager/manifest.json",
+	} {
+		status, body := f.get(t, "alice", ownIteration+rawPath)
+		if status == fiber.StatusOK || strings.Contains(body, "secret") || strings.Contains(body, f.secretSHA256) {
+			t.Errorf("%s: got %d %s", rawPath, status, body)
+		}
+	}
+
+	// The layer's metadata is never served, even in the user's own iteration
+	status, _ := f.get(t, "bob", f.iterationPath(f.companyB, f.projectB, f.iterationB)+"/geojson/.filemanager/manifest.json")
+	if status != fiber.StatusNotFound {
+		t.Errorf("manifest of an own layer: got %d", status)
+	}
+}
+
+func TestIterationFileKey(t *testing.T) {
+	for _, test := range []struct {
+		rawPath string
+		want    string
+		ok      bool
+	}{
+		{"geojson/a.geojson", "c/p/i/geojson/a.geojson", true},
+		{"geojson/dir/./a.geojson", "c/p/i/geojson/dir/a.geojson", true},
+		{"geojson//a%20b.geojson", "c/p/i/geojson/a b.geojson", true},
+		{"geojson/..a/b..", "c/p/i/geojson/..a/b..", true},
+		{"geojson/../tile_3d/a.b3dm", "", false},
+		{"geojson/%2e%2e/%2e%2e/other", "", false},
+		{"geojson/..%2f..%2fother", "", false},
+		{"geojson\\..\\..\\other", "", false},
+		{"%zz", "", false},
+		{"", "", false},
+		{".", "", false},
+	} {
+		key, ok := iterationFileKey("c/p/i", test.rawPath)
+		if key != test.want || ok != test.ok {
+			t.Errorf("%q: got %q %v, want %q %v", test.rawPath, key, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/maptile"
+	"filemanager/storage"
+	"fmt"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// GetOrthoPhotoTile returns a 256 pixel PNG map tile in Web Mercator rendered from the ortho photos of an
+// iteration, XYZ numbered. Tiles are cached on disk until the layer is replaced or the cache is full, tiles
+// outside of the images are transparent and tiles far past their resolution are not found
+// Params
+// companyID: ID of the company
+// projectID: ID of the project
+// iterationID: ID of the iteration
+// z: zoom of the tile
+// x: column of the tile, from the west
+// y: row of the tile, from the north
+func GetOrthoPhotoTile(c *fiber.Ctx) error {
+	projectID, iterationID, ok := checkIterationURL(c)
+	if !ok {
+		return nil
+	}
+
+	z, zErr := strconv.Atoi(c.Params("z"))
+	x, xErr := strconv.Atoi(c.Params("x"))
+	y, yErr := strconv.Atoi(c.Params("y"))
+	if zErr != nil || xErr != nil || yErr != nil || !maptile.Valid(z, x, y) {
+		return c.Status(fiber.StatusNotFound).SendString("Tile not found")
+	}
+
+	backend := storage.GetBackend()
+	layerKey := storage.Join(c.Params("companyID"), projectID.String(), iterationID.String(), tileLayer)
+	manifest, err := getLayerManifest(backend, layerKey)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	} else if manifest == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
+	}
+
+	// Tiles past the images' resolution are only enlarged, they are refused a few zooms
+	// past it, TILE_MAX_OVERZOOM (default 2), instead of being rendered and cached
+	sources, err := getTileSources(backend, layerKey, manifest)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+	if len(sources) > 0 && z > tileMaxZoom(sources)+getEnvInt("TILE_MAX_OVERZOOM", 2) {
+		return c.Status(fiber.StatusNotFound).SendString("Tile not found")
+	}
+
+	tileCache := getTileDiskCache()
+	tilePath := tileCachePath(layerKey, manifest, z, x, y)
+	data, err := tileCache.read(tilePath)
+	if err != nil {
+		if data, err = renderOrthoPhotoTile(c, backend, layerKey, manifest, z, x, y); err != nil {
+			return nil
+		}
+		if len(data) > 0 {
+			if err := tileCache.write(tilePath, data); err != nil {
+				log.Error(fmt.Sprintf("caching tile %s: %s", tilePath, err))
+			}
+		} else {
+			data = emptyTile
+		}
+	}
+
+	// Tiles only change when the layer is replaced
+	etag := fmt.Sprintf("\"%x-%d-%d-%d\"", manifest.CreatedTime.UnixNano(), z, x, y)
+	c.Type("png")
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("private, max-age=%d", getFileCacheMaxAge()))
+	c.Response().Header.SetLastModified(manifest.CreatedTime)
+	if status := checkPreconditions(c, etag, manifest.CreatedTime); status != 0 {
+		c.Status(status)
+		return nil
+	}
+	return c.Send(data)
+}
+
+// GetOrthoPhotoCapabilities returns a WMTS GetCapabilities document of the ortho photos of an iteration,
+// whose tiles are the ones of GetOrthoPhotoTile
+// Params
+// companyID: ID of the company
+// projectID: ID of the project
+// iterationID: ID of the iteration
+func GetOrthoPhotoCapabilities(c *fiber.Ctx) error {
+	projectID, iterationID, ok := checkIterationURL(c)
+	if !ok {
+		return nil
+	}
+
+	backend := storage.GetBackend()
+	iterationPath := fmt.Sprintf("/project/%s/%s/%s", c.Params("companyID"), projectID, iterationID)
+	layerKey := storage.Join(c.Params("companyID"), projectID.String(), iterationID.String(), tileLayer)
+	manifest, err := getLayerManifest(backend, layerKey)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	} else if manifest == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
+	}
+
+	sources, err := getTileSources(backend, layerKey, manifest)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+	if len(sources) == 0 {
+		helpers.BadRequest(c, errNotRenderable.Error(), constants.ERR_FILE_NOT_RENDERABLE)
+		return nil
+	}
+
+	layer := maptile.Layer{
+		Identifier: tileLayer,
+		Title:      tileLayer,
+		URL:        c.BaseURL() + iterationPath + "/tiles/{TileMatrix}/{TileCol}/{TileRow}.png",
+	}
+	for _, source := range sources {
+		layer.BBox = unionBBox(layer.BBox, source.Image.Metadata.BBox)
+	}
+	layer.MaxZoom = tileMaxZoom(sources)
+
+	c.Type("xml")
+	return c.Send(maptile.Capabilities(fmt.Sprintf("Iteration %s", iterationID), c.BaseURL()+iterationPath+"/wmts", []maptile.Layer{layer}))
+}
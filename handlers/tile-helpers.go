@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"filemanager/common/cache"
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/geotiff"
+	"filemanager/maptile"
+	"filemanager/storage"
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Layer whose images are served as map tiles
+const tileLayer = "ortho_photo"
+
+var errNotRenderable = errors.New("ortho photo has no georeferenced image which can be rendered")
+
+// blockCacheKey is a decoded block of a level of an opened image
+type blockCacheKey struct {
+	image *geotiff.Image
+	level int
+	index int
+}
+
+var (
+	tileSourceCache *cache.Cache[string, []*maptile.Source]
+	blockCache      *cache.Cache[blockCacheKey, *image.NRGBA]
+	tileCacheOnce   sync.Once
+	emptyTile       []byte
+)
+
+// getTileCaches returns the caches of opened images, TILE_IMAGE_CACHE_SIZE layers (default 16), and of their
+// decoded blocks, TILE_BLOCK_CACHE_SIZE MB of pixels (default 256). Both are kept TILE_CACHE_TTL seconds (default 600)
+func getTileCaches() (*cache.Cache[string, []*maptile.Source], *cache.Cache[blockCacheKey, *image.NRGBA]) {
+	tileCacheOnce.Do(func() {
+		ttl := time.Duration(getEnvInt("TILE_CACHE_TTL", 600)) * time.Second
+		tileSourceCache = cache.New[string, []*maptile.Source](getEnvInt("TILE_IMAGE_CACHE_SIZE", 16), ttl)
+		blockCache = cache.NewSized[blockCacheKey, *image.NRGBA](int64(getEnvInt("TILE_BLOCK_CACHE_SIZE", 256))*1024*1024, ttl,
+			func(block *image.NRGBA) int64 { return int64(len(block.Pix)) })
+
+		var buffer bytes.Buffer
+		png.Encode(&buffer, image.NewNRGBA(image.Rect(0, 0, maptile.Size, maptile.Size)))
+		emptyTile = buffer.Bytes()
+	})
+	return tileSourceCache, blockCache
+}
+
+// getTileSources opens every .tif and .tiff file of a layer which can be rendered: georeferenced in a known
+// CRS with pixels this server decodes. Other files are left out, they are still served as uploaded
+func getTileSources(backend storage.Backend, layerKey string, manifest *layerManifest) ([]*maptile.Source, error) {
+	sourceCache, blocks := getTileCaches()
+	cacheKey := fmt.Sprintf("%s@%d", layerKey, manifest.CreatedTime.UnixNano())
+	if sources, exist := sourceCache.Get(cacheKey); exist {
+		return sources, nil
+	}
+
+	sources := []*maptile.Source{}
+	for _, file := range manifest.Files {
+		extension := strings.ToLower(path.Ext(file.Path))
+		if extension != ".tif" && extension != ".tiff" {
+			continue
+		}
+
+		reader := &storageReaderAt{ctx: context.Background(), backend: backend, key: fileKey(layerKey, file), size: file.Size}
+		img, err := geotiff.Open(reader, file.Size)
+		var formatErr *geotiff.FormatError
+		var unsupportedErr *geotiff.UnsupportedError
+		if errors.As(err, &formatErr) || errors.As(err, &unsupportedErr) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		source, err := maptile.NewSource(img, func(level, index int) (*image.NRGBA, error) {
+			key := blockCacheKey{image: img, level: level, index: index}
+			if block, exist := blocks.Get(key); exist {
+				return block, nil
+			}
+			block, err := img.Levels[level].Block(index)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file.Path, err)
+			}
+			blocks.Set(key, block)
+			return block, nil
+		})
+		if err != nil {
+			continue
+		}
+		sources = append(sources, source)
+	}
+
+	sourceCache.Set(cacheKey, sources)
+	return sources, nil
+}
+
+// renderOrthoPhotoTile renders a tile of a layer as PNG, empty when no image covers it. Responds and
+// returns an error when the layer can not be rendered
+func renderOrthoPhotoTile(c *fiber.Ctx, backend storage.Backend, layerKey string, manifest *layerManifest, z, x, y int) ([]byte, error) {
+	sources, err := getTileSources(backend, layerKey, manifest)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil, err
+	}
+	if len(sources) == 0 {
+		helpers.BadRequest(c, errNotRenderable.Error(), constants.ERR_FILE_NOT_RENDERABLE)
+		return nil, errNotRenderable
+	}
+
+	tile, drawn, err := maptile.Render(sources, z, x, y)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil, err
+	} else if !drawn {
+		return nil, nil
+	}
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, tile); err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// tileCachePath returns where a rendered tile of a layer is cached. The manifest's creation time is part
+// of the path so tiles of a replaced layer are never served
+func tileCachePath(layerKey string, manifest *layerManifest, z, x, y int) string {
+	return filepath.Join(helpers.GetTileCacheLocation(), filepath.FromSlash(layerKey),
+		fmt.Sprint(manifest.CreatedTime.UnixNano()), fmt.Sprint(z), fmt.Sprint(x), fmt.Sprintf("%d.png", y))
+}
+
+// tileMaxZoom returns the zoom whose pixels are as small as the smallest pixels of the images
+func tileMaxZoom(sources []*maptile.Source) int {
+	maxZoom := 0
+	for _, source := range sources {
+		maxZoom = max(maxZoom, source.MaxZoom())
+	}
+	return maxZoom
+}
+
+// tileDiskCache tracks the tiles cached on disk, the least recently used are deleted once all of
+// them take more than TILE_DISK_CACHE_SIZE MB (default 1024)
+type tileDiskCache struct {
+	lock    sync.Mutex
+	maxSize int64
+	size    int64
+	tiles   map[string]*list.Element
+	order   *list.List
+}
+
+type cachedTile struct {
+	path string
+	size int64
+}
+
+var (
+	diskCache     *tileDiskCache
+	diskCacheOnce sync.Once
+)
+
+// getTileDiskCache returns the cache of tiles on disk, tiles cached by a previous run are tracked
+// from oldest to newest and temporary files they left are deleted
+func getTileDiskCache() *tileDiskCache {
+	diskCacheOnce.Do(func() {
+		diskCache = &tileDiskCache{
+			maxSize: int64(getEnvInt("TILE_DISK_CACHE_SIZE", 1024)) * 1024 * 1024,
+			tiles:   map[string]*list.Element{},
+			order:   list.New(),
+		}
+
+		var tiles []cachedTile
+		modTimes := map[string]time.Time{}
+		filepath.WalkDir(helpers.GetTileCacheLocation(), func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return nil
+			}
+			if strings.HasPrefix(entry.Name(), ".tile-") {
+				os.Remove(filePath)
+				return nil
+			}
+			if info, err := entry.Info(); err == nil {
+				tiles = append(tiles, cachedTile{path: filePath, size: info.Size()})
+				modTimes[filePath] = info.ModTime()
+			}
+			return nil
+		})
+		sort.Slice(tiles, func(i, k int) bool { return modTimes[tiles[i].path].Before(modTimes[tiles[k].path]) })
+
+		diskCache.lock.Lock()
+		for _, tile := range tiles {
+			diskCache.add(tile)
+		}
+		diskCache.evict()
+		diskCache.lock.Unlock()
+	})
+	return diskCache
+}
+
+// read returns a cached tile and marks it as used
+func (d *tileDiskCache) read(tilePath string) ([]byte, error) {
+	data, err := os.ReadFile(tilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if element, exist := d.tiles[tilePath]; exist {
+		d.order.MoveToFront(element)
+	}
+	return data, nil
+}
+
+// write saves a tile through a temporary file, so a tile being written is never read, then deletes the
+// least recently used tiles past the cache's size
+func (d *tileDiskCache) write(tilePath string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(tilePath), 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(tilePath), ".tile-*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), tilePath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.add(cachedTile{path: tilePath, size: int64(len(data))})
+	d.evict()
+	return nil
+}
+
+// forget stops tracking the tiles under a directory, once it is deleted
+func (d *tileDiskCache) forget(directory string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for tilePath, element := range d.tiles {
+		if strings.HasPrefix(tilePath, directory+string(filepath.Separator)) {
+			d.remove(element)
+		}
+	}
+}
+
+// add tracks a tile as the most recently used, callers hold the lock
+func (d *tileDiskCache) add(tile cachedTile) {
+	if element, exist := d.tiles[tile.path]; exist {
+		d.remove(element)
+	}
+	d.tiles[tile.path] = d.order.PushFront(tile)
+	d.size += tile.size
+}
+
+// evict deletes the least recently used tiles until the cache fits, callers hold the lock
+func (d *tileDiskCache) evict() {
+	for d.maxSize > 0 && d.size > d.maxSize && d.order.Len() > 0 {
+		element := d.order.Back()
+		os.Remove(element.Value.(cachedTile).path)
+		d.remove(element)
+	}
+}
+
+func (d *tileDiskCache) remove(element *list.Element) {
+	tile := d.order.Remove(element).(cachedTile)
+	delete(d.tiles, tile.path)
+	d.size -= tile.size
+}
+
+// invalidateTiles drops the cached tiles, opened images and opened vector tiles of every iteration under a key
+func invalidateTiles(key string) {
+	segments := strings.Split(storage.CleanKey(key), "/")
+	iterationKey := strings.Join(segments[:min(3, len(segments))], "/")
+	if iterationKey == "" {
+		return
+	}
+
+	tileDirectory := filepath.Join(helpers.GetTileCacheLocation(), filepath.FromSlash(iterationKey))
+	os.RemoveAll(tileDirectory)
+	getTileDiskCache().forget(tileDirectory)
+	inIteration := func(cacheKey string) bool {
+		return strings.HasPrefix(cacheKey, iterationKey+"/")
+	}
+	sourceCache, _ := getTileCaches()
+	sourceCache.DeleteFunc(inIteration)
+	getVectorTileCache().DeleteFunc(inIteration)
+}
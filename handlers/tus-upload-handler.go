@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/models/response"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Resumable uploads implement the tus 1.0.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, termination and expiration extensions. A completed upload's ID can be sent
+// instead of the file to upload-iteration and edit-iteration, as geojson_upload_id,
+// tile_3d_upload_id and ortho_photo_upload_id. Uploads belong to the user who created them,
+// they are not found by anyone else
+
+// TusOptions returns the server's tus capabilities
+func TusOptions(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", "creation,termination,expiration")
+	if maxSize := getPartialUploadMaxSize(); maxSize > 0 {
+		c.Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// CreateUpload creates a new resumable upload.
+// Headers
+// Upload-Length: total size of the file in bytes
+// Upload-Metadata: optional, e.g. filename base64(name.zip)
+func CreateUpload(c *fiber.Ctx) error {
+	if !checkTusResumable(c) {
+		return nil
+	}
+
+	// Deferred length is not supported, length is required
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		helpers.BadRequest(c, "invalid upload length")
+		return nil
+	}
+	if maxSize := getPartialUploadMaxSize(); maxSize > 0 && length > maxSize {
+		c.Status(fiber.StatusRequestEntityTooLarge)
+		c.JSON(response.ErrorResponse{
+			ErrorCode: constants.ERR_COMMON_REQUEST_TOO_LARGE,
+			Error:     "upload too large",
+		})
+		return nil
+	}
+
+	metadata, err := parseTusMetadata(c.Get("Upload-Metadata"))
+	if err != nil {
+		helpers.BadRequest(c, err.Error())
+		return nil
+	}
+
+	upload, err := createPartialUpload(helpers.GetUserID(c), length, metadata)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	c.Set("Location", fmt.Sprintf("%s/%s", c.Path(), upload.ID))
+	c.Set("Upload-Expires", upload.ExpiresTime.UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// GetUploadStatus returns the offset of an upload, so that clients know where to resume from
+func GetUploadStatus(c *fiber.Ctx) error {
+	if !checkTusResumable(c) {
+		return nil
+	}
+
+	id := c.Params("uploadID")
+	lock := getPartialUploadLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	upload, err := getPartialUpload(id, helpers.GetUserID(c))
+	if err != nil {
+		return c.SendStatus(partialUploadErrorStatus(err))
+	}
+
+	c.Set("Cache-Control", "no-store")
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Set("Upload-Expires", upload.ExpiresTime.UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// PatchUpload appends a chunk to an upload.
+// Headers
+// Content-Type: application/offset+octet-stream
+// Upload-Offset: must equal the upload's current offset
+func PatchUpload(c *fiber.Ctx) error {
+	if !checkTusResumable(c) {
+		return nil
+	}
+
+	if c.Get(fiber.HeaderContentType) != "application/offset+octet-stream" {
+		return c.SendStatus(fiber.StatusUnsupportedMediaType)
+	}
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		helpers.BadRequest(c, "invalid upload offset")
+		return nil
+	}
+
+	// Only one request may write to an upload at a time
+	id := c.Params("uploadID")
+	lock := getPartialUploadLock(id)
+	if !lock.TryLock() {
+		partialUploadLocked(c, errors.New("upload is locked by another request"))
+		return nil
+	}
+	defer lock.Unlock()
+
+	upload, err := getPartialUpload(id, helpers.GetUserID(c))
+	if err != nil {
+		return c.SendStatus(partialUploadErrorStatus(err))
+	}
+	if isPartialUploadClaimed(id) {
+		partialUploadLocked(c, errPartialUploadClaimed)
+		return nil
+	}
+
+	if offset != upload.Offset {
+		c.Status(fiber.StatusConflict)
+		c.JSON(response.ErrorResponse{
+			ErrorCode: constants.ERR_UPLOAD_OFFSET_MISMATCH,
+			Error:     "upload offset mismatch",
+		})
+		return nil
+	}
+	if upload.Offset+int64(c.Request().Header.ContentLength()) > upload.Length {
+		helpers.BadRequest(c, "upload exceeds upload length", constants.ERR_COMMON_REQUEST_TOO_LARGE)
+		return nil
+	}
+
+	// The chunk is written as it is read, a chunked body is cut at the upload's length
+	body := c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	upload, err = appendPartialUpload(upload, body)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Expires", upload.ExpiresTime.UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// DeleteUpload terminates an upload and removes its data
+func DeleteUpload(c *fiber.Ctx) error {
+	if !checkTusResumable(c) {
+		return nil
+	}
+
+	id := c.Params("uploadID")
+	lock := getPartialUploadLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := getPartialUpload(id, helpers.GetUserID(c)); err != nil {
+		return c.SendStatus(partialUploadErrorStatus(err))
+	}
+	if isPartialUploadClaimed(id) {
+		partialUploadLocked(c, errPartialUploadClaimed)
+		return nil
+	}
+
+	removePartialUpload(id)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// checkTusResumable sets the Tus-Resumable response header and rejects clients of other protocol versions
+func checkTusResumable(c *fiber.Ctx) bool {
+	c.Set("Tus-Resumable", tusVersion)
+
+	if c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		c.SendStatus(fiber.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// partialUploadLocked answers 423 for an upload which can not be changed now
+func partialUploadLocked(c *fiber.Ctx, err error) {
+	c.Status(fiber.StatusLocked)
+	c.JSON(response.ErrorResponse{
+		ErrorCode: constants.ERR_UPLOAD_LOCKED,
+		Error:     err.Error(),
+	})
+}
+
+func partialUploadErrorStatus(err error) int {
+	if errors.Is(err, errPartialUploadNotFound) {
+		return fiber.StatusNotFound
+	} else if errors.Is(err, errPartialUploadExpired) {
+		return fiber.StatusGone
+	}
+	return fiber.StatusInternalServerError
+}
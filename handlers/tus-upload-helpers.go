@@ -0,0 +1,443 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/google/uuid"
+)
+
+const tusVersion = "1.0.0"
+
+var (
+	errPartialUploadNotFound   = errors.New("upload not found")
+	errPartialUploadExpired    = errors.New("upload expired")
+	errPartialUploadIncomplete = errors.New("upload not completed")
+	errPartialUploadClaimed    = errors.New("upload is used by another request")
+)
+
+// partialUpload is the state of a resumable (tus) upload, persisted next to its data
+// in the partial upload location as <id>.info and <id>.bin. Only its owner can see and use it
+type partialUpload struct {
+	ID          string            `json:"id"`
+	Owner       string            `json:"owner"`
+	Length      int64             `json:"length"`
+	Offset      int64             `json:"offset"`
+	Metadata    map[string]string `json:"metadata"`
+	CreatedTime time.Time         `json:"created_time"`
+	ExpiresTime time.Time         `json:"expires_time"`
+}
+
+// Per upload locks so that two requests can not change the same upload at the same time.
+// Uploads claimed by a request stay its own until released, they can not be appended to,
+// removed, expired or used by another request meanwhile. Claims end with the process as its jobs do
+var (
+	partialUploadLocks     = map[string]*sync.Mutex{}
+	claimedPartialUploads  = map[string]bool{}
+	partialUploadLocksLock sync.Mutex
+)
+
+func getPartialUploadLock(id string) *sync.Mutex {
+	partialUploadLocksLock.Lock()
+	defer partialUploadLocksLock.Unlock()
+
+	lock, exist := partialUploadLocks[id]
+	if !exist {
+		lock = &sync.Mutex{}
+		partialUploadLocks[id] = lock
+	}
+	return lock
+}
+
+func isPartialUploadClaimed(id string) bool {
+	partialUploadLocksLock.Lock()
+	defer partialUploadLocksLock.Unlock()
+
+	return claimedPartialUploads[id]
+}
+
+// claimPartialUpload claims an upload, false if it is already claimed
+func claimPartialUpload(id string) bool {
+	partialUploadLocksLock.Lock()
+	defer partialUploadLocksLock.Unlock()
+
+	if claimedPartialUploads[id] {
+		return false
+	}
+	claimedPartialUploads[id] = true
+	return true
+}
+
+func releasePartialUpload(id string) {
+	partialUploadLocksLock.Lock()
+	defer partialUploadLocksLock.Unlock()
+
+	delete(claimedPartialUploads, id)
+}
+
+func getPartialUploadExpiration() time.Duration {
+	hours, err := strconv.Atoi(os.Getenv("PARTIAL_UPLOAD_EXPIRATION"))
+	if err != nil || hours <= 0 {
+		hours = 24
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// getPartialUploadMaxSize returns the max size of a single upload in bytes, 0 means unlimited
+func getPartialUploadMaxSize() int64 {
+	maxSize, _ := strconv.ParseInt(os.Getenv("PARTIAL_UPLOAD_MAX_SIZE"), 10, 64)
+	return maxSize * 1024 * 1024
+}
+
+func partialUploadInfoPath(id string) string {
+	return filepath.Join(helpers.GetPartialUploadLocation(), id+".info")
+}
+
+func partialUploadDataPath(id string) string {
+	return filepath.Join(helpers.GetPartialUploadLocation(), id+".bin")
+}
+
+// parseTusMetadata decodes the Upload-Metadata header, "key base64value,key2 base64value2"
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encodedValue, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid upload metadata")
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encodedValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upload metadata value of %s", key)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+func createPartialUpload(owner string, length int64, metadata map[string]string) (partialUpload, error) {
+	if err := os.MkdirAll(helpers.GetPartialUploadLocation(), os.ModePerm); err != nil {
+		return partialUpload{}, err
+	}
+
+	now := time.Now()
+	upload := partialUpload{
+		ID:          uuid.New().String(),
+		Owner:       owner,
+		Length:      length,
+		Metadata:    metadata,
+		CreatedTime: now,
+		ExpiresTime: now.Add(getPartialUploadExpiration()),
+	}
+
+	// Create empty data file
+	dataFile, err := os.OpenFile(partialUploadDataPath(upload.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return partialUpload{}, err
+	}
+	dataFile.Close()
+
+	if err := savePartialUpload(upload); err != nil {
+		os.Remove(partialUploadDataPath(upload.ID))
+		return partialUpload{}, err
+	}
+
+	return upload, nil
+}
+
+func savePartialUpload(upload partialUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so the info file is never half written
+	tempPath := partialUploadInfoPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, partialUploadInfoPath(upload.ID))
+}
+
+// getPartialUpload returns an upload of the owner, uploads of others are not found. Callers hold the upload's lock
+func getPartialUpload(id, owner string) (partialUpload, error) {
+	upload, err := readPartialUpload(id)
+	if err != nil {
+		return upload, err
+	}
+	if upload.Owner != owner {
+		return partialUpload{}, errPartialUploadNotFound
+	}
+
+	// Expired uploads are removed by CleanExpiredPartialUploads, claimed ones are kept until released
+	if time.Now().After(upload.ExpiresTime) && !isPartialUploadClaimed(id) {
+		return upload, errPartialUploadExpired
+	}
+
+	return upload, nil
+}
+
+func readPartialUpload(id string) (partialUpload, error) {
+	var upload partialUpload
+
+	// IDs are only ever uuids, anything else could be a path
+	if _, err := uuid.Parse(id); err != nil {
+		return upload, errPartialUploadNotFound
+	}
+
+	data, err := os.ReadFile(partialUploadInfoPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return upload, errPartialUploadNotFound
+	} else if err != nil {
+		return upload, err
+	}
+
+	err = json.Unmarshal(data, &upload)
+	return upload, err
+}
+
+// appendPartialUpload writes a chunk at the upload's current offset and returns the new state.
+// A failed write is truncated back so the offset stays consistent with the data on disk
+func appendPartialUpload(upload partialUpload, reader io.Reader) (partialUpload, error) {
+	dataFile, err := os.OpenFile(partialUploadDataPath(upload.ID), os.O_WRONLY, 0600)
+	if err != nil {
+		return upload, err
+	}
+	defer dataFile.Close()
+
+	if _, err := dataFile.Seek(upload.Offset, io.SeekStart); err != nil {
+		return upload, err
+	}
+
+	written, err := io.Copy(dataFile, io.LimitReader(reader, upload.Length-upload.Offset))
+	if err != nil {
+		dataFile.Truncate(upload.Offset)
+		return upload, err
+	}
+
+	upload.Offset += written
+	upload.ExpiresTime = time.Now().Add(getPartialUploadExpiration())
+	if err := savePartialUpload(upload); err != nil {
+		return upload, err
+	}
+
+	return upload, nil
+}
+
+// removePartialUpload removes an upload and its claim, callers hold the upload's lock
+func removePartialUpload(id string) {
+	os.Remove(partialUploadInfoPath(id))
+	os.Remove(partialUploadDataPath(id))
+
+	partialUploadLocksLock.Lock()
+	delete(partialUploadLocks, id)
+	delete(claimedPartialUploads, id)
+	partialUploadLocksLock.Unlock()
+}
+
+// removeExpiredPartialUpload removes an upload if it expired and is not claimed, reporting if it did
+func removeExpiredPartialUpload(id string) bool {
+	lock := getPartialUploadLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	upload, err := readPartialUpload(id)
+	if err != nil || !time.Now().After(upload.ExpiresTime) || isPartialUploadClaimed(id) {
+		return false
+	}
+	removePartialUpload(id)
+	return true
+}
+
+// CleanExpiredPartialUploads removes expired uploads every interval, runs until the process exits
+func CleanExpiredPartialUploads(interval time.Duration) {
+	for {
+		entries, _ := os.ReadDir(helpers.GetPartialUploadLocation())
+		for _, entry := range entries {
+			if id, isInfo := strings.CutSuffix(entry.Name(), ".info"); isInfo {
+				if removeExpiredPartialUpload(id) {
+					log.Info(fmt.Sprintf("Removed expired upload %s", id))
+				}
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// layerFile is an uploaded layer archive, either a multipart form file
+// or a completed resumable upload referenced by its ID
+type layerFile struct {
+	Filename string
+	Size     int64
+	UploadID string
+	open     func() (multipart.File, error)
+
+	// spooled form files were copied to an upload only to outlive their request,
+	// claimed uploads are the request's until released
+	spooled bool
+	claimed bool
+}
+
+func (f *layerFile) Open() (multipart.File, error) {
+	return f.open()
+}
+
+// getLayerFile returns the layer's form file, or the owner's completed upload referenced
+// by the <layer>_upload_id form value. Returns nil if neither was sent
+func getLayerFile(form *multipart.Form, layer, owner string) (*layerFile, int, error) {
+	if len(form.File[layer]) != 0 {
+		fileHeader := form.File[layer][0]
+		return &layerFile{
+			Filename: fileHeader.Filename,
+			Size:     fileHeader.Size,
+			open:     fileHeader.Open,
+		}, 0, nil
+	}
+
+	if len(form.Value[layer+"_upload_id"]) == 0 || form.Value[layer+"_upload_id"][0] == "" {
+		return nil, 0, nil
+	}
+
+	uploadID := form.Value[layer+"_upload_id"][0]
+	lock := getPartialUploadLock(uploadID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	upload, err := getPartialUpload(uploadID, owner)
+	if errors.Is(err, errPartialUploadNotFound) || errors.Is(err, errPartialUploadExpired) {
+		return nil, constants.ERR_UPLOAD_NOT_FOUND, fmt.Errorf("%s: %s", layer, err.Error())
+	} else if err != nil {
+		return nil, constants.ERR_COMMON_INTERNAL_SERVER_ERROR, err
+	}
+	if upload.Offset != upload.Length {
+		return nil, constants.ERR_UPLOAD_INCOMPLETE, fmt.Errorf("%s: %s", layer, errPartialUploadIncomplete.Error())
+	}
+
+	// Name of the file from the upload's metadata, tus clients use either filename or name
+	fileName := upload.Metadata["filename"]
+	if fileName == "" {
+		fileName = upload.Metadata["name"]
+	}
+
+	return &layerFile{
+		Filename: fileName,
+		Size:     upload.Length,
+		UploadID: upload.ID,
+		open: func() (multipart.File, error) {
+			return os.Open(partialUploadDataPath(upload.ID))
+		},
+	}, 0, nil
+}
+
+// removeConsumedUploads deletes resumable uploads once their files are saved to the storage
+func removeConsumedUploads(files []*layerFile) {
+	for _, file := range files {
+		if file != nil && file.UploadID != "" {
+			lock := getPartialUploadLock(file.UploadID)
+			lock.Lock()
+			removePartialUpload(file.UploadID)
+			lock.Unlock()
+			file.claimed = false
+		}
+	}
+}
+
+// claimLayerFiles claims the uploads of the files for the job extracting them, failing if another request
+// already did. Claims are released by releaseLayerFiles
+func claimLayerFiles(files []*layerFile) (int, error) {
+	for _, file := range files {
+		if file == nil || file.UploadID == "" {
+			continue
+		}
+
+		lock := getPartialUploadLock(file.UploadID)
+		lock.Lock()
+		_, err := readPartialUpload(file.UploadID)
+		if err == nil && !claimPartialUpload(file.UploadID) {
+			err = errPartialUploadClaimed
+		}
+		lock.Unlock()
+
+		if errors.Is(err, errPartialUploadClaimed) {
+			return constants.ERR_UPLOAD_LOCKED, fmt.Errorf("%s: %s", file.Filename, err.Error())
+		} else if errors.Is(err, errPartialUploadNotFound) {
+			return constants.ERR_UPLOAD_NOT_FOUND, fmt.Errorf("%s: %s", file.Filename, err.Error())
+		} else if err != nil {
+			return constants.ERR_COMMON_INTERNAL_SERVER_ERROR, err
+		}
+		file.claimed = true
+	}
+	return 0, nil
+}
+
+// spoolLayerFiles copies form files to resumable uploads of the owner, form files are deleted once their
+// request ends while the files are only extracted later by a job
+func spoolLayerFiles(files []*layerFile, owner string) error {
+	for _, file := range files {
+		if file == nil || file.UploadID != "" {
+			continue
+		}
+
+		upload, err := createPartialUpload(owner, file.Size, map[string]string{"filename": file.Filename})
+		if err != nil {
+			return err
+		}
+		opened, err := file.Open()
+		if err != nil {
+			removePartialUpload(upload.ID)
+			return err
+		}
+		upload, err = appendPartialUpload(upload, opened)
+		opened.Close()
+		if err != nil {
+			removePartialUpload(upload.ID)
+			return err
+		}
+
+		uploadID := upload.ID
+		file.UploadID = uploadID
+		file.spooled = true
+		file.open = func() (multipart.File, error) {
+			return os.Open(partialUploadDataPath(uploadID))
+		}
+	}
+	return nil
+}
+
+// releaseLayerFiles removes the uploads made by spoolLayerFiles, uploads made by
+// the client are released and kept for it to retry with
+func releaseLayerFiles(files []*layerFile) {
+	for _, file := range files {
+		if file == nil {
+			continue
+		}
+		if file.spooled {
+			lock := getPartialUploadLock(file.UploadID)
+			lock.Lock()
+			removePartialUpload(file.UploadID)
+			lock.Unlock()
+		} else if file.claimed {
+			releasePartialUpload(file.UploadID)
+		}
+		file.claimed = false
+	}
+}
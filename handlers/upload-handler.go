@@ -1,44 +1,35 @@
 package handlers
 
 import (
-	"errors"
+	"context"
 	"filemanager/common/constants"
 	"filemanager/common/helpers"
+	"filemanager/jobs"
 	"filemanager/models/request"
 	"filemanager/models/response"
+	"filemanager/storage"
 	"fmt"
-	"mime/multipart"
-	"os"
-	"sync"
 
 	"github.com/devfeel/mapper"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/gofiber/fiber/v2/log"
 	"github.com/google/uuid"
 )
 
 // CreateProjectIteration calls project microservice to create an iteration on db
-// then saves all its files to the file system root location.
+// then queues a job saving all its files to the storage, answering 202 with the job's ID.
+// The iteration's urls are only set once the job succeeds, a failed job deletes the iteration
 // Params
 // project_id: ID of the project this iteration belongs to
 // geojson: geojson files as zip
 // tile_3d: 3DTile files as zip
 // ortho_photo: ortho photo files as zip
+// geojson_upload_id, tile_3d_upload_id, ortho_photo_upload_id: completed resumable uploads, instead of the files
 func CreateProjectIteration(c *fiber.Ctx) error {
-	var updatedProjectIteration response.IterationResponse
-
 	// Get info from token
-	userLocal := c.Locals("user").(*jwt.Token)
-	claims := userLocal.Claims.(jwt.MapClaims)
-	isRoot := claims["is_root"].(bool)
 	token := c.Cookies("token")
 	refreshToken := c.Cookies("refreshToken")
-
-	// Only allow root to create
-	if !isRoot {
-		helpers.BadRequest(c, "field not found", constants.ERR_PROJECT_ITERATION_UPLOAD_NOT_ALLOWED)
-		return nil
-	}
+	userID := helpers.GetUserID(c)
 
 	// => *multipart.Form
 	form, err := c.MultipartForm()
@@ -55,6 +46,12 @@ func CreateProjectIteration(c *fiber.Ctx) error {
 		return nil
 	}
 
+	// Only allow root or users who can edit the project to create
+	if err := checkProjectPermission(c, projectID, constants.PERM_LEVEL_EDIT); err != nil {
+		helpers.BadRequest(c, "no permission to upload", constants.ERR_PROJECT_ITERATION_UPLOAD_NOT_ALLOWED)
+		return nil
+	}
+
 	// Get company ID from project's ID
 	companyID, errCode, err := callGetCompanyIDFromProjectID(projectID, token, refreshToken)
 	if err != nil {
@@ -62,24 +59,54 @@ func CreateProjectIteration(c *fiber.Ctx) error {
 		return nil
 	}
 
-	// Get files
-	var geoJSONFile, tile3DFile, orthoPhotoFile *multipart.FileHeader
-	if len(form.File["geojson"]) != 0 {
-		geoJSONFile = form.File["geojson"][0]
+	// Get files, either uploaded in this form or as completed resumable uploads
+	geoJSONFile, errCode, err := getLayerFile(form, "geojson", userID)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
 	}
-	if len(form.File["tile_3d"]) != 0 {
-		tile3DFile = form.File["tile_3d"][0]
+	tile3DFile, errCode, err := getLayerFile(form, "tile_3d", userID)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
 	}
-	if len(form.File["ortho_photo"]) != 0 {
-		orthoPhotoFile = form.File["ortho_photo"][0]
+	orthoPhotoFile, errCode, err := getLayerFile(form, "ortho_photo", userID)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
 	}
+	files := map[string]*layerFile{"geojson": geoJSONFile, "tile_3d": tile3DFile, "ortho_photo": orthoPhotoFile}
+	fileList := []*layerFile{geoJSONFile, tile3DFile, orthoPhotoFile}
 
 	// Check for allowed file types
-	if fileCheckErr := allowFileTypeCheck([]*multipart.FileHeader{geoJSONFile, tile3DFile, orthoPhotoFile}); fileCheckErr != nil {
+	if fileCheckErr := allowFileTypeCheck(fileList); fileCheckErr != nil {
 		helpers.BadRequest(c, fileCheckErr.Error(), constants.ERR_FILE_TYPE_NOT_ALLOWED)
 		return nil
 	}
 
+	// Check the company's storage quota, extraction stops once it is used up
+	budget, err := getCompanyBudget(companyID, fileList, nil)
+	if err != nil {
+		saveFileError(c, err)
+		return nil
+	}
+
+	// Keep form files past this request, the job extracts them once a worker is free
+	if err := spoolLayerFiles(fileList, userID); err != nil {
+		releaseLayerFiles(fileList)
+		releaseCompanyBudget(companyID, budget, false)
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	// Uploads are the job's until it is done, no other request may change or use them meanwhile
+	if errCode, err := claimLayerFiles(fileList); err != nil {
+		releaseLayerFiles(fileList)
+		releaseCompanyBudget(companyID, budget, false)
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
+	}
+
 	// Call project service to create a project iteration first
 	revision := "" // Get revision
 	if len(form.Value["revision"]) > 0 {
@@ -87,115 +114,52 @@ func CreateProjectIteration(c *fiber.Ctx) error {
 	}
 	projectIteration, errCode, err := callCreateProjectIteration(projectID, revision, token, refreshToken)
 	if err != nil {
+		releaseLayerFiles(fileList)
+		releaseCompanyBudget(companyID, budget, false)
 		helpers.BadRequest(c, err.Error(), errCode)
 		return nil
 	}
 
-	// Get file save location
-	fileSystemRoot := helpers.GetFileSystemRootLocation()
-	saveDirectory := fmt.Sprintf("%s/%s/%s/%s", fileSystemRoot, companyID, projectID, projectIteration.ID.String())
-	geoJSONDirectory := fmt.Sprintf("%s/%s", saveDirectory, "geojson")
-	tile3DDirectory := fmt.Sprintf("%s/%s", saveDirectory, "tile_3d")
-	orthoPhotoDirectory := fmt.Sprintf("%s/%s", saveDirectory, "ortho_photo")
-
-	// Create save locations
-	if _, err := os.Stat(geoJSONDirectory); errors.Is(err, os.ErrNotExist) {
-		if err := os.MkdirAll(geoJSONDirectory, os.ModePerm); err != nil {
-			helpers.InternalServerError(c, err.Error())
-			return nil
-		}
-		if err := os.MkdirAll(tile3DDirectory, os.ModePerm); err != nil {
-			helpers.InternalServerError(c, err.Error())
-			return nil
-		}
-		if err := os.MkdirAll(orthoPhotoDirectory, os.ModePerm); err != nil {
-			helpers.InternalServerError(c, err.Error())
-			return nil
-		}
+	// Journal the create so it is compensated on the next start if the process stops midway
+	operationData := &iterationOperation{
+		CompanyID:   companyID,
+		ProjectID:   projectID,
+		IterationID: projectIteration.ID,
 	}
-
-	// Spawn go processes to save files cocurrenly
-	var wg sync.WaitGroup
-	wg.Add(3)
-	errChannel := make(chan error)
-
-	go saveAndUnzipFile(geoJSONDirectory, geoJSONFile, errChannel, &wg)
-	go saveAndUnzipFile(tile3DDirectory, tile3DFile, errChannel, &wg)
-	go saveAndUnzipFile(orthoPhotoDirectory, orthoPhotoFile, errChannel, &wg)
-
-	// here we wait in other goroutine to all jobs done and close the channels
-	go func() {
-		wg.Wait()
-		close(errChannel)
-	}()
-
-	// Check for error, then revert by deleting project iteration
-	for err := range errChannel {
-		// Delete files
-		os.RemoveAll(saveDirectory)
-
-		// Delete project iteration db record
-		errCode, deleteErr := callDeleteProjectIteration(projectIteration.ID, token, refreshToken)
-		if deleteErr != nil {
-			helpers.InternalServerError(c, deleteErr.Error(), errCode)
-			return nil
-		}
-
-		// Return save error
-		helpers.InternalServerError(c, err.Error())
+	operation, errCode, err := beginIterationOperation(operationCreateIteration, stepRecordCreated, operationData)
+	if err != nil {
+		callDeleteProjectIteration(projectIteration.ID, token, refreshToken)
+		releaseLayerFiles(fileList)
+		releaseCompanyBudget(companyID, budget, false)
+		helpers.BadRequest(c, err.Error(), errCode)
 		return nil
 	}
 
-	// No error, update project iteration on db with project's url and file names
-	updateIterationRequest := request.UpdateIterationRequest{
-		ID:       projectIteration.ID,
-		Revision: &revision,
-	}
-	baseURL := fmt.Sprintf("/%s/%s/%s", companyID, projectID, updateIterationRequest.ID.String())
-	if geoJSONFile != nil {
-		geoJSONURL := fmt.Sprintf("%s/%s", baseURL, "geojson")
-		updateIterationRequest.GeoJSONURL = &geoJSONURL
-		updateIterationRequest.GeoJSONFileName = &geoJSONFile.Filename
-	}
-	if tile3DFile != nil {
-		tile3DURL := fmt.Sprintf("%s/%s", baseURL, "tile_3d")
-		updateIterationRequest.Tile3DURL = &tile3DURL
-		updateIterationRequest.Tile3DFileName = &tile3DFile.Filename
-	}
-	if orthoPhotoFile != nil {
-		orthoPhotoURL := fmt.Sprintf("%s/%s", baseURL, "ortho_photo")
-		updateIterationRequest.OrthoPhotoURL = &orthoPhotoURL
-		updateIterationRequest.OrthoPhotoFileName = &orthoPhotoFile.Filename
-	}
-	updatedProjectIteration, errCode, err = callUpdateProjectIteration(updateIterationRequest, token, refreshToken)
-
+	// Save files in the background
+	job, err := jobs.Get().Submit(jobKindCreateIteration, userID, projectID.String(),
+		func(ctx context.Context, job *jobs.Job) (any, int, error) {
+			return createIterationJob(ctx, job, operation, operationData, files, budget, revision)
+		})
 	if err != nil {
-		// Delete files
-		os.RemoveAll(saveDirectory)
-
-		// Delete project iteration db record
-		deleteErrCode, deleteErr := callDeleteProjectIteration(projectIteration.ID, token, refreshToken)
-		if deleteErr != nil {
-			helpers.InternalServerError(c, deleteErr.Error(), deleteErrCode)
+		releaseLayerFiles(fileList)
+		releaseCompanyBudget(companyID, budget, false)
+		if errCode, compensateErr := compensateCreateIteration(storage.GetBackend(), operation, operationData); compensateErr != nil {
+			helpers.InternalServerError(c, compensateErr.Error(), errCode)
 			return nil
 		}
-
-		helpers.InternalServerError(c, err.Error(), errCode)
+		helpers.BadRequest(c, err.Error(), constants.ERR_JOB_QUEUE_FULL)
 		return nil
 	}
 
-	// Return created iteration
-	c.Status(201)
-	c.JSON(response.BaseResponse{
-		Data: updatedProjectIteration,
-		Meta: struct{ Status int }{Status: 200},
-	})
+	// Return the job saving the files and the iteration
+	jobAccepted(c, job, projectIteration)
 	return nil
 }
 
-// UpdateProjectIteration calls project microservice to update an iteration on db
-// then saves thee new files/keep the old files if remmove is not true. Else deletes
-// the old files and update url to null
+// UpdateProjectIteration queues a job saving the new files/keeping the old files if remove is
+// not true, answering 202 with the job's ID. Once saved the job updates the iteration on db then
+// replaces the old files, or removes them and sets their url to null when remove is true. Old files
+// are kept as a version of their layer, see GetLayerVersions
 // Params
 // iteration_id: ID of the iteration to be updated
 // geojson: geojson files as zip, to be upploaded if remove != true
@@ -204,21 +168,12 @@ func CreateProjectIteration(c *fiber.Ctx) error {
 // removeTile3D: true to delete old files, false to upload new or keep old files
 // ortho_photo: ortho photo files as zip, to be upploaded if remove != true
 // removeOrthoPhoto: true to delete old files, false to upload new or keep old files
+// geojson_upload_id, tile_3d_upload_id, ortho_photo_upload_id: completed resumable uploads, instead of the files
 func UpdateProjectIteration(c *fiber.Ctx) error {
-	var updatedProjectIteration response.IterationResponse
-
 	// Get info from token
-	userLocal := c.Locals("user").(*jwt.Token)
-	claims := userLocal.Claims.(jwt.MapClaims)
-	isRoot := claims["is_root"].(bool)
 	token := c.Cookies("token")
 	refreshToken := c.Cookies("refreshToken")
-
-	// Only allow root to create
-	if !isRoot {
-		helpers.BadRequest(c, "no permission to upload", constants.ERR_PROJECT_ITERATION_UPLOAD_NOT_ALLOWED)
-		return nil
-	}
+	userID := helpers.GetUserID(c)
 
 	// => *multipart.Form
 	form, err := c.MultipartForm()
@@ -234,9 +189,22 @@ func UpdateProjectIteration(c *fiber.Ctx) error {
 		helpers.BadRequest(c, err.Error(), errCode)
 		return nil
 	}
+
+	// Only allow root or users who can edit the project to edit
+	if err := checkProjectPermission(c, projectIteration.ProjectID, constants.PERM_LEVEL_EDIT); err != nil {
+		helpers.BadRequest(c, "no permission to edit", constants.ERR_PROJECT_ITERATION_EDIT_NOT_ALLOWED)
+		return nil
+	}
+
+	// One change at a time, a queued job would clash with this one's temporary directories
+	if errCode, err := checkIterationNotBusy(projectIteration.ID); err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
+	}
 	var toBeUpdatedProjectIteration request.UpdateIterationRequest
 	toBeUpdatedProjectIteration.ID = projectIteration.ID
 	mapper.Mapper(&projectIteration, &toBeUpdatedProjectIteration)
+	previousProjectIteration := toBeUpdatedProjectIteration
 
 	// Get company ID from project's ID
 	companyID, errCode, err := callGetCompanyIDFromProjectID(projectIteration.ProjectID, token, refreshToken)
@@ -250,59 +218,35 @@ func UpdateProjectIteration(c *fiber.Ctx) error {
 	isRemoveTile3D := form.Value["removeTile3D"][0]
 	isRemoveOrthoPhoto := form.Value["removeOrthoPhoto"][0]
 
-	// Get files
-	var geoJSONFile, tile3DFile, orthoPhotoFile *multipart.FileHeader
-	if len(form.File["geojson"]) != 0 {
-		geoJSONFile = form.File["geojson"][0]
-	}
-	if len(form.File["tile_3d"]) != 0 {
-		tile3DFile = form.File["tile_3d"][0]
-	}
-	if len(form.File["ortho_photo"]) != 0 {
-		orthoPhotoFile = form.File["ortho_photo"][0]
-	}
-
-	// Check for allowed file types
-	if fileCheckErr := allowFileTypeCheck([]*multipart.FileHeader{geoJSONFile, tile3DFile, orthoPhotoFile}); fileCheckErr != nil {
-		helpers.BadRequest(c, fileCheckErr.Error(), constants.ERR_FILE_TYPE_NOT_ALLOWED)
+	// Get files, either uploaded in this form or as completed resumable uploads
+	geoJSONFile, errCode, err := getLayerFile(form, "geojson", userID)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
 		return nil
 	}
-
-	// Get temporary file save location
-	fileSystemRoot := helpers.GetFileSystemRootLocation()
-	saveDirectory := fmt.Sprintf("%s/%s/%s/%s", fileSystemRoot, companyID, projectIteration.ProjectID, projectIteration.ID.String())
-	geoJSONTempDirectory := fmt.Sprintf("%s/%s", saveDirectory, "geojson_temp")
-	geoJSONDirectory := fmt.Sprintf("%s/%s", saveDirectory, "geojson")
-	tile3DTempDirectory := fmt.Sprintf("%s/%s", saveDirectory, "tile_3d_temp")
-	tile3DDirectory := fmt.Sprintf("%s/%s", saveDirectory, "tile_3d")
-	orthoPhotoTempDirectory := fmt.Sprintf("%s/%s", saveDirectory, "ortho_photo_temp")
-	orthoPhotoDirectory := fmt.Sprintf("%s/%s", saveDirectory, "ortho_photo")
-
-	// Create save locations
-	if err := os.MkdirAll(geoJSONTempDirectory, os.ModePerm); err != nil {
-		helpers.InternalServerError(c, err.Error())
+	tile3DFile, errCode, err := getLayerFile(form, "tile_3d", userID)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
 		return nil
 	}
-	if err := os.MkdirAll(tile3DTempDirectory, os.ModePerm); err != nil {
-		helpers.InternalServerError(c, err.Error())
+	orthoPhotoFile, errCode, err := getLayerFile(form, "ortho_photo", userID)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
 		return nil
 	}
-	if err := os.MkdirAll(orthoPhotoTempDirectory, os.ModePerm); err != nil {
-		helpers.InternalServerError(c, err.Error())
+
+	// Check for allowed file types
+	if fileCheckErr := allowFileTypeCheck([]*layerFile{geoJSONFile, tile3DFile, orthoPhotoFile}); fileCheckErr != nil {
+		helpers.BadRequest(c, fileCheckErr.Error(), constants.ERR_FILE_TYPE_NOT_ALLOWED)
 		return nil
 	}
 
-	// Spawn go processes to save files cocurrenly
-	var wg sync.WaitGroup
-	errChannel := make(chan error)
-	var saveFileErr error
-
 	// Only save and set URL if isRemove is not true
+	files := map[string]*layerFile{}
 	baseURL := fmt.Sprintf("/%s/%s/%s", companyID, projectIteration.ProjectID, projectIteration.ID.String())
 	if isRemoveGeoJSON != "true" {
 		if geoJSONFile != nil {
-			wg.Add(1)
-			go saveAndUnzipFile(geoJSONTempDirectory, geoJSONFile, errChannel, &wg)
+			files["geojson"] = geoJSONFile
 
 			geoJSONURL := fmt.Sprintf("%s/%s", baseURL, "geojson")
 			toBeUpdatedProjectIteration.GeoJSONURL = &geoJSONURL
@@ -315,8 +259,7 @@ func UpdateProjectIteration(c *fiber.Ctx) error {
 	// Same for 3DTile
 	if isRemoveTile3D != "true" {
 		if tile3DFile != nil {
-			wg.Add(1)
-			go saveAndUnzipFile(tile3DTempDirectory, tile3DFile, errChannel, &wg)
+			files["tile_3d"] = tile3DFile
 
 			tile3DURL := fmt.Sprintf("%s/%s", baseURL, "tile_3d")
 			toBeUpdatedProjectIteration.Tile3DURL = &tile3DURL
@@ -329,8 +272,7 @@ func UpdateProjectIteration(c *fiber.Ctx) error {
 	// Same for Ortho Photo
 	if isRemoveOrthoPhoto != "true" {
 		if orthoPhotoFile != nil {
-			wg.Add(1)
-			go saveAndUnzipFile(orthoPhotoTempDirectory, orthoPhotoFile, errChannel, &wg)
+			files["ortho_photo"] = orthoPhotoFile
 
 			orthoPhotoURL := fmt.Sprintf("%s/%s", baseURL, "ortho_photo")
 			toBeUpdatedProjectIteration.OrthoPhotoURL = &orthoPhotoURL
@@ -340,83 +282,85 @@ func UpdateProjectIteration(c *fiber.Ctx) error {
 		toBeUpdatedProjectIteration.OrthoPhotoURL = nil
 		toBeUpdatedProjectIteration.OrthoPhotoFileName = nil
 	}
+	fileList := []*layerFile{files["geojson"], files["tile_3d"], files["ortho_photo"]}
 
 	// Get revision to update
 	if len(form.Value["revision"]) > 0 {
 		toBeUpdatedProjectIteration.Revision = &form.Value["revision"][0]
 	}
 
-	// Update record on db
-	updatedProjectIteration, updateErrCode, updateErr := callUpdateProjectIteration(toBeUpdatedProjectIteration, token, refreshToken)
-
-	// Wait for all files to save
-	go func() {
-		wg.Wait()
-		close(errChannel)
-	}()
-	for err := range errChannel {
-		if err != nil {
-			saveFileErr = err
+	// Layers replaced by a new file or removed
+	operationData := &iterationOperation{
+		CompanyID:   companyID,
+		ProjectID:   projectIteration.ProjectID,
+		IterationID: projectIteration.ID,
+		Update:      &toBeUpdatedProjectIteration,
+		Previous:    &previousProjectIteration,
+		Layers:      map[string]string{},
+	}
+	for layer, isRemove := range map[string]string{
+		"geojson":     isRemoveGeoJSON,
+		"tile_3d":     isRemoveTile3D,
+		"ortho_photo": isRemoveOrthoPhoto,
+	} {
+		if isRemove == "true" {
+			operationData.Layers[layer] = layerActionRemove
+		} else if files[layer] != nil {
+			operationData.Layers[layer] = layerActionReplace
 		}
 	}
 
-	// Failed, revert by deleting the files and update back the old Iteration db record
-	if saveFileErr != nil || updateErr != nil {
-		// Delete temporary uploaded directories
-		os.RemoveAll(geoJSONTempDirectory)
-		os.RemoveAll(tile3DTempDirectory)
-		os.RemoveAll(orthoPhotoTempDirectory)
-
-		// Update to the old record
-		mapper.Mapper(&projectIteration, &toBeUpdatedProjectIteration)
-		if _, updateErrCode, updateErr := callUpdateProjectIteration(toBeUpdatedProjectIteration, token, refreshToken); updateErr != nil {
-			helpers.InternalServerError(c, updateErr.Error(), updateErrCode)
-			return nil
-		}
+	// Check the company's storage quota, replaced and removed layers give their bytes back
+	var changedLayers []string
+	for layer := range operationData.Layers {
+		changedLayers = append(changedLayers, storage.Join(operationData.saveDirectory(), layer))
+	}
+	budget, err := getCompanyBudget(companyID, fileList, changedLayers)
+	if err != nil {
+		saveFileError(c, err)
+		return nil
+	}
 
-		// Return save error
-		if updateErr != nil {
-			helpers.InternalServerError(c, updateErr.Error(), updateErrCode)
-		} else {
-			helpers.InternalServerError(c, saveFileErr.Error())
-		}
+	// Keep form files past this request, the job extracts them once a worker is free
+	if err := spoolLayerFiles(fileList, userID); err != nil {
+		releaseLayerFiles(fileList)
+		releaseCompanyBudget(companyID, budget, false)
+		helpers.InternalServerError(c, err.Error())
 		return nil
 	}
 
-	// Success, if remove is true then delete all files in the folder and remake the directory.
-	// Else if remove is false, and uploaded a new file, then remove the old files and rename the
-	// temporary folder to the original folder name
-	if isRemoveGeoJSON == "true" {
-		os.RemoveAll(geoJSONDirectory)
-		os.RemoveAll(geoJSONTempDirectory)
-		os.MkdirAll(geoJSONDirectory, os.ModePerm)
-	} else if geoJSONFile != nil {
-		os.RemoveAll(geoJSONDirectory)
-		os.Rename(geoJSONTempDirectory, geoJSONDirectory)
+	// Uploads are the job's until it is done, no other request may change or use them meanwhile
+	if errCode, err := claimLayerFiles(fileList); err != nil {
+		releaseLayerFiles(fileList)
+		releaseCompanyBudget(companyID, budget, false)
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
 	}
-	if isRemoveTile3D == "true" {
-		os.RemoveAll(tile3DDirectory)
-		os.RemoveAll(tile3DTempDirectory)
-		os.MkdirAll(tile3DDirectory, os.ModePerm)
-	} else if tile3DFile != nil {
-		os.RemoveAll(tile3DDirectory)
-		os.Rename(tile3DTempDirectory, tile3DDirectory)
+
+	// Journal the update so it is compensated or completed on the next start if the process stops midway
+	operation, errCode, err := beginIterationOperation(operationUpdateIteration, stepFilesSaving, operationData)
+	if err != nil {
+		releaseLayerFiles(fileList)
+		releaseCompanyBudget(companyID, budget, false)
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
 	}
-	if isRemoveOrthoPhoto == "true" {
-		os.RemoveAll(orthoPhotoDirectory)
-		os.RemoveAll(orthoPhotoTempDirectory)
-		os.MkdirAll(orthoPhotoDirectory, os.ModePerm)
-	} else if orthoPhotoFile != nil {
-		os.RemoveAll(orthoPhotoDirectory)
-		os.Rename(orthoPhotoTempDirectory, orthoPhotoDirectory)
+
+	// Save files in the background
+	job, err := jobs.Get().Submit(jobKindUpdateIteration, userID, projectIteration.ProjectID.String(),
+		func(ctx context.Context, job *jobs.Job) (any, int, error) {
+			return updateIterationJob(ctx, job, operation, operationData, files, budget)
+		})
+	if err != nil {
+		releaseLayerFiles(fileList)
+		releaseCompanyBudget(companyID, budget, false)
+		finishIterationOperation(operation)
+		helpers.BadRequest(c, err.Error(), constants.ERR_JOB_QUEUE_FULL)
+		return nil
 	}
 
-	// Return created iteration
-	c.Status(201)
-	c.JSON(response.BaseResponse{
-		Data: updatedProjectIteration,
-		Meta: struct{ Status int }{Status: 200},
-	})
+	// Return the job saving the files and the iteration as it is until the job is done
+	jobAccepted(c, job, projectIteration)
 	return nil
 }
 
@@ -433,21 +377,24 @@ func DeleteProjectIteration(c *fiber.Ctx) error {
 	}
 
 	// Get info from token
-	userLocal := c.Locals("user").(*jwt.Token)
-	claims := userLocal.Claims.(jwt.MapClaims)
-	isRoot := claims["is_root"].(bool)
 	token := c.Cookies("token")
 	refreshToken := c.Cookies("refreshToken")
 
-	// Only allow root to delete
-	if !isRoot {
+	// Get iteration from Project microservice
+	projectIteration, errCode, err := callGetProjectIteration(request.ID.String(), token, refreshToken)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
+	}
+
+	// Only allow root, or users with DELETE_ITERATION_PERMISSION_LEVEL on the project, to delete
+	if err := checkProjectPermission(c, projectIteration.ProjectID, getDeleteIterationPermissionLevel()); err != nil {
 		helpers.BadRequest(c, "no permission to delete", constants.ERR_PROJECT_ITERATION_DELETE_NOT_ALLOWED)
 		return nil
 	}
 
-	// Get iteration from Project microservice
-	projectIteration, errCode, err := callGetProjectIteration(request.ID.String(), token, refreshToken)
-	if err != nil {
+	// Wait for queued changes, their job would write the files back
+	if errCode, err := checkIterationNotBusy(projectIteration.ID); err != nil {
 		helpers.BadRequest(c, err.Error(), errCode)
 		return nil
 	}
@@ -459,17 +406,38 @@ func DeleteProjectIteration(c *fiber.Ctx) error {
 		return nil
 	}
 
+	// Journal the delete so files are still deleted on the next start if the process stops midway
+	operationData := &iterationOperation{
+		CompanyID:   companyID,
+		ProjectID:   projectIteration.ProjectID,
+		IterationID: request.ID,
+	}
+	operation, errCode, err := beginIterationOperation(operationDeleteIteration, stepDeletingRecord, operationData)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
+	}
+
 	// Delete project iteration db record
 	errCode, err = callDeleteProjectIteration(request.ID, token, refreshToken)
 	if err != nil {
+		finishIterationOperation(operation)
 		helpers.InternalServerError(c, err.Error(), errCode)
 		return nil
 	}
+	stepIterationOperation(operation, stepRecordDeleted, operationData)
 
-	// Get file save location then delete
-	fileSystemRoot := helpers.GetFileSystemRootLocation()
-	saveDirectory := fmt.Sprintf("%s/%s/%s/%s", fileSystemRoot, companyID, projectIteration.ProjectID, request.ID.String())
-	os.RemoveAll(saveDirectory)
+	// Get file save location then delete, blobs the iteration shares with others stay referenced by them
+	saveDirectory := operationData.saveDirectory()
+	if err := deleteLayerFiles(storage.GetBackend(), saveDirectory); err != nil {
+		log.Error(fmt.Sprintf("Failed to delete files of iteration %s, deleted in the background: %v", request.ID, err))
+		retryIterationOperation(operation)
+	} else {
+		finishIterationOperation(operation)
+	}
+	invalidateManifests(saveDirectory)
+	forgetIteration(request.ID)
+	refreshIterationUsage(storage.GetBackend(), saveDirectory)
 
 	// Return created iteration
 	c.Status(200)
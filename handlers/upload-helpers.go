@@ -1,21 +1,30 @@
 package handlers
 
 import (
-	"archive/zip"
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"filemanager/archive"
 	"filemanager/common/constants"
 	"filemanager/common/helpers"
+	"filemanager/geojson"
+	"filemanager/geotiff"
+	"filemanager/jobs"
 	"filemanager/models/request"
 	"filemanager/models/response"
+	"filemanager/storage"
+	"filemanager/tiles3d"
+	"filemanager/vectortile"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"os"
-	"path/filepath"
-	"slices"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -110,121 +119,358 @@ func callGetCompanyIDFromProjectID(projectID uuid.UUID, token, refreshToken stri
 	return data, errCode, err
 }
 
-func companySavedFileSize(path string) (int64, error) {
-	var size int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+// companySavedFileSize returns the size of each company/project/iteration/layer of a company, counted as
+// for refreshIterationUsage: files shared as blobs count in every layer listing them. Dot directories,
+// where blobs are, and files outside of a layer are not counted
+func companySavedFileSize(backend storage.Backend, companyID string) (map[string]int64, error) {
+	layerSizes := map[string]int64{}
+	projects, err := listDirectories(backend, companyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, project := range projects {
+		iterations, err := listDirectories(backend, project.Key)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if !info.IsDir() {
-			size += info.Size()
+		for _, iteration := range iterations {
+			if err := iterationSavedFileSize(backend, iteration.Key, layerSizes); err != nil {
+				return nil, err
+			}
 		}
-		return err
-	})
-	return size, err
+	}
+	return layerSizes, nil
 }
 
-func saveAndUnzipFile(saveDirectory string, file *multipart.FileHeader, errChannel chan<- error, wg *sync.WaitGroup) {
+// listDirectories returns the directories of a directory, leaving out dot directories
+// which belong to the file manager itself
+func listDirectories(backend storage.Backend, key string) ([]storage.ObjectInfo, error) {
+	children, err := backend.List(key)
+	directories := children[:0]
+	for _, child := range children {
+		if child.IsDir && !strings.HasPrefix(path.Base(child.Key), ".") {
+			directories = append(directories, child)
+		}
+	}
+	return directories, err
+}
+
+// getExtractionLimits reads a layer's extraction limits from EXTRACT_<LIMIT>_<LAYER>,
+// falling back to EXTRACT_<LIMIT> then to the defaults. Sizes are in MB
+// EXTRACT_MAX_TOTAL_SIZE: default 102400 (100 GB)
+// EXTRACT_MAX_ENTRIES: default 1000000
+// EXTRACT_MAX_ENTRY_SIZE: default 20480 (20 GB)
+// EXTRACT_MAX_RATIO: default 100
+// EXTRACT_MAX_DEPTH: default 32
+func getExtractionLimits(layer string) archive.Limits {
+	getLimit := func(name string, defaultValue int64) int64 {
+		value := os.Getenv(fmt.Sprintf("EXTRACT_%s_%s", name, strings.ToUpper(layer)))
+		if value == "" {
+			value = os.Getenv(fmt.Sprintf("EXTRACT_%s", name))
+		}
+		if limit, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return limit
+		}
+		return defaultValue
+	}
+
+	return archive.Limits{
+		MaxTotalSize: getLimit("MAX_TOTAL_SIZE", 102400) * 1024 * 1024,
+		MaxEntries:   int(getLimit("MAX_ENTRIES", 1000000)),
+		MaxEntrySize: getLimit("MAX_ENTRY_SIZE", 20480) * 1024 * 1024,
+		MaxRatio:     float64(getLimit("MAX_RATIO", 100)),
+		MaxDepth:     int(getLimit("MAX_DEPTH", 32)),
+	}
+}
+
+// saveLayerFiles extracts the files of every layer concurrently to <saveDirectory>/<layer><suffix>,
+// waiting for all of them and returning the first error. Each layer reports its progress to the job
+func saveLayerFiles(ctx context.Context, job *jobs.Job, backend storage.Backend, saveDirectory, suffix string, files map[string]*layerFile, budget *archive.Budget) error {
+	var wg sync.WaitGroup
+	errChannel := make(chan error)
+	for _, layer := range iterationLayers {
+		if files[layer] == nil {
+			continue
+		}
+		wg.Add(1)
+		go saveAndUnzipFile(ctx, job, backend, layer, storage.Join(saveDirectory, layer+suffix), files[layer], budget, errChannel, &wg)
+	}
+
+	// here we wait in other goroutine to all jobs done and close the channels
+	go func() {
+		wg.Wait()
+		close(errChannel)
+	}()
+
+	// Wait for every file to finish, keeping the first error
+	var saveFileErr error
+	for err := range errChannel {
+		if saveFileErr == nil {
+			saveFileErr = err
+		}
+	}
+	return saveFileErr
+}
+
+func saveAndUnzipFile(ctx context.Context, job *jobs.Job, backend storage.Backend, layer, saveKey string, file *layerFile, budget *archive.Budget, errChannel chan<- error, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	if file == nil {
 		return
 	}
 
-	// Create new unzipper from mime multipart file
+	// The layer fails unless it gets to the end
+	progress := &layerProgress{job: job, layer: layer}
+	status := jobs.StatusFailed
+	defer func() {
+		progress.report(func(p *jobs.Progress) {
+			p.Status = status
+		})
+	}()
+	progress.report(func(p *jobs.Progress) {
+		p.Status = jobs.StatusExtracting
+		p.BytesTotal = file.Size
+	})
+
+	// Create new archive reader from the uploaded file, format is detected from its content
 	fileOpened, err := file.Open()
 	if err != nil {
 		errChannel <- err
 		return
 	}
-	unzipper, err := zip.NewReader(fileOpened, file.Size)
+	defer fileOpened.Close()
+
+	// Bytes read from the archive are counted once its index is read
+	progress.archive = &countingReaderAt{reader: fileOpened}
+	unzipper, err := archive.NewReader(progress.archive, file.Size)
 	if err != nil {
 		errChannel <- err
 		return
 	}
+	defer unzipper.Close()
+	progress.archive.count.Store(0)
+	progress.report(func(p *jobs.Progress) {
+		p.EntriesTotal = unzipper.Count()
+	})
+
+	// Extract files inside of the archive, within the layer's limits
+	limits := getExtractionLimits(layer)
+	limits.Budget = budget
+	limiter := archive.NewLimiter(limits, file.Size)
+	manifest := &layerManifest{Layer: layer}
+	for {
+		if err := ctx.Err(); err != nil {
+			errChannel <- err
+			return
+		}
+
+		entry, err := unzipper.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			errChannel <- err
+			return
+		}
+
+		if err := limiter.CheckEntry(entry); err != nil {
+			errChannel <- err
+			return
+		}
 
-	// Unzip files inside of the zipped file
-	for _, f := range unzipper.File {
-		err := unzipFile(f, saveDirectory)
+		extracted, err := unzipFile(ctx, backend, unzipper, limiter, entry, saveKey, progress)
 		if err != nil {
 			errChannel <- err
 			return
 		}
+		if extracted != nil {
+			manifest.add(*extracted)
+		}
+		progress.report(func(p *jobs.Progress) {
+			p.Entries++
+		})
 	}
 
+	// List every extracted file with its checksum
+	if err := writeLayerManifest(backend, saveKey, manifest); err != nil {
+		errChannel <- err
+		return
+	}
+	status = jobs.StatusDone
+	progress.report(func(p *jobs.Progress) {
+		p.BytesRead = p.BytesTotal
+		p.EntriesTotal = p.Entries
+	})
 }
 
-func unzipFile(f *zip.File, destination string) error {
-	// 4. Check if file paths are not vulnerable to Zip Slip
-	filePath := filepath.Join(destination, f.Name)
-	if !strings.HasPrefix(filePath, filepath.Clean(destination)+string(os.PathSeparator)) {
-		return fmt.Errorf("invalid file path: %s", filePath)
+func unzipFile(ctx context.Context, backend storage.Backend, unzipper archive.Reader, limiter *archive.Limiter, entry *archive.Entry, destination string, progress *layerProgress) (*manifestFile, error) {
+	// 4. Directories are created along with the files inside of them
+	if entry.IsDir {
+		return nil, nil
 	}
 
-	// 5. Create directory tree
-	if f.FileInfo().IsDir() {
-		if err := os.MkdirAll(filePath, os.ModePerm); err != nil {
-			return err
-		}
-		return nil
+	// 5. Check if file paths are not vulnerable to Zip Slip, nor overwriting the layer's metadata
+	fileKey := path.Join(destination, entry.Name)
+	if !strings.HasPrefix(fileKey, path.Clean(destination)+"/") {
+		return nil, fmt.Errorf("invalid file path: %s", entry.Name)
 	}
-
-	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
-		return err
+	relativePath := strings.TrimPrefix(fileKey, path.Clean(destination)+"/")
+	if isReservedLayerPath(relativePath) {
+		return nil, &archive.LimitError{Reason: fmt.Sprintf("%s is a reserved path", entry.Name)}
 	}
 
-	// 6. Create a destination file for unzipped content
-	destinationFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+	// 6. Extract the content of a file and copy it to the layer's staging directory
+	zippedFile, err := unzipper.Open()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer destinationFile.Close()
+	defer zippedFile.Close()
 
-	// 7. Unzip the content of a file and copy it to the destination file
-	zippedFile, err := f.Open()
-	if err != nil {
-		return err
+	// 7. Count what is actually extracted, headers can lie about sizes, and hash it on the way.
+	// The header's size is given to the storage, backends buffering unknown sizes would buffer a lot,
+	// the limiter fails entries of another size and whatever the storage left unread is checked
+	hash := sha256.New()
+	counter := &countingWriter{}
+	reader := io.TeeReader(limiter.Reader(entry, &contextReader{ctx: ctx, reader: zippedFile}), io.MultiWriter(hash, counter, progress))
+	stagingKey := storage.Join(destination, layerMetadataDirectory, "staging", uuid.NewString())
+	if err := backend.Put(stagingKey, reader, entry.Size); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		return nil, err
 	}
-	defer zippedFile.Close()
 
-	if _, err := io.Copy(destinationFile, zippedFile); err != nil {
-		return err
+	// 8. Move the file to the project's blob of its content, shared with every other copy
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if err := storeBlob(backend, destination, stagingKey, checksum); err != nil {
+		return nil, err
 	}
-	return nil
+
+	return &manifestFile{
+		Path:        relativePath,
+		Size:        counter.count,
+		SHA256:      checksum,
+		ModTime:     time.Now(),
+		ContentType: contentTypeOf(relativePath),
+		Blob:        true,
+	}, nil
 }
 
-func allowFileTypeCheck(files []*multipart.FileHeader) error {
-	allowedExtensionsList := []string{".zip", ".rar", ".7z"}
-	var notAllowed []string
+// contextReader fails reading once its context is cancelled, stopping an extraction midway
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
 
-	for _, file := range files {
-		if file != nil {
-			extension := filepath.Ext(file.Filename)
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
 
-			if !slices.Contains(allowedExtensionsList, extension) &&
-				!slices.Contains(notAllowed, extension) {
+// layerProgress reports how far the extraction of a layer is to the layer's job
+type layerProgress struct {
+	job     *jobs.Job
+	layer   string
+	archive *countingReaderAt
+}
 
-				notAllowed = append(notAllowed, extension)
-			}
-		}
+func (p *layerProgress) report(update func(p *jobs.Progress)) {
+	p.job.Report(p.layer, update)
+}
+
+// Write counts extracted bytes, along with the bytes of the archive read so far
+func (p *layerProgress) Write(b []byte) (int, error) {
+	p.report(func(progress *jobs.Progress) {
+		progress.BytesWritten += int64(len(b))
+		progress.BytesRead = min(p.archive.count.Load(), progress.BytesTotal)
+	})
+	return len(b), nil
+}
+
+// countingReaderAt counts the bytes read from an archive, formats with an index read it out of order
+type countingReaderAt struct {
+	reader io.ReaderAt
+	count  atomic.Int64
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.reader.ReadAt(p, off)
+	r.count.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.count += int64(len(p))
+	return len(p), nil
+}
+
+// saveFileError responds with the error of a failed save, broken archive limits are the client's fault
+func saveFileError(c *fiber.Ctx, err error) {
+	if errCode := saveFileErrorCode(err); errCode != constants.ERR_COMMON_INTERNAL_SERVER_ERROR {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return
 	}
 
-	if len(notAllowed) != 0 {
-		var buffer bytes.Buffer
+	helpers.InternalServerError(c, err.Error())
+}
+
+func saveFileErrorCode(err error) int {
+	var limitErr *archive.LimitError
+	if errors.As(err, &limitErr) {
+		return constants.ERR_FILE_ARCHIVE_LIMIT_EXCEEDED
+	}
+	if errors.Is(err, archive.ErrBudgetExceeded) {
+		return constants.ERR_FILE_QUOTA_EXCEEDED
+	}
+	var geoJSONErr *geojson.ValidationError
+	if errors.As(err, &geoJSONErr) {
+		return constants.ERR_FILE_INVALID_GEOJSON
+	}
+	var tilesErr *tiles3d.ValidationError
+	if errors.As(err, &tilesErr) {
+		return constants.ERR_FILE_INVALID_3D_TILES
+	}
+	var geoTIFFErr *geotiff.FormatError
+	if errors.As(err, &geoTIFFErr) || errors.Is(err, geotiff.ErrNotGeoreferenced) {
+		return constants.ERR_FILE_INVALID_GEOTIFF
+	}
+	if errors.Is(err, vectortile.ErrTooManyTiles) {
+		return constants.ERR_FILE_TOO_MANY_TILES
+	}
+	return constants.ERR_COMMON_INTERNAL_SERVER_ERROR
+}
 
-		buffer.WriteString("File extensions: ")
+// allowFileTypeCheck only allows files which content is a supported archive (zip, 7z, rar, tar, tar.gz, tar.zst)
+func allowFileTypeCheck(files []*layerFile) error {
+	var notAllowed []string
 
-		for i := 0; i < len(notAllowed); i++ {
-			if i == len(notAllowed)-1 {
-				buffer.WriteString(fmt.Sprintf("%s ", notAllowed[i]))
-			} else {
-				buffer.WriteString(fmt.Sprintf("%s, ", notAllowed[i]))
-			}
+	for _, file := range files {
+		if file == nil {
+			continue
+		}
+
+		fileOpened, err := file.Open()
+		if err != nil {
+			return err
 		}
+		_, err = archive.Detect(fileOpened, file.Size)
+		fileOpened.Close()
 
-		buffer.WriteString("not allowed.")
+		if errors.Is(err, archive.ErrUnknownFormat) {
+			notAllowed = append(notAllowed, file.Filename)
+		} else if err != nil {
+			return err
+		}
+	}
 
-		return errors.New(buffer.String())
+	if len(notAllowed) != 0 {
+		return fmt.Errorf("File types of %s not allowed, only zip, 7z, rar, tar, tar.gz and tar.zst archives are.",
+			strings.Join(notAllowed, ", "))
 	}
 
 	return nil
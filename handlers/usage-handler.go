@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/models/response"
+	"filemanager/usage"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// GetCompanyUsage returns the storage used by a company against its quota, per project
+// and per layer.
+// Params
+// companyID: ID of the company
+func GetCompanyUsage(c *fiber.Ctx) error {
+	companyID := c.Params("companyID")
+
+	// Get info from token
+	userLocal := c.Locals("user").(*jwt.Token)
+	claims := userLocal.Claims.(jwt.MapClaims)
+	isRoot := claims["is_root"].(bool)
+
+	// Only allow root to see usage
+	if !isRoot {
+		helpers.BadRequest(c, "no permission to see usage", constants.ERR_COMMON_PERMISSION_NOT_ALLOWED)
+		return nil
+	}
+
+	layerSizes, err := usage.Get().Layers(companyID)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	// Sum layers of every iteration per project and per layer name, versions with their layer
+	companyUsage := response.CompanyUsageResponse{
+		CompanyID: companyID,
+		Limit:     getCompanyQuota(companyID),
+		Layers:    map[string]int64{},
+		Projects:  []response.ProjectUsageResponse{},
+	}
+	projects := map[string]*response.ProjectUsageResponse{}
+	for layerKey, size := range layerSizes {
+		// company/project/iteration/layer or company/project/iteration/.versions/layer/version
+		segments := strings.Split(layerKey, "/")
+		var projectID, layer string
+		if len(segments) == 4 {
+			projectID, layer = segments[1], segments[3]
+		} else if len(segments) == 6 && segments[3] == layerVersionDirectory {
+			projectID, layer = segments[1], segments[4]
+		} else {
+			continue
+		}
+
+		project, exist := projects[projectID]
+		if !exist {
+			project = &response.ProjectUsageResponse{ProjectID: projectID, Layers: map[string]int64{}}
+			projects[projectID] = project
+		}
+		project.Used += size
+		project.Layers[layer] += size
+		companyUsage.Used += size
+		companyUsage.Layers[layer] += size
+	}
+	for _, project := range projects {
+		companyUsage.Projects = append(companyUsage.Projects, *project)
+	}
+	sort.Slice(companyUsage.Projects, func(i, j int) bool {
+		return companyUsage.Projects[i].ProjectID < companyUsage.Projects[j].ProjectID
+	})
+	if verifiedTime := usage.Get().VerifiedTime(companyID); !verifiedTime.IsZero() {
+		companyUsage.VerifiedTime = &verifiedTime
+	}
+
+	c.Status(200)
+	c.JSON(response.BaseResponse{
+		Data: companyUsage,
+		Meta: struct{ Status int }{Status: 200},
+	})
+	return nil
+}
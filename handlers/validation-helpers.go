@@ -0,0 +1,299 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"filemanager/geojson"
+	"filemanager/geotiff"
+	"filemanager/jobs"
+	"filemanager/storage"
+	"filemanager/tiles3d"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// layerMetadata describes the files of a layer, written once they are validated
+type layerMetadata struct {
+	Layer       string    `json:"layer"`
+	CreatedTime time.Time `json:"created_time"`
+	BBox        []float64 `json:"bbox,omitempty"` // west, south, east, north of every file
+	Files       any       `json:"files"`
+	Warnings    any       `json:"warnings,omitempty"` // problems which do not fail the upload
+}
+
+// layerValidator checks the extracted files of a layer and describes them
+type layerValidator func(ctx context.Context, backend storage.Backend, layerKey string, manifest *layerManifest) (*layerMetadata, error)
+
+// layerValidators are the layers whose files are checked once extracted, other layers are kept as uploaded
+var layerValidators = map[string]layerValidator{
+	"geojson":     validateGeoJSONLayer,
+	"tile_3d":     validateTile3DLayer,
+	"ortho_photo": validateOrthoPhotoLayer,
+}
+
+// validateLayerFiles checks every layer extracted to <saveDirectory>/<layer><suffix> which has a validator,
+// saving what it found in the layer's metadata. Returns the first invalid file
+func validateLayerFiles(ctx context.Context, job *jobs.Job, backend storage.Backend, saveDirectory, suffix string, files map[string]*layerFile) error {
+	for _, layer := range iterationLayers {
+		validator, exist := layerValidators[layer]
+		if files[layer] == nil || !exist {
+			continue
+		}
+
+		job.Report(layer, func(p *jobs.Progress) {
+			p.Status = jobs.StatusValidating
+		})
+		layerKey := storage.Join(saveDirectory, layer+suffix)
+		err := validateLayer(ctx, backend, layer, layerKey, validator)
+		status := jobs.StatusDone
+		if err != nil {
+			status = jobs.StatusFailed
+		}
+		job.Report(layer, func(p *jobs.Progress) {
+			p.Status = status
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateLayer(ctx context.Context, backend storage.Backend, layer, layerKey string, validator layerValidator) error {
+	manifest, err := readLayerManifest(backend, layerKey)
+	if err != nil {
+		return err
+	} else if manifest == nil {
+		return fmt.Errorf("%s has no manifest", layerKey)
+	}
+
+	metadata, err := validator(ctx, backend, layerKey, manifest)
+	if err != nil {
+		return err
+	}
+	metadata.Layer = layer
+	metadata.CreatedTime = time.Now()
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return backend.Put(metadataKey(layerKey), bytes.NewReader(data), int64(len(data)))
+}
+
+// validateGeoJSONLayer checks every .geojson and .json file of a layer against RFC 7946,
+// describing each one by its path
+func validateGeoJSONLayer(ctx context.Context, backend storage.Backend, layerKey string, manifest *layerManifest) (*layerMetadata, error) {
+	files := map[string]*geojson.Metadata{}
+	metadata := &layerMetadata{Files: files}
+	for _, file := range manifest.Files {
+		extension := strings.ToLower(path.Ext(file.Path))
+		if extension != ".geojson" && extension != ".json" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		reader, err := backend.Get(fileKey(layerKey, file))
+		if err != nil {
+			return nil, err
+		}
+		fileMetadata, err := geojson.Validate(&contextReader{ctx: ctx, reader: reader})
+		reader.Close()
+		var validationErr *geojson.ValidationError
+		if errors.As(err, &validationErr) {
+			return nil, fmt.Errorf("%s is not valid GeoJSON, %w", file.Path, err)
+		} else if err != nil {
+			return nil, err
+		}
+
+		files[file.Path] = fileMetadata
+		metadata.BBox = unionBBox(metadata.BBox, fileMetadata.BBox)
+	}
+	return metadata, nil
+}
+
+// unionBBox returns the bounding box of two west, south, east, north boxes, either may be nil
+func unionBBox(a, b []float64) []float64 {
+	if a == nil {
+		return b
+	} else if b == nil {
+		return a
+	}
+	return []float64{min(a[0], b[0]), min(a[1], b[1]), max(a[2], b[2]), max(a[3], b[3])}
+}
+
+// validateTile3DLayer checks the tileset.json closest to the top of a layer against the 3D Tiles
+// specification, along with every file it references
+func validateTile3DLayer(ctx context.Context, backend storage.Backend, layerKey string, manifest *layerManifest) (*layerMetadata, error) {
+	paths := make([]string, len(manifest.Files))
+	for i, file := range manifest.Files {
+		paths[i] = file.Path
+	}
+	root, exist := tiles3d.FindRoot(paths)
+	if !exist {
+		return nil, &tiles3d.ValidationError{Report: &tiles3d.Report{
+			Errors: []tiles3d.Issue{{Severity: tiles3d.SeverityError, File: "tileset.json", Message: "not found in the archive"}},
+		}}
+	}
+
+	report, err := tiles3d.Validate(&layerFiles{ctx: ctx, backend: backend, layerKey: layerKey, manifest: manifest}, root)
+	if err != nil {
+		return nil, err
+	}
+	return &layerMetadata{BBox: report.Region, Files: report.Tilesets, Warnings: report.Warnings}, nil
+}
+
+// layerFiles reads the files of a layer listed in its manifest
+type layerFiles struct {
+	ctx      context.Context
+	backend  storage.Backend
+	layerKey string
+	manifest *layerManifest
+}
+
+func (f *layerFiles) Size(name string) (int64, bool) {
+	file, exist := f.manifest.find(name)
+	return file.Size, exist
+}
+
+func (f *layerFiles) Read(name string, offset, length int64) ([]byte, error) {
+	if err := f.ctx.Err(); err != nil {
+		return nil, err
+	}
+	file, exist := f.manifest.find(name)
+	if !exist {
+		return nil, storage.ErrNotFound
+	}
+	reader, err := f.backend.GetRange(fileKey(f.layerKey, file), offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// validateOrthoPhotoLayer reads the headers of every .tif and .tiff file of a layer, describing its size,
+// bands, georeference and whether it is cloud optimized. Files which are not TIFF fail the upload, as do
+// images without georeference when ORTHO_PHOTO_REQUIRE_GEOREFERENCE is true
+func validateOrthoPhotoLayer(ctx context.Context, backend storage.Backend, layerKey string, manifest *layerManifest) (*layerMetadata, error) {
+	requireGeoreference := os.Getenv("ORTHO_PHOTO_REQUIRE_GEOREFERENCE") == "true"
+	files := map[string]*geotiff.Metadata{}
+	warnings := []string{}
+	metadata := &layerMetadata{Files: files}
+	for _, file := range manifest.Files {
+		extension := strings.ToLower(path.Ext(file.Path))
+		if extension != ".tif" && extension != ".tiff" {
+			continue
+		}
+
+		reader := &storageReaderAt{ctx: ctx, backend: backend, key: fileKey(layerKey, file), size: file.Size}
+		fileMetadata, err := geotiff.Read(reader, file.Size)
+		var formatErr *geotiff.FormatError
+		if errors.As(err, &formatErr) {
+			return nil, fmt.Errorf("%s: %w", file.Path, err)
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !fileMetadata.Georeferenced {
+			if requireGeoreference {
+				return nil, fmt.Errorf("%s: %w", file.Path, geotiff.ErrNotGeoreferenced)
+			}
+			warnings = append(warnings, fmt.Sprintf("%s is not georeferenced", file.Path))
+		}
+		if !fileMetadata.CloudOptimized.Valid {
+			warnings = append(warnings, fmt.Sprintf("%s is not a cloud optimized GeoTIFF", file.Path))
+		}
+		files[file.Path] = fileMetadata
+		metadata.BBox = unionBBox(metadata.BBox, fileMetadata.BBox)
+	}
+	if len(warnings) > 0 {
+		metadata.Warnings = warnings
+	}
+	return metadata, nil
+}
+
+// storageReaderAt reads a stored file at random offsets, a block at a time since headers are read in small pieces.
+// Reads of a block or more go straight to the storage
+type storageReaderAt struct {
+	ctx     context.Context
+	backend storage.Backend
+	key     string
+	size    int64
+
+	lock        sync.Mutex
+	blockOffset int64
+	block       []byte
+}
+
+const storageReaderBlockSize = 64 * 1024
+
+func (r *storageReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) >= storageReaderBlockSize && off < r.size {
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+		reader, err := r.backend.GetRange(r.key, off, min(int64(len(p)), r.size-off))
+		if err != nil {
+			return 0, err
+		}
+		defer reader.Close()
+		read, err := io.ReadFull(reader, p[:min(int64(len(p)), r.size-off)])
+		if err == nil && read < len(p) {
+			err = io.EOF
+		}
+		return read, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	read := 0
+	for read < len(p) {
+		offset := off + int64(read)
+		if offset >= r.size {
+			return read, io.EOF
+		}
+
+		// Outside of the current block, load the block around it
+		if r.block == nil || offset < r.blockOffset || offset >= r.blockOffset+int64(len(r.block)) {
+			if err := r.ctx.Err(); err != nil {
+				return read, err
+			}
+			blockOffset := offset - offset%storageReaderBlockSize
+			reader, err := r.backend.GetRange(r.key, blockOffset, min(storageReaderBlockSize, r.size-blockOffset))
+			if err != nil {
+				return read, err
+			}
+			block, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return read, err
+			}
+			if len(block) == 0 {
+				return read, io.ErrUnexpectedEOF
+			}
+			r.blockOffset, r.block = blockOffset, block
+		}
+
+		read += copy(p[read:], r.block[offset-r.blockOffset:])
+	}
+	return read, nil
+}
+
+// validationErrorResult returns the details of a failed validation, for the job's result
+func validationErrorResult(err error) any {
+	var tilesErr *tiles3d.ValidationError
+	if errors.As(err, &tilesErr) {
+		return tilesErr.Report
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"filemanager/common/helpers"
+	"filemanager/maptile"
+	"filemanager/storage"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetVectorTile returns a Mapbox Vector Tile of the GeoJSON of an iteration, XYZ numbered in Web Mercator.
+// Each GeoJSON file is a layer of the tile named by its path without extension. Tiles without features
+// answer 204, tiles past the maximum zoom are to be overzoomed by the client
+// Params
+// companyID: ID of the company
+// projectID: ID of the project
+// iterationID: ID of the iteration
+// z: zoom of the tile
+// x: column of the tile, from the west
+// y: row of the tile, from the north
+func GetVectorTile(c *fiber.Ctx) error {
+	projectID, iterationID, ok := checkIterationURL(c)
+	if !ok {
+		return nil
+	}
+
+	z, zErr := strconv.Atoi(c.Params("z"))
+	x, xErr := strconv.Atoi(c.Params("x"))
+	y, yErr := strconv.Atoi(c.Params("y"))
+	if zErr != nil || xErr != nil || yErr != nil || !maptile.Valid(z, x, y) {
+		return c.Status(fiber.StatusNotFound).SendString("Tile not found")
+	}
+
+	backend := storage.GetBackend()
+	layerKey := storage.Join(c.Params("companyID"), projectID.String(), iterationID.String(), "geojson")
+	manifest, err := getLayerManifest(backend, layerKey)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	} else if manifest == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Layer not found")
+	}
+	tiles, err := getVectorTiles(backend, layerKey, manifest)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	} else if tiles == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Layer has no vector tiles")
+	}
+	data, err := tiles.Tile(z, x, y)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	// Tiles only change when the layer is replaced
+	etag := fmt.Sprintf("\"%x-%d-%d-%d\"", manifest.CreatedTime.UnixNano(), z, x, y)
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("private, max-age=%d", getFileCacheMaxAge()))
+	c.Set(fiber.HeaderVary, fiber.HeaderAcceptEncoding)
+	c.Response().Header.SetLastModified(manifest.CreatedTime)
+	if status := checkPreconditions(c, etag, manifest.CreatedTime); status != 0 {
+		c.Status(status)
+		return nil
+	}
+	if data == nil {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	// Tiles are stored gzipped, sent as they are to clients which accept it
+	c.Set(fiber.HeaderContentType, "application/vnd.mapbox-vector-tile")
+	if c.AcceptsEncodings("gzip") == "gzip" {
+		c.Set(fiber.HeaderContentEncoding, "gzip")
+		return c.Send(data)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+	tile, err := io.ReadAll(reader)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+	return c.Send(tile)
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"filemanager/common/cache"
+	"filemanager/geojson"
+	"filemanager/jobs"
+	"filemanager/pmtiles"
+	"filemanager/storage"
+	"filemanager/vectortile"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// layerTiler cuts the validated files of a layer into vector tiles, saved with the layer's metadata
+type layerTiler func(ctx context.Context, backend storage.Backend, layerKey string, manifest *layerManifest) error
+
+// layerTilers are the layers served as vector tiles
+var layerTilers = map[string]layerTiler{
+	"geojson": tileGeoJSONLayer,
+}
+
+var (
+	vectorTileCache     *cache.Cache[string, *pmtiles.Reader]
+	vectorTileCacheOnce sync.Once
+)
+
+// getVectorTileCache returns the cache of opened vector tile archives, VECTOR_TILE_CACHE_SIZE layers
+// (default 16) kept TILE_CACHE_TTL seconds (default 600)
+func getVectorTileCache() *cache.Cache[string, *pmtiles.Reader] {
+	vectorTileCacheOnce.Do(func() {
+		ttl := time.Duration(getEnvInt("TILE_CACHE_TTL", 600)) * time.Second
+		vectorTileCache = cache.New[string, *pmtiles.Reader](getEnvInt("VECTOR_TILE_CACHE_SIZE", 16), ttl)
+	})
+	return vectorTileCache
+}
+
+// vectorTilesKey is where the vector tiles of a layer are saved, a PMTiles archive
+func vectorTilesKey(layerKey string) string {
+	return storage.Join(layerKey, layerMetadataDirectory, "vector.pmtiles")
+}
+
+// tileLayerFiles cuts every layer extracted to <saveDirectory>/<layer><suffix> which has a tiler into vector tiles
+func tileLayerFiles(ctx context.Context, job *jobs.Job, backend storage.Backend, saveDirectory, suffix string, files map[string]*layerFile) error {
+	for _, layer := range iterationLayers {
+		tiler, exist := layerTilers[layer]
+		if files[layer] == nil || !exist {
+			continue
+		}
+
+		job.Report(layer, func(p *jobs.Progress) {
+			p.Status = jobs.StatusTiling
+		})
+		layerKey := storage.Join(saveDirectory, layer+suffix)
+		manifest, err := readLayerManifest(backend, layerKey)
+		if err == nil && manifest == nil {
+			err = fmt.Errorf("%s has no manifest", layerKey)
+		}
+		if err == nil {
+			err = tiler(ctx, backend, layerKey, manifest)
+		}
+		status := jobs.StatusDone
+		if err != nil {
+			status = jobs.StatusFailed
+		}
+		job.Report(layer, func(p *jobs.Progress) {
+			p.Status = status
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tileGeoJSONLayer cuts every .geojson and .json file of a layer into vector tiles up to
+// VECTOR_TILE_MAX_ZOOM (default 14), each file a layer of the tiles named by its path without extension.
+// The layer fails when its features cover more than VECTOR_TILE_MAX_TILES tiles (default 1000000).
+// Nothing is saved when the files have no features
+func tileGeoJSONLayer(ctx context.Context, backend storage.Backend, layerKey string, manifest *layerManifest) error {
+	maxZoom := min(max(getEnvInt("VECTOR_TILE_MAX_ZOOM", 14), 0), 24)
+	tiler := vectortile.NewTiler(maxZoom, getEnvInt("VECTOR_TILE_MAX_TILES", 1000000))
+	err := readLayerFeatures(ctx, backend, layerKey, manifest, func(filePath string, feature *geojson.Feature) error {
+		return tiler.Add(strings.TrimSuffix(filePath, path.Ext(filePath)), feature)
+	})
+	if err != nil {
+		return err
+	}
+	bounds := tiler.Bounds()
+	if bounds == nil {
+		return nil
+	}
+
+	// Tiles go to a temporary file, the archive starts with their directory which is only known at the end
+	tiles, err := os.CreateTemp("", "vector-tiles-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tiles.Name())
+	defer tiles.Close()
+
+	writer := pmtiles.NewWriter(tiles)
+	var compressed bytes.Buffer
+	err = tiler.Build(ctx, func(z, x, y int, tile []byte) error {
+		compressed.Reset()
+		zw := gzip.NewWriter(&compressed)
+		zw.Write(tile)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		return writer.WriteTile(z, x, y, compressed.Bytes())
+	})
+	if err != nil {
+		return err
+	}
+
+	metadata, err := json.Marshal(map[string]any{
+		"name":          path.Base(layerKey),
+		"format":        "pbf",
+		"vector_layers": tiler.Layers(),
+	})
+	if err != nil {
+		return err
+	}
+	header := pmtiles.Header{
+		TileType:        pmtiles.TileTypeMVT,
+		TileCompression: pmtiles.CompressionGzip,
+		MaxZoom:         byte(maxZoom),
+		Bounds:          [4]float64{bounds[0], bounds[1], bounds[2], bounds[3]},
+		Center:          [2]float64{(bounds[0] + bounds[2]) / 2, (bounds[1] + bounds[3]) / 2},
+	}
+	start, err := writer.Finish(header, metadata)
+	if err != nil {
+		return err
+	}
+
+	size, err := tiles.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tiles.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return backend.Put(vectorTilesKey(layerKey), io.MultiReader(bytes.NewReader(start), tiles), int64(len(start))+size)
+}
+
+// readLayerFeatures calls fn with every feature of the .geojson and .json files of a layer, a file at a time
+func readLayerFeatures(ctx context.Context, backend storage.Backend, layerKey string, manifest *layerManifest,
+	fn func(filePath string, feature *geojson.Feature) error) error {
+	for _, file := range manifest.Files {
+		extension := strings.ToLower(path.Ext(file.Path))
+		if extension != ".geojson" && extension != ".json" {
+			continue
+		}
+
+		reader, err := backend.Get(fileKey(layerKey, file))
+		if err != nil {
+			return err
+		}
+		err = geojson.ReadFeatures(&contextReader{ctx: ctx, reader: reader}, func(feature *geojson.Feature) error {
+			return fn(file.Path, feature)
+		})
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.Path, err)
+		}
+	}
+	return nil
+}
+
+// getVectorTiles opens the vector tiles of a layer, nil when the layer has none
+func getVectorTiles(backend storage.Backend, layerKey string, manifest *layerManifest) (*pmtiles.Reader, error) {
+	cacheKey := fmt.Sprintf("%s@%d", layerKey, manifest.CreatedTime.UnixNano())
+	if reader, exist := getVectorTileCache().Get(cacheKey); exist {
+		return reader, nil
+	}
+
+	key := vectorTilesKey(layerKey)
+	info, err := backend.Stat(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	reader, err := pmtiles.Open(&storageReaderAt{ctx: context.Background(), backend: backend, key: key, size: info.Size}, info.Size)
+	if err != nil {
+		return nil, err
+	}
+	getVectorTileCache().Set(cacheKey, reader)
+	return reader, nil
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"errors"
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/models/request"
+	"filemanager/models/response"
+	"filemanager/storage"
+	"fmt"
+	"slices"
+
+	"github.com/devfeel/mapper"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetLayerVersions lists the previous versions of a layer of an iteration, the latest replaced first.
+// A version is kept whenever the layer is replaced or removed, up to LAYER_VERSION_MAX_COUNT versions
+// no older than LAYER_VERSION_MAX_AGE days
+// Params
+// companyID: ID of the company
+// projectID: ID of the project
+// iterationID: ID of the iteration
+// layer: geojson, tile_3d or ortho_photo
+func GetLayerVersions(c *fiber.Ctx) error {
+	projectID, iterationID, ok := checkIterationURL(c)
+	if !ok {
+		return nil
+	}
+	layer := c.Params("layer")
+	if !slices.Contains(iterationLayers, layer) {
+		helpers.BadRequest(c, fmt.Sprintf("unknown layer %s", layer), constants.ERR_FILE_UNKNOWN_LAYER)
+		return nil
+	}
+
+	backend := storage.GetBackend()
+	versions, err := listLayerVersions(backend, storage.Join(c.Params("companyID"), projectID.String(), iterationID.String()), layer)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+	versionResponses := []response.LayerVersionResponse{}
+	for _, version := range versions {
+		files, err := listLayerFiles(backend, version.Key)
+		if err != nil {
+			helpers.InternalServerError(c, err.Error())
+			return nil
+		}
+		versionResponse := response.LayerVersionResponse{
+			ID:           version.ID,
+			Layer:        layer,
+			FileName:     version.Version.FileName,
+			ReplacedTime: version.Version.ReplacedTime,
+			Files:        len(files),
+		}
+		if version.Manifest != nil {
+			versionResponse.CreatedTime = version.Manifest.CreatedTime
+		}
+		for _, file := range files {
+			versionResponse.Size += file.Size
+		}
+		versionResponses = append(versionResponses, versionResponse)
+	}
+
+	c.Status(200)
+	c.JSON(response.BaseResponse{
+		Data: versionResponses,
+		Meta: struct{ Status int }{Status: 200},
+	})
+	return nil
+}
+
+// RollbackLayerVersion replaces a layer of an iteration by one of its previous versions and sets the
+// layer's url and file name on the iteration record to the version's. The replaced layer is kept as a
+// version in turn, so a rollback can be undone. The record is updated first, then the layer is swapped,
+// finished on the next start if the process stops midway
+// Params
+// id: ID of the iteration
+// layer: geojson, tile_3d or ortho_photo
+// version_id: ID of the version, as listed by GetLayerVersions
+func RollbackLayerVersion(c *fiber.Ctx) error {
+	// Parse request model
+	rollbackRequest := request.RollbackIterationRequest{}
+	if err := c.BodyParser(&rollbackRequest); err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	// Get info from token
+	token := c.Cookies("token")
+	refreshToken := c.Cookies("refreshToken")
+
+	// Get iteration from Project microservice
+	projectIteration, errCode, err := callGetProjectIteration(rollbackRequest.ID.String(), token, refreshToken)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
+	}
+
+	// Only allow root or users who can edit the project to roll back
+	if err := checkProjectPermission(c, projectIteration.ProjectID, constants.PERM_LEVEL_EDIT); err != nil {
+		helpers.BadRequest(c, "no permission to edit", constants.ERR_PROJECT_ITERATION_EDIT_NOT_ALLOWED)
+		return nil
+	}
+	if !slices.Contains(iterationLayers, rollbackRequest.Layer) {
+		helpers.BadRequest(c, fmt.Sprintf("unknown layer %s", rollbackRequest.Layer), constants.ERR_FILE_UNKNOWN_LAYER)
+		return nil
+	}
+
+	// One change at a time, the rollback uses the layer's temporary directory
+	if errCode, err := checkIterationNotBusy(projectIteration.ID); err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
+	}
+
+	// Get company ID from project's ID
+	companyID, errCode, err := callGetCompanyIDFromProjectID(projectIteration.ProjectID, token, refreshToken)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
+	}
+
+	operationData := &iterationOperation{
+		CompanyID:   companyID,
+		ProjectID:   projectIteration.ProjectID,
+		IterationID: projectIteration.ID,
+		Layer:       rollbackRequest.Layer,
+		Version:     rollbackRequest.VersionID,
+	}
+
+	// The version must be one of the layer's, its file name goes to the record
+	backend := storage.GetBackend()
+	storedVersionKey := storage.Join(layerVersionsKey(operationData.saveDirectory(), rollbackRequest.Layer), rollbackRequest.VersionID)
+	if versionReplacedTime(rollbackRequest.VersionID).IsZero() {
+		helpers.BadRequest(c, "version not found", constants.ERR_FILE_VERSION_NOT_FOUND)
+		return nil
+	}
+	if _, err := backend.Stat(storedVersionKey); errors.Is(err, storage.ErrNotFound) {
+		helpers.BadRequest(c, "version not found", constants.ERR_FILE_VERSION_NOT_FOUND)
+		return nil
+	} else if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+	version, err := readLayerVersion(backend, storedVersionKey)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	// Record with the layer's url and the version's file name
+	var previousProjectIteration request.UpdateIterationRequest
+	previousProjectIteration.ID = projectIteration.ID
+	mapper.Mapper(&projectIteration, &previousProjectIteration)
+	toBeUpdatedProjectIteration := previousProjectIteration
+	layerURL := fmt.Sprintf("/%s/%s/%s/%s", companyID, projectIteration.ProjectID, projectIteration.ID, rollbackRequest.Layer)
+	setLayerRecord(&toBeUpdatedProjectIteration, rollbackRequest.Layer, &layerURL, version.FileName)
+	operationData.Update = &toBeUpdatedProjectIteration
+	operationData.Previous = &previousProjectIteration
+
+	// Clear leftovers of a previous failed edit, the version is moved there first
+	if err := deleteLayerFiles(backend, storage.Join(operationData.saveDirectory(), rollbackRequest.Layer+"_temp")); err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+
+	// Journal the rollback so it is compensated or completed on the next start if the process stops midway
+	operation, errCode, err := beginIterationOperation(operationRollbackLayer, stepUpdatingRecord, operationData)
+	if err != nil {
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
+	}
+
+	// Update record on db
+	updatedProjectIteration, errCode, err := callUpdateProjectIteration(toBeUpdatedProjectIteration, token, refreshToken)
+	if err != nil {
+		finishIterationOperation(operation)
+		helpers.BadRequest(c, err.Error(), errCode)
+		return nil
+	}
+
+	// Swap the layer and the version, a failed swap is resumed in the background
+	stepIterationOperation(operation, stepRestoringVersion, operationData)
+	layerKey := storage.Join(operationData.saveDirectory(), rollbackRequest.Layer)
+	err = restoreLayerVersion(backend, operationData.saveDirectory(), rollbackRequest.Layer, rollbackRequest.VersionID,
+		layerFileName(&previousProjectIteration, rollbackRequest.Layer), false)
+	invalidateManifests(layerKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		// The version was pruned since it was checked, the layer is untouched so the record is restored.
+		// If it can not be, the operation stays journaled to be compensated in the background
+		stepIterationOperation(operation, stepUpdatingRecord, operationData)
+		if _, errCode, err := callUpdateProjectIteration(previousProjectIteration, token, refreshToken); err != nil {
+			retryIterationOperation(operation)
+			helpers.BadRequest(c, err.Error(), errCode)
+			return nil
+		}
+		finishIterationOperation(operation)
+		helpers.BadRequest(c, "version not found", constants.ERR_FILE_VERSION_NOT_FOUND)
+		return nil
+	} else if err != nil {
+		retryIterationOperation(operation)
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	}
+	finishIterationOperation(operation)
+	refreshIterationUsage(backend, operationData.saveDirectory())
+
+	c.Status(200)
+	c.JSON(response.BaseResponse{
+		Data: updatedProjectIteration,
+		Meta: struct{ Status int }{Status: 200},
+	})
+	return nil
+}
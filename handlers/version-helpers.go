@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"filemanager/models/request"
+	"filemanager/storage"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/google/uuid"
+)
+
+// Replaced and removed layers are moved to <iteration>/.versions/<layer>/<version> so they can be restored,
+// versions are named by when they were replaced. Their files are blobs, a version only moves its metadata
+const layerVersionDirectory = ".versions"
+
+// layerVersion is saved with the metadata of a layer once it is replaced
+type layerVersion struct {
+	FileName     *string   `json:"file_name"`
+	ReplacedTime time.Time `json:"replaced_time"`
+}
+
+// storedLayerVersion is a previous version of a layer, Manifest is nil for layers without one
+type storedLayerVersion struct {
+	ID       string
+	Key      string
+	Version  layerVersion
+	Manifest *layerManifest
+}
+
+func layerVersionsKey(iterationKey, layer string) string {
+	return storage.Join(iterationKey, layerVersionDirectory, layer)
+}
+
+func versionKey(layerKey string) string {
+	return storage.Join(layerKey, layerMetadataDirectory, "version.json")
+}
+
+// getLayerVersionLimits returns how many previous versions of a layer are kept, LAYER_VERSION_MAX_COUNT
+// (default 5, 0 keeps none), and for how long, LAYER_VERSION_MAX_AGE days (default 0, no limit)
+func getLayerVersionLimits() (int, time.Duration) {
+	maxCount := max(getEnvInt("LAYER_VERSION_MAX_COUNT", 5), 0)
+	maxAge := time.Duration(max(getEnvInt("LAYER_VERSION_MAX_AGE", 0), 0)) * 24 * time.Hour
+	return maxCount, maxAge
+}
+
+// archiveLayer moves a layer being replaced or removed to its versions with the file name it was uploaded
+// as, or deletes it when no version is kept. Nothing is done for a layer already gone, so archiving again is safe
+func archiveLayer(backend storage.Backend, iterationKey, layer string, fileName *string) error {
+	layerKey := storage.Join(iterationKey, layer)
+	if maxCount, _ := getLayerVersionLimits(); maxCount == 0 {
+		return deleteLayerFiles(backend, layerKey)
+	}
+	if _, err := backend.Stat(layerKey); errors.Is(err, storage.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	replacedTime := time.Now()
+	data, err := json.Marshal(layerVersion{FileName: fileName, ReplacedTime: replacedTime})
+	if err != nil {
+		return err
+	}
+	if err := backend.Put(versionKey(layerKey), bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	id := fmt.Sprintf("%016x", replacedTime.UnixNano())
+	if err := backend.Rename(layerKey, storage.Join(layerVersionsKey(iterationKey, layer), id)); err != nil {
+		return err
+	}
+
+	// Too many versions is not a reason to fail the replace, they go with the next one
+	if _, err := pruneLayerVersions(backend, iterationKey, layer); err != nil {
+		log.Error(fmt.Sprintf("Failed to prune versions of %s: %v", layerKey, err))
+	}
+	return nil
+}
+
+// restoreLayerVersion replaces a layer by one of its versions, the replaced layer becoming a version itself.
+// The version is first moved to the layer's temporary directory so pruning never reaches it, each step is
+// checked before it is done so restoring again resumes wherever it stopped. A version missing on a first
+// restore, not resumed, is storage.ErrNotFound and the layer is untouched
+func restoreLayerVersion(backend storage.Backend, iterationKey, layer, id string, fileName *string, resumed bool) error {
+	layerKey := storage.Join(iterationKey, layer)
+	tempKey := storage.Join(iterationKey, layer+"_temp")
+
+	if _, err := backend.Stat(storage.Join(layerVersionsKey(iterationKey, layer), id)); err == nil {
+		if err := backend.Rename(storage.Join(layerVersionsKey(iterationKey, layer), id), tempKey); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	} else if !resumed {
+		return err
+	}
+
+	if _, err := backend.Stat(tempKey); errors.Is(err, storage.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := archiveLayer(backend, iterationKey, layer, fileName); err != nil {
+		return err
+	}
+	if err := backend.Rename(tempKey, layerKey); err != nil {
+		return err
+	}
+
+	// The restored layer is the current one again
+	if err := backend.Delete(versionKey(layerKey)); err != nil {
+		log.Error(fmt.Sprintf("Failed to clear version of %s: %v", layerKey, err))
+	}
+	return nil
+}
+
+// listLayerVersions returns the previous versions of a layer, the latest replaced first
+func listLayerVersions(backend storage.Backend, iterationKey, layer string) ([]storedLayerVersion, error) {
+	children, err := backend.List(layerVersionsKey(iterationKey, layer))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	versions := []storedLayerVersion{}
+	for _, child := range children {
+		if !child.IsDir {
+			continue
+		}
+		version, err := readLayerVersion(backend, child.Key)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err := getLayerManifest(backend, child.Key)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, storedLayerVersion{ID: path.Base(child.Key), Key: child.Key, Version: version, Manifest: manifest})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID > versions[j].ID })
+	return versions, nil
+}
+
+// readLayerVersion reads the version saved with a replaced layer, replaced when it was moved if it has none
+func readLayerVersion(backend storage.Backend, key string) (layerVersion, error) {
+	var version layerVersion
+	reader, err := backend.Get(versionKey(key))
+	if errors.Is(err, storage.ErrNotFound) {
+		version.ReplacedTime = versionReplacedTime(path.Base(key))
+		return version, nil
+	} else if err != nil {
+		return version, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return version, err
+	}
+	err = json.Unmarshal(data, &version)
+	return version, err
+}
+
+// versionReplacedTime returns when a version was replaced from its ID, zero if the ID is not one
+func versionReplacedTime(id string) time.Time {
+	nanoseconds, err := strconv.ParseInt(id, 16, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanoseconds)
+}
+
+// pruneLayerVersions deletes the versions of a layer past the count or age limits, returning how many.
+// Directories which are not versions are left alone
+func pruneLayerVersions(backend storage.Backend, iterationKey, layer string) (int, error) {
+	children, err := backend.List(layerVersionsKey(iterationKey, layer))
+	if errors.Is(err, storage.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Key > children[j].Key })
+
+	maxCount, maxAge := getLayerVersionLimits()
+	kept, pruned := 0, 0
+	for _, child := range children {
+		replacedTime := versionReplacedTime(path.Base(child.Key))
+		if !child.IsDir || replacedTime.IsZero() {
+			continue
+		}
+		if kept < maxCount && (maxAge == 0 || time.Since(replacedTime) < maxAge) {
+			kept++
+			continue
+		}
+		if err := deleteLayerFiles(backend, child.Key); err != nil {
+			return pruned, err
+		}
+		// Only the version's manifest was cached, tiles are rendered from the layers
+		getManifestCache().Delete(storage.CleanKey(child.Key))
+		pruned++
+	}
+	return pruned, nil
+}
+
+// pruneExpiredLayerVersions prunes the versions of every layer of every iteration, versions only
+// expire with time once LAYER_VERSION_MAX_AGE is set
+func pruneExpiredLayerVersions(backend storage.Backend) (int, error) {
+	pruned := 0
+	companies, err := listDirectories(backend, "")
+	if err != nil {
+		return 0, err
+	}
+	for _, company := range companies {
+		projects, err := listDirectories(backend, company.Key)
+		if err != nil {
+			return pruned, err
+		}
+		for _, project := range projects {
+			iterations, err := listDirectories(backend, project.Key)
+			if err != nil {
+				return pruned, err
+			}
+			for _, iteration := range iterations {
+				count, err := pruneIterationVersions(backend, iteration.Key)
+				pruned += count
+				if err != nil {
+					return pruned, err
+				}
+			}
+		}
+	}
+	return pruned, nil
+}
+
+// pruneIterationVersions prunes the versions of every layer of an iteration. An iteration with a change in
+// progress is skipped, a rollback may be restoring one of its versions, and no change begins meanwhile
+func pruneIterationVersions(backend storage.Backend, iterationKey string) (int, error) {
+	iterationID, err := uuid.Parse(path.Base(iterationKey))
+	if err != nil {
+		return 0, nil
+	}
+	lock := getIterationLock(iterationID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	busy, err := busyIterations()
+	if err != nil {
+		return 0, err
+	}
+	if busy[iterationID] {
+		return 0, nil
+	}
+
+	pruned := 0
+	for _, layer := range iterationLayers {
+		count, err := pruneLayerVersions(backend, iterationKey, layer)
+		pruned += count
+		if err != nil {
+			refreshIterationUsage(backend, iterationKey)
+			return pruned, err
+		}
+	}
+	if pruned > 0 {
+		refreshIterationUsage(backend, iterationKey)
+	}
+	return pruned, nil
+}
+
+// layerFileName returns the file name of a layer in an iteration record
+func layerFileName(record *request.UpdateIterationRequest, layer string) *string {
+	if record == nil {
+		return nil
+	}
+	switch layer {
+	case "geojson":
+		return record.GeoJSONFileName
+	case "tile_3d":
+		return record.Tile3DFileName
+	case "ortho_photo":
+		return record.OrthoPhotoFileName
+	}
+	return nil
+}
+
+// setLayerRecord sets the url and file name of a layer in an iteration record
+func setLayerRecord(record *request.UpdateIterationRequest, layer string, url, fileName *string) {
+	switch layer {
+	case "geojson":
+		record.GeoJSONURL = url
+		record.GeoJSONFileName = fileName
+	case "tile_3d":
+		record.Tile3DURL = url
+		record.Tile3DFileName = fileName
+	case "ortho_photo":
+		record.OrthoPhotoURL = url
+		record.OrthoPhotoFileName = fileName
+	}
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"bufio"
+	"filemanager/common/constants"
+	"filemanager/common/helpers"
+	"filemanager/storage"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// GetIterationArchive returns the files of an iteration as a zip, built while it is sent without
+// a temporary file. Each layer is a directory of the zip, the SHA256SUMS file at its root has the
+// checksum of every file. The size is not known beforehand, the zip is sent chunked
+// Params
+// companyID: ID of the company
+// projectID: ID of the project
+// iterationID: ID of the iteration
+// layers: layers to be zipped separated by commas, geojson, tile_3d and ortho_photo. Every layer if empty
+func GetIterationArchive(c *fiber.Ctx) error {
+	projectID, iterationID, ok := checkIterationURL(c)
+	if !ok {
+		return nil
+	}
+
+	layers := iterationLayers
+	if query := c.Query("layers"); query != "" {
+		layers = nil
+		for _, layer := range strings.Split(query, ",") {
+			layer = strings.TrimSpace(layer)
+			if !slices.Contains(iterationLayers, layer) {
+				helpers.BadRequest(c, fmt.Sprintf("unknown layer %s", layer), constants.ERR_FILE_UNKNOWN_LAYER)
+				return nil
+			}
+			if !slices.Contains(layers, layer) {
+				layers = append(layers, layer)
+			}
+		}
+	}
+
+	// Files are listed first, so a missing iteration is still answered with an error
+	backend := storage.GetBackend()
+	iterationKey := storage.Join(c.Params("companyID"), projectID.String(), iterationID.String())
+	files, err := listZipFiles(backend, iterationKey, layers)
+	if err != nil {
+		helpers.InternalServerError(c, err.Error())
+		return nil
+	} else if len(files) == 0 {
+		return c.Status(fiber.StatusNotFound).SendString("File not found")
+	}
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%s.zip\"", iterationID))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Status(200)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// Headers are sent already, a failure can only cut the zip short
+		if err := writeZip(w, backend, files); err != nil {
+			log.Error(fmt.Sprintf("zipping %s: %s", iterationKey, err))
+			return
+		}
+		w.Flush()
+	})
+	return nil
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"filemanager/storage"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Name of the checksums file of a zip, in the format of sha256sum so it can be checked with sha256sum -c
+const zipChecksumsName = "SHA256SUMS"
+
+// Extensions of files which are already compressed, stored as they are in a zip
+var compressedExtensions = map[string]bool{
+	".tif": true, ".tiff": true, ".jpg": true, ".jpeg": true, ".png": true, ".webp": true, ".ktx2": true,
+	".glb": true, ".b3dm": true, ".i3dm": true, ".pnts": true, ".cmpt": true,
+	".zip": true, ".gz": true, ".pmtiles": true,
+}
+
+// zipFile is a stored file and its name in a zip
+type zipFile struct {
+	key     string
+	name    string
+	modTime time.Time
+}
+
+// listZipFiles returns the files of layers of an iteration, named <layer>/<path>. Layers which do not exist are left out
+func listZipFiles(backend storage.Backend, iterationKey string, layers []string) ([]zipFile, error) {
+	var files []zipFile
+	for _, layer := range layers {
+		layerKey := storage.Join(iterationKey, layer)
+		layerFiles, err := listLayerFiles(backend, layerKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range layerFiles {
+			files = append(files, zipFile{key: fileKey(layerKey, file), name: path.Join(layer, file.Path), modTime: file.ModTime})
+		}
+	}
+	return files, nil
+}
+
+// writeZip writes files to a zip as they are read from the storage, followed by their checksums.
+// Zip64 records are written when the zip needs them, past 4 GB or 65535 files
+func writeZip(w io.Writer, backend storage.Backend, files []zipFile) error {
+	zw := zip.NewWriter(w)
+	var checksums strings.Builder
+	for _, file := range files {
+		method := zip.Deflate
+		if compressedExtensions[strings.ToLower(path.Ext(file.name))] {
+			method = zip.Store
+		}
+		entry, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: method, Modified: file.modTime})
+		if err != nil {
+			return err
+		}
+
+		reader, err := backend.Get(file.key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.key, err)
+		}
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(entry, hash), reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.key, err)
+		}
+		fmt.Fprintf(&checksums, "%x  %s\n", hash.Sum(nil), file.name)
+	}
+
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: zipChecksumsName, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(entry, checksums.String()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,313 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Statuses of a job, done, failed and cancelled are final
+const (
+	StatusQueued     = "queued"
+	StatusExtracting = "extracting"
+	StatusValidating = "validating"
+	StatusTiling     = "tiling"
+	StatusComparing  = "comparing"
+	StatusDone       = "done"
+	StatusFailed     = "failed"
+	StatusCancelled  = "cancelled"
+)
+
+var (
+	ErrNotFound  = errors.New("job not found")
+	ErrQueueFull = errors.New("too many jobs queued, try again later")
+	ErrFinished  = errors.New("job already finished")
+)
+
+// RunFunc does the work of a job, returning its result or an error code and error like the
+// service calls do, with details of the error as result when there are any. It must stop early
+// once ctx is cancelled
+type RunFunc func(ctx context.Context, job *Job) (any, int, error)
+
+// Job is a unit of background work. Owner and Project are kept to authorize who may see it
+type Job struct {
+	ID      string
+	Kind    string
+	Owner   string
+	Project string
+
+	lock        sync.Mutex
+	status      string
+	errorCode   int
+	err         string
+	result      any
+	createdTime time.Time
+	updatedTime time.Time
+	run         RunFunc
+	ctx         context.Context
+	cancel      context.CancelFunc
+	progress    map[string]*Progress
+	current     string
+	listeners   map[chan struct{}]bool
+}
+
+// Progress is how far a job got in one of its parts, like a layer of an upload
+type Progress struct {
+	Status       string `json:"status"`
+	BytesRead    int64  `json:"bytes_read"`
+	BytesTotal   int64  `json:"bytes_total"`
+	BytesWritten int64  `json:"bytes_written"`
+	Entries      int    `json:"entries"`
+	EntriesTotal int    `json:"entries_total"` // -1 until every entry is read when the archive has no index
+}
+
+// Info is a snapshot of a job, safe to encode while the job runs
+type Info struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	Status      string    `json:"status"`
+	ErrorCode   int       `json:"error_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Result      any       `json:"result,omitempty"`
+	CreatedTime time.Time `json:"created_time"`
+	UpdatedTime time.Time `json:"updated_time"`
+
+	// Current is the part last reported, Progress has every part reported so far
+	Current  string              `json:"current,omitempty"`
+	Progress map[string]Progress `json:"progress,omitempty"`
+}
+
+// SetStatus moves a running job to its next stage
+func (j *Job) SetStatus(status string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if !IsFinal(j.status) {
+		j.status = status
+		j.updatedTime = time.Now()
+		j.notify()
+	}
+}
+
+// Report updates the progress of a part of the job and makes it the current one
+func (j *Job) Report(part string, update func(progress *Progress)) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.progress == nil {
+		j.progress = map[string]*Progress{}
+	}
+	if j.progress[part] == nil {
+		j.progress[part] = &Progress{EntriesTotal: -1}
+	}
+	update(j.progress[part])
+	j.current = part
+	j.notify()
+}
+
+// Subscribe returns a channel signalled whenever the job changes, several changes in a row may
+// be signalled once. The returned func stops the signals
+func (j *Job) Subscribe() (<-chan struct{}, func()) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	changed := make(chan struct{}, 1)
+	if j.listeners == nil {
+		j.listeners = map[chan struct{}]bool{}
+	}
+	j.listeners[changed] = true
+
+	return changed, func() {
+		j.lock.Lock()
+		defer j.lock.Unlock()
+		delete(j.listeners, changed)
+	}
+}
+
+// notify signals the listeners without waiting for them, the lock must be held
+func (j *Job) notify() {
+	for listener := range j.listeners {
+		select {
+		case listener <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (j *Job) Info() Info {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	info := Info{
+		ID:          j.ID,
+		Kind:        j.Kind,
+		Status:      j.status,
+		ErrorCode:   j.errorCode,
+		Error:       j.err,
+		Result:      j.result,
+		CreatedTime: j.createdTime,
+		UpdatedTime: j.updatedTime,
+		Current:     j.current,
+	}
+	if len(j.progress) > 0 {
+		info.Progress = map[string]Progress{}
+		for part, progress := range j.progress {
+			info.Progress[part] = *progress
+		}
+	}
+	return info
+}
+
+func (j *Job) finish(result any, errCode int, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	j.updatedTime = time.Now()
+	j.result = result
+	defer j.notify()
+	switch {
+	case err == nil:
+		j.status = StatusDone
+	case j.ctx.Err() != nil:
+		j.status = StatusCancelled
+		j.err = err.Error()
+	default:
+		j.status = StatusFailed
+		j.errorCode = errCode
+		j.err = err.Error()
+	}
+}
+
+// IsFinal reports if a job with this status will not change anymore
+func IsFinal(status string) bool {
+	return status == StatusDone || status == StatusFailed || status == StatusCancelled
+}
+
+// Pool runs jobs on a fixed number of workers, jobs wait in a bounded queue
+type Pool struct {
+	lock      sync.Mutex
+	jobs      map[string]*Job
+	queue     chan *Job
+	retention time.Duration
+}
+
+var (
+	pool     *Pool
+	poolOnce sync.Once
+)
+
+// Get returns the pool, started on first use with JOB_WORKERS workers (default 2) and a queue of
+// JOB_QUEUE_SIZE jobs (default 100). Finished jobs are kept JOB_RETENTION hours (default 24)
+func Get() *Pool {
+	poolOnce.Do(func() {
+		pool = NewPool(getEnvInt("JOB_WORKERS", 2), getEnvInt("JOB_QUEUE_SIZE", 100),
+			time.Duration(getEnvInt("JOB_RETENTION", 24))*time.Hour)
+	})
+	return pool
+}
+
+func NewPool(workers, queueSize int, retention time.Duration) *Pool {
+	p := &Pool{
+		jobs:      map[string]*Job{},
+		queue:     make(chan *Job, queueSize),
+		retention: retention,
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	go p.clean()
+	return p
+}
+
+// Submit queues a job, ErrQueueFull when the queue has no room left
+func (p *Pool) Submit(kind, owner, project string, run RunFunc) (*Job, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	now := time.Now()
+	job := &Job{
+		ID:          uuid.NewString(),
+		Kind:        kind,
+		Owner:       owner,
+		Project:     project,
+		status:      StatusQueued,
+		createdTime: now,
+		updatedTime: now,
+		run:         run,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	select {
+	case p.queue <- job:
+		p.jobs[job.ID] = job
+		return job, nil
+	default:
+		cancel()
+		return nil, ErrQueueFull
+	}
+}
+
+func (p *Pool) Find(id string) (*Job, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	job, exist := p.jobs[id]
+	if !exist {
+		return nil, ErrNotFound
+	}
+	return job, nil
+}
+
+// Cancel asks a job to stop, the job still runs to undo what it did and ends as cancelled
+func (p *Pool) Cancel(id string) error {
+	job, err := p.Find(id)
+	if err != nil {
+		return err
+	}
+	if IsFinal(job.Info().Status) {
+		return ErrFinished
+	}
+
+	job.cancel()
+	return nil
+}
+
+func (p *Pool) work() {
+	for job := range p.queue {
+		// Cancelled jobs run too, they have to undo what was done before they were queued
+		result, errCode, err := job.run(job.ctx, job)
+		job.finish(result, errCode, err)
+		job.cancel()
+	}
+}
+
+// clean forgets finished jobs once they are older than the retention
+func (p *Pool) clean() {
+	for {
+		time.Sleep(time.Minute)
+
+		p.lock.Lock()
+		for id, job := range p.jobs {
+			info := job.Info()
+			if IsFinal(info.Status) && time.Since(info.UpdatedTime) > p.retention {
+				delete(p.jobs, id)
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+func getEnvInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return defaultValue
+	}
+	return value
+}
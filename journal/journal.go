@@ -0,0 +1,195 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"filemanager/common/helpers"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+var operationsBucket = []byte("operations")
+
+// ErrConflict is returned by BeginUnless when an unfinished operation conflicts with the new one
+var ErrConflict = errors.New("conflicting operation in progress")
+
+// Operation is one multi step workflow, e.g. creating an iteration. It is kept in the journal
+// from before its first step until it is finished, so an operation still in the journal after
+// a restart was interrupted and has to be completed or compensated
+type Operation struct {
+	ID          string          `json:"id"`
+	Kind        string          `json:"kind"`
+	Step        string          `json:"step"`
+	Data        json.RawMessage `json:"data"`
+	Attempts    int             `json:"attempts"`
+	CreatedTime time.Time       `json:"created_time"`
+	UpdatedTime time.Time       `json:"updated_time"`
+}
+
+// Journal persists operations in a bbolt file, every write is synced to disk before returning
+type Journal struct {
+	db *bolt.DB
+}
+
+var (
+	journal     *Journal
+	journalLock sync.Mutex
+)
+
+// Get returns the journal at GetJournalLocation, opened on first use
+func Get() *Journal {
+	journalLock.Lock()
+	defer journalLock.Unlock()
+
+	if journal == nil {
+		opened, err := Open(helpers.GetJournalLocation())
+		if err != nil {
+			log.Fatalf("failed to open journal: %v", err)
+		}
+		journal = opened
+	}
+
+	return journal
+}
+
+func Open(location string) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return nil, err
+	}
+
+	// Fail instead of waiting forever when another process holds the file
+	db, err := bolt.Open(location, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(operationsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Journal{db: db}, nil
+}
+
+func (j *Journal) Close() error {
+	return j.db.Close()
+}
+
+// Begin records a new operation at its first step
+func (j *Journal) Begin(kind, step string, data any) (*Operation, error) {
+	return j.BeginUnless(kind, step, data, nil)
+}
+
+// BeginUnless records a new operation at its first step unless conflicts reports an unfinished
+// operation conflicting with it. Both are done in one transaction, no operation begins in between
+func (j *Journal) BeginUnless(kind, step string, data any, conflicts func(*Operation) bool) (*Operation, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	operation := &Operation{
+		ID:          uuid.NewString(),
+		Kind:        kind,
+		Step:        step,
+		Data:        encoded,
+		CreatedTime: now,
+		UpdatedTime: now,
+	}
+	value, err := json.Marshal(operation)
+	if err != nil {
+		return nil, err
+	}
+
+	err = j.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(operationsBucket)
+		if conflicts != nil {
+			err := bucket.ForEach(func(_, value []byte) error {
+				var unfinished Operation
+				if json.Unmarshal(value, &unfinished) == nil && conflicts(&unfinished) {
+					return ErrConflict
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte(operation.ID), value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return operation, nil
+}
+
+// Step records that an operation reached a step, data replaces the operation's data unless nil
+func (j *Journal) Step(operation *Operation, step string, data any) error {
+	if data != nil {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		operation.Data = encoded
+	}
+	operation.Step = step
+	operation.UpdatedTime = time.Now()
+	return j.put(operation)
+}
+
+// Retry counts a failed attempt to recover an operation
+func (j *Journal) Retry(operation *Operation) error {
+	operation.Attempts++
+	operation.UpdatedTime = time.Now()
+	return j.put(operation)
+}
+
+// Finish removes a completed or compensated operation, finishing it twice is not an error
+func (j *Journal) Finish(operation *Operation) error {
+	return j.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(operationsBucket).Delete([]byte(operation.ID))
+	})
+}
+
+// Unfinished returns every operation still in the journal, oldest first
+func (j *Journal) Unfinished() ([]*Operation, error) {
+	var operations []*Operation
+	err := j.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(operationsBucket).ForEach(func(_, value []byte) error {
+			var operation Operation
+			if err := json.Unmarshal(value, &operation); err != nil {
+				return err
+			}
+			operations = append(operations, &operation)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(operations, func(i, k int) bool { return operations[i].CreatedTime.Before(operations[k].CreatedTime) })
+	return operations, nil
+}
+
+func (j *Journal) put(operation *Operation) error {
+	value, err := json.Marshal(operation)
+	if err != nil {
+		return err
+	}
+	return j.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(operationsBucket).Put([]byte(operation.ID), value)
+	})
+}
@@ -0,0 +1,66 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestBeginUnless(t *testing.T) {
+	journal, err := Open(filepath.Join(t.TempDir(), "journal.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	sameIteration := func(iteration string) func(*Operation) bool {
+		return func(unfinished *Operation) bool {
+			var data string
+			return json.Unmarshal(unfinished.Data, &data) == nil && data == iteration
+		}
+	}
+
+	// Of many operations of one iteration beginning together, only one begins
+	var wg sync.WaitGroup
+	var begun sync.Map
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			operation, err := journal.BeginUnless("update", "start", "a", sameIteration("a"))
+			if err == nil {
+				begun.Store(operation.ID, operation)
+			} else if !errors.Is(err, ErrConflict) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var operations []*Operation
+	begun.Range(func(_, value any) bool {
+		operations = append(operations, value.(*Operation))
+		return true
+	})
+	if len(operations) != 1 {
+		t.Fatalf("%d operations begun, want 1", len(operations))
+	}
+
+	// Other iterations are not held off, the iteration is free again once its operation is finished
+	if _, err := journal.BeginUnless("update", "start", "b", sameIteration("b")); err != nil {
+		t.Errorf("got %v beginning another iteration", err)
+	}
+	if err := journal.Finish(operations[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := journal.BeginUnless("update", "start", "a", sameIteration("a")); err != nil {
+		t.Errorf("got %v beginning a finished iteration", err)
+	}
+
+	unfinished, err := journal.Unfinished()
+	if err != nil || len(unfinished) != 2 {
+		t.Errorf("got %d unfinished operations and %v, want 2", len(unfinished), err)
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
+	"filemanager/handlers"
 	"filemanager/server"
+	"flag"
 	"log"
 	"os"
 
@@ -15,5 +18,30 @@ func main() {
 		}
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		reconcile(os.Args[2:])
+		return
+	}
+
 	server.RunServer()
 }
+
+// reconcile runs the storage reconciler once and prints its report. It needs the journal,
+// so run it while the server is stopped, the /maintenance/reconcile endpoint does the same online
+// Usage: filemanager reconcile [-dry-run=false] [-token TOKEN] [-refresh-token TOKEN]
+func reconcile(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", true, "only report issues, false to fix them")
+	token := flags.String("token", os.Getenv("RECONCILE_TOKEN"), "token to call the project service with")
+	refreshToken := flags.String("refresh-token", os.Getenv("RECONCILE_REFRESH_TOKEN"), "refresh token to call the project service with")
+	flags.Parse(args)
+
+	report, err := handlers.RunReconcile(*dryRun, *token, *refreshToken)
+	if err != nil {
+		log.Fatalf("reconcile failed: %v", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
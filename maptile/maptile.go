@@ -0,0 +1,169 @@
+package maptile
+
+import (
+	"filemanager/geotiff"
+	"fmt"
+	"image"
+	"math"
+)
+
+// Tiles are squares of this many pixels in Web Mercator (EPSG:3857), numbered like XYZ tiles:
+// zoom z has 2^z by 2^z tiles, x from the west and y from the north
+const Size = 256
+
+// Zoom levels served at most
+const MaxZoom = 24
+
+// Sources are not drawn at zooms where a tile pixel covers more pixels of their smallest level than this
+// across, every block of the image would be decoded for a few tiles otherwise. Overviews lower the zoom
+const maxDownsampling = 16
+
+// Half of the width of the Web Mercator world in meters
+const worldExtent = 20037508.342789244
+
+var webMercator = geotiff.ProjectionOf(&geotiff.CRS{Model: "projected", EPSG: 3857})
+
+// Valid reports if z/x/y is a tile of the world
+func Valid(z, x, y int) bool {
+	return z >= 0 && z <= MaxZoom && x >= 0 && y >= 0 && x < 1<<z && y < 1<<z
+}
+
+// resolution returns the size in meters of a pixel of zoom z
+func resolution(z int) float64 {
+	return 2 * worldExtent / float64(int64(Size)<<z)
+}
+
+// Bounds returns the west, south, east, north of a tile in WGS 84 degrees
+func Bounds(z, x, y int) []float64 {
+	west, north := webMercator.Inverse(-worldExtent+float64(x*Size)*resolution(z), worldExtent-float64(y*Size)*resolution(z))
+	east, south := webMercator.Inverse(-worldExtent+float64((x+1)*Size)*resolution(z), worldExtent-float64((y+1)*Size)*resolution(z))
+	return []float64{west, south, east, north}
+}
+
+// Source is an image tiles are rendered from
+type Source struct {
+	Image      *geotiff.Image
+	Projection geotiff.Projection
+
+	// Block returns a decoded block of a level of the image, so callers can cache blocks
+	Block func(level, index int) (*image.NRGBA, error)
+
+	inverse [4]float64 // map coordinates to pixels of the main image, without the origin
+}
+
+// NewSource returns a source of a georeferenced image in a CRS with a known projection
+func NewSource(img *geotiff.Image, block func(level, index int) (*image.NRGBA, error)) (*Source, error) {
+	metadata := img.Metadata
+	if !metadata.Georeferenced || metadata.BBox == nil {
+		return nil, fmt.Errorf("image is not georeferenced in a known CRS")
+	}
+
+	g := metadata.GeoTransform
+	determinant := g[1]*g[5] - g[2]*g[4]
+	if determinant == 0 {
+		return nil, fmt.Errorf("image has a singular geotransform")
+	}
+	return &Source{
+		Image:      img,
+		Projection: geotiff.ProjectionOf(metadata.CRS),
+		Block:      block,
+		inverse:    [4]float64{g[5] / determinant, -g[2] / determinant, -g[4] / determinant, g[1] / determinant},
+	}, nil
+}
+
+// pixel returns the column and row of the main image at a longitude and latitude
+func (s *Source) pixel(longitude, latitude float64) (float64, float64) {
+	x, y := s.Projection.Forward(longitude, latitude)
+	g := s.Image.Metadata.GeoTransform
+	x, y = x-g[0], y-g[3]
+	return s.inverse[0]*x + s.inverse[1]*y, s.inverse[2]*x + s.inverse[3]*y
+}
+
+// MaxZoom returns the zoom whose pixels are as small as the pixels of the image
+func (s *Source) MaxZoom() int {
+	bbox := s.Image.Metadata.BBox
+	west, south := webMercator.Forward(bbox[0], bbox[1])
+	east, north := webMercator.Forward(bbox[2], bbox[3])
+	pixelSize := math.Min((east-west)/float64(s.Image.Metadata.Width), (north-south)/float64(s.Image.Metadata.Height))
+	if pixelSize <= 0 {
+		return MaxZoom
+	}
+	return max(0, min(MaxZoom, int(math.Ceil(math.Log2(resolution(0)/pixelSize)))))
+}
+
+// Render draws a tile from sources, later sources over earlier ones. Returns false when no source covers the tile
+func Render(sources []*Source, z, x, y int) (*image.NRGBA, bool, error) {
+	tile := image.NewNRGBA(image.Rect(0, 0, Size, Size))
+	bounds := Bounds(z, x, y)
+	drawn := false
+	for _, source := range sources {
+		bbox := source.Image.Metadata.BBox
+		if bbox[0] > bounds[2] || bbox[2] < bounds[0] || bbox[1] > bounds[3] || bbox[3] < bounds[1] {
+			continue
+		}
+		sourceDrawn, err := source.render(tile, z, x, y)
+		if err != nil {
+			return nil, false, err
+		}
+		drawn = drawn || sourceDrawn
+	}
+	return tile, drawn, nil
+}
+
+// render samples the nearest pixel of the level closest to the resolution of the tile
+func (s *Source) render(tile *image.NRGBA, z, x, y int) (bool, error) {
+	res := resolution(z)
+	originX, originY := -worldExtent+float64(x*Size)*res, worldExtent-float64(y*Size)*res
+
+	// Pixels of the main image under a pixel of the tile, at its center
+	centerX, centerY := originX+Size/2*res, originY-Size/2*res
+	column0, row0 := s.pixel(webMercator.Inverse(centerX, centerY))
+	column1, row1 := s.pixel(webMercator.Inverse(centerX+res, centerY))
+	scale := math.Hypot(column1-column0, row1-row0)
+
+	levels := s.Image.Levels
+	level := 0
+	for i := 1; i < len(levels); i++ {
+		if float64(levels[0].Width)/float64(levels[i].Width) <= scale {
+			level = i
+		}
+	}
+	l := levels[level]
+	if scale*float64(l.Width)/float64(levels[0].Width) > maxDownsampling {
+		return false, nil
+	}
+	scaleX, scaleY := float64(l.Width)/float64(levels[0].Width), float64(l.Height)/float64(levels[0].Height)
+
+	drawn := false
+	blocks := map[int]*image.NRGBA{}
+	for py := 0; py < Size; py++ {
+		for px := 0; px < Size; px++ {
+			longitude, latitude := webMercator.Inverse(originX+(float64(px)+0.5)*res, originY-(float64(py)+0.5)*res)
+			column, row := s.pixel(longitude, latitude)
+			column, row = column*scaleX, row*scaleY
+			if column < 0 || row < 0 || column >= float64(l.Width) || row >= float64(l.Height) {
+				continue
+			}
+
+			c, r := int(column), int(row)
+			index := r/l.BlockHeight*l.BlocksAcross + c/l.BlockWidth
+			block, exist := blocks[index]
+			if !exist {
+				var err error
+				if block, err = s.Block(level, index); err != nil {
+					return false, err
+				}
+				blocks[index] = block
+			}
+
+			from := block.PixOffset(c%l.BlockWidth, r%l.BlockHeight)
+			if block.Pix[from+3] == 0 {
+				continue
+			}
+			to := tile.PixOffset(px, py)
+			copy(tile.Pix[to:to+4], block.Pix[from:from+4])
+			drawn = true
+		}
+	}
+	return drawn, nil
+}
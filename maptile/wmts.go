@@ -0,0 +1,89 @@
+package maptile
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Scale denominator of zoom 0 in the GoogleMapsCompatible tile matrix set of WMTS 1.0
+const scaleDenominator = 559082264.0287178
+
+// Layer is a layer of a WMTS capabilities document
+type Layer struct {
+	Identifier string
+	Title      string
+	BBox       []float64 // west, south, east, north in WGS 84 degrees
+	MaxZoom    int
+	URL        string // template of the tile URL, with {TileMatrix}, {TileCol} and {TileRow}
+}
+
+// Capabilities returns a WMTS 1.0 GetCapabilities document of layers served as PNG tiles in the
+// GoogleMapsCompatible tile matrix set, which is the same grid as XYZ tiles
+func Capabilities(title, url string, layers []Layer) []byte {
+	maxZoom := 0
+	for _, layer := range layers {
+		maxZoom = max(maxZoom, layer.MaxZoom)
+	}
+
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<Capabilities xmlns="http://www.opengis.net/wmts/1.0" xmlns:ows="http://www.opengis.net/ows/1.1" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.0.0">` + "\n")
+	fmt.Fprintf(&b, "  <ows:ServiceIdentification>\n    <ows:Title>%s</ows:Title>\n", escape(title))
+	b.WriteString("    <ows:ServiceType>OGC WMTS</ows:ServiceType>\n    <ows:ServiceTypeVersion>1.0.0</ows:ServiceTypeVersion>\n  </ows:ServiceIdentification>\n")
+	b.WriteString("  <Contents>\n")
+	for _, layer := range layers {
+		b.WriteString("    <Layer>\n")
+		fmt.Fprintf(&b, "      <ows:Title>%s</ows:Title>\n", escape(layer.Title))
+		fmt.Fprintf(&b, "      <ows:WGS84BoundingBox>\n        <ows:LowerCorner>%s %s</ows:LowerCorner>\n        <ows:UpperCorner>%s %s</ows:UpperCorner>\n      </ows:WGS84BoundingBox>\n",
+			number(layer.BBox[0]), number(layer.BBox[1]), number(layer.BBox[2]), number(layer.BBox[3]))
+		fmt.Fprintf(&b, "      <ows:Identifier>%s</ows:Identifier>\n", escape(layer.Identifier))
+		b.WriteString("      <Style isDefault=\"true\">\n        <ows:Identifier>default</ows:Identifier>\n      </Style>\n")
+		b.WriteString("      <Format>image/png</Format>\n")
+		b.WriteString("      <TileMatrixSetLink>\n        <TileMatrixSet>GoogleMapsCompatible</TileMatrixSet>\n        <TileMatrixSetLimits>\n")
+		for z := 0; z <= layer.MaxZoom; z++ {
+			west, north := tileOf(layer.BBox[0], layer.BBox[3], z)
+			east, south := tileOf(layer.BBox[2], layer.BBox[1], z)
+			fmt.Fprintf(&b, "          <TileMatrixLimits>\n            <TileMatrix>%d</TileMatrix>\n            <MinTileRow>%d</MinTileRow>\n            <MaxTileRow>%d</MaxTileRow>\n            <MinTileCol>%d</MinTileCol>\n            <MaxTileCol>%d</MaxTileCol>\n          </TileMatrixLimits>\n",
+				z, north, south, west, east)
+		}
+		b.WriteString("        </TileMatrixSetLimits>\n      </TileMatrixSetLink>\n")
+		fmt.Fprintf(&b, "      <ResourceURL format=\"image/png\" resourceType=\"tile\" template=\"%s\"/>\n", escape(layer.URL))
+		b.WriteString("    </Layer>\n")
+	}
+
+	b.WriteString("    <TileMatrixSet>\n      <ows:Identifier>GoogleMapsCompatible</ows:Identifier>\n")
+	b.WriteString("      <ows:SupportedCRS>urn:ogc:def:crs:EPSG::3857</ows:SupportedCRS>\n")
+	b.WriteString("      <WellKnownScaleSet>urn:ogc:def:wkss:OGC:1.0:GoogleMapsCompatible</WellKnownScaleSet>\n")
+	for z := 0; z <= maxZoom; z++ {
+		fmt.Fprintf(&b, "      <TileMatrix>\n        <ows:Identifier>%d</ows:Identifier>\n        <ScaleDenominator>%s</ScaleDenominator>\n", z, number(scaleDenominator/float64(int64(1)<<z)))
+		fmt.Fprintf(&b, "        <TopLeftCorner>%s %s</TopLeftCorner>\n", number(-worldExtent), number(worldExtent))
+		fmt.Fprintf(&b, "        <TileWidth>%d</TileWidth>\n        <TileHeight>%d</TileHeight>\n", Size, Size)
+		fmt.Fprintf(&b, "        <MatrixWidth>%d</MatrixWidth>\n        <MatrixHeight>%d</MatrixHeight>\n      </TileMatrix>\n", 1<<z, 1<<z)
+	}
+	b.WriteString("    </TileMatrixSet>\n  </Contents>\n")
+	fmt.Fprintf(&b, "  <ServiceMetadataURL xlink:href=\"%s\"/>\n", escape(url))
+	b.WriteString("</Capabilities>\n")
+	return []byte(b.String())
+}
+
+// tileOf returns the column and row of the tile of zoom z at a longitude and latitude
+func tileOf(longitude, latitude float64, z int) (int, int) {
+	x, y := webMercator.Forward(longitude, max(-85.0511, min(85.0511, latitude)))
+	last := 1<<z - 1
+	column := int(math.Floor((x + worldExtent) / resolution(z) / Size))
+	row := int(math.Floor((worldExtent - y) / resolution(z) / Size))
+	return max(0, min(last, column)), max(0, min(last, row))
+}
+
+func number(value float64) string {
+	return fmt.Sprintf("%.10g", value)
+}
+
+func escape(text string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
@@ -22,3 +22,9 @@ type UpdateIterationRequest struct {
 	Tile3DURL          *string   `json:"tile_3d_url"`
 	Tile3DFileName     *string   `json:"tile_3d_file_name"`
 }
+
+type RollbackIterationRequest struct {
+	ID        uuid.UUID `json:"id"`
+	Layer     string    `json:"layer"`
+	VersionID string    `json:"version_id"`
+}
@@ -7,3 +7,8 @@ type GetUserSpecificPermissionRequest struct {
 	PermissionType  string     `json:"permission_type"`
 	PermissionLevel string     `json:"permission_level"`
 }
+
+type InvalidatePermissionCacheRequest struct {
+	UserID    string     `json:"user_id"`
+	ProjectID *uuid.UUID `json:"project_id"`
+}
@@ -0,0 +1,7 @@
+package response
+
+type BlobCollectionReport struct {
+	PrunedVersions int   `json:"pruned_versions"`
+	Collected      int   `json:"collected"`
+	FreedBytes     int64 `json:"freed_bytes"`
+}
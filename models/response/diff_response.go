@@ -0,0 +1,20 @@
+package response
+
+import "github.com/google/uuid"
+
+// DiffAcceptedResponse answers a diff of iterations which a job is computing, it is at URL once the job is done
+type DiffAcceptedResponse struct {
+	JobID string `json:"job_id"`
+	URL   string `json:"url"`
+}
+
+// IterationDiffResponse is the result of a job computing a diff of iterations, counts are of features
+type IterationDiffResponse struct {
+	URL             string    `json:"url"`
+	FromIterationID uuid.UUID `json:"from_iteration_id"`
+	ToIterationID   uuid.UUID `json:"to_iteration_id"`
+	Added           int       `json:"added"`
+	Removed         int       `json:"removed"`
+	Modified        int       `json:"modified"`
+	Unchanged       int       `json:"unchanged"`
+}
@@ -0,0 +1,22 @@
+package response
+
+import "time"
+
+// FileListResponse is a page of the files of an iteration, Total counts every file matching the filters
+type FileListResponse struct {
+	Files []FileResponse `json:"files"`
+	Page  int            `json:"page"`
+	Count int            `json:"count"`
+	Total int            `json:"total"`
+}
+
+// FileResponse is a file of a layer, SHA256 is empty for layers uploaded before checksums were kept
+type FileResponse struct {
+	Layer       string    `json:"layer"`
+	Path        string    `json:"path"`
+	URL         string    `json:"url"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"modified_time"`
+	ContentType string    `json:"content_type"`
+	SHA256      string    `json:"sha256,omitempty"`
+}
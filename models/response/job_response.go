@@ -0,0 +1,7 @@
+package response
+
+// JobAcceptedResponse answers a request whose work continues in a job
+type JobAcceptedResponse struct {
+	JobID     string            `json:"job_id"`
+	Iteration IterationResponse `json:"iteration"`
+}
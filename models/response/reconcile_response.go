@@ -0,0 +1,27 @@
+package response
+
+// Kinds of reconcile issues
+const (
+	ReconcileOrphanDirectory  = "orphan_directory"
+	ReconcileOrphanLayer      = "orphan_layer"
+	ReconcileTempDirectory    = "temp_directory"
+	ReconcileDanglingURL      = "dangling_url"
+	ReconcileUnknownDirectory = "unknown_directory"
+	ReconcileCheckFailed      = "check_failed"
+)
+
+type ReconcileReport struct {
+	DryRun            bool             `json:"dry_run"`
+	CheckedIterations int              `json:"checked_iterations"`
+	SkippedIterations int              `json:"skipped_iterations"`
+	Issues            []ReconcileIssue `json:"issues"`
+}
+
+type ReconcileIssue struct {
+	Kind        string `json:"kind"`
+	Path        string `json:"path"`
+	IterationID string `json:"iteration_id,omitempty"`
+	Layer       string `json:"layer,omitempty"`
+	Fixed       bool   `json:"fixed"`
+	Error       string `json:"error,omitempty"`
+}
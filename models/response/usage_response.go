@@ -0,0 +1,19 @@
+package response
+
+import "time"
+
+// CompanyUsageResponse is the storage used by a company in bytes, Limit 0 means unlimited
+type CompanyUsageResponse struct {
+	CompanyID    string                 `json:"company_id"`
+	Used         int64                  `json:"used"`
+	Limit        int64                  `json:"limit"`
+	Layers       map[string]int64       `json:"layers"`
+	Projects     []ProjectUsageResponse `json:"projects"`
+	VerifiedTime *time.Time             `json:"verified_time"`
+}
+
+type ProjectUsageResponse struct {
+	ProjectID string           `json:"project_id"`
+	Used      int64            `json:"used"`
+	Layers    map[string]int64 `json:"layers"`
+}
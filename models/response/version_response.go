@@ -0,0 +1,15 @@
+package response
+
+import "time"
+
+// LayerVersionResponse is a previous version of a layer, kept when the layer was replaced or removed.
+// CreatedTime is zero for layers uploaded before manifests were kept
+type LayerVersionResponse struct {
+	ID           string    `json:"id"`
+	Layer        string    `json:"layer"`
+	FileName     *string   `json:"file_name"`
+	CreatedTime  time.Time `json:"created_time"`
+	ReplacedTime time.Time `json:"replaced_time"`
+	Files        int       `json:"files"`
+	Size         int64     `json:"size"`
+}
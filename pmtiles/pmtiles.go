@@ -0,0 +1,234 @@
+package pmtiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// PMTiles version 3 archives: a header, a directory of tile IDs to offsets, JSON metadata, leaf
+// directories when the root one does not fit in the first 16 KB, then the tile data. See
+// https://github.com/protomaps/PMTiles/blob/main/spec/v3/spec.md
+const (
+	headerSize  = 127
+	rootMaxSize = 16384 - headerSize
+	version     = 3
+)
+
+// Compressions of directories, metadata and tiles
+const (
+	CompressionNone = 1
+	CompressionGzip = 2
+)
+
+// Tile types
+const (
+	TileTypeMVT = 1
+	TileTypePNG = 2
+)
+
+// FormatError is a file which is not a readable PMTiles archive
+type FormatError struct {
+	Reason string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("invalid PMTiles: %s", e.Reason)
+}
+
+// Header describes an archive, offsets and counts are filled when it is written
+type Header struct {
+	TileType        byte
+	TileCompression byte
+	MinZoom         byte
+	MaxZoom         byte
+	Bounds          [4]float64 // west, south, east, north in degrees
+	CenterZoom      byte
+	Center          [2]float64 // longitude, latitude
+
+	rootOffset, rootLength         uint64
+	metadataOffset, metadataLength uint64
+	leafOffset, leafLength         uint64
+	dataOffset, dataLength         uint64
+	addressedTiles, tileEntries    uint64
+	tileContents                   uint64
+	clustered                      bool
+	internalCompression            byte
+}
+
+func (h *Header) encode() []byte {
+	b := make([]byte, headerSize)
+	copy(b, "PMTiles")
+	b[7] = version
+	for i, value := range []uint64{h.rootOffset, h.rootLength, h.metadataOffset, h.metadataLength, h.leafOffset,
+		h.leafLength, h.dataOffset, h.dataLength, h.addressedTiles, h.tileEntries, h.tileContents} {
+		binary.LittleEndian.PutUint64(b[8+8*i:], value)
+	}
+	if h.clustered {
+		b[96] = 1
+	}
+	b[97], b[98], b[99], b[100], b[101] = h.internalCompression, h.TileCompression, h.TileType, h.MinZoom, h.MaxZoom
+	for i, value := range h.Bounds {
+		binary.LittleEndian.PutUint32(b[102+4*i:], uint32(int32(math.Round(value*1e7))))
+	}
+	b[118] = h.CenterZoom
+	binary.LittleEndian.PutUint32(b[119:], uint32(int32(math.Round(h.Center[0]*1e7))))
+	binary.LittleEndian.PutUint32(b[123:], uint32(int32(math.Round(h.Center[1]*1e7))))
+	return b
+}
+
+func decodeHeader(b []byte) (*Header, error) {
+	if len(b) < headerSize || string(b[:7]) != "PMTiles" {
+		return nil, &FormatError{Reason: "no PMTiles magic number"}
+	}
+	if b[7] != version {
+		return nil, &FormatError{Reason: fmt.Sprintf("version %d is not supported", b[7])}
+	}
+	h := &Header{}
+	for i, value := range []*uint64{&h.rootOffset, &h.rootLength, &h.metadataOffset, &h.metadataLength, &h.leafOffset,
+		&h.leafLength, &h.dataOffset, &h.dataLength, &h.addressedTiles, &h.tileEntries, &h.tileContents} {
+		*value = binary.LittleEndian.Uint64(b[8+8*i:])
+	}
+	h.clustered = b[96] == 1
+	h.internalCompression, h.TileCompression, h.TileType, h.MinZoom, h.MaxZoom = b[97], b[98], b[99], b[100], b[101]
+	for i := range h.Bounds {
+		h.Bounds[i] = float64(int32(binary.LittleEndian.Uint32(b[102+4*i:]))) / 1e7
+	}
+	h.CenterZoom = b[118]
+	h.Center[0] = float64(int32(binary.LittleEndian.Uint32(b[119:]))) / 1e7
+	h.Center[1] = float64(int32(binary.LittleEndian.Uint32(b[123:]))) / 1e7
+	return h, nil
+}
+
+// TileID numbers tiles along a Hilbert curve per zoom, after every tile of the lower zooms
+func TileID(z, x, y int) uint64 {
+	var id uint64
+	for i := 0; i < z; i++ {
+		id += uint64(1) << (2 * i)
+	}
+	n := 1 << z
+	for s := n / 2; s > 0; s /= 2 {
+		rx, ry := 0, 0
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		id += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+		if ry == 0 {
+			if rx == 1 {
+				x, y = n-1-x, n-1-y
+			}
+			x, y = y, x
+		}
+	}
+	return id
+}
+
+// entry points to a run of tiles with the same data, or to a leaf directory when RunLength is 0
+type entry struct {
+	tileID    uint64
+	offset    uint64
+	length    uint32
+	runLength uint32
+}
+
+func encodeDirectory(entries []entry) ([]byte, error) {
+	b := binary.AppendUvarint(nil, uint64(len(entries)))
+	var lastID uint64
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, e.tileID-lastID)
+		lastID = e.tileID
+	}
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, uint64(e.runLength))
+	}
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, uint64(e.length))
+	}
+	for i, e := range entries {
+		// 0 is an offset right after the previous entry
+		if i > 0 && e.offset == entries[i-1].offset+uint64(entries[i-1].length) {
+			b = binary.AppendUvarint(b, 0)
+		} else {
+			b = binary.AppendUvarint(b, e.offset+1)
+		}
+	}
+	return compress(b)
+}
+
+func decodeDirectory(data []byte, compression byte) ([]entry, error) {
+	data, err := decompress(data, compression)
+	if err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(data)
+	next := func() uint64 {
+		value, readErr := binary.ReadUvarint(reader)
+		if readErr != nil && err == nil {
+			err = &FormatError{Reason: "truncated directory"}
+		}
+		return value
+	}
+
+	count := next()
+	if count > uint64(len(data)) {
+		return nil, &FormatError{Reason: "directory has more entries than bytes"}
+	}
+	entries := make([]entry, count)
+	var lastID uint64
+	for i := range entries {
+		lastID += next()
+		entries[i].tileID = lastID
+	}
+	for i := range entries {
+		entries[i].runLength = uint32(next())
+	}
+	for i := range entries {
+		entries[i].length = uint32(next())
+	}
+	for i := range entries {
+		offset := next()
+		if offset == 0 && i > 0 {
+			entries[i].offset = entries[i-1].offset + uint64(entries[i-1].length)
+		} else {
+			entries[i].offset = offset - 1
+		}
+	}
+	return entries, err
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decompress(data []byte, compression byte) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, &FormatError{Reason: err.Error()}
+		}
+		decompressed, err := io.ReadAll(reader)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, &FormatError{Reason: err.Error()}
+		}
+		return decompressed, nil
+	}
+	return nil, &FormatError{Reason: fmt.Sprintf("compression %d is not supported", compression)}
+}
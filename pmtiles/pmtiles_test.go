@@ -0,0 +1,113 @@
+package pmtiles
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Tile IDs of the specification, along a Hilbert curve per zoom
+func TestTileID(t *testing.T) {
+	for _, test := range []struct {
+		z, x, y int
+		want    uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1},
+		{1, 0, 1, 2},
+		{1, 1, 1, 3},
+		{1, 1, 0, 4},
+		{2, 0, 0, 5},
+		{3, 7, 0, 84},
+		{12, 3423, 1763, 19078479},
+	} {
+		if id := TileID(test.z, test.x, test.y); id != test.want {
+			t.Errorf("%d/%d/%d: got %d, want %d", test.z, test.x, test.y, id, test.want)
+		}
+	}
+
+	// Every tile of a zoom has its own ID after the lower zooms
+	seen := map[uint64]bool{}
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			id := TileID(4, x, y)
+			if seen[id] || id < 85 || id >= 85+256 {
+				t.Fatalf("4/%d/%d: got %d, want a new ID from 85 to 340", x, y, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	header := &Header{
+		TileType: TileTypeMVT, TileCompression: CompressionGzip, MinZoom: 1, MaxZoom: 14,
+		Bounds: [4]float64{-180, -85.0511287, 180, 85.0511287}, CenterZoom: 7, Center: [2]float64{2.3522219, 48.856614},
+		rootOffset: 127, rootLength: 10, metadataOffset: 137, metadataLength: 20, leafOffset: 157, leafLength: 0,
+		dataOffset: 157, dataLength: 1 << 40, addressedTiles: 5, tileEntries: 4, tileContents: 3, clustered: true,
+		internalCompression: CompressionGzip,
+	}
+	decoded, err := decodeHeader(header.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, header) {
+		t.Errorf("got %+v, want %+v", decoded, header)
+	}
+
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"short", header.encode()[:100]},
+		{"magic", append([]byte("MBTiles"), header.encode()[7:]...)},
+		{"version", append(append([]byte("PMTiles"), 2), header.encode()[8:]...)},
+	} {
+		_, err := decodeHeader(test.data)
+		var formatErr *FormatError
+		if !errors.As(err, &formatErr) {
+			t.Errorf("%s: got %v, want a FormatError", test.name, err)
+		}
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	entries := []entry{
+		{tileID: 0, offset: 0, length: 10, runLength: 1},
+		{tileID: 1, offset: 10, length: 20, runLength: 3},
+		{tileID: 7, offset: 0, length: 10, runLength: 1},
+		{tileID: 1 << 40, offset: 5000, length: 100, runLength: 0},
+	}
+	data, err := encodeDirectory(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeDirectory(data, CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, entries) {
+		t.Errorf("got %+v, want %+v", decoded, entries)
+	}
+
+	raw, err := decompress(data, CompressionGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name        string
+		data        []byte
+		compression byte
+	}{
+		{"truncated", raw[:len(raw)-1], CompressionNone},
+		{"more entries than bytes", []byte{0x7f, 1}, CompressionNone},
+		{"not gzip", raw, CompressionGzip},
+		{"unknown compression", data, 3},
+	} {
+		_, err := decodeDirectory(test.data, test.compression)
+		var formatErr *FormatError
+		if !errors.As(err, &formatErr) {
+			t.Errorf("%s: got %v, want a FormatError", test.name, err)
+		}
+	}
+}
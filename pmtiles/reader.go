@@ -0,0 +1,116 @@
+package pmtiles
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Leaf directories kept parsed by a reader at most
+const maxCachedLeaves = 64
+
+// Reader finds the tiles of an archive, safe for concurrent use
+type Reader struct {
+	Header *Header
+
+	r    io.ReaderAt
+	size int64
+	root []entry
+
+	lock   sync.Mutex
+	leaves map[uint64][]entry
+}
+
+// Open reads the header and root directory of an archive
+func Open(r io.ReaderAt, size int64) (*Reader, error) {
+	reader := &Reader{r: r, size: size, leaves: map[uint64][]entry{}}
+	data, err := reader.read(0, headerSize)
+	if err != nil {
+		return nil, err
+	}
+	if reader.Header, err = decodeHeader(data); err != nil {
+		return nil, err
+	}
+
+	data, err = reader.read(reader.Header.rootOffset, reader.Header.rootLength)
+	if err != nil {
+		return nil, err
+	}
+	if reader.root, err = decodeDirectory(data, reader.Header.internalCompression); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Metadata returns the JSON metadata of the archive
+func (r *Reader) Metadata() ([]byte, error) {
+	data, err := r.read(r.Header.metadataOffset, r.Header.metadataLength)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(data, r.Header.internalCompression)
+}
+
+// Tile returns the data of a tile as stored, compressed by Header.TileCompression. Nil when the archive does not have it
+func (r *Reader) Tile(z, x, y int) ([]byte, error) {
+	id := TileID(z, x, y)
+	entries := r.root
+	for depth := 0; depth < 4; depth++ {
+		// The last entry at or before the tile
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].tileID > id }) - 1
+		if i < 0 {
+			return nil, nil
+		}
+		e := entries[i]
+		if e.runLength > 0 {
+			if id >= e.tileID+uint64(e.runLength) {
+				return nil, nil
+			}
+			return r.read(r.Header.dataOffset+e.offset, uint64(e.length))
+		}
+
+		var err error
+		if entries, err = r.leaf(e); err != nil {
+			return nil, err
+		}
+	}
+	return nil, &FormatError{Reason: "leaf directories are nested too deep"}
+}
+
+func (r *Reader) leaf(e entry) ([]entry, error) {
+	r.lock.Lock()
+	entries, exist := r.leaves[e.offset]
+	r.lock.Unlock()
+	if exist {
+		return entries, nil
+	}
+
+	data, err := r.read(r.Header.leafOffset+e.offset, uint64(e.length))
+	if err != nil {
+		return nil, err
+	}
+	if entries, err = decodeDirectory(data, r.Header.internalCompression); err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	if len(r.leaves) >= maxCachedLeaves {
+		r.leaves = map[uint64][]entry{}
+	}
+	r.leaves[e.offset] = entries
+	r.lock.Unlock()
+	return entries, nil
+}
+
+func (r *Reader) read(offset, length uint64) ([]byte, error) {
+	if offset+length > uint64(r.size) || offset+length < offset {
+		return nil, &FormatError{Reason: fmt.Sprintf("%d bytes at %d are past the end of the file", length, offset)}
+	}
+	data := make([]byte, length)
+	if _, err := r.r.ReadAt(data, int64(offset)); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,165 @@
+package pmtiles
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	tiles := map[[3]int][]byte{
+		{0, 0, 0}: []byte("world"),
+		{1, 0, 0}: []byte("north west"),
+		{1, 0, 1}: []byte("south west"),
+		{1, 1, 1}: []byte("south east"),
+		// Ocean: the same data for tiles 4 to 7 and 15, stored once
+		{1, 1, 0}: []byte("ocean"),
+		{2, 0, 0}: []byte("ocean"),
+		{2, 1, 0}: []byte("ocean"),
+		{2, 1, 1}: []byte("ocean"),
+		{2, 3, 3}: []byte("ocean"),
+	}
+	var data bytes.Buffer
+	writer := NewWriter(&data)
+	// In any order
+	for _, z := range []int{2, 0, 1} {
+		for tile, content := range tiles {
+			if tile[0] == z {
+				if err := writer.WriteTile(tile[0], tile[1], tile[2], content); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	reader := open(t, writer, &data, Header{TileType: TileTypePNG, MaxZoom: 2}, []byte(`{"name": "test"}`))
+
+	// Tiles 4 to 7 are one run
+	if h := reader.Header; h.addressedTiles != 9 || h.tileEntries != 6 || h.tileContents != 5 || h.leafLength != 0 {
+		t.Errorf("got %d tiles in %d entries of %d contents and %d bytes of leaves, want 9 tiles in 6 entries of 5 contents without leaves",
+			h.addressedTiles, h.tileEntries, h.tileContents, h.leafLength)
+	}
+	if h := reader.Header; h.TileType != TileTypePNG || h.MaxZoom != 2 {
+		t.Errorf("got header %+v, want the one written", h)
+	}
+	if metadata, err := reader.Metadata(); err != nil || string(metadata) != `{"name": "test"}` {
+		t.Errorf("got metadata %s and %v, want the one written", metadata, err)
+	}
+	for tile, content := range tiles {
+		if got, err := reader.Tile(tile[0], tile[1], tile[2]); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%v: got %q and %v, want %q", tile, got, err, content)
+		}
+	}
+	for _, tile := range [][3]int{{2, 0, 1}, {2, 3, 0}, {2, 3, 2}, {3, 0, 0}} {
+		if got, err := reader.Tile(tile[0], tile[1], tile[2]); got != nil || err != nil {
+			t.Errorf("%v: got %q and %v, want no tile", tile, got, err)
+		}
+	}
+}
+
+// Root directories larger than 16 KB are split in leaves
+func TestReaderLeaves(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tiles := map[[3]int][]byte{}
+	var data bytes.Buffer
+	writer := NewWriter(&data)
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 256; y++ {
+			if rng.Intn(2) == 0 {
+				continue
+			}
+			content := []byte(fmt.Sprintf("%d/%d%s", x, y, bytes.Repeat([]byte{'.'}, rng.Intn(200))))
+			tiles[[3]int{8, x, y}] = content
+			if err := writer.WriteTile(8, x, y, content); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	reader := open(t, writer, &data, Header{}, []byte("{}"))
+	if reader.Header.leafLength == 0 || reader.Header.rootLength > rootMaxSize {
+		t.Fatalf("got a root of %d bytes and %d bytes of leaves, want leaves", reader.Header.rootLength, reader.Header.leafLength)
+	}
+
+	for tile, content := range tiles {
+		if got, err := reader.Tile(tile[0], tile[1], tile[2]); err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("%v: got %q and %v, want %q", tile, got, err, content)
+		}
+	}
+	for x := 0; x < 256; x++ {
+		if _, exist := tiles[[3]int{8, x, 0}]; !exist {
+			if got, err := reader.Tile(8, x, 0); got != nil || err != nil {
+				t.Errorf("8/%d/0: got %q and %v, want no tile", x, got, err)
+			}
+		}
+	}
+	if len(reader.leaves) > maxCachedLeaves {
+		t.Errorf("got %d cached leaves, want %d at most", len(reader.leaves), maxCachedLeaves)
+	}
+}
+
+// Offsets and lengths past the end of the file are a FormatError, never a read out of bounds
+func TestReaderRejects(t *testing.T) {
+	var data bytes.Buffer
+	writer := NewWriter(&data)
+	if err := writer.WriteTile(0, 0, 0, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	start, err := writer.Finish(Header{}, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := append(start, data.Bytes()...)
+
+	for _, test := range []struct {
+		name   string
+		data   []byte
+		header func(h *Header)
+	}{
+		{"no header", archive[:headerSize-1], nil},
+		{"root past the end", nil, func(h *Header) { h.rootLength = uint64(len(archive)) }},
+		{"root overflowing", nil, func(h *Header) { h.rootOffset = 1<<64 - 1 }},
+		{"root of another compression", nil, func(h *Header) { h.internalCompression = CompressionNone }},
+	} {
+		data := test.data
+		if test.header != nil {
+			h, err := decodeHeader(archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.header(h)
+			data = append(h.encode(), archive[headerSize:]...)
+		}
+		_, err := Open(bytes.NewReader(data), int64(len(data)))
+		var formatErr *FormatError
+		if !errors.As(err, &formatErr) {
+			t.Errorf("%s: got %v, want a FormatError", test.name, err)
+		}
+	}
+
+	// A tile past the end of a truncated archive
+	truncated := archive[:len(archive)-1]
+	reader, err := Open(bytes.NewReader(truncated), int64(len(truncated)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var formatErr *FormatError
+	if _, err := reader.Tile(0, 0, 0); !errors.As(err, &formatErr) {
+		t.Errorf("got %v, want a FormatError", err)
+	}
+}
+
+// open finishes the archive of a writer and opens it
+func open(t *testing.T, writer *Writer, data *bytes.Buffer, header Header, metadata []byte) *Reader {
+	t.Helper()
+	start, err := writer.Finish(header, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := append(start, data.Bytes()...)
+	reader, err := Open(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
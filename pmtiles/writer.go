@@ -0,0 +1,101 @@
+package pmtiles
+
+import (
+	"crypto/sha256"
+	"io"
+	"sort"
+)
+
+// Writer writes the tiles of an archive as they come, tiles with the same data are stored once
+type Writer struct {
+	tiles    io.Writer
+	offset   uint64
+	entries  []entry
+	contents map[[sha256.Size]byte]entry
+}
+
+// NewWriter returns a writer appending tile data to tiles, which becomes the end of the archive
+func NewWriter(tiles io.Writer) *Writer {
+	return &Writer{tiles: tiles, contents: map[[sha256.Size]byte]entry{}}
+}
+
+// WriteTile adds a tile, in any order
+func (w *Writer) WriteTile(z, x, y int, data []byte) error {
+	hash := sha256.Sum256(data)
+	content, exist := w.contents[hash]
+	if !exist {
+		if _, err := w.tiles.Write(data); err != nil {
+			return err
+		}
+		content = entry{offset: w.offset, length: uint32(len(data))}
+		w.contents[hash] = content
+		w.offset += uint64(len(data))
+	}
+	w.entries = append(w.entries, entry{tileID: TileID(z, x, y), offset: content.offset, length: content.length, runLength: 1})
+	return nil
+}
+
+// Finish returns the start of the archive, the tile data written so far follows it
+func (w *Writer) Finish(header Header, metadata []byte) ([]byte, error) {
+	sort.Slice(w.entries, func(i, j int) bool { return w.entries[i].tileID < w.entries[j].tileID })
+
+	// Consecutive tiles with the same data are one run
+	var entries []entry
+	for _, e := range w.entries {
+		if last := len(entries) - 1; last >= 0 && entries[last].tileID+uint64(entries[last].runLength) == e.tileID &&
+			entries[last].offset == e.offset && entries[last].length == e.length {
+			entries[last].runLength++
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	root, leaves, err := buildDirectories(entries)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err = compress(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	header.internalCompression = CompressionGzip
+	header.rootOffset, header.rootLength = headerSize, uint64(len(root))
+	header.metadataOffset, header.metadataLength = header.rootOffset+header.rootLength, uint64(len(metadata))
+	header.leafOffset, header.leafLength = header.metadataOffset+header.metadataLength, uint64(len(leaves))
+	header.dataOffset, header.dataLength = header.leafOffset+header.leafLength, w.offset
+	header.addressedTiles = uint64(len(w.entries))
+	header.tileEntries = uint64(len(entries))
+	header.tileContents = uint64(len(w.contents))
+
+	start := header.encode()
+	start = append(start, root...)
+	start = append(start, metadata...)
+	return append(start, leaves...), nil
+}
+
+// buildDirectories returns the root directory, and leaf directories with a part of the entries each
+// when the root would not fit in the first 16 KB of the archive
+func buildDirectories(entries []entry) ([]byte, []byte, error) {
+	root, err := encodeDirectory(entries)
+	if err != nil || len(root) <= rootMaxSize {
+		return root, nil, err
+	}
+
+	for leafSize := 4096; ; leafSize *= 2 {
+		var rootEntries []entry
+		var leaves []byte
+		for start := 0; start < len(entries); start += leafSize {
+			leaf, err := encodeDirectory(entries[start:min(start+leafSize, len(entries))])
+			if err != nil {
+				return nil, nil, err
+			}
+			rootEntries = append(rootEntries, entry{tileID: entries[start].tileID, offset: uint64(len(leaves)), length: uint32(len(leaf))})
+			leaves = append(leaves, leaf...)
+		}
+		root, err := encodeDirectory(rootEntries)
+		if err != nil || len(root) <= rootMaxSize {
+			return root, leaves, err
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package middlewares
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	jwks     *keyfunc.JWKS
+	jwksOnce sync.Once
+)
+
+// getJWKS returns the token service's signing keys from JWKS_URL, nil when not configured.
+// Keys are refreshed every JWKS_REFRESH_INTERVAL minutes (default 60) and whenever a token
+// is signed with an unknown key ID, so key rotation needs no restart
+func getJWKS() *keyfunc.JWKS {
+	jwksOnce.Do(func() {
+		jwksURL := os.Getenv("JWKS_URL")
+		if jwksURL == "" {
+			return
+		}
+
+		refreshMinutes, err := strconv.Atoi(os.Getenv("JWKS_REFRESH_INTERVAL"))
+		if err != nil || refreshMinutes <= 0 {
+			refreshMinutes = 60
+		}
+
+		jwks, err = keyfunc.Get(jwksURL, keyfunc.Options{
+			RefreshInterval:   time.Duration(refreshMinutes) * time.Minute,
+			RefreshRateLimit:  time.Minute,
+			RefreshTimeout:    10 * time.Second,
+			RefreshUnknownKID: true,
+			RefreshErrorHandler: func(err error) {
+				log.Error(fmt.Sprintf("JWKS refresh failed: %v", err))
+			},
+			// Start even if the token service is down, keys are fetched again in the background
+			TolerateInitialJWKHTTPError: true,
+		})
+		if err != nil {
+			log.Error(fmt.Sprintf("JWKS unavailable, validating tokens with the token service: %v", err))
+			jwks = nil
+		}
+	})
+
+	return jwks
+}
+
+// parseVerifiedToken verifies a token's signature and claims with the JWKS
+func parseVerifiedToken(keys *keyfunc.JWKS, token string) (*jwt.Token, error) {
+	var options []jwt.ParserOption
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+
+	return jwt.Parse(token, keys.Keyfunc, options...)
+}
@@ -1,11 +1,13 @@
 package middlewares
 
 import (
+	"errors"
 	"filemanager/common/constants"
 	"filemanager/common/helpers"
 	"filemanager/models/request"
 	"filemanager/models/response"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/gofiber/fiber/v2"
@@ -29,6 +31,39 @@ func CatchPanic() fiber.Handler {
 	}
 }
 
+// LimitBody answers 413 to requests whose body is larger than limit bytes. Bodies are streamed so the
+// app's BodyLimit does not reject them: those of a known length are checked here, chunked ones are
+// read up to the limit. Chunks of resumable uploads stay streamed, their handler bounds them by the upload
+func LimitBody(limit int) fiber.Handler {
+	// Return new handler
+	return func(c *fiber.Ctx) error {
+		length := c.Request().Header.ContentLength()
+		if length == -1 && c.Get(fiber.HeaderContentType) != "application/offset+octet-stream" {
+			if stream := c.Context().RequestBodyStream(); stream != nil {
+				body, err := io.ReadAll(io.LimitReader(stream, int64(limit)+1))
+				if err != nil {
+					helpers.BadRequest(c, err.Error())
+					return nil
+				}
+				length = len(body)
+				c.Request().SetBody(body)
+			}
+		}
+
+		// The rest of the body is not read, the connection is closed after answering
+		if length > limit {
+			c.Context().SetConnectionClose()
+			c.Status(fiber.StatusRequestEntityTooLarge)
+			c.JSON(response.ErrorResponse{
+				ErrorCode: constants.ERR_COMMON_REQUEST_TOO_LARGE,
+				Error:     "request body too large",
+			})
+			return nil
+		}
+		return c.Next()
+	}
+}
+
 func ValidateJWT() fiber.Handler {
 	// Return new handler
 	return func(c *fiber.Ctx) (err error) { //nolint:nonamedreturns // Uses recover() to overwrite the error
@@ -49,6 +84,28 @@ func ValidateJWT() fiber.Handler {
 			return nil
 		}
 
+		// Verify the token locally when the JWKS is configured. Only expired tokens (to be refreshed)
+		// or tokens signed by a key not fetched yet are sent to the token service
+		if keys := getJWKS(); keys != nil {
+			localToken, err := parseVerifiedToken(keys, token)
+			if err == nil {
+				if !setUser(c, localToken) {
+					return nil
+				}
+				return c.Next()
+			} else if !errors.Is(err, jwt.ErrTokenExpired) && !errors.Is(err, jwt.ErrTokenUnverifiable) {
+				// Clear cookies
+				c.ClearCookie("token", "refreshToken")
+
+				c.Status(fiber.StatusUnauthorized)
+				c.JSON(response.ErrorResponse{
+					ErrorCode: 401,
+					Error:     "unauthorized",
+				})
+				return nil
+			}
+		}
+
 		// Get info of Token Validation microservice
 		host := os.Getenv("TOKEN_SERVICE_HOST")
 		port := os.Getenv("TOKEN_SERVICE_PORT")
@@ -90,12 +147,45 @@ func ValidateJWT() fiber.Handler {
 			Value: data.Token,
 		})
 
-		// Set token in local scope (this request's scope) to be able to parse when needed
+		// Set token in local scope (this request's scope) to be able to parse when needed.
+		// The token service already validated it, verify the signature too when the JWKS is available
 		var localToken *jwt.Token
-		localToken, _ = jwt.Parse(data.Token, nil)
-		c.Locals("user", localToken)
+		if keys := getJWKS(); keys != nil {
+			if localToken, err = parseVerifiedToken(keys, data.Token); errors.Is(err, jwt.ErrTokenUnverifiable) {
+				localToken, _, _ = jwt.NewParser().ParseUnverified(data.Token, jwt.MapClaims{})
+			} else if err != nil {
+				c.Status(fiber.StatusUnauthorized)
+				c.JSON(response.ErrorResponse{
+					ErrorCode: 401,
+					Error:     "unauthorized",
+				})
+				return nil
+			}
+		} else {
+			localToken, _, _ = jwt.NewParser().ParseUnverified(data.Token, jwt.MapClaims{})
+		}
+		if !setUser(c, localToken) {
+			return nil
+		}
 
 		// Move to next handler
 		return c.Next()
 	}
 }
+
+// setUser keeps a valid token in the request's scope for handlers to parse. Tokens must hold the
+// user's ID, permissions, jobs and uploads are tied to it
+func setUser(c *fiber.Ctx, token *jwt.Token) bool {
+	if _, err := helpers.GetTokenUserID(token); err != nil {
+		log.Error(fmt.Sprintf("Rejected token: %v", err))
+		c.Status(fiber.StatusUnauthorized)
+		c.JSON(response.ErrorResponse{
+			ErrorCode: 401,
+			Error:     err.Error(),
+		})
+		return false
+	}
+
+	c.Locals("user", token)
+	return true
+}
@@ -14,16 +14,21 @@ func SetupRoutes(app *fiber.App) {
 	allowedDevOrigins := os.Getenv("ALLOWED_DEV_ORIGINS")
 	allowedOrigins := os.Getenv("ALLOWED_ORIGINS")
 
+	// Headers browsers need to read for resumable uploads
+	exposeHeaders := "Location,Upload-Offset,Upload-Length,Upload-Expires,Tus-Resumable,Tus-Version,Tus-Extension,Tus-Max-Size"
+
 	// Apply CORS
 	if os.Getenv("ENVIRONMENT") == "development" {
 		app.Use(cors.New(cors.Config{
 			AllowOrigins:     allowedDevOrigins,
 			AllowCredentials: true,
+			ExposeHeaders:    exposeHeaders,
 		}))
 	} else {
 		app.Use(cors.New(cors.Config{
 			AllowOrigins:     allowedOrigins,
 			AllowCredentials: true,
+			ExposeHeaders:    exposeHeaders,
 		}))
 	}
 
@@ -33,13 +38,45 @@ func SetupRoutes(app *fiber.App) {
 	// Unauthenticated
 	app.Get("/health-check", healthcheck.HealthCheck)
 	app.Get("/connection-check", healthcheck.ConnectionCheck)
+	app.Options("/project/uploads", handlers.TusOptions)
 
 	// JWT Middleware
 	app.Use(middlewares.ValidateJWT())
 
 	// Authenticated
+	app.Get("/project/:companyID/:projectID/:iterationID/metadata", handlers.GetIterationMetadata)
+	app.Get("/project/:companyID/:projectID/:iterationID/tiles/:z/:x/:y.png", handlers.GetOrthoPhotoTile)
+	app.Get("/project/:companyID/:projectID/:iterationID/wmts", handlers.GetOrthoPhotoCapabilities)
+	app.Get("/project/:companyID/:projectID/:iterationID/vector/:z/:x/:y.pbf", handlers.GetVectorTile)
+	app.Get("/project/:companyID/:projectID/:iterationID/diff/:otherIterationID", handlers.GetIterationDiff)
+	app.Get("/project/:companyID/:projectID/:iterationID/archive", handlers.GetIterationArchive)
+	app.Get("/project/:companyID/:projectID/:iterationID/files", handlers.GetIterationFiles)
+	app.Get("/project/:companyID/:projectID/:iterationID/versions/:layer", handlers.GetLayerVersions)
 	app.Get("/project/:companyID/:projectID/:iterationID/*", handlers.GetProjectFile)
 	app.Post("/project/upload-iteration", handlers.CreateProjectIteration)
 	app.Post("/project/edit-iteration", handlers.UpdateProjectIteration)
 	app.Post("/project/remove-iteration", handlers.DeleteProjectIteration)
+	app.Post("/project/rollback-iteration", handlers.RollbackLayerVersion)
+
+	// Permission cache
+	app.Post("/permission/invalidate-cache", handlers.InvalidatePermissionCache)
+	app.Get("/metrics/permission-cache", handlers.GetPermissionCacheMetrics)
+
+	// Background jobs
+	app.Get("/jobs/:id", handlers.GetJob)
+	app.Get("/jobs/:id/events", handlers.GetJobEvents)
+	app.Post("/jobs/:id/cancel", handlers.CancelJob)
+
+	// Storage quotas
+	app.Get("/company/:companyID/usage", handlers.GetCompanyUsage)
+
+	// Storage maintenance
+	app.Post("/maintenance/reconcile", handlers.Reconcile)
+	app.Post("/maintenance/collect-blobs", handlers.CollectBlobs)
+
+	// Resumable uploads (tus)
+	app.Post("/project/uploads", handlers.CreateUpload)
+	app.Head("/project/uploads/:uploadID", handlers.GetUploadStatus)
+	app.Patch("/project/uploads/:uploadID", handlers.PatchUpload)
+	app.Delete("/project/uploads/:uploadID", handlers.DeleteUpload)
 }
@@ -1,9 +1,15 @@
 package server
 
 import (
+	"filemanager/common/helpers"
+	"filemanager/handlers"
+	"filemanager/server/middlewares"
+	"filemanager/storage"
 	"fmt"
+	"log"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -11,20 +17,59 @@ import (
 func RunServer() {
 	env := os.Getenv("ENVIRONMENT")
 
+	// Initialize storage early so misconfiguration fails at startup
+	storage.GetBackend()
+
+	// Changes finished in the background and their recovery call the project service as the filemanager
+	if token, _ := helpers.GetServiceCredentials(); token == "" {
+		log.Fatal("SERVICE_TOKEN is not set")
+	}
+
+	// Finish iteration operations interrupted by the last shutdown before taking new ones
+	handlers.RecoverIterationOperations()
+
+	// Remove expired resumable uploads in the background
+	go handlers.CleanExpiredPartialUploads(time.Hour)
+
+	// Recount storage usage every USAGE_VERIFY_INTERVAL hours (default 24)
+	usageVerifyInterval, err := strconv.Atoi(os.Getenv("USAGE_VERIFY_INTERVAL"))
+	if err != nil || usageVerifyInterval <= 0 {
+		usageVerifyInterval = 24
+	}
+	go handlers.VerifyStorageUsage(time.Duration(usageVerifyInterval) * time.Hour)
+
+	// Prune expired layer versions and delete blobs no layer references anymore
+	// every BLOB_COLLECT_INTERVAL hours (default 24)
+	blobCollectInterval, err := strconv.Atoi(os.Getenv("BLOB_COLLECT_INTERVAL"))
+	if err != nil || blobCollectInterval <= 0 {
+		blobCollectInterval = 24
+	}
+	go handlers.CollectUnusedBlobs(time.Duration(blobCollectInterval) * time.Hour)
+
 	var app *fiber.App
+	var bodyLimit int
 
+	// Bodies are streamed, so chunks of resumable uploads are written as they arrive instead of being
+	// buffered whole. Multipart forms are read by their handlers, after the body limit is checked
 	if env == "development" {
+		bodyLimit = 1024 * 1024 * 1024 // 1024 MB = 1 GB
 		app = fiber.New(fiber.Config{
-			BodyLimit:               1024 * 1024 * 1024, // 1024 MB = 1 GB
-			EnableTrustedProxyCheck: false,
+			BodyLimit:                    bodyLimit,
+			StreamRequestBody:            true,
+			DisablePreParseMultipartForm: true,
+			EnableTrustedProxyCheck:      false,
 		})
 	} else {
 		requestLimit, _ := strconv.Atoi(os.Getenv("REQUEST_LIMIT"))
+		bodyLimit = requestLimit * 1024 * 1024 // requestLimit * 1 MB
 		app = fiber.New(fiber.Config{
-			BodyLimit:               requestLimit * 1024 * 1024, // requestLimit * 1 MB
-			EnableTrustedProxyCheck: true,
+			BodyLimit:                    bodyLimit,
+			StreamRequestBody:            true,
+			DisablePreParseMultipartForm: true,
+			EnableTrustedProxyCheck:      true,
 		})
 	}
+	app.Use(middlewares.LimitBody(bodyLimit))
 
 	SetupRoutes(app)
 
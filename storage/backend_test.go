@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Every backend must behave the same, S3 only runs when a test server is configured
+func TestLocalBackend(t *testing.T) {
+	testBackend(t, func() Backend { return NewLocalBackend(t.TempDir()) })
+}
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, func() Backend { return NewMemoryBackend() })
+}
+
+// Runs against the S3 compatible server of S3_TEST_SERVICE_HOST, with S3_TEST_ACCESS_KEY and S3_TEST_SECRET_KEY.
+// Every backend gets its own bucket, deleted once the test is done
+func TestS3Backend(t *testing.T) {
+	host := os.Getenv("S3_TEST_SERVICE_HOST")
+	if host == "" {
+		t.Skip("S3_TEST_SERVICE_HOST is not set")
+	}
+	prefix := fmt.Sprintf("filemanager-test-%d", time.Now().UnixNano())
+	t.Setenv("S3_SERVICE_HOST", host)
+	t.Setenv("S3_SERVICE_PORT", "")
+	t.Setenv("S3_ACCESS_KEY", os.Getenv("S3_TEST_ACCESS_KEY"))
+	t.Setenv("S3_SECRET_KEY", os.Getenv("S3_TEST_SECRET_KEY"))
+	t.Setenv("S3_BUCKET", prefix)
+	t.Setenv("S3_PRESIGN_EXPIRY", "")
+	backend, err := NewS3BackendFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { removeBucket(t, backend) })
+
+	buckets := 0
+	testBackend(t, func() Backend {
+		buckets++
+		bucket := &S3Backend{client: backend.client, bucket: fmt.Sprintf("%s-%d", prefix, buckets)}
+		if err := backend.client.MakeBucket(context.Background(), bucket.bucket, minio.MakeBucketOptions{Region: os.Getenv("S3_REGION")}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { removeBucket(t, bucket) })
+		return bucket
+	})
+}
+
+func testBackend(t *testing.T, newBackend func() Backend) {
+	t.Run("PutGet", func(t *testing.T) {
+		backend := newBackend()
+		put(t, backend, "a/b/c.txt", "hello")
+		if got := get(t, backend, "a/b/c.txt"); got != "hello" {
+			t.Fatalf("got %q, want %q", got, "hello")
+		}
+
+		// Putting again replaces the file
+		put(t, backend, "a/b/c.txt", "bye")
+		if got := get(t, backend, "a/b/c.txt"); got != "bye" {
+			t.Fatalf("got %q, want %q", got, "bye")
+		}
+		if _, err := backend.Get("a/b/missing.txt"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("GetRange", func(t *testing.T) {
+		backend := newBackend()
+		put(t, backend, "file", "0123456789")
+		for _, test := range []struct {
+			offset, length int64
+			want           string
+		}{
+			{0, -1, "0123456789"},
+			{2, 3, "234"},
+			{7, -1, "789"},
+			{8, 10, "89"},
+		} {
+			reader, err := backend.GetRange("file", test.offset, test.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.want {
+				t.Errorf("range %d+%d: got %q, want %q", test.offset, test.length, data, test.want)
+			}
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		backend := newBackend()
+		put(t, backend, "dir/file", "12345")
+
+		info, err := backend.Stat("dir/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != "dir/file" || info.Size != 5 || info.IsDir {
+			t.Errorf("got %+v for a file", info)
+		}
+		info, err = backend.Stat("dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Key != "dir" || !info.IsDir {
+			t.Errorf("got %+v for a directory", info)
+		}
+		if _, err := backend.Stat("dir/missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		backend := newBackend()
+		put(t, backend, "root/b.txt", "b")
+		put(t, backend, "root/a/1.txt", "1")
+		put(t, backend, "root/a/2.txt", "2")
+		put(t, backend, "other/c.txt", "c")
+
+		infos, err := backend.List("root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 2 {
+			t.Fatalf("got %+v, want 2 children", infos)
+		}
+		if infos[0].Key != "root/a" || !infos[0].IsDir {
+			t.Errorf("got %+v, want directory root/a", infos[0])
+		}
+		if infos[1].Key != "root/b.txt" || infos[1].IsDir || infos[1].Size != 1 {
+			t.Errorf("got %+v, want file root/b.txt", infos[1])
+		}
+
+		infos, err = backend.List("missing")
+		if err != nil || len(infos) != 0 {
+			t.Errorf("got %+v %v, want nothing for a missing directory", infos, err)
+		}
+	})
+
+	t.Run("Walk", func(t *testing.T) {
+		backend := newBackend()
+		put(t, backend, "root/a/1.txt", "1")
+		put(t, backend, "root/a/b/2.txt", "2")
+		put(t, backend, "root/3.txt", "3")
+
+		var keys []string
+		err := Walk(backend, "root", func(info ObjectInfo) error {
+			keys = append(keys, info.Key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(keys, ","); got != "root/3.txt,root/a/1.txt,root/a/b/2.txt" {
+			t.Errorf("walked %s", got)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		backend := newBackend()
+		put(t, backend, "dir/a/1.txt", "1")
+		put(t, backend, "dir/2.txt", "2")
+		put(t, backend, "dirty.txt", "3")
+
+		if err := backend.Delete("dir"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := backend.Stat("dir"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want the directory deleted", err)
+		}
+		if got := get(t, backend, "dirty.txt"); got != "3" {
+			t.Errorf("a sibling sharing the prefix was deleted")
+		}
+		if err := backend.Delete("dir"); err != nil {
+			t.Errorf("deleting nothing failed: %v", err)
+		}
+		if err := backend.Delete(""); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("got %v, want ErrInvalidKey deleting the root", err)
+		}
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		backend := newBackend()
+		put(t, backend, "layer_temp/a/1.txt", "1")
+		put(t, backend, "layer_temp/2.txt", "2")
+		put(t, backend, "file", "f")
+
+		if err := backend.Rename("layer_temp", "iteration/layer"); err != nil {
+			t.Fatal(err)
+		}
+		if got := get(t, backend, "iteration/layer/a/1.txt"); got != "1" {
+			t.Errorf("got %q after moving a directory", got)
+		}
+		if _, err := backend.Stat("layer_temp"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want the source gone", err)
+		}
+		if err := backend.Rename("file", "moved/file"); err != nil {
+			t.Fatal(err)
+		}
+		if got := get(t, backend, "moved/file"); got != "f" {
+			t.Errorf("got %q after moving a file", got)
+		}
+		if err := backend.Rename("missing", "elsewhere"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("RenameOntoExisting", func(t *testing.T) {
+		backend := newBackend()
+		put(t, backend, "source/1.txt", "new")
+		put(t, backend, "destination/1.txt", "old")
+		put(t, backend, "destination/2.txt", "old")
+		put(t, backend, "file", "new")
+		put(t, backend, "other", "old")
+
+		if err := backend.Rename("source", "destination"); !errors.Is(err, ErrExist) {
+			t.Fatalf("got %v, want ErrExist moving onto a directory", err)
+		}
+		if err := backend.Rename("file", "other"); !errors.Is(err, ErrExist) {
+			t.Fatalf("got %v, want ErrExist moving onto a file", err)
+		}
+
+		// Nothing moved
+		if got := get(t, backend, "source/1.txt"); got != "new" {
+			t.Errorf("source changed to %q", got)
+		}
+		if got := get(t, backend, "destination/1.txt"); got != "old" {
+			t.Errorf("destination changed to %q", got)
+		}
+		if got := get(t, backend, "other"); got != "old" {
+			t.Errorf("destination file changed to %q", got)
+		}
+	})
+
+	t.Run("CleanKeys", func(t *testing.T) {
+		backend := newBackend()
+		put(t, backend, "/a//b/../c.txt", "c")
+		if got := get(t, backend, "a/c.txt"); got != "c" {
+			t.Errorf("got %q", got)
+		}
+		if got := get(t, backend, "../../a/c.txt"); got != "c" {
+			t.Errorf("a key escaped the root, got %q", got)
+		}
+	})
+}
+
+// removeBucket deletes the objects of the bucket of a backend then the bucket
+func removeBucket(t *testing.T, backend *S3Backend) {
+	ctx := context.Background()
+	for object := range backend.client.ListObjects(ctx, backend.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			t.Error(object.Err)
+			return
+		}
+		if err := backend.client.RemoveObject(ctx, backend.bucket, object.Key, minio.RemoveObjectOptions{}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if err := backend.client.RemoveBucket(ctx, backend.bucket); err != nil {
+		t.Error(err)
+	}
+}
+
+func put(t *testing.T, backend Backend, key, content string) {
+	t.Helper()
+	if err := backend.Put(key, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, backend Backend, key string) string {
+	t.Helper()
+	reader, err := backend.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// LocalBackend stores files on the local disk, keeping the
+// root/company/project/iteration/layer directory layout
+type LocalBackend struct {
+	root string
+}
+
+func NewLocalBackend(root string) *LocalBackend {
+	return &LocalBackend{root: filepath.Clean(root)}
+}
+
+func (b *LocalBackend) path(key string) string {
+	return filepath.Join(b.root, filepath.FromSlash(CleanKey(key)))
+}
+
+func (b *LocalBackend) Put(key string, reader io.Reader, size int64) error {
+	filePath := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+
+	destinationFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer destinationFile.Close()
+
+	if _, err := io.Copy(destinationFile, reader); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b *LocalBackend) Get(key string) (io.ReadCloser, error) {
+	return b.GetRange(key, 0, -1)
+}
+
+func (b *LocalBackend) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	file, err := os.Open(b.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if offset == 0 && length < 0 {
+		return file, nil
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return file, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, nil
+}
+
+func (b *LocalBackend) Stat(key string) (ObjectInfo, error) {
+	info, err := os.Stat(b.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return ObjectInfo{}, ErrNotFound
+	} else if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return toObjectInfo(CleanKey(key), info), nil
+}
+
+func (b *LocalBackend) List(prefix string) ([]ObjectInfo, error) {
+	entries, err := os.ReadDir(b.path(prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var infos []ObjectInfo
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, toObjectInfo(Join(prefix, entry.Name()), info))
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+func (b *LocalBackend) Delete(prefix string) error {
+	// Never remove the root itself
+	if CleanKey(prefix) == "" {
+		return ErrInvalidKey
+	}
+
+	return os.RemoveAll(b.path(prefix))
+}
+
+func (b *LocalBackend) Rename(oldPrefix, newPrefix string) error {
+	newPath := b.path(newPrefix)
+	if _, err := os.Lstat(newPath); err == nil {
+		return ErrExist
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if _, err := os.Lstat(b.path(oldPrefix)); errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	err := os.Rename(b.path(oldPrefix), newPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func toObjectInfo(key string, info os.FileInfo) ObjectInfo {
+	if info.IsDir() {
+		return ObjectInfo{Key: key, ModTime: info.ModTime(), IsDir: true}
+	}
+
+	return ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}
+}
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// MemoryBackend keeps every file in memory, meant for tests and local experiments
+type MemoryBackend struct {
+	lock    sync.RWMutex
+	objects map[string]memoryObject
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{objects: map[string]memoryObject{}}
+}
+
+func (b *MemoryBackend) Put(key string, reader io.Reader, size int64) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.objects[CleanKey(key)] = memoryObject{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (b *MemoryBackend) Get(key string) (io.ReadCloser, error) {
+	return b.GetRange(key, 0, -1)
+}
+
+func (b *MemoryBackend) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	object, exist := b.objects[CleanKey(key)]
+	if !exist {
+		return nil, ErrNotFound
+	}
+
+	data := object.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *MemoryBackend) Stat(key string) (ObjectInfo, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	key = CleanKey(key)
+	if object, exist := b.objects[key]; exist {
+		return ObjectInfo{Key: key, Size: int64(len(object.data)), ModTime: object.modTime}, nil
+	}
+
+	// A directory exists as long as there is a file under it
+	for objectKey := range b.objects {
+		if key == "" || strings.HasPrefix(objectKey, key+"/") {
+			return ObjectInfo{Key: key, IsDir: true}, nil
+		}
+	}
+
+	return ObjectInfo{}, ErrNotFound
+}
+
+func (b *MemoryBackend) List(prefix string) ([]ObjectInfo, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	prefix = CleanKey(prefix)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	children := map[string]ObjectInfo{}
+	for objectKey, object := range b.objects {
+		if !strings.HasPrefix(objectKey, prefix) {
+			continue
+		}
+
+		name, _, isDir := strings.Cut(strings.TrimPrefix(objectKey, prefix), "/")
+		if isDir {
+			children[name] = ObjectInfo{Key: prefix + name, IsDir: true}
+		} else {
+			children[name] = ObjectInfo{Key: objectKey, Size: int64(len(object.data)), ModTime: object.modTime}
+		}
+	}
+
+	var infos []ObjectInfo
+	for _, info := range children {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+func (b *MemoryBackend) Delete(prefix string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	prefix = CleanKey(prefix)
+	if prefix == "" {
+		return ErrInvalidKey
+	}
+
+	for objectKey := range b.objects {
+		if objectKey == prefix || strings.HasPrefix(objectKey, prefix+"/") {
+			delete(b.objects, objectKey)
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Rename(oldPrefix, newPrefix string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	oldPrefix, newPrefix = CleanKey(oldPrefix), CleanKey(newPrefix)
+	for objectKey := range b.objects {
+		if objectKey == newPrefix || strings.HasPrefix(objectKey, newPrefix+"/") {
+			return ErrExist
+		}
+	}
+
+	moved := map[string]memoryObject{}
+	for objectKey, object := range b.objects {
+		if objectKey == oldPrefix || strings.HasPrefix(objectKey, oldPrefix+"/") {
+			moved[newPrefix+strings.TrimPrefix(objectKey, oldPrefix)] = object
+			delete(b.objects, objectKey)
+		}
+	}
+
+	if len(moved) == 0 {
+		return ErrNotFound
+	}
+	for objectKey, object := range moved {
+		b.objects[objectKey] = object
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Presigner is implemented by backends able to hand out direct download urls.
+// PresignGet returns an empty url when presigning is disabled. fileName and contentType,
+// when not empty, replace the name and type the file is downloaded with
+type Presigner interface {
+	PresignGet(key, fileName, contentType string) (string, error)
+}
+
+// Part size of uploads of unknown size, up to 10000 parts so objects of up to 160 GB
+const s3UnknownSizePartSize = 16 * 1024 * 1024
+
+// S3Backend stores files as objects of an S3 compatible bucket (AWS S3, MinIO...),
+// using the same company/project/iteration/layer/... keys as the local layout
+type S3Backend struct {
+	client        *minio.Client
+	bucket        string
+	presignExpiry time.Duration
+}
+
+// NewS3BackendFromEnv creates an S3 backend configured by
+// S3_SERVICE_HOST: e.g. http://minio or https://s3.amazonaws.com, scheme decides SSL
+// S3_SERVICE_PORT: optional, e.g. 9000
+// S3_ACCESS_KEY, S3_SECRET_KEY: credentials
+// S3_BUCKET: bucket name, created if it does not exist
+// S3_REGION: optional
+// S3_PRESIGN_EXPIRY: optional minutes, when set downloads redirect to presigned urls
+func NewS3BackendFromEnv() (*S3Backend, error) {
+	host := os.Getenv("S3_SERVICE_HOST")
+	port := os.Getenv("S3_SERVICE_PORT")
+	bucket := os.Getenv("S3_BUCKET")
+	if host == "" || bucket == "" {
+		return nil, errors.New("S3_SERVICE_HOST and S3_BUCKET are required for s3 storage")
+	}
+
+	// Split scheme from host, minio wants host:port only
+	useSSL := strings.HasPrefix(host, "https://")
+	endpoint := strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://")
+	if port != "" {
+		endpoint = fmt.Sprintf("%s:%s", endpoint, port)
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"), ""),
+		Secure: useSSL,
+		Region: os.Getenv("S3_REGION"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Create bucket on first run
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: os.Getenv("S3_REGION")}); err != nil {
+			return nil, err
+		}
+	}
+
+	presignMinutes, _ := strconv.Atoi(os.Getenv("S3_PRESIGN_EXPIRY"))
+
+	return &S3Backend{
+		client:        client,
+		bucket:        bucket,
+		presignExpiry: time.Duration(presignMinutes) * time.Minute,
+	}, nil
+}
+
+func (b *S3Backend) Put(key string, reader io.Reader, size int64) error {
+	key = CleanKey(key)
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// Parts are buffered in memory, of the largest size allowed when the size is unknown
+	options := minio.PutObjectOptions{ContentType: contentType}
+	if size < 0 {
+		options.PartSize = s3UnknownSizePartSize
+	}
+
+	_, err := b.client.PutObject(context.Background(), b.bucket, key, reader, size, options)
+	return err
+}
+
+func (b *S3Backend) Get(key string) (io.ReadCloser, error) {
+	return b.GetRange(key, 0, -1)
+}
+
+func (b *S3Backend) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	options := minio.GetObjectOptions{}
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	} else if length > 0 {
+		if err := options.SetRange(offset, offset+length-1); err != nil {
+			return nil, err
+		}
+	} else if offset > 0 {
+		if err := options.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	object, err := b.client.GetObject(context.Background(), b.bucket, CleanKey(key), options)
+	if err != nil {
+		return nil, toStorageError(err)
+	}
+
+	// GetObject is lazy, stat to find out if the object exists at all
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, toStorageError(err)
+	}
+
+	return object, nil
+}
+
+func (b *S3Backend) Stat(key string) (ObjectInfo, error) {
+	key = CleanKey(key)
+
+	object, err := b.client.StatObject(context.Background(), b.bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return ObjectInfo{Key: key, Size: object.Size, ModTime: object.LastModified}, nil
+	} else if !errors.Is(toStorageError(err), ErrNotFound) {
+		return ObjectInfo{}, err
+	}
+
+	// Not an object, could still be a "directory" with objects under it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for object := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: key + "/", MaxKeys: 1}) {
+		if object.Err != nil {
+			return ObjectInfo{}, object.Err
+		}
+		return ObjectInfo{Key: key, IsDir: true}, nil
+	}
+
+	return ObjectInfo{}, ErrNotFound
+}
+
+func (b *S3Backend) List(prefix string) ([]ObjectInfo, error) {
+	prefix = CleanKey(prefix)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var infos []ObjectInfo
+	for object := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+
+		// Common prefixes end with a slash
+		if strings.HasSuffix(object.Key, "/") {
+			infos = append(infos, ObjectInfo{Key: strings.TrimSuffix(object.Key, "/"), IsDir: true})
+		} else {
+			infos = append(infos, ObjectInfo{Key: object.Key, Size: object.Size, ModTime: object.LastModified})
+		}
+	}
+
+	return infos, nil
+}
+
+func (b *S3Backend) Delete(prefix string) error {
+	prefix = CleanKey(prefix)
+	if prefix == "" {
+		return ErrInvalidKey
+	}
+
+	ctx := context.Background()
+	if err := b.client.RemoveObject(ctx, b.bucket, prefix, minio.RemoveObjectOptions{}); err != nil && !errors.Is(toStorageError(err), ErrNotFound) {
+		return err
+	}
+
+	// Remove everything under the prefix in batches
+	objects := b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: prefix + "/", Recursive: true})
+	var err error
+	for removeErr := range b.client.RemoveObjects(ctx, b.bucket, objects, minio.RemoveObjectsOptions{}) {
+		if err == nil {
+			err = removeErr.Err
+		}
+	}
+
+	return err
+}
+
+func (b *S3Backend) Rename(oldPrefix, newPrefix string) error {
+	oldPrefix, newPrefix = CleanKey(oldPrefix), CleanKey(newPrefix)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Objects can not be renamed, copy every object to its new key then delete the old ones.
+	// Compose is used instead of copy since copy is limited to 5 GB objects
+	var keys []string
+	if _, err := b.client.StatObject(ctx, b.bucket, oldPrefix, minio.StatObjectOptions{}); err == nil {
+		keys = append(keys, oldPrefix)
+	}
+	for object := range b.client.ListObjects(ctx, b.bucket, minio.ListObjectsOptions{Prefix: oldPrefix + "/", Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		keys = append(keys, object.Key)
+	}
+
+	if len(keys) == 0 {
+		return ErrNotFound
+	}
+	if _, err := b.Stat(newPrefix); err == nil {
+		return ErrExist
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	for _, key := range keys {
+		destination := minio.CopyDestOptions{Bucket: b.bucket, Object: newPrefix + strings.TrimPrefix(key, oldPrefix)}
+		source := minio.CopySrcOptions{Bucket: b.bucket, Object: key}
+		if _, err := b.client.ComposeObject(ctx, destination, source); err != nil {
+			return err
+		}
+	}
+
+	return b.Delete(oldPrefix)
+}
+
+func (b *S3Backend) PresignGet(key, fileName, contentType string) (string, error) {
+	if b.presignExpiry <= 0 {
+		return "", nil
+	}
+
+	parameters := url.Values{}
+	if fileName != "" {
+		parameters.Set("response-content-disposition", mime.FormatMediaType("inline", map[string]string{"filename": fileName}))
+	}
+	if contentType != "" {
+		parameters.Set("response-content-type", contentType)
+	}
+	presignedURL, err := b.client.PresignedGetObject(context.Background(), b.bucket, CleanKey(key), b.presignExpiry, parameters)
+	if err != nil {
+		return "", err
+	}
+	return presignedURL.String(), nil
+}
+
+func toStorageError(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return ErrNotFound
+	}
+	return err
+}
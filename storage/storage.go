@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"filemanager/common/helpers"
+)
+
+var (
+	ErrNotFound   = errors.New("file not found")
+	ErrExist      = errors.New("file already exists")
+	ErrInvalidKey = errors.New("invalid file path")
+)
+
+// ObjectInfo describes a stored file, or a directory when IsDir is true.
+// Key is always the full slash separated key relative to the storage root.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Backend is where iteration files live. Keys are slash separated paths
+// relative to the storage root, e.g. company/project/iteration/layer/file.
+type Backend interface {
+	// Put writes a file, creating whatever parents it needs. size may be -1 when unknown
+	Put(key string, reader io.Reader, size int64) error
+
+	// Get opens a file for reading
+	Get(key string) (io.ReadCloser, error)
+
+	// GetRange opens length bytes of a file starting at offset. length -1 reads to the end
+	GetRange(key string, offset, length int64) (io.ReadCloser, error)
+
+	// Stat returns info of a file or directory, ErrNotFound if neither exists
+	Stat(key string) (ObjectInfo, error)
+
+	// List returns the direct children of a directory
+	List(prefix string) ([]ObjectInfo, error)
+
+	// Delete removes a file or a whole directory. Deleting nothing is not an error
+	Delete(prefix string) error
+
+	// Rename moves a file or directory to a new key, used to commit temporary uploads.
+	// The destination must not exist, ErrExist is returned and nothing is moved otherwise
+	Rename(oldPrefix, newPrefix string) error
+}
+
+var (
+	backend     Backend
+	backendLock sync.Mutex
+)
+
+// GetBackend returns the backend configured by STORAGE_BACKEND (local, s3 or memory),
+// defaults to the local file system under GetFileSystemRootLocation
+func GetBackend() Backend {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+
+	if backend == nil {
+		switch os.Getenv("STORAGE_BACKEND") {
+		case "memory":
+			backend = NewMemoryBackend()
+		case "s3":
+			s3Backend, err := NewS3BackendFromEnv()
+			if err != nil {
+				log.Fatalf("failed to create s3 storage: %v", err)
+			}
+			backend = s3Backend
+		default:
+			backend = NewLocalBackend(helpers.GetFileSystemRootLocation())
+		}
+	}
+
+	return backend
+}
+
+// SetBackend replaces the backend returned by GetBackend
+func SetBackend(b Backend) {
+	backendLock.Lock()
+	defer backendLock.Unlock()
+
+	backend = b
+}
+
+// Join joins key elements and cleans the result, so that the key
+// can never point outside of the storage root
+func Join(elem ...string) string {
+	return CleanKey(path.Join(elem...))
+}
+
+// CleanKey removes "..", "." and duplicated separators from a key
+func CleanKey(key string) string {
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+// Walk calls fn for every file under prefix, directories are descended into but not reported
+func Walk(b Backend, prefix string, fn func(info ObjectInfo) error) error {
+	children, err := b.List(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if child.IsDir {
+			if err := Walk(b, child.Key, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := fn(child); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,548 @@
+package tiles3d
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Reports stop collecting issues of a severity past this many
+const maxIssues = 1000
+
+// Tileset JSON larger than this is refused instead of read in memory
+const maxTilesetSize = 256 * 1024 * 1024
+
+// Files gives access to the files of a layer by their path relative to the layer
+type Files interface {
+	// Size returns the size of a file, false when there is no such file
+	Size(name string) (int64, bool)
+
+	// Read returns length bytes of a file starting at offset, length -1 reads to the end
+	Read(name string, offset, length int64) ([]byte, error)
+}
+
+// Issue is a problem found in a tileset or in one of its content files. Pointer locates it
+// in the tileset JSON like root.children[2].content.uri
+type Issue struct {
+	Severity string `json:"severity"`
+	File     string `json:"file"`
+	Pointer  string `json:"pointer,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (i Issue) String() string {
+	if i.Pointer == "" {
+		return fmt.Sprintf("%s: %s", i.File, i.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", i.File, i.Pointer, i.Message)
+}
+
+// Tileset describes a tileset JSON, the root one or an external one
+type Tileset struct {
+	Version        string  `json:"version"`
+	GeometricError float64 `json:"geometric_error"`
+	Tiles          int     `json:"tiles"`
+	Contents       int     `json:"contents"`
+}
+
+// Report is the result of validating a tileset with every external tileset it references.
+// Errors break the tileset for viewers, warnings are kept for information
+type Report struct {
+	Root      string              `json:"root"`
+	Region    []float64           `json:"region,omitempty"` // west, south, east, north in degrees, when the root has a bounding region
+	Tilesets  map[string]*Tileset `json:"tilesets"`
+	Errors    []Issue             `json:"errors"`
+	Warnings  []Issue             `json:"warnings"`
+	Truncated bool                `json:"truncated,omitempty"`
+}
+
+// ValidationError is a tileset with errors, its report has all of them
+type ValidationError struct {
+	Report *Report
+}
+
+func (e *ValidationError) Error() string {
+	message := e.Report.Errors[0].String()
+	if more := len(e.Report.Errors) - 1; more > 0 {
+		message += fmt.Sprintf(" (and %d more errors)", more)
+	}
+	return message
+}
+
+// FindRoot returns the tileset.json closest to the top of the layer, archives often wrap it in a directory
+func FindRoot(paths []string) (string, bool) {
+	var candidates []string
+	for _, name := range paths {
+		if path.Base(name) == "tileset.json" {
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		depthI, depthJ := strings.Count(candidates[i], "/"), strings.Count(candidates[j], "/")
+		if depthI != depthJ {
+			return depthI < depthJ
+		}
+		return candidates[i] < candidates[j]
+	})
+	return candidates[0], true
+}
+
+// Validate checks a tileset against the 3D Tiles 1.0 and 1.1 specifications, following external
+// tilesets and checking every content file exists with a sound header. Returns a ValidationError
+// with the report when there are errors, other errors come from reading the files
+func Validate(files Files, root string) (*Report, error) {
+	v := &validator{
+		files:   files,
+		checked: map[string]bool{},
+		report: &Report{
+			Root:     root,
+			Tilesets: map[string]*Tileset{},
+			Errors:   []Issue{},
+			Warnings: []Issue{},
+		},
+	}
+	if err := v.tileset(root, true); err != nil {
+		return nil, err
+	}
+
+	if len(v.report.Errors) > 0 {
+		return v.report, &ValidationError{Report: v.report}
+	}
+	return v.report, nil
+}
+
+type tilesetJSON struct {
+	Asset *struct {
+		Version *string `json:"version"`
+	} `json:"asset"`
+	GeometricError     *float64  `json:"geometricError"`
+	Root               *tileJSON `json:"root"`
+	ExtensionsRequired []string  `json:"extensionsRequired"`
+}
+
+type tileJSON struct {
+	BoundingVolume *boundingVolumeJSON `json:"boundingVolume"`
+	GeometricError *float64            `json:"geometricError"`
+	Refine         *string             `json:"refine"`
+	Transform      []float64           `json:"transform"`
+	Content        *contentJSON        `json:"content"`
+	Contents       []contentJSON       `json:"contents"`
+	Children       []tileJSON          `json:"children"`
+	ImplicitTiling json.RawMessage     `json:"implicitTiling"`
+}
+
+type contentJSON struct {
+	URI            *string             `json:"uri"`
+	URL            *string             `json:"url"`
+	BoundingVolume *boundingVolumeJSON `json:"boundingVolume"`
+}
+
+type boundingVolumeJSON struct {
+	Box        []float64       `json:"box"`
+	Region     []float64       `json:"region"`
+	Sphere     []float64       `json:"sphere"`
+	Extensions json.RawMessage `json:"extensions"`
+}
+
+type validator struct {
+	files   Files
+	report  *Report
+	checked map[string]bool
+
+	// Of the tileset being checked
+	file    string
+	version string
+}
+
+func (v *validator) addIssue(severity, pointer, message string) {
+	issues := &v.report.Errors
+	if severity == SeverityWarning {
+		issues = &v.report.Warnings
+	}
+	if len(*issues) >= maxIssues {
+		v.report.Truncated = true
+		return
+	}
+	*issues = append(*issues, Issue{Severity: severity, File: v.file, Pointer: pointer, Message: message})
+}
+
+// tileset checks a tileset JSON and everything it references, each tileset is checked once
+func (v *validator) tileset(name string, isRoot bool) error {
+	if v.checked[name] {
+		return nil
+	}
+	v.checked[name] = true
+
+	// Back to the referencing tileset once this one is checked
+	parentFile, parentVersion := v.file, v.version
+	defer func() {
+		v.file, v.version = parentFile, parentVersion
+	}()
+	v.file = name
+
+	size, exist := v.files.Size(name)
+	if !exist {
+		v.addIssue(SeverityError, "", "tileset not found in the archive")
+		return nil
+	}
+	if size > maxTilesetSize {
+		v.addIssue(SeverityError, "", fmt.Sprintf("tileset is larger than %d bytes", maxTilesetSize))
+		return nil
+	}
+	data, err := v.files.Read(name, 0, -1)
+	if err != nil {
+		return err
+	}
+
+	var tileset tilesetJSON
+	if err := json.Unmarshal(data, &tileset); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			v.addIssue(SeverityError, typeErr.Field, fmt.Sprintf("must be a %s, not a %s", jsonTypeName(typeErr.Type.Kind().String()), typeErr.Value))
+		} else {
+			v.addIssue(SeverityError, "", fmt.Sprintf("invalid JSON: %v", err))
+		}
+		return nil
+	}
+
+	summary := &Tileset{}
+	v.report.Tilesets[name] = summary
+	if tileset.Asset == nil {
+		v.addIssue(SeverityError, "asset", "missing")
+	} else if tileset.Asset.Version == nil {
+		v.addIssue(SeverityError, "asset.version", "missing")
+	} else {
+		v.version = *tileset.Asset.Version
+		summary.Version = v.version
+		switch v.version {
+		case "1.0", "1.1":
+		case "0.0":
+			v.addIssue(SeverityWarning, "asset.version", "0.0 is a pre-release version, viewers may not load it")
+		default:
+			v.addIssue(SeverityError, "asset.version", fmt.Sprintf("unsupported version %s, expected 1.0 or 1.1", v.version))
+		}
+	}
+	for _, extension := range tileset.ExtensionsRequired {
+		v.addIssue(SeverityWarning, "extensionsRequired", fmt.Sprintf("viewers must support %s to load the tileset", extension))
+	}
+
+	if tileset.GeometricError == nil {
+		v.addIssue(SeverityError, "geometricError", "missing")
+	} else if *tileset.GeometricError < 0 {
+		v.addIssue(SeverityError, "geometricError", "must not be negative")
+	} else {
+		summary.GeometricError = *tileset.GeometricError
+	}
+
+	if tileset.Root == nil {
+		v.addIssue(SeverityError, "root", "missing")
+		return nil
+	}
+	if tileset.Root.Refine == nil {
+		v.addIssue(SeverityWarning, "root.refine", "missing on the root tile, viewers have to guess")
+	}
+	if isRoot && tileset.Root.BoundingVolume != nil && len(tileset.Root.BoundingVolume.Region) == 6 {
+		region := tileset.Root.BoundingVolume.Region
+		v.report.Region = []float64{degrees(region[0]), degrees(region[1]), degrees(region[2]), degrees(region[3])}
+	}
+
+	parentError := math.Inf(1)
+	if tileset.GeometricError != nil {
+		parentError = *tileset.GeometricError
+	}
+	return v.tile(tileset.Root, "root", parentError, summary)
+}
+
+func (v *validator) tile(tile *tileJSON, pointer string, parentError float64, summary *Tileset) error {
+	summary.Tiles++
+
+	v.boundingVolume(tile.BoundingVolume, pointer+".boundingVolume", true)
+	geometricError := parentError
+	if tile.GeometricError == nil {
+		v.addIssue(SeverityError, pointer+".geometricError", "missing")
+	} else if *tile.GeometricError < 0 {
+		v.addIssue(SeverityError, pointer+".geometricError", "must not be negative")
+	} else {
+		geometricError = *tile.GeometricError
+		if geometricError > parentError {
+			v.addIssue(SeverityWarning, pointer+".geometricError", "larger than the parent's, the tile may never be refined")
+		}
+	}
+	if tile.Refine != nil && *tile.Refine != "ADD" && *tile.Refine != "REPLACE" {
+		if strings.EqualFold(*tile.Refine, "ADD") || strings.EqualFold(*tile.Refine, "REPLACE") {
+			v.addIssue(SeverityWarning, pointer+".refine", "must be upper case")
+		} else {
+			v.addIssue(SeverityError, pointer+".refine", fmt.Sprintf("must be ADD or REPLACE, not %s", *tile.Refine))
+		}
+	}
+	if tile.Transform != nil && len(tile.Transform) != 16 {
+		v.addIssue(SeverityError, pointer+".transform", "must be a 4x4 matrix of 16 numbers")
+	}
+
+	// Implicit tiling names its contents with templates, they can not be resolved to files
+	implicit := len(tile.ImplicitTiling) > 0
+	if implicit {
+		if v.version == "1.0" {
+			v.addIssue(SeverityWarning, pointer+".implicitTiling", "needs 3D Tiles 1.1")
+		}
+		v.addIssue(SeverityWarning, pointer+".implicitTiling", "contents of implicit tiles are not checked")
+	}
+
+	if tile.Content != nil && tile.Contents != nil {
+		v.addIssue(SeverityError, pointer, "has both content and contents")
+	}
+	if tile.Content != nil {
+		if err := v.content(tile.Content, pointer+".content", implicit, summary); err != nil {
+			return err
+		}
+	}
+	if tile.Contents != nil && v.version == "1.0" {
+		v.addIssue(SeverityWarning, pointer+".contents", "needs 3D Tiles 1.1")
+	}
+	for i := range tile.Contents {
+		if err := v.content(&tile.Contents[i], fmt.Sprintf("%s.contents[%d]", pointer, i), implicit, summary); err != nil {
+			return err
+		}
+	}
+
+	for i := range tile.Children {
+		if err := v.tile(&tile.Children[i], fmt.Sprintf("%s.children[%d]", pointer, i), geometricError, summary); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *validator) boundingVolume(volume *boundingVolumeJSON, pointer string, required bool) {
+	if volume == nil {
+		if required {
+			v.addIssue(SeverityError, pointer, "missing")
+		}
+		return
+	}
+
+	kinds := 0
+	if volume.Box != nil {
+		kinds++
+		if len(volume.Box) != 12 {
+			v.addIssue(SeverityError, pointer+".box", "must have 12 numbers, a center and three half axes")
+		}
+	}
+	if volume.Region != nil {
+		kinds++
+		region := volume.Region
+		if len(region) != 6 {
+			v.addIssue(SeverityError, pointer+".region", "must have 6 numbers, west, south, east, north, minimum and maximum height")
+		} else if region[0] < -math.Pi || region[0] > math.Pi || region[2] < -math.Pi || region[2] > math.Pi {
+			v.addIssue(SeverityError, pointer+".region", "west and east must be within [-π, π] radians")
+		} else if region[1] < -math.Pi/2 || region[3] > math.Pi/2 || region[1] > region[3] {
+			v.addIssue(SeverityError, pointer+".region", "south and north must be within [-π/2, π/2] radians, south first")
+		} else if region[4] > region[5] {
+			v.addIssue(SeverityError, pointer+".region", "minimum height is above the maximum height")
+		}
+	}
+	if volume.Sphere != nil {
+		kinds++
+		if len(volume.Sphere) != 4 {
+			v.addIssue(SeverityError, pointer+".sphere", "must have 4 numbers, a center and a radius")
+		} else if volume.Sphere[3] < 0 {
+			v.addIssue(SeverityError, pointer+".sphere", "radius must not be negative")
+		}
+	}
+
+	switch {
+	case kinds == 0 && len(volume.Extensions) == 0:
+		v.addIssue(SeverityError, pointer, "needs a box, a region or a sphere")
+	case kinds > 1:
+		v.addIssue(SeverityWarning, pointer, "has more than one of box, region and sphere")
+	}
+}
+
+func (v *validator) content(content *contentJSON, pointer string, implicit bool, summary *Tileset) error {
+	summary.Contents++
+	v.boundingVolume(content.BoundingVolume, pointer+".boundingVolume", false)
+
+	uri := content.URI
+	if uri == nil && content.URL != nil {
+		v.addIssue(SeverityWarning, pointer+".url", "deprecated, use uri")
+		uri = content.URL
+	}
+	if uri == nil {
+		v.addIssue(SeverityError, pointer+".uri", "missing")
+		return nil
+	}
+	if implicit {
+		return nil
+	}
+
+	parsed, err := url.Parse(*uri)
+	if err != nil {
+		v.addIssue(SeverityError, pointer+".uri", fmt.Sprintf("invalid uri %s", *uri))
+		return nil
+	}
+	if parsed.Scheme == "data" {
+		return nil
+	}
+	if parsed.Scheme != "" || parsed.Host != "" {
+		v.addIssue(SeverityWarning, pointer+".uri", fmt.Sprintf("%s is outside of the archive, it is not checked", *uri))
+		return nil
+	}
+
+	// Relative to the tileset referencing it
+	name := path.Join(path.Dir(v.file), parsed.Path)
+	if strings.HasPrefix(parsed.Path, "/") || name == ".." || strings.HasPrefix(name, "../") {
+		v.addIssue(SeverityError, pointer+".uri", fmt.Sprintf("%s is outside of the archive", *uri))
+		return nil
+	}
+	if _, exist := v.files.Size(name); !exist {
+		v.addIssue(SeverityError, pointer+".uri", fmt.Sprintf("%s not found in the archive", name))
+		return nil
+	}
+
+	extension := strings.ToLower(path.Ext(name))
+	if extension == ".json" {
+		return v.tileset(name, false)
+	}
+	if v.checked[name] {
+		return nil
+	}
+	v.checked[name] = true
+
+	switch extension {
+	case ".b3dm", ".i3dm", ".pnts", ".cmpt", ".glb":
+		message, err := v.checkHeader(name, extension)
+		if err != nil {
+			return err
+		}
+		if message != "" {
+			v.addIssue(SeverityError, pointer+".uri", fmt.Sprintf("%s %s", name, message))
+		}
+	case ".gltf":
+	default:
+		v.addIssue(SeverityWarning, pointer+".uri", fmt.Sprintf("%s is not a known tile format", name))
+	}
+	return nil
+}
+
+// Header sizes and magic of the tile formats, tile formats are version 1, binary glTF is version 2
+var tileHeaders = map[string]struct {
+	magic string
+	size  int64
+}{
+	".b3dm": {"b3dm", 28},
+	".i3dm": {"i3dm", 32},
+	".pnts": {"pnts", 28},
+	".cmpt": {"cmpt", 16},
+	".glb":  {"glTF", 12},
+}
+
+// checkHeader checks the magic and lengths of a binary tile, returning what is wrong with it
+func (v *validator) checkHeader(name, extension string) (string, error) {
+	expected := tileHeaders[extension]
+	size, _ := v.files.Size(name)
+	if size < expected.size {
+		return fmt.Sprintf("is %d bytes, too small for a %s header", size, expected.magic), nil
+	}
+	header, err := v.files.Read(name, 0, expected.size)
+	if err != nil {
+		return "", err
+	}
+
+	magic := string(header[0:4])
+	version := binary.LittleEndian.Uint32(header[4:8])
+	byteLength := int64(binary.LittleEndian.Uint32(header[8:12]))
+	if magic != expected.magic {
+		return fmt.Sprintf("starts with %q, expected %q", magic, expected.magic), nil
+	}
+	if extension == ".glb" {
+		if version != 2 {
+			return fmt.Sprintf("is binary glTF version %d, expected 2", version), nil
+		}
+	} else if version != 1 {
+		return fmt.Sprintf("is version %d, expected 1", version), nil
+	}
+	if byteLength != size {
+		return fmt.Sprintf("header says %d bytes but the file has %d", byteLength, size), nil
+	}
+
+	switch extension {
+	case ".b3dm", ".i3dm", ".pnts":
+		// Feature table then batch table, JSON and binary, then the glTF or points
+		tables := expected.size
+		for offset := 12; offset < 28; offset += 4 {
+			tables += int64(binary.LittleEndian.Uint32(header[offset : offset+4]))
+		}
+		if tables > byteLength {
+			return fmt.Sprintf("tables end at byte %d, after the end of the file", tables), nil
+		}
+		if extension == ".i3dm" {
+			if format := binary.LittleEndian.Uint32(header[28:32]); format > 1 {
+				return fmt.Sprintf("has glTF format %d, expected 0 for an uri or 1 for embedded", format), nil
+			}
+		}
+	case ".cmpt":
+		return v.checkComposite(name, header, byteLength)
+	}
+	return "", nil
+}
+
+// checkComposite checks the inner tiles of a composite follow each other up to its end
+func (v *validator) checkComposite(name string, header []byte, byteLength int64) (string, error) {
+	tilesLength := binary.LittleEndian.Uint32(header[12:16])
+	offset := int64(16)
+	for i := uint32(0); i < tilesLength; i++ {
+		if offset+12 > byteLength {
+			return fmt.Sprintf("inner tile %d starts after the end of the file", i), nil
+		}
+		inner, err := v.files.Read(name, offset, 12)
+		if err != nil {
+			return "", err
+		}
+		switch magic := string(inner[0:4]); magic {
+		case "b3dm", "i3dm", "pnts", "cmpt":
+		default:
+			return fmt.Sprintf("inner tile %d starts with %q, not a tile format", i, magic), nil
+		}
+		innerLength := int64(binary.LittleEndian.Uint32(inner[8:12]))
+		if innerLength < 12 {
+			return fmt.Sprintf("inner tile %d is %d bytes, too small for a header", i, innerLength), nil
+		}
+		offset += innerLength
+	}
+	if offset > byteLength {
+		return fmt.Sprintf("inner tiles end at byte %d, after the end of the file", offset), nil
+	}
+	return "", nil
+}
+
+func degrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+// jsonTypeName names a Go kind the way a JSON schema would
+func jsonTypeName(kind string) string {
+	switch kind {
+	case "float64", "int", "int64", "uint32":
+		return "number"
+	case "slice", "array":
+		return "array"
+	case "struct", "map", "ptr":
+		return "object"
+	}
+	return kind
+}
@@ -0,0 +1,270 @@
+package tiles3d
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// testFiles are the files of a layer in memory, reading a name in failing fails
+type testFiles struct {
+	files   map[string][]byte
+	failing string
+}
+
+func (f testFiles) Size(name string) (int64, bool) {
+	data, exist := f.files[name]
+	return int64(len(data)), exist
+}
+
+func (f testFiles) Read(name string, offset, length int64) ([]byte, error) {
+	if name == f.failing {
+		return nil, errors.New("read failed")
+	}
+	data := f.files[name][offset:]
+	if length >= 0 {
+		data = data[:length]
+	}
+	return data, nil
+}
+
+const sphere = `{"sphere": [0, 0, 0, 10]}`
+
+func TestFindRoot(t *testing.T) {
+	for _, test := range []struct {
+		paths []string
+		want  string
+	}{
+		{[]string{"tiles/0.b3dm", "tileset.json", "tiles/tileset.json"}, "tileset.json"},
+		{[]string{"b/tileset.json", "a/tileset.json", "a/b/tileset.json"}, "a/tileset.json"},
+		{[]string{"tiles/0.b3dm", "tileset.json.bak"}, ""},
+	} {
+		root, found := FindRoot(test.paths)
+		if root != test.want || found != (test.want != "") {
+			t.Errorf("%v: got %q and %v, want %q", test.paths, root, found, test.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	files := testFiles{files: map[string][]byte{
+		"data/tileset.json": []byte(`{"asset": {"version": "1.1"}, "geometricError": 500, "root": {
+			"boundingVolume": {"region": [-1, -0.5, 1, 0.5, 0, 100]}, "geometricError": 100, "refine": "ADD",
+			"content": {"uri": "0.b3dm"},
+			"children": [
+				{"boundingVolume": ` + sphere + `, "geometricError": 10, "contents": [{"uri": "tiles/1.glb"}, {"uri": "tiles/2.cmpt"}]},
+				{"boundingVolume": ` + sphere + `, "geometricError": 10, "content": {"uri": "./tiles/tileset.json"}},
+				{"boundingVolume": ` + sphere + `, "geometricError": 0, "content": {"uri": "0.b3dm"}}
+			]}}`),
+		"data/0.b3dm":       tile("b3dm", 1, 28),
+		"data/tiles/1.glb":  tile("glTF", 2, 12),
+		"data/tiles/2.cmpt": composite(tile("pnts", 1, 28), tile("i3dm", 1, 32)),
+		"data/tiles/tileset.json": []byte(`{"asset": {"version": "1.0"}, "geometricError": 10, "root": {
+			"boundingVolume": {"box": [0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1]}, "geometricError": 0, "refine": "REPLACE",
+			"content": {"uri": "3.i3dm"}}}`),
+		"data/tiles/3.i3dm": tile("i3dm", 1, 32),
+	}}
+
+	report, err := Validate(files, "data/tileset.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Report{
+		Root:   "data/tileset.json",
+		Region: []float64{-180 / math.Pi, -90 / math.Pi, 180 / math.Pi, 90 / math.Pi},
+		Tilesets: map[string]*Tileset{
+			"data/tileset.json":       {Version: "1.1", GeometricError: 500, Tiles: 4, Contents: 5},
+			"data/tiles/tileset.json": {Version: "1.0", GeometricError: 10, Tiles: 1, Contents: 1},
+		},
+		Errors:   []Issue{},
+		Warnings: []Issue{},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("got %+v, want %+v", report, want)
+	}
+
+	// Errors reading the files are not issues of the tileset
+	files.failing = "data/tiles/1.glb"
+	if _, err := Validate(files, "data/tileset.json"); err == nil || errors.As(err, new(*ValidationError)) {
+		t.Errorf("got %v, want the read error", err)
+	}
+}
+
+func TestValidateIssues(t *testing.T) {
+	// root is the root tile of a valid tileset, its content is 0.b3dm
+	valid := func(root string) map[string][]byte {
+		return map[string][]byte{
+			"tileset.json": []byte(`{"asset": {"version": "1.0"}, "geometricError": 100, "root": ` + root + `}`),
+			"0.b3dm":       tile("b3dm", 1, 28),
+		}
+	}
+	withTile := func(name string, data []byte) map[string][]byte {
+		files := valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD", "content": {"uri": "` + name + `"}}`)
+		files[name] = data
+		return files
+	}
+	b3dm := tile("b3dm", 1, 28)
+
+	for _, test := range []struct {
+		name     string
+		files    map[string][]byte
+		severity string
+		issue    Issue
+	}{
+		// Tileset JSON
+		{"no tileset", map[string][]byte{}, SeverityError, Issue{File: "tileset.json"}},
+		{"not JSON", map[string][]byte{"tileset.json": []byte(`{"asset": `)}, SeverityError, Issue{File: "tileset.json"}},
+		{"wrong type", map[string][]byte{"tileset.json": []byte(`{"geometricError": "100"}`)}, SeverityError,
+			Issue{File: "tileset.json", Pointer: "geometricError"}},
+		{"no asset", map[string][]byte{"tileset.json": []byte(`{"geometricError": 1, "root": {"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD"}}`)},
+			SeverityError, Issue{File: "tileset.json", Pointer: "asset"}},
+		{"no version", map[string][]byte{"tileset.json": []byte(`{"asset": {}, "geometricError": 1, "root": {"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD"}}`)},
+			SeverityError, Issue{File: "tileset.json", Pointer: "asset.version"}},
+		{"unknown version", map[string][]byte{"tileset.json": []byte(`{"asset": {"version": "2.0"}, "geometricError": 1, "root": {"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD"}}`)},
+			SeverityError, Issue{File: "tileset.json", Pointer: "asset.version"}},
+		{"pre-release version", map[string][]byte{"tileset.json": []byte(`{"asset": {"version": "0.0"}, "geometricError": 1, "root": {"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD"}}`)},
+			SeverityWarning, Issue{File: "tileset.json", Pointer: "asset.version"}},
+		{"no geometric error", map[string][]byte{"tileset.json": []byte(`{"asset": {"version": "1.0"}, "root": {"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD"}}`)},
+			SeverityError, Issue{File: "tileset.json", Pointer: "geometricError"}},
+		{"no root", map[string][]byte{"tileset.json": []byte(`{"asset": {"version": "1.0"}, "geometricError": 1}`)},
+			SeverityError, Issue{File: "tileset.json", Pointer: "root"}},
+
+		// Tiles
+		{"no refine on the root", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0}`), SeverityWarning,
+			Issue{File: "tileset.json", Pointer: "root.refine"}},
+		{"unknown refine", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "MERGE"}`), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.refine"}},
+		{"lower case refine", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "add"}`), SeverityWarning,
+			Issue{File: "tileset.json", Pointer: "root.refine"}},
+		{"negative geometric error", valid(`{"boundingVolume": ` + sphere + `, "geometricError": -1, "refine": "ADD"}`), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.geometricError"}},
+		{"child never refined", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 10, "refine": "ADD",
+			"children": [{"boundingVolume": ` + sphere + `, "geometricError": 20}]}`), SeverityWarning,
+			Issue{File: "tileset.json", Pointer: "root.children[0].geometricError"}},
+		{"transform", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD", "transform": [1, 0, 0]}`), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.transform"}},
+		{"contents in 1.0", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD", "contents": [{"uri": "0.b3dm"}]}`),
+			SeverityWarning, Issue{File: "tileset.json", Pointer: "root.contents"}},
+		{"content and contents", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD",
+			"content": {"uri": "0.b3dm"}, "contents": [{"uri": "0.b3dm"}]}`), SeverityError, Issue{File: "tileset.json", Pointer: "root"}},
+
+		// Bounding volumes
+		{"no bounding volume", valid(`{"geometricError": 0, "refine": "ADD"}`), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.boundingVolume"}},
+		{"empty bounding volume", valid(`{"boundingVolume": {}, "geometricError": 0, "refine": "ADD"}`), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.boundingVolume"}},
+		{"two bounding volumes", valid(`{"boundingVolume": {"sphere": [0, 0, 0, 1], "box": [0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1]}, "geometricError": 0, "refine": "ADD"}`),
+			SeverityWarning, Issue{File: "tileset.json", Pointer: "root.boundingVolume"}},
+		{"short box", valid(`{"boundingVolume": {"box": [0, 0, 0]}, "geometricError": 0, "refine": "ADD"}`), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.boundingVolume.box"}},
+		{"region in degrees", valid(`{"boundingVolume": {"region": [-10, 40, 10, 50, 0, 1]}, "geometricError": 0, "refine": "ADD"}`), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.boundingVolume.region"}},
+		{"region north first", valid(`{"boundingVolume": {"region": [0, 1, 1, 0.5, 0, 1]}, "geometricError": 0, "refine": "ADD"}`), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.boundingVolume.region"}},
+		{"region upside down", valid(`{"boundingVolume": {"region": [0, 0, 1, 1, 10, 1]}, "geometricError": 0, "refine": "ADD"}`), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.boundingVolume.region"}},
+		{"negative radius", valid(`{"boundingVolume": {"sphere": [0, 0, 0, -1]}, "geometricError": 0, "refine": "ADD"}`), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.boundingVolume.sphere"}},
+
+		// Contents
+		{"no uri", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD", "content": {}}`), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"deprecated url", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD", "content": {"url": "0.b3dm"}}`),
+			SeverityWarning, Issue{File: "tileset.json", Pointer: "root.content.url"}},
+		{"missing content", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD", "content": {"uri": "1.b3dm"}}`),
+			SeverityError, Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"outside of the archive", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD", "content": {"uri": "../0.b3dm"}}`),
+			SeverityError, Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"absolute path", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD", "content": {"uri": "/0.b3dm"}}`),
+			SeverityError, Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"remote content", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD", "content": {"uri": "https://example.com/0.b3dm"}}`),
+			SeverityWarning, Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"unknown format", withTile("0.obj", []byte("v 0 0 0")), SeverityWarning, Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"implicit tiling", valid(`{"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD",
+			"implicitTiling": {"subdivisionScheme": "QUADTREE"}, "content": {"uri": "{level}/{x}/{y}.glb"}}`),
+			SeverityWarning, Issue{File: "tileset.json", Pointer: "root.implicitTiling"}},
+
+		// Headers of the tiles
+		{"short tile", withTile("1.b3dm", b3dm[:20]), SeverityError, Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"wrong magic", withTile("1.b3dm", tile("pnts", 1, 28)), SeverityError, Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"wrong version", withTile("1.b3dm", tile("b3dm", 2, 28)), SeverityError, Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"glTF 1", withTile("1.glb", tile("glTF", 1, 12)), SeverityError, Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"truncated tile", withTile("1.b3dm", append(b3dm, 0)), SeverityError, Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"tables past the end", withTile("1.b3dm", tile("b3dm", 1, 28, 4)), SeverityError, Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"i3dm glTF format", withTile("1.i3dm", tile("i3dm", 1, 32, 0, 0, 0, 0, 2)), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"composite of glTF", withTile("1.cmpt", composite(tile("glTF", 2, 12))), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+		{"composite past the end", withTile("1.cmpt", func() []byte {
+			data := composite(tile("b3dm", 1, 28))
+			binary.LittleEndian.PutUint32(data[12:], 2)
+			return data
+		}()), SeverityError,
+			Issue{File: "tileset.json", Pointer: "root.content.uri"}},
+
+		// Issues of an external tileset are reported against it
+		{"external tileset", withTile("tiles/tileset.json", []byte(`{"asset": {"version": "1.0"}, "geometricError": 1,
+			"root": {"boundingVolume": `+sphere+`, "geometricError": 0, "content": {"uri": "../1.b3dm"}}}`)), SeverityError, Issue{File: "tiles/tileset.json", Pointer: "root.content.uri"}},
+	} {
+		report, err := Validate(testFiles{files: test.files}, "tileset.json")
+		issues := report.Warnings
+		if test.severity == SeverityError {
+			issues = report.Errors
+			if !errors.As(err, new(*ValidationError)) {
+				t.Errorf("%s: got %v, want a ValidationError", test.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+
+		found := false
+		for _, issue := range issues {
+			found = found || (issue.File == test.issue.File && issue.Pointer == test.issue.Pointer && issue.Severity == test.severity)
+		}
+		if !found {
+			t.Errorf("%s: got errors %v and warnings %v, want a %s in %s at %q", test.name, report.Errors, report.Warnings,
+				test.severity, test.issue.File, test.issue.Pointer)
+		}
+	}
+}
+
+// Reports keep a bounded number of issues
+func TestValidateTruncates(t *testing.T) {
+	children := ""
+	for i := 0; i < maxIssues+10; i++ {
+		children += `{"geometricError": -1},`
+	}
+	files := testFiles{files: map[string][]byte{"tileset.json": []byte(`{"asset": {"version": "1.0"}, "geometricError": 1,
+		"root": {"boundingVolume": ` + sphere + `, "geometricError": 0, "refine": "ADD", "children": [` + children[:len(children)-1] + `]}}`)}}
+	report, err := Validate(files, "tileset.json")
+	if !errors.As(err, new(*ValidationError)) {
+		t.Fatalf("got %v, want a ValidationError", err)
+	}
+	if len(report.Errors) != maxIssues || !report.Truncated {
+		t.Errorf("got %d errors, truncated %v, want %d truncated", len(report.Errors), report.Truncated, maxIssues)
+	}
+}
+
+// tile returns the header of a tile format with its length, followed by words like the
+// lengths of its tables, padded up to length
+func tile(magic string, version uint32, length int, words ...uint32) []byte {
+	data := make([]byte, length)
+	copy(data, magic)
+	binary.LittleEndian.PutUint32(data[4:], version)
+	binary.LittleEndian.PutUint32(data[8:], uint32(length))
+	for i, word := range words {
+		binary.LittleEndian.PutUint32(data[12+4*i:], word)
+	}
+	return data
+}
+
+func composite(tiles ...[]byte) []byte {
+	data := tile("cmpt", 1, 16, uint32(len(tiles)))
+	for _, inner := range tiles {
+		data = append(data, inner...)
+	}
+	binary.LittleEndian.PutUint32(data[8:], uint32(len(data)))
+	return data
+}
@@ -0,0 +1,187 @@
+package usage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"filemanager/common/helpers"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	layersBucket   = []byte("layers")
+	verifiedBucket = []byte("verified")
+)
+
+// Store keeps the bytes stored in every layer, keyed by company/project/iteration/layer,
+// so a company's usage is known without walking its files
+type Store struct {
+	db *bolt.DB
+}
+
+var (
+	store     *Store
+	storeLock sync.Mutex
+)
+
+// Get returns the store at GetUsageLocation, opened on first use
+func Get() *Store {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+
+	if store == nil {
+		opened, err := Open(helpers.GetUsageLocation())
+		if err != nil {
+			log.Fatalf("failed to open usage store: %v", err)
+		}
+		store = opened
+	}
+
+	return store
+}
+
+func Open(location string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return nil, err
+	}
+
+	// Fail instead of waiting forever when another process holds the file
+	db, err := bolt.Open(location, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(layersBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(verifiedBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// SetLayers replaces the usage of every layer under prefix, layers missing from sizes are removed
+func (s *Store) SetLayers(prefix string, sizes map[string]int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(layersBucket)
+		if err := deletePrefix(bucket, prefix); err != nil {
+			return err
+		}
+		for layerKey, size := range sizes {
+			if err := bucket.Put([]byte(layerKey), encodeSize(size)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Verified replaces a company's usage with sizes counted from its files
+func (s *Store) Verified(companyID string, sizes map[string]int64) error {
+	if err := s.SetLayers(companyID, sizes); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		verifiedTime, _ := time.Now().MarshalText()
+		return tx.Bucket(verifiedBucket).Put([]byte(companyID), verifiedTime)
+	})
+}
+
+// Forget removes a company that has no files anymore
+func (s *Store) Forget(companyID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := deletePrefix(tx.Bucket(layersBucket), companyID); err != nil {
+			return err
+		}
+		return tx.Bucket(verifiedBucket).Delete([]byte(companyID))
+	})
+}
+
+// Layers returns the usage of every layer under prefix
+func (s *Store) Layers(prefix string) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(layersBucket).Cursor()
+		prefixBytes := []byte(prefix + "/")
+		for key, value := cursor.Seek(prefixBytes); key != nil && bytes.HasPrefix(key, prefixBytes); key, value = cursor.Next() {
+			sizes[string(key)] = decodeSize(value)
+		}
+		return nil
+	})
+	return sizes, err
+}
+
+// Total returns the bytes used under prefix
+func (s *Store) Total(prefix string) (int64, error) {
+	sizes, err := s.Layers(prefix)
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return total, err
+}
+
+// Companies returns every company with tracked usage
+func (s *Store) Companies() ([]string, error) {
+	var companies []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(verifiedBucket).ForEach(func(key, _ []byte) error {
+			companies = append(companies, string(key))
+			return nil
+		})
+	})
+	return companies, err
+}
+
+// VerifiedTime returns when a company's usage was last counted from its files, zero if never
+func (s *Store) VerifiedTime(companyID string) time.Time {
+	var verifiedTime time.Time
+	s.db.View(func(tx *bolt.Tx) error {
+		return verifiedTime.UnmarshalText(tx.Bucket(verifiedBucket).Get([]byte(companyID)))
+	})
+	return verifiedTime
+}
+
+func deletePrefix(bucket *bolt.Bucket, prefix string) error {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+
+	// Collect first, deleting while iterating skips keys
+	var keys [][]byte
+	cursor := bucket.Cursor()
+	for key, _ := cursor.Seek([]byte(prefix)); key != nil && bytes.HasPrefix(key, []byte(prefix)); key, _ = cursor.Next() {
+		keys = append(keys, append([]byte{}, key...))
+	}
+	for _, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeSize(size int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(size))
+}
+
+func decodeSize(value []byte) int64 {
+	if len(value) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(value))
+}
@@ -0,0 +1,259 @@
+package vectortile
+
+import (
+	"math"
+)
+
+// Kinds of geometry, numbered like the GeomType of vector tiles
+const (
+	kindPoint   = 1
+	kindLine    = 2
+	kindPolygon = 3
+)
+
+// point is a position projected to Web Mercator, scaled so the world is 0 to 1 from the north west.
+// importance is the distance squared at which simplification drops it, intersections are never dropped
+type point struct {
+	x, y       float64
+	importance float64
+}
+
+// feature is a geometry of a single kind with the properties of the GeoJSON feature it comes from.
+// Features cut by a tile are copies, the others are shared by every tile they are in
+type feature struct {
+	layer      int
+	id         uint64
+	hasID      bool
+	kind       int
+	parts      [][]point // points in one part, line strings, or rings each followed by their holes
+	exterior   []bool    // rings which are exteriors
+	properties []property
+
+	minX, minY, maxX, maxY float64
+}
+
+func project(longitude, latitude float64) point {
+	latitude = math.Max(-85.05112878, math.Min(85.05112878, latitude))
+	sin := math.Sin(latitude * math.Pi / 180)
+	return point{
+		x: longitude/360 + 0.5,
+		y: 0.5 - 0.25*math.Log((1+sin)/(1-sin))/math.Pi,
+	}
+}
+
+func (f *feature) computeBounds() {
+	f.minX, f.minY, f.maxX, f.maxY = math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, part := range f.parts {
+		for _, p := range part {
+			f.minX, f.minY = math.Min(f.minX, p.x), math.Min(f.minY, p.y)
+			f.maxX, f.maxY = math.Max(f.maxX, p.x), math.Max(f.maxY, p.y)
+		}
+	}
+}
+
+// rank sets the importance of the points of a line or ring by Douglas-Peucker: the first and last
+// points are always kept, every other point by how far it is from the line its neighbours make
+func rank(points []point) {
+	if len(points) == 0 {
+		return
+	}
+	points[0].importance, points[len(points)-1].importance = math.Inf(1), math.Inf(1)
+
+	type span struct{ first, last int }
+	stack := []span{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		index, farthest := -1, -1.0
+		for i := s.first + 1; i < s.last; i++ {
+			if distance := segmentDistance(points[i], points[s.first], points[s.last]); distance > farthest {
+				index, farthest = i, distance
+			}
+		}
+		if index < 0 {
+			continue
+		}
+		points[index].importance = farthest
+		stack = append(stack, span{s.first, index}, span{index, s.last})
+	}
+}
+
+// segmentDistance returns the distance squared from p to the segment a b
+func segmentDistance(p, a, b point) float64 {
+	x, y := a.x, a.y
+	dx, dy := b.x-x, b.y-y
+	if dx != 0 || dy != 0 {
+		t := ((p.x-x)*dx + (p.y-y)*dy) / (dx*dx + dy*dy)
+		if t > 1 {
+			x, y = b.x, b.y
+		} else if t > 0 {
+			x, y = x+dx*t, y+dy*t
+		}
+	}
+	dx, dy = p.x-x, p.y-y
+	return dx*dx + dy*dy
+}
+
+// clip returns the features within k1 and k2 on an axis, 0 for x and 1 for y. Features entirely
+// inside are returned as they are, the ones across a bound are cut
+func clip(features []*feature, k1, k2 float64, axis int) []*feature {
+	var clipped []*feature
+	for _, f := range features {
+		low, high := f.minX, f.maxX
+		if axis == 1 {
+			low, high = f.minY, f.maxY
+		}
+		if high < k1 || low > k2 {
+			continue
+		}
+		if low >= k1 && high <= k2 {
+			clipped = append(clipped, f)
+			continue
+		}
+
+		cut := &feature{layer: f.layer, id: f.id, hasID: f.hasID, kind: f.kind, properties: f.properties}
+		switch f.kind {
+		case kindPoint:
+			var points []point
+			for _, p := range f.parts[0] {
+				if value := coordinate(p, axis); value >= k1 && value <= k2 {
+					points = append(points, p)
+				}
+			}
+			if len(points) > 0 {
+				cut.parts = [][]point{points}
+			}
+		case kindLine:
+			for _, line := range f.parts {
+				cut.parts = append(cut.parts, clipLine(line, k1, k2, axis)...)
+			}
+		case kindPolygon:
+			keepHoles := false
+			for i, ring := range f.parts {
+				// Holes of an exterior clipped away go with it
+				if !f.exterior[i] && !keepHoles {
+					continue
+				}
+				ring = clipRing(clipRing(ring, k1, axis, 1), k2, axis, -1)
+				if f.exterior[i] {
+					keepHoles = len(ring) > 0
+				}
+				if len(ring) > 0 {
+					cut.parts = append(cut.parts, ring)
+					cut.exterior = append(cut.exterior, f.exterior[i])
+				}
+			}
+		}
+		if len(cut.parts) > 0 {
+			cut.computeBounds()
+			clipped = append(clipped, cut)
+		}
+	}
+	return clipped
+}
+
+func coordinate(p point, axis int) float64 {
+	if axis == 0 {
+		return p.x
+	}
+	return p.y
+}
+
+// intersect returns the point of the segment a b at value on an axis
+func intersect(a, b point, value float64, axis int) point {
+	t := (value - coordinate(a, axis)) / (coordinate(b, axis) - coordinate(a, axis))
+	p := point{x: a.x + (b.x-a.x)*t, y: a.y + (b.y-a.y)*t, importance: math.Inf(1)}
+	if axis == 0 {
+		p.x = value
+	} else {
+		p.y = value
+	}
+	return p
+}
+
+// clipLine returns the pieces of a line string within k1 and k2 on an axis
+func clipLine(line []point, k1, k2 float64, axis int) [][]point {
+	var pieces [][]point
+	var piece []point
+	flush := func() {
+		if len(piece) >= 2 {
+			pieces = append(pieces, piece)
+		}
+		piece = nil
+	}
+
+	for i := 0; i+1 < len(line); i++ {
+		a, b := line[i], line[i+1]
+		av, bv := coordinate(a, axis), coordinate(b, axis)
+
+		// Part of the segment inside, from t0 to t1
+		t0, t1 := 0.0, 1.0
+		if av == bv {
+			if av < k1 || av > k2 {
+				flush()
+				continue
+			}
+		} else {
+			tk1, tk2 := (k1-av)/(bv-av), (k2-av)/(bv-av)
+			t0, t1 = math.Max(0, math.Min(tk1, tk2)), math.Min(1, math.Max(tk1, tk2))
+			if t0 > t1 {
+				flush()
+				continue
+			}
+		}
+
+		if len(piece) == 0 {
+			start := a
+			if t0 > 0 {
+				start = intersect(a, b, valueAt(av, bv, t0, k1, k2), axis)
+			}
+			piece = append(piece, start)
+		}
+		if t1 < 1 {
+			piece = append(piece, intersect(a, b, valueAt(av, bv, t1, k1, k2), axis))
+			flush()
+		} else {
+			piece = append(piece, b)
+		}
+	}
+	flush()
+	return pieces
+}
+
+// valueAt returns the bound a segment crosses at t, exactly, so cut lines end on the bound
+func valueAt(av, bv, t, k1, k2 float64) float64 {
+	value := av + (bv-av)*t
+	if math.Abs(value-k1) < math.Abs(value-k2) {
+		return k1
+	}
+	return k2
+}
+
+// clipRing keeps the part of a closed ring on one side of a bound on an axis, above it for a side
+// of 1 and below it for -1, closing what is left. Nil when nothing is left
+func clipRing(ring []point, bound float64, axis int, side float64) []point {
+	if len(ring) == 0 {
+		return nil
+	}
+	inside := func(p point) bool {
+		return (coordinate(p, axis)-bound)*side >= 0
+	}
+
+	var clipped []point
+	for i := 0; i+1 < len(ring); i++ {
+		a, b := ring[i], ring[i+1]
+		switch {
+		case inside(a) && inside(b):
+			clipped = append(clipped, b)
+		case inside(a):
+			clipped = append(clipped, intersect(a, b, bound, axis))
+		case inside(b):
+			clipped = append(clipped, intersect(a, b, bound, axis), b)
+		}
+	}
+	if len(clipped) < 3 {
+		return nil
+	}
+	return append(clipped, clipped[0])
+}
@@ -0,0 +1,116 @@
+package vectortile
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestClip(t *testing.T) {
+	points := func(coordinates ...float64) []point {
+		var line []point
+		for i := 0; i+1 < len(coordinates); i += 2 {
+			line = append(line, point{x: coordinates[i], y: coordinates[i+1]})
+		}
+		return line
+	}
+	newFeature := func(kind int, exterior []bool, parts ...[]point) *feature {
+		f := &feature{kind: kind, parts: parts, exterior: exterior}
+		f.computeBounds()
+		return f
+	}
+	// xy drops the importance of the points of every part
+	xy := func(f *feature) [][][2]float64 {
+		var parts [][][2]float64
+		for _, part := range f.parts {
+			var coordinates [][2]float64
+			for _, p := range part {
+				coordinates = append(coordinates, [2]float64{p.x, p.y})
+			}
+			parts = append(parts, coordinates)
+		}
+		return parts
+	}
+
+	for _, test := range []struct {
+		name    string
+		feature *feature
+		axis    int
+		want    [][][2]float64 // nil when clipped away
+	}{
+		{"inside", newFeature(kindLine, nil, points(0.3, 0, 0.6, 1)), 0, [][][2]float64{{{0.3, 0}, {0.6, 1}}}},
+		{"outside", newFeature(kindLine, nil, points(0, 0, 0.1, 1)), 0, nil},
+		{"points", newFeature(kindPoint, nil, points(0.1, 0, 0.5, 0, 0.9, 0)), 0, [][][2]float64{{{0.5, 0}}}},
+		{"points on the bounds", newFeature(kindPoint, nil, points(0.25, 0, 0.75, 0, 0.8, 0)), 0, [][][2]float64{{{0.25, 0}, {0.75, 0}}}},
+		{"line across", newFeature(kindLine, nil, points(0, 0, 1, 1)), 0, [][][2]float64{{{0.25, 0.25}, {0.75, 0.75}}}},
+		{"line on the other axis", newFeature(kindLine, nil, points(0, 0, 1, 1)), 1, [][][2]float64{{{0.25, 0.25}, {0.75, 0.75}}}},
+		{"line leaving and coming back", newFeature(kindLine, nil, points(0.5, 0, 0.9, 0, 0.9, 1, 0.5, 1)), 0,
+			[][][2]float64{{{0.5, 0}, {0.75, 0}}, {{0.75, 1}, {0.5, 1}}}},
+		{"vertical line outside", newFeature(kindLine, nil, points(0.5, 0, 0.5, 1, 0.9, 1, 0.9, 0)), 0,
+			[][][2]float64{{{0.5, 0}, {0.5, 1}, {0.75, 1}}}},
+		{"ring across", newFeature(kindPolygon, []bool{true}, points(0, 0, 1, 0, 1, 1, 0, 1, 0, 0)), 0,
+			[][][2]float64{{{0.75, 0}, {0.75, 1}, {0.25, 1}, {0.25, 0}, {0.75, 0}}}},
+		{"holes of a ring clipped away", newFeature(kindPolygon, []bool{true, false, true},
+			points(0, 0, 0.2, 0, 0.2, 1, 0, 0), points(0.05, 0.1, 0.1, 0.2, 0.15, 0.1, 0.05, 0.1),
+			points(0.3, 0, 0.5, 0, 0.5, 1, 0.3, 0)), 0,
+			[][][2]float64{{{0.5, 1}, {0.3, 0}, {0.5, 0}, {0.5, 1}}}},
+	} {
+		clipped := clip([]*feature{test.feature}, 0.25, 0.75, test.axis)
+		switch {
+		case test.want == nil && len(clipped) != 0:
+			t.Errorf("%s: got %v, want it clipped away", test.name, xy(clipped[0]))
+		case test.want != nil && len(clipped) != 1:
+			t.Errorf("%s: got %d features, want one", test.name, len(clipped))
+		case test.want != nil && !reflect.DeepEqual(xy(clipped[0]), test.want):
+			t.Errorf("%s: got %v, want %v", test.name, xy(clipped[0]), test.want)
+		}
+	}
+
+	// Features inside are not copied, cut ones have their bounds and properties
+	inside := newFeature(kindLine, nil, points(0.3, 0, 0.6, 1))
+	if clipped := clip([]*feature{inside}, 0, 1, 0); clipped[0] != inside {
+		t.Error("a feature inside was copied")
+	}
+	across := newFeature(kindLine, nil, points(0, 0, 1, 1))
+	across.id, across.hasID, across.properties = 3, true, []property{{key: "a", value: value{kind: valueString, text: "b"}}}
+	cut := clip([]*feature{across}, 0.25, 0.75, 0)[0]
+	if cut.minX != 0.25 || cut.maxX != 0.75 || cut.id != 3 || !cut.hasID || !reflect.DeepEqual(cut.properties, across.properties) {
+		t.Errorf("got %+v, want the bounds of the cut and the ID and properties of the feature", cut)
+	}
+	// Intersections are never simplified away
+	if !math.IsInf(cut.parts[0][0].importance, 1) || !math.IsInf(cut.parts[0][1].importance, 1) {
+		t.Errorf("got importances %v and %v, want intersections kept", cut.parts[0][0].importance, cut.parts[0][1].importance)
+	}
+}
+
+func TestRank(t *testing.T) {
+	line := []point{{x: 0, y: 0}, {x: 1, y: 0.1}, {x: 2, y: 0}, {x: 3, y: 2}, {x: 4, y: 0}}
+	rank(line)
+
+	// The ends are always kept, the peak is farthest from them, the bump from the line to the peak
+	if !math.IsInf(line[0].importance, 1) || !math.IsInf(line[4].importance, 1) {
+		t.Errorf("got ends of importance %v and %v, want them kept", line[0].importance, line[4].importance)
+	}
+	if line[3].importance != 4 {
+		t.Errorf("got peak of importance %v, want 4", line[3].importance)
+	}
+	if line[1].importance >= line[2].importance || line[2].importance >= line[3].importance {
+		t.Errorf("got importances %v, %v and %v, want the bump, the valley then the peak", line[1].importance, line[2].importance, line[3].importance)
+	}
+
+	// Simplifying drops the points which matter less than the tolerance
+	transform := func(p point) (int64, int64) { return int64(math.Round(p.x)), int64(math.Round(p.y)) }
+	for _, test := range []struct {
+		tolerance float64
+		want      [][2]int64
+	}{
+		{0, [][2]int64{{0, 0}, {1, 0}, {2, 0}, {3, 2}, {4, 0}}},
+		{line[1].importance, [][2]int64{{0, 0}, {2, 0}, {3, 2}, {4, 0}}},
+		{line[2].importance, [][2]int64{{0, 0}, {3, 2}, {4, 0}}},
+		{line[3].importance, [][2]int64{{0, 0}, {4, 0}}},
+	} {
+		if got := simplify(line, transform, test.tolerance); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tolerance %v: got %v, want %v", test.tolerance, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package vectortile
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Mapbox Vector Tiles 2.1, protocol buffers written by hand since only a few messages are needed.
+// See https://github.com/mapbox/vector-tile-spec/tree/master/2.1
+
+// Wire types of protocol buffers
+const (
+	wireVarint = 0
+	wire64     = 1
+	wireBytes  = 2
+)
+
+// Commands of a geometry
+const (
+	commandMoveTo    = 1
+	commandLineTo    = 2
+	commandClosePath = 7
+)
+
+// value is a property value of a tile, of one of the kinds vector tiles have
+type value struct {
+	kind    int // field number of the value in its message
+	text    string
+	number  float64
+	integer int64
+	flag    bool
+}
+
+// Fields of a Value message
+const (
+	valueString = 1
+	valueDouble = 3
+	valueUint   = 5
+	valueSint   = 6
+	valueBool   = 7
+)
+
+type property struct {
+	key   string
+	value value
+}
+
+// layerEncoder writes the features of a layer of a tile, keys and values are shared by its features
+type layerEncoder struct {
+	name      string
+	keys      map[string]int
+	keyList   []string
+	values    map[value]int
+	valueList [][]byte
+	features  [][]byte
+}
+
+func newLayerEncoder(name string) *layerEncoder {
+	return &layerEncoder{name: name, keys: map[string]int{}, values: map[value]int{}}
+}
+
+// addFeature adds a feature whose geometry is already in tile coordinates
+func (l *layerEncoder) addFeature(f *feature, geometry []uint32) {
+	var tags []uint32
+	for _, p := range f.properties {
+		key, exist := l.keys[p.key]
+		if !exist {
+			key = len(l.keyList)
+			l.keys[p.key] = key
+			l.keyList = append(l.keyList, p.key)
+		}
+		index, exist := l.values[p.value]
+		if !exist {
+			index = len(l.valueList)
+			l.values[p.value] = index
+			l.valueList = append(l.valueList, encodeValue(p.value))
+		}
+		tags = append(tags, uint32(key), uint32(index))
+	}
+
+	var b []byte
+	if f.hasID {
+		b = appendVarintField(b, 1, f.id)
+	}
+	if len(tags) > 0 {
+		b = appendPacked(b, 2, tags)
+	}
+	b = appendVarintField(b, 3, uint64(f.kind))
+	b = appendPacked(b, 4, geometry)
+	l.features = append(l.features, b)
+}
+
+func (l *layerEncoder) encode(extent int) []byte {
+	b := appendVarintField(nil, 15, 2)
+	b = appendBytesField(b, 1, []byte(l.name))
+	for _, f := range l.features {
+		b = appendBytesField(b, 2, f)
+	}
+	for _, key := range l.keyList {
+		b = appendBytesField(b, 3, []byte(key))
+	}
+	for _, v := range l.valueList {
+		b = appendBytesField(b, 4, v)
+	}
+	return appendVarintField(b, 5, uint64(extent))
+}
+
+func encodeValue(v value) []byte {
+	switch v.kind {
+	case valueString:
+		return appendBytesField(nil, valueString, []byte(v.text))
+	case valueDouble:
+		b := appendTag(nil, valueDouble, wire64)
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(v.number))
+	case valueUint:
+		return appendVarintField(nil, valueUint, uint64(v.integer))
+	case valueSint:
+		return appendVarintField(nil, valueSint, zigzag(v.integer))
+	}
+	flag := uint64(0)
+	if v.flag {
+		flag = 1
+	}
+	return appendVarintField(nil, valueBool, flag)
+}
+
+// encodeTile writes the layers of a tile, layers without features are left out
+func encodeTile(layers []*layerEncoder, extent int) []byte {
+	var b []byte
+	for _, layer := range layers {
+		if layer != nil && len(layer.features) > 0 {
+			b = appendBytesField(b, 3, layer.encode(extent))
+		}
+	}
+	return b
+}
+
+func command(id, count int) uint32 {
+	return uint32(id&0x7) | uint32(count)<<3
+}
+
+func zigzag(n int64) uint64 {
+	return uint64((n << 1) ^ (n >> 63))
+}
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendVarintField(b []byte, field int, value uint64) []byte {
+	return binary.AppendUvarint(appendTag(b, field, wireVarint), value)
+}
+
+func appendBytesField(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(appendTag(b, field, wireBytes), uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendPacked(b []byte, field int, values []uint32) []byte {
+	var packed []byte
+	for _, v := range values {
+		packed = binary.AppendUvarint(packed, uint64(v))
+	}
+	return appendBytesField(b, field, packed)
+}
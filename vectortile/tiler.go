@@ -0,0 +1,423 @@
+package vectortile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"filemanager/geojson"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Tiles are this many units across
+const Extent = 4096
+
+const (
+	// Units drawn past the edges of a tile, so lines and polygons join across tiles
+	buffer = 64
+
+	// Units simplification may move a line by, below the maximum zoom
+	tolerance = 3
+)
+
+// ErrTooManyTiles is returned by Build when the features cover more tiles than the tiler's maximum
+var ErrTooManyTiles = errors.New("features cover too many vector tiles")
+
+// Layer describes a layer of the tiles, the vector_layers of TileJSON
+type Layer struct {
+	ID      string            `json:"id"`
+	Fields  map[string]string `json:"fields"` // property name to String, Number, Boolean or Mixed
+	MinZoom int               `json:"minzoom"`
+	MaxZoom int               `json:"maxzoom"`
+}
+
+// Tiler cuts GeoJSON features into vector tiles from zoom 0 to a maximum zoom. Features are
+// added first, kept in memory projected, then every tile with features is built at once
+type Tiler struct {
+	maxZoom    int
+	maxTiles   int
+	tiles      int
+	layers     []*Layer
+	layerIndex map[string]int
+	features   []*feature
+
+	west, south, east, north float64
+}
+
+// NewTiler returns a tiler building at most maxTiles tiles, 0 for no limit. Large polygons cover
+// four times more tiles at every zoom, they would otherwise fill the tiles' storage
+func NewTiler(maxZoom, maxTiles int) *Tiler {
+	return &Tiler{
+		maxZoom:    maxZoom,
+		maxTiles:   maxTiles,
+		layerIndex: map[string]int{},
+		west:       math.Inf(1),
+		south:      math.Inf(1),
+		east:       math.Inf(-1),
+		north:      math.Inf(-1),
+	}
+}
+
+// Layers returns the layers of the features added so far, in the order they were added
+func (t *Tiler) Layers() []*Layer {
+	return t.layers
+}
+
+// Bounds returns the west, south, east, north of the features added so far, nil without any
+func (t *Tiler) Bounds() []float64 {
+	if t.west > t.east {
+		return nil
+	}
+	return []float64{t.west, t.south, t.east, t.north}
+}
+
+// Add adds a feature to a layer of the tiles. Features without geometry are left out
+func (t *Tiler) Add(layer string, f *geojson.Feature) error {
+	index, exist := t.layerIndex[layer]
+	if !exist {
+		index = len(t.layers)
+		t.layerIndex[layer] = index
+		t.layers = append(t.layers, &Layer{ID: layer, Fields: map[string]string{}, MaxZoom: t.maxZoom})
+	}
+	if f.Geometry == nil {
+		return nil
+	}
+
+	template := &feature{layer: index}
+	template.properties = t.properties(t.layers[index], f)
+	if id, ok := f.ID.(json.Number); ok {
+		if value, err := id.Int64(); err == nil && value >= 0 {
+			template.id, template.hasID = uint64(value), true
+		}
+	}
+	if f.ID != nil && !template.hasID && f.Properties["id"] == nil {
+		if v, ok := toValue(f.ID); ok {
+			template.properties = append(template.properties, property{key: "id", value: v})
+		}
+	}
+	return t.addGeometry(template, f.Geometry)
+}
+
+// properties returns the properties of a feature sorted by name, so equal features encode the same
+func (t *Tiler) properties(layer *Layer, f *geojson.Feature) []property {
+	var properties []property
+	for key, raw := range f.Properties {
+		v, ok := toValue(raw)
+		if !ok {
+			continue
+		}
+		properties = append(properties, property{key: key, value: v})
+
+		fieldType := map[int]string{valueString: "String", valueBool: "Boolean"}[v.kind]
+		if fieldType == "" {
+			fieldType = "Number"
+		}
+		if known, exist := layer.Fields[key]; !exist {
+			layer.Fields[key] = fieldType
+		} else if known != fieldType {
+			layer.Fields[key] = "Mixed"
+		}
+	}
+	sort.Slice(properties, func(i, j int) bool { return properties[i].key < properties[j].key })
+	return properties
+}
+
+// toValue converts a JSON value to a tile value, objects and arrays become their JSON. False for null
+func toValue(raw any) (value, bool) {
+	switch raw := raw.(type) {
+	case nil:
+		return value{}, false
+	case string:
+		return value{kind: valueString, text: raw}, true
+	case bool:
+		return value{kind: valueBool, flag: raw}, true
+	case json.Number:
+		if integer, err := raw.Int64(); err == nil {
+			if integer < 0 {
+				return value{kind: valueSint, integer: integer}, true
+			}
+			return value{kind: valueUint, integer: integer}, true
+		}
+		if number, err := raw.Float64(); err == nil {
+			return value{kind: valueDouble, number: number}, true
+		}
+		return value{kind: valueString, text: raw.String()}, true
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return value{}, false
+	}
+	return value{kind: valueString, text: string(data)}, true
+}
+
+// addGeometry adds a feature of each kind of geometry, the parts of collections and multi geometries together
+func (t *Tiler) addGeometry(template *feature, geometry *geojson.Geometry) error {
+	add := func(kind int, parts [][]point, exterior []bool) {
+		if len(parts) == 0 {
+			return
+		}
+		f := *template
+		f.kind, f.parts, f.exterior = kind, parts, exterior
+		if kind != kindPoint {
+			for _, part := range parts {
+				rank(part)
+			}
+		}
+		f.computeBounds()
+		t.features = append(t.features, &f)
+	}
+
+	var err error
+	switch geometry.Type {
+	case "GeometryCollection":
+		for _, child := range geometry.Geometries {
+			if child != nil {
+				if err := t.addGeometry(template, child); err != nil {
+					return err
+				}
+			}
+		}
+	case "Point":
+		var position []float64
+		if err = json.Unmarshal(geometry.Coordinates, &position); err == nil && len(position) >= 2 {
+			add(kindPoint, [][]point{{t.project(position)}}, nil)
+		}
+	case "MultiPoint":
+		var positions [][]float64
+		if err = json.Unmarshal(geometry.Coordinates, &positions); err == nil && len(positions) > 0 {
+			add(kindPoint, [][]point{t.projectAll(positions)}, nil)
+		}
+	case "LineString":
+		var positions [][]float64
+		if err = json.Unmarshal(geometry.Coordinates, &positions); err == nil && len(positions) > 0 {
+			add(kindLine, [][]point{t.projectAll(positions)}, nil)
+		}
+	case "MultiLineString":
+		var lines [][][]float64
+		if err = json.Unmarshal(geometry.Coordinates, &lines); err == nil {
+			var parts [][]point
+			for _, line := range lines {
+				parts = append(parts, t.projectAll(line))
+			}
+			add(kindLine, parts, nil)
+		}
+	case "Polygon", "MultiPolygon":
+		var polygons [][][][]float64
+		if geometry.Type == "Polygon" {
+			var polygon [][][]float64
+			err = json.Unmarshal(geometry.Coordinates, &polygon)
+			polygons = [][][][]float64{polygon}
+		} else {
+			err = json.Unmarshal(geometry.Coordinates, &polygons)
+		}
+		if err == nil {
+			var parts [][]point
+			var exterior []bool
+			for _, polygon := range polygons {
+				for i, ring := range polygon {
+					parts = append(parts, t.projectAll(ring))
+					exterior = append(exterior, i == 0)
+				}
+			}
+			add(kindPolygon, parts, exterior)
+		}
+	default:
+		return fmt.Errorf("unknown geometry type %s", geometry.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("%s coordinates: %w", geometry.Type, err)
+	}
+	return nil
+}
+
+func (t *Tiler) project(position []float64) point {
+	t.west, t.east = math.Min(t.west, position[0]), math.Max(t.east, position[0])
+	t.south, t.north = math.Min(t.south, position[1]), math.Max(t.north, position[1])
+	return project(position[0], position[1])
+}
+
+func (t *Tiler) projectAll(positions [][]float64) []point {
+	points := make([]point, 0, len(positions))
+	for _, position := range positions {
+		if len(position) >= 2 {
+			points = append(points, t.project(position))
+		}
+	}
+	return points
+}
+
+// Build calls emit with every tile which has features, encoded as a vector tile. Tiles are built
+// depth first: the features of a tile are clipped from the features of its parent. ErrTooManyTiles
+// is returned once more tiles than the maximum have features
+func (t *Tiler) Build(ctx context.Context, emit func(z, x, y int, tile []byte) error) error {
+	if len(t.features) == 0 {
+		return nil
+	}
+	t.tiles = 0
+	return t.build(ctx, t.features, 0, 0, 0, emit)
+}
+
+func (t *Tiler) build(ctx context.Context, features []*feature, z, x, y int, emit func(z, x, y int, tile []byte) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t.tiles++
+	if t.maxTiles > 0 && t.tiles > t.maxTiles {
+		return fmt.Errorf("%w, more than %d", ErrTooManyTiles, t.maxTiles)
+	}
+	if tile := t.encode(features, z, x, y); tile != nil {
+		if err := emit(z, x, y, tile); err != nil {
+			return err
+		}
+	}
+	if z == t.maxZoom {
+		return nil
+	}
+
+	// Children with their buffer
+	size := 1 / float64(int64(1)<<(z+1))
+	margin := buffer / float64(Extent) * size
+	for dx := 0; dx < 2; dx++ {
+		column := clip(features, float64(2*x+dx)*size-margin, float64(2*x+dx+1)*size+margin, 0)
+		if len(column) == 0 {
+			continue
+		}
+		for dy := 0; dy < 2; dy++ {
+			cell := clip(column, float64(2*y+dy)*size-margin, float64(2*y+dy+1)*size+margin, 1)
+			if len(cell) == 0 {
+				continue
+			}
+			if err := t.build(ctx, cell, z+1, 2*x+dx, 2*y+dy, emit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encode writes the features of a tile simplified for its zoom, nil when none is left
+func (t *Tiler) encode(features []*feature, z, x, y int) []byte {
+	scale := float64(Extent) * float64(int64(1)<<z)
+	sqTolerance, minArea := 0.0, 0.0
+	if z < t.maxZoom {
+		sqTolerance = math.Pow(tolerance/scale, 2)
+		minArea = tolerance * tolerance
+	}
+	transform := func(p point) (int64, int64) {
+		return int64(math.Round(p.x*scale)) - int64(x)*Extent, int64(math.Round(p.y*scale)) - int64(y)*Extent
+	}
+
+	layers := make([]*layerEncoder, len(t.layers))
+	empty := true
+	for _, f := range features {
+		geometry := encodeGeometry(f, transform, sqTolerance, minArea)
+		if geometry == nil {
+			continue
+		}
+		if layers[f.layer] == nil {
+			layers[f.layer] = newLayerEncoder(t.layers[f.layer].ID)
+		}
+		layers[f.layer].addFeature(f, geometry)
+		empty = false
+	}
+	if empty {
+		return nil
+	}
+	return encodeTile(layers, Extent)
+}
+
+// encodeGeometry returns the commands drawing a feature in a tile, nil when it is simplified away
+func encodeGeometry(f *feature, transform func(point) (int64, int64), sqTolerance, minArea float64) []uint32 {
+	var geometry []uint32
+	var cursorX, cursorY int64
+	appendDeltas := func(coordinates [][2]int64) {
+		for _, c := range coordinates {
+			geometry = append(geometry, uint32(zigzag(c[0]-cursorX)), uint32(zigzag(c[1]-cursorY)))
+			cursorX, cursorY = c[0], c[1]
+		}
+	}
+	draw := func(coordinates [][2]int64, closed bool) {
+		geometry = append(geometry, command(commandMoveTo, 1))
+		appendDeltas(coordinates[:1])
+		geometry = append(geometry, command(commandLineTo, len(coordinates)-1))
+		appendDeltas(coordinates[1:])
+		if closed {
+			geometry = append(geometry, command(commandClosePath, 1))
+		}
+	}
+
+	switch f.kind {
+	case kindPoint:
+		coordinates := make([][2]int64, len(f.parts[0]))
+		for i, p := range f.parts[0] {
+			coordinates[i][0], coordinates[i][1] = transform(p)
+		}
+		geometry = append(geometry, command(commandMoveTo, len(coordinates)))
+		appendDeltas(coordinates)
+	case kindLine:
+		for _, part := range f.parts {
+			if coordinates := simplify(part, transform, sqTolerance); len(coordinates) >= 2 {
+				draw(coordinates, false)
+			}
+		}
+	case kindPolygon:
+		skipHoles := false
+		for i, ring := range f.parts {
+			if !f.exterior[i] && skipHoles {
+				continue
+			}
+			coordinates := simplify(ring, transform, sqTolerance)
+			if len(coordinates) > 1 && coordinates[0] == coordinates[len(coordinates)-1] {
+				coordinates = coordinates[:len(coordinates)-1]
+			}
+			area := signedArea(coordinates)
+			if len(coordinates) < 3 || area == 0 || math.Abs(area)/2 < minArea {
+				// Holes of a dropped exterior go with it
+				skipHoles = f.exterior[i]
+				continue
+			}
+			if f.exterior[i] {
+				skipHoles = false
+			}
+
+			// Exteriors are clockwise in tile coordinates, which grow to the south, holes counterclockwise
+			if (f.exterior[i] && area < 0) || (!f.exterior[i] && area > 0) {
+				for a, b := 0, len(coordinates)-1; a < b; a, b = a+1, b-1 {
+					coordinates[a], coordinates[b] = coordinates[b], coordinates[a]
+				}
+			}
+			draw(coordinates, true)
+		}
+	}
+	if len(geometry) == 0 {
+		return nil
+	}
+	return geometry
+}
+
+// simplify returns the points of a line or ring which matter at a tolerance, in tile coordinates without repeats
+func simplify(points []point, transform func(point) (int64, int64), sqTolerance float64) [][2]int64 {
+	coordinates := make([][2]int64, 0, len(points))
+	for i, p := range points {
+		if i > 0 && i < len(points)-1 && p.importance <= sqTolerance {
+			continue
+		}
+		x, y := transform(p)
+		if n := len(coordinates); n > 0 && coordinates[n-1] == [2]int64{x, y} {
+			continue
+		}
+		coordinates = append(coordinates, [2]int64{x, y})
+	}
+	return coordinates
+}
+
+// signedArea returns twice the area of a ring, positive when it is clockwise in tile coordinates
+func signedArea(coordinates [][2]int64) float64 {
+	var sum float64
+	for i := range coordinates {
+		a, b := coordinates[i], coordinates[(i+1)%len(coordinates)]
+		sum += float64(a[0]*b[1] - b[0]*a[1])
+	}
+	return sum
+}
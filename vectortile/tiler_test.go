@@ -0,0 +1,478 @@
+package vectortile
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"filemanager/geojson"
+	"filemanager/pmtiles"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	tiler := NewTiler(2, 0)
+	add(t, tiler, "points", `{"type": "Feature", "id": 7, "geometry": {"type": "Point", "coordinates": [0, 0]},
+		"properties": {"name": "a", "n": 1.5, "negative": -2, "count": 3, "ok": true, "tags": ["x"], "none": null}}`)
+	add(t, tiler, "areas", `{"type": "Feature", "id": "x", "geometry": {"type": "Polygon", "coordinates": [
+		[[-10, -10], [10, -10], [10, 10], [-10, 10], [-10, -10]],
+		[[-5, -5], [-5, 5], [5, 5], [5, -5], [-5, -5]]]}, "properties": {"name": 1}}`)
+	add(t, tiler, "points", `{"type": "Feature", "geometry": null, "properties": {"name": "nowhere"}}`)
+
+	if bounds := tiler.Bounds(); !reflect.DeepEqual(bounds, []float64{-10, -10, 10, 10}) {
+		t.Errorf("got bounds %v, want [-10 -10 10 10]", bounds)
+	}
+	wantLayers := []*Layer{
+		{ID: "points", Fields: map[string]string{"name": "String", "n": "Number", "negative": "Number", "count": "Number",
+			"ok": "Boolean", "tags": "String"}, MaxZoom: 2},
+		{ID: "areas", Fields: map[string]string{"name": "Number"}, MaxZoom: 2},
+	}
+	if !reflect.DeepEqual(tiler.Layers(), wantLayers) {
+		t.Errorf("got layers %+v, want %+v", tiler.Layers(), wantLayers)
+	}
+
+	tiles := build(t, tiler)
+	// Both features are at the corner of the four tiles around the center from zoom 1, within their buffer
+	if len(tiles) != 9 {
+		t.Errorf("got %d tiles, want 9", len(tiles))
+	}
+
+	layers := decodeTile(t, tiles["0/0/0"])
+	if len(layers) != 2 || layers[0].name != "points" || layers[1].name != "areas" {
+		t.Fatalf("got layers %+v, want points and areas", layers)
+	}
+	point := layers[0].features[0]
+	wantPoint := testFeature{id: 7, hasID: true, kind: kindPoint,
+		properties: map[string]any{"name": "a", "n": 1.5, "negative": int64(-2), "count": uint64(3), "ok": true, "tags": `["x"]`},
+		parts:      [][][2]int64{{{2048, 2048}}}}
+	if layers[0].extent != Extent || len(layers[0].features) != 1 || !reflect.DeepEqual(point, wantPoint) {
+		t.Errorf("got %+v, want %+v", point, wantPoint)
+	}
+
+	// A string ID is a property, the exterior is clockwise and the hole counterclockwise in tile coordinates
+	polygon := layers[1].features[0]
+	if polygon.hasID || polygon.kind != kindPolygon || !reflect.DeepEqual(polygon.properties, map[string]any{"name": uint64(1), "id": "x"}) {
+		t.Errorf("got %+v, want a polygon with the properties name and id", polygon)
+	}
+	if len(polygon.parts) != 2 || signedArea(polygon.parts[0]) <= 0 || signedArea(polygon.parts[1]) >= 0 {
+		t.Errorf("got rings %v, want a clockwise exterior and a counterclockwise hole", polygon.parts)
+	}
+
+	// The point is on the edge of the tiles around it
+	for name, want := range map[string][2]int64{"1/0/0": {Extent, Extent}, "1/1/1": {0, 0}, "2/1/2": {Extent, 0}, "2/2/1": {0, Extent}} {
+		layers := decodeTile(t, tiles[name])
+		if got := layers[0].features[0].parts[0][0]; got != want {
+			t.Errorf("%s: got the point at %v, want %v", name, got, want)
+		}
+	}
+}
+
+// Features are cut at the buffer around a tile
+func TestBuildClips(t *testing.T) {
+	tiler := NewTiler(1, 0)
+	add(t, tiler, "lines", `{"type": "Feature", "geometry": {"type": "LineString", "coordinates": [[-170, 10], [170, 10]]}, "properties": {}}`)
+	add(t, tiler, "areas", `{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [
+		[[-170, 20], [170, 20], [170, 30], [-170, 30], [-170, 20]]]}, "properties": {}}`)
+	add(t, tiler, "points", `{"type": "Feature", "geometry": {"type": "MultiPoint", "coordinates": [[-170, 40], [170, 40]]}, "properties": {}}`)
+	tiles := build(t, tiler)
+
+	// Only the northern tiles have features
+	if _, exist := tiles["1/0/1"]; exist || len(tiles) != 3 {
+		t.Errorf("got tiles %v, want 0/0/0, 1/0/0 and 1/1/0", keys(tiles))
+	}
+	for _, name := range []string{"1/0/0", "1/1/0"} {
+		layers := decodeTile(t, tiles[name])
+		if len(layers) != 3 {
+			t.Fatalf("%s: got %d layers, want 3", name, len(layers))
+		}
+		line, polygon, points := layers[0].features[0].parts, layers[1].features[0].parts, layers[2].features[0].parts
+		if len(line) != 1 || len(line[0]) != 2 || len(polygon) != 1 || len(points) != 1 || len(points[0]) != 1 {
+			t.Fatalf("%s: got line %v, polygon %v and points %v, want a line, a ring and a point", name, line, polygon, points)
+		}
+
+		// The western tile is cut at its east buffer, the eastern at its west buffer
+		edge := int64(Extent + buffer)
+		if name == "1/1/0" {
+			edge = -buffer
+		}
+		if line[0][0][0] != edge && line[0][1][0] != edge {
+			t.Errorf("%s: got line %v, want it cut at %d", name, line[0], edge)
+		}
+		onEdge := 0
+		for _, p := range polygon[0] {
+			if p[0] == edge {
+				onEdge++
+			}
+			if p[0] < -buffer || p[0] > Extent+buffer {
+				t.Errorf("%s: ring %v is past the buffer", name, polygon[0])
+				break
+			}
+		}
+		if onEdge != 2 {
+			t.Errorf("%s: got ring %v, want two points at %d", name, polygon[0], edge)
+		}
+	}
+}
+
+// Lines are simplified and small polygons dropped below the maximum zoom
+func TestBuildSimplifies(t *testing.T) {
+	var wiggles []string
+	for i := 0; i <= 100; i++ {
+		wiggles = append(wiggles, fmt.Sprintf("[%d, %g]", -50+i, 5+0.01*float64(i%2)))
+	}
+	tiler := NewTiler(1, 0)
+	add(t, tiler, "lines", `{"type": "Feature", "geometry": {"type": "LineString", "coordinates": [`+strings.Join(wiggles, ",")+`]}, "properties": {}}`)
+	add(t, tiler, "areas", `{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [
+		[[100, 50], [100.2, 50], [100.2, 50.2], [100, 50.2], [100, 50]]]}, "properties": {}}`)
+	tiles := build(t, tiler)
+
+	layers := decodeTile(t, tiles["0/0/0"])
+	if len(layers) != 1 || layers[0].name != "lines" {
+		t.Fatalf("got layers %+v, want the line without the small polygon", layers)
+	}
+	if line := layers[0].features[0].parts; len(line) != 1 || len(line[0]) != 2 {
+		t.Errorf("got %v, want a straight line", line)
+	}
+
+	// At the maximum zoom every point which is not rounded away is drawn
+	points := 0
+	for _, name := range []string{"1/0/0", "1/1/0"} {
+		for _, layer := range decodeTile(t, tiles[name]) {
+			if layer.name == "lines" {
+				points += len(layer.features[0].parts[0])
+			}
+		}
+	}
+	if points < 100 {
+		t.Errorf("got %d points at the maximum zoom, want every one of the 101", points)
+	}
+	if layers := decodeTile(t, tiles["1/1/0"]); len(layers) != 2 || layers[1].name != "areas" {
+		t.Errorf("got layers %+v, want the line and the small polygon", layers)
+	}
+}
+
+func TestBuildTooManyTiles(t *testing.T) {
+	tiler := NewTiler(4, 10)
+	add(t, tiler, "areas", `{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [
+		[[-170, -80], [170, -80], [170, 80], [-170, 80], [-170, -80]]]}, "properties": {}}`)
+	err := tiler.Build(context.Background(), func(z, x, y int, tile []byte) error { return nil })
+	if !errors.Is(err, ErrTooManyTiles) {
+		t.Errorf("got %v, want ErrTooManyTiles", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := NewTiler(4, 0).Build(ctx, nil); err != nil {
+		t.Errorf("got %v building no features, want nothing", err)
+	}
+	tiler = NewTiler(4, 0)
+	add(t, tiler, "points", `{"type": "Feature", "geometry": {"type": "Point", "coordinates": [0, 0]}, "properties": {}}`)
+	if err := tiler.Build(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want the context's error", err)
+	}
+}
+
+// Tiles written to an archive come back as they were built
+func TestBuildPMTiles(t *testing.T) {
+	tiler := NewTiler(3, 0)
+	add(t, tiler, "roads", `{"type": "Feature", "id": 1, "geometry": {"type": "MultiLineString", "coordinates": [
+		[[2.35, 48.85], [13.4, 52.52]], [[-0.12, 51.5], [2.35, 48.85]]]}, "properties": {"name": "road"}}`)
+	add(t, tiler, "places", `{"type": "Feature", "id": 2, "geometry": {"type": "GeometryCollection", "geometries": [
+		{"type": "Point", "coordinates": [2.35, 48.85]}, {"type": "LineString", "coordinates": [[2.35, 48.85], [2.4, 48.9]]}]},
+		"properties": {"name": "Paris"}}`)
+
+	var data bytes.Buffer
+	writer := pmtiles.NewWriter(&data)
+	tiles := map[string][]byte{}
+	err := tiler.Build(context.Background(), func(z, x, y int, tile []byte) error {
+		tiles[fmt.Sprintf("%d/%d/%d", z, x, y)] = tile
+		return writer.WriteTile(z, x, y, tile)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := json.Marshal(map[string]any{"vector_layers": tiler.Layers()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds := tiler.Bounds()
+	start, err := writer.Finish(pmtiles.Header{TileType: pmtiles.TileTypeMVT, TileCompression: pmtiles.CompressionNone, MaxZoom: 3,
+		Bounds: [4]float64{bounds[0], bounds[1], bounds[2], bounds[3]}}, metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := append(start, data.Bytes()...)
+
+	reader, err := pmtiles.Open(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.Header.MaxZoom != 3 || reader.Header.TileType != pmtiles.TileTypeMVT ||
+		math.Abs(reader.Header.Bounds[0]+0.12) > 1e-7 || math.Abs(reader.Header.Bounds[3]-52.52) > 1e-7 {
+		t.Errorf("got header %+v, want the one written", reader.Header)
+	}
+	if got, err := reader.Metadata(); err != nil || !bytes.Equal(got, metadata) {
+		t.Errorf("got metadata %s and %v, want %s", got, err, metadata)
+	}
+
+	for name, tile := range tiles {
+		var z, x, y int
+		fmt.Sscanf(name, "%d/%d/%d", &z, &x, &y)
+		got, err := reader.Tile(z, x, y)
+		if err != nil || !bytes.Equal(got, tile) {
+			t.Errorf("%s: got %d bytes and %v, want the %d bytes built", name, len(got), err, len(tile))
+			continue
+		}
+		for _, layer := range decodeTile(t, got) {
+			for _, f := range layer.features {
+				if f.properties["name"] == nil || !f.hasID {
+					t.Errorf("%s: got %+v in %s, want the name and ID of the feature", name, f, layer.name)
+				}
+			}
+		}
+	}
+	if got, err := reader.Tile(3, 0, 7); got != nil || err != nil {
+		t.Errorf("got %d bytes and %v for a tile without features, want nothing", len(got), err)
+	}
+
+	// Paris is in both layers at zoom 3
+	layers := decodeTile(t, tiles["3/4/2"])
+	if len(layers) != 2 || layers[1].name != "places" || len(layers[1].features) != 2 {
+		t.Fatalf("got %+v, want roads and the point and line of Paris", layers)
+	}
+	if kinds := []int{layers[1].features[0].kind, layers[1].features[1].kind}; kinds[0] != kindPoint || kinds[1] != kindLine {
+		t.Errorf("got kinds %v, want a point then a line", kinds)
+	}
+}
+
+func add(t *testing.T, tiler *Tiler, layer, feature string) {
+	t.Helper()
+	err := geojson.ReadFeatures(strings.NewReader(feature), func(f *geojson.Feature) error {
+		return tiler.Add(layer, f)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// build returns the tiles of a tiler by z/x/y
+func build(t *testing.T, tiler *Tiler) map[string][]byte {
+	t.Helper()
+	tiles := map[string][]byte{}
+	err := tiler.Build(context.Background(), func(z, x, y int, tile []byte) error {
+		tiles[fmt.Sprintf("%d/%d/%d", z, x, y)] = tile
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tiles
+}
+
+func keys(tiles map[string][]byte) []string {
+	var names []string
+	for name := range tiles {
+		names = append(names, name)
+	}
+	return names
+}
+
+type testLayer struct {
+	name     string
+	extent   uint64
+	features []testFeature
+}
+
+// testFeature is a decoded feature, its parts are points, lines or rings in tile coordinates
+type testFeature struct {
+	id         uint64
+	hasID      bool
+	kind       int
+	properties map[string]any
+	parts      [][][2]int64
+}
+
+// decodeTile reads the layers of a vector tile, failing on anything the specification does not allow
+func decodeTile(t *testing.T, data []byte) []testLayer {
+	t.Helper()
+	if data == nil {
+		t.Fatal("no tile")
+	}
+	var layers []testLayer
+	for _, field := range decodeMessage(t, data) {
+		if field.number != 3 {
+			t.Fatalf("tile field %d", field.number)
+		}
+		var layer testLayer
+		var keys []string
+		var values []any
+		var features [][]protoField
+		for _, field := range decodeMessage(t, field.data) {
+			switch field.number {
+			case 15:
+				if field.value != 2 {
+					t.Fatalf("layer version %d", field.value)
+				}
+			case 1:
+				layer.name = string(field.data)
+			case 2:
+				features = append(features, decodeMessage(t, field.data))
+			case 3:
+				keys = append(keys, string(field.data))
+			case 4:
+				values = append(values, decodeValue(t, field.data))
+			case 5:
+				layer.extent = field.value
+			}
+		}
+
+		for _, fields := range features {
+			f := testFeature{properties: map[string]any{}}
+			for _, field := range fields {
+				switch field.number {
+				case 1:
+					f.id, f.hasID = field.value, true
+				case 2:
+					tags := decodePacked(t, field.data)
+					for i := 0; i+1 < len(tags); i += 2 {
+						f.properties[keys[tags[i]]] = values[tags[i+1]]
+					}
+				case 3:
+					f.kind = int(field.value)
+				case 4:
+					f.parts = decodeGeometry(t, f.kind, decodePacked(t, field.data))
+				}
+			}
+			layer.features = append(layer.features, f)
+		}
+		layers = append(layers, layer)
+	}
+	return layers
+}
+
+// decodeGeometry returns the parts a geometry draws, rings without their closing point
+func decodeGeometry(t *testing.T, kind int, commands []uint64) [][][2]int64 {
+	t.Helper()
+	var parts [][][2]int64
+	var x, y int64
+	for i := 0; i < len(commands); {
+		id, count := int(commands[i]&0x7), int(commands[i]>>3)
+		i++
+		switch id {
+		case commandMoveTo, commandLineTo:
+			if i+2*count > len(commands) || (id == commandLineTo && len(parts) == 0) {
+				t.Fatalf("truncated geometry %v", commands)
+			}
+			for j := 0; j < count; j++ {
+				x += unzigzag(commands[i])
+				y += unzigzag(commands[i+1])
+				i += 2
+				if id == commandMoveTo && (j == 0 || kind == kindPoint) {
+					parts = append(parts, nil)
+				}
+				parts[len(parts)-1] = append(parts[len(parts)-1], [2]int64{x, y})
+			}
+		case commandClosePath:
+			if kind != kindPolygon {
+				t.Fatalf("closed path in a geometry of kind %d", kind)
+			}
+		default:
+			t.Fatalf("command %d", id)
+		}
+	}
+	if kind == kindPoint && len(parts) > 1 {
+		// A multi point is one part
+		var points [][2]int64
+		for _, part := range parts {
+			points = append(points, part...)
+		}
+		parts = [][][2]int64{points}
+	}
+	return parts
+}
+
+func decodeValue(t *testing.T, data []byte) any {
+	t.Helper()
+	fields := decodeMessage(t, data)
+	if len(fields) != 1 {
+		t.Fatalf("value with %d fields", len(fields))
+	}
+	field := fields[0]
+	switch field.number {
+	case valueString:
+		return string(field.data)
+	case valueDouble:
+		return math.Float64frombits(field.value)
+	case valueUint:
+		return field.value
+	case valueSint:
+		return unzigzag(field.value)
+	case valueBool:
+		return field.value == 1
+	}
+	t.Fatalf("value field %d", field.number)
+	return nil
+}
+
+type protoField struct {
+	number int
+	value  uint64 // of varint and 64 bit fields
+	data   []byte // of length delimited fields
+}
+
+func decodeMessage(t *testing.T, data []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatalf("truncated field key")
+		}
+		data = data[n:]
+		field := protoField{number: int(key >> 3)}
+		switch key & 0x7 {
+		case wireVarint:
+			if field.value, n = binary.Uvarint(data); n <= 0 {
+				t.Fatalf("truncated varint of field %d", field.number)
+			}
+			data = data[n:]
+		case wire64:
+			if len(data) < 8 {
+				t.Fatalf("truncated 64 bit field %d", field.number)
+			}
+			field.value, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				t.Fatalf("truncated field %d", field.number)
+			}
+			field.data, data = data[n:n+int(length)], data[n+int(length):]
+		default:
+			t.Fatalf("wire type %d", key&0x7)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+func decodePacked(t *testing.T, data []byte) []uint64 {
+	t.Helper()
+	var values []uint64
+	for len(data) > 0 {
+		value, n := binary.Uvarint(data)
+		if n <= 0 {
+			t.Fatal("truncated packed field")
+		}
+		values, data = append(values, value), data[n:]
+	}
+	return values
+}
+
+func unzigzag(n uint64) int64 {
+	return int64(n>>1) ^ -int64(n&1)
+}